@@ -2,48 +2,146 @@ package testGoSDK
 
 import (
 	"flag"
+	"log"
 	"os"
 	"testing"
 
+	"github.com/xenserver/xenserver-samples/go/config"
+	"github.com/xenserver/xenserver-samples/go/fakexapi"
+	"github.com/xenserver/xenserver-samples/go/xsutil"
 	"xenapi"
 )
 
-var IP_FLAG = flag.String("ip", "", "the URL of the form https://ip[:port] pointing at the server")
-var USERNAME_FLAG = flag.String("username", "", "the username of the host (e.g. root)")
-var PASSWORD_FLAG = flag.String("password", "", "the password of the host")
-var CA_CERT_PATH_FLAG = flag.String("ca_cert_path", "", "the CA certificate file path for the host")
-var NFS_SERVER_FLAG = flag.String("nfs_server", "", "the ip address pointing at the nfs server")
-var NFS_PATH_FLAG = flag.String("nfs_path", "", "the nfs server path")
-var IP1_FLAG = flag.String("ip1", "", "the URL of the form https://ip[:port] pointing at another host1")
-var USERNAME1_FLAG = flag.String("username1", "", "the username of the host1 (e.g. root)")
-var PASSWORD1_FLAG = flag.String("password1", "", "the password of the host1")
+var CONFIG_FLAG = flag.String("config", "", "the YAML or TOML file describing the servers to test against (default $XS_CONFIG)")
 
+// The names of the targets the tests look up in the config.
+const (
+	PRIMARY_TARGET   = "primary"
+	SUPPORTER_TARGET = "supporter"
+	NFS_TARGET       = "nfs"
+)
+
+var targets *config.Config
+
+// GetTarget returns the named target, or nil if it is not configured.
+func GetTarget(name string) *config.Target {
+	return targets.Target(name)
+}
+
+// session is the session the tests call the pool through: the current
+// session of poolSession as of the start of the test, see Connected.
 var session *xenapi.Session
 
+// poolSession is the tests' login to the pool, made by TestLogin. Calls
+// made through poolSession.Do log in again if the pool coordinator moves
+// while a test runs.
+var poolSession *xsutil.PoolSession
+
+// Connected brings session up to date at the start of a test: if the
+// pool coordinator has moved or the session has been invalidated since the
+// last test, it logs in again first. Every test that calls the pool
+// through session starts with it.
+func Connected(t testing.TB) {
+	t.Helper()
+	if poolSession == nil {
+		t.Fatal("not logged in")
+	}
+	err := poolSession.Do(func(session *xenapi.Session) error {
+		_, err := xenapi.Pool.GetAll(session)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	session = poolSession.Session()
+}
+
 func TestLogin(t *testing.T) {
-	session = xenapi.NewSession(&xenapi.ClientOpts{
-		URL: "http://" + *IP_FLAG,
+	primary := GetTarget(PRIMARY_TARGET)
+	if primary == nil {
+		t.Log("The primary target is not configured")
+		t.Fail()
+		return
+	}
+	var err error
+	poolSession, err = xsutil.Connect(&xenapi.ClientOpts{
+		URL: "http://" + primary.Host,
 		Headers: map[string]string{
 			"User-Agent": "XS SDK for Go - Examples v1.0",
 		},
-	})
-	_, err := session.LoginWithPassword(*USERNAME_FLAG, *PASSWORD_FLAG, "1.0", "Go sdk samples")
+	}, primary.Credentials("Go sdk samples"))
 	if err != nil {
 		t.Log(err)
 		t.Fail()
 		return
 	}
+	session = poolSession.Session()
 	t.Log("api version: ", session.APIVersion)
 	t.Log("xapi rpm version: ", session.XAPIVersion)
 }
 
+// startFakeXAPI points the tests at two in-process fake hosts, a primary and
+// a supporter, and returns a function that shuts them down again.
+func startFakeXAPI() (func(), error) {
+	primary := fakexapi.NewServer()
+	supporter := fakexapi.NewServer()
+	stop := func() {
+		primary.Close()
+		supporter.Close()
+	}
+	caCert, err := os.CreateTemp("", "fakexapi-*.pem")
+	if err != nil {
+		stop()
+		return nil, err
+	}
+	defer caCert.Close()
+	_, err = caCert.Write(primary.CACert())
+	if err != nil {
+		stop()
+		return nil, err
+	}
+	targets.Targets[PRIMARY_TARGET] = &config.Target{
+		Host:       primary.Addr(),
+		Username:   primary.Username,
+		Password:   primary.Password,
+		CACertPath: caCert.Name(),
+	}
+	targets.Targets[SUPPORTER_TARGET] = &config.Target{
+		Host:     supporter.Addr(),
+		Username: supporter.Username,
+		Password: supporter.Password,
+	}
+	targets.Targets[NFS_TARGET] = &config.Target{Host: "192.0.2.10", Path: "/exports/test"}
+	return func() {
+		stop()
+		os.Remove(caCert.Name())
+	}, nil
+}
+
 func TestMain(m *testing.M) {
 	flag.Parse()
-	exitVal := m.Run()
-	var t *testing.T
-	err := session.Logout()
+	var err error
+	targets, err = config.Load(*CONFIG_FLAG)
 	if err != nil {
-		t.Log(err)
+		panic(err)
+	}
+	stop := func() {}
+	if GetTarget(PRIMARY_TARGET) == nil {
+		stop, err = startFakeXAPI()
+		if err != nil {
+			panic(err)
+		}
+	}
+	exitVal := m.Run()
+	if cache != nil {
+		resetCache()
+	}
+	if poolSession != nil {
+		err := poolSession.Logout()
+		if err != nil {
+			log.Println(err)
+		}
 	}
+	stop()
 	os.Exit(exitVal)
 }
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"xenapi"
+
+	"github.com/xenserver/xenserver-samples/go/rrd"
+	"github.com/xenserver/xenserver-samples/go/xsutil"
+)
+
+// rrdStep is the resolution asked of /rrd_updates: the finest one, kept
+// for the last ten minutes.
+const rrdStep = 5 * time.Second
+
+// exporter collects the metrics of a pool and serves the last collection.
+type exporter struct {
+	pool *xsutil.PoolSession
+	opts *xenapi.ClientOpts
+	// interval is how often collect is called; the first fetch from a
+	// host goes back that far.
+	interval time.Duration
+	// hosts is what the last fetch from each host, by UUID, returned.
+	hosts map[string]*hostRRD
+
+	mu   sync.Mutex
+	page []byte
+}
+
+// hostRRD is where the next fetch from a host starts, and the last one
+// that had samples, to serve again if a fetch comes too soon for new ones.
+type hostRRD struct {
+	next    time.Time
+	updates *rrd.Updates
+}
+
+func newExporter(pool *xsutil.PoolSession, opts *xenapi.ClientOpts, interval time.Duration) *exporter {
+	return &exporter{pool: pool, opts: opts, interval: interval, hosts: make(map[string]*hostRRD)}
+}
+
+// ServeHTTP serves the last collection.
+func (e *exporter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	e.mu.Lock()
+	page := e.page
+	e.mu.Unlock()
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Write(page)
+}
+
+// collect gathers the pool's metrics and replaces the page ServeHTTP
+// serves. If the pool cannot be read, the page says so with xen_up 0.
+func (e *exporter) collect(ctx context.Context) error {
+	began := time.Now()
+	reg := newRegistry()
+	var state poolState
+	err := e.pool.Do(func(session *xenapi.Session) error {
+		var err error
+		state, err = readPool(session)
+		return err
+	})
+	if err == nil {
+		e.addRecords(reg, state)
+		e.addRRDs(ctx, reg, state)
+		reg.add(up, 1)
+	} else {
+		reg.add(up, 0)
+	}
+	reg.add(collectSeconds, time.Since(began).Seconds())
+
+	var page bytes.Buffer
+	if writeErr := reg.write(&page); writeErr != nil {
+		return writeErr
+	}
+	e.mu.Lock()
+	e.page = page.Bytes()
+	e.mu.Unlock()
+	return err
+}
+
+// poolState is the records a collection reads from the pool.
+type poolState struct {
+	name        string
+	hosts       map[xenapi.HostRef]xenapi.HostRecord
+	hostMetrics map[xenapi.HostMetricsRef]xenapi.HostMetricsRecord
+	vms         map[xenapi.VMRef]xenapi.VMRecord
+	vmMetrics   map[xenapi.VMMetricsRef]xenapi.VMMetricsRecord
+}
+
+func readPool(session *xenapi.Session) (poolState, error) {
+	var state poolState
+	pools, err := xenapi.Pool.GetAllRecords(session)
+	if err != nil {
+		return state, err
+	}
+	if state.hosts, err = xenapi.Host.GetAllRecords(session); err != nil {
+		return state, err
+	}
+	if state.hostMetrics, err = xenapi.HostMetrics.GetAllRecords(session); err != nil {
+		return state, err
+	}
+	if state.vms, err = xenapi.VM.GetAllRecords(session); err != nil {
+		return state, err
+	}
+	if state.vmMetrics, err = xenapi.VMMetrics.GetAllRecords(session); err != nil {
+		return state, err
+	}
+	// A pool with no name goes by its coordinator's, as in XenCenter.
+	for _, pool := range pools {
+		state.name = pool.NameLabel
+		if state.name == "" {
+			state.name = state.hosts[pool.Master].NameLabel
+		}
+	}
+	return state, nil
+}
+
+func (s poolState) hostLabels(host xenapi.HostRecord) []label {
+	return []label{{"pool", s.name}, {"host", host.NameLabel}, {"host_uuid", host.UUID}}
+}
+
+func (s poolState) vmLabels(vm xenapi.VMRecord) []label {
+	return []label{{"pool", s.name}, {"host", s.hosts[vm.ResidentOn].NameLabel}, {"vm", vm.NameLabel}, {"vm_uuid", vm.UUID}}
+}
+
+// addRecords adds what the host and VM records say.
+func (e *exporter) addRecords(reg *registry, s poolState) {
+	for _, host := range sortedHosts(s.hosts) {
+		labels := s.hostLabels(host)
+		metrics, ok := s.hostMetrics[host.Metrics]
+		if !ok {
+			continue
+		}
+		reg.add(hostLive, boolValue(metrics.Live), labels...)
+		reg.add(hostMemTotal, float64(metrics.MemoryTotal), labels...)
+		reg.add(hostMemFree, float64(metrics.MemoryFree), labels...)
+	}
+	for _, vm := range sortedVMs(s.vms) {
+		if vm.IsATemplate || vm.IsASnapshot {
+			continue
+		}
+		labels := s.vmLabels(vm)
+		reg.add(vmPowerState, 1, append(labels, label{"state", string(vm.PowerState)})...)
+		if vm.PowerState != xenapi.VMPowerStateRunning {
+			continue
+		}
+		if metrics, ok := s.vmMetrics[vm.Metrics]; ok {
+			reg.add(vmMemActual, float64(metrics.MemoryActual), labels...)
+			reg.add(vmVCPUs, float64(metrics.VCPUsNumber), labels...)
+		}
+	}
+}
+
+// addRRDs fetches the RRD updates of every live host, each from the host
+// itself, and adds the latest sample of each series.
+func (e *exporter) addRRDs(ctx context.Context, reg *registry, s poolState) {
+	vmsByUUID := make(map[string]xenapi.VMRecord, len(s.vms))
+	for _, vm := range s.vms {
+		vmsByUUID[vm.UUID] = vm
+	}
+	for _, host := range sortedHosts(s.hosts) {
+		if !s.hostMetrics[host.Metrics].Live {
+			continue
+		}
+		labels := s.hostLabels(host)
+		updates, err := e.fetch(ctx, host)
+		if err != nil {
+			log.Printf("fetching RRD updates from %s: %v", host.NameLabel, err)
+			reg.add(rrdUp, 0, labels...)
+			continue
+		}
+		reg.add(rrdUp, 1, labels...)
+		if report := updates.Hosts[host.UUID]; report != nil {
+			addReport(reg, report, labels, hostCPU, hostNetRX, hostNetTX)
+		}
+		for _, uuid := range sortedKeys(updates.VMs) {
+			vm, ok := vmsByUUID[uuid]
+			if !ok {
+				continue
+			}
+			report := updates.VMs[uuid]
+			labels := s.vmLabels(vm)
+			addReport(reg, report, labels, vmCPU, vmNetRX, vmNetTX)
+			if _, free := report.Memory(); free != nil {
+				reg.add(vmMemFree, latest(free), labels...)
+			}
+			disks := report.Disks()
+			for _, device := range sortedKeys(disks) {
+				labels := append(labels[:len(labels):len(labels)], label{"device", device})
+				reg.add(vmDiskRead, latest(disks[device].Read), labels...)
+				reg.add(vmDiskWrite, latest(disks[device].Write), labels...)
+			}
+		}
+	}
+}
+
+// addReport adds the CPU and network series that hosts and VMs share.
+func addReport(reg *registry, report *rrd.Report, labels []label, cpu, rx, tx metric) {
+	cpus := report.CPUs()
+	numbers := make([]int, 0, len(cpus))
+	for n := range cpus {
+		numbers = append(numbers, n)
+	}
+	sort.Ints(numbers)
+	for _, n := range numbers {
+		reg.add(cpu, latest(cpus[n]), append(labels[:len(labels):len(labels)], label{"cpu", strconv.Itoa(n)})...)
+	}
+	interfaces := report.Interfaces()
+	for _, name := range sortedKeys(interfaces) {
+		labels := append(labels[:len(labels):len(labels)], label{"interface", name})
+		reg.add(rx, latest(interfaces[name].RX), labels...)
+		reg.add(tx, latest(interfaces[name].TX), labels...)
+	}
+}
+
+// fetch returns the host's updates since the last fetch, or the last ones
+// again if there are no new samples yet.
+func (e *exporter) fetch(ctx context.Context, host xenapi.HostRecord) (*rrd.Updates, error) {
+	state := e.hosts[host.UUID]
+	if state == nil {
+		state = &hostRRD{next: time.Now().Add(-e.interval)}
+		e.hosts[host.UUID] = state
+	}
+	opts, err := xsutil.HostOpts(e.opts, host.Address)
+	if err != nil {
+		return nil, err
+	}
+	_, ref := e.pool.Current()
+	client, err := rrd.NewClient(ref, opts)
+	if err != nil {
+		return nil, err
+	}
+	poller := client.Poller(rrd.Query{Start: state.next, Interval: rrdStep, Host: true})
+	updates, err := poller.Poll(ctx)
+	if err != nil {
+		return nil, err
+	}
+	state.next = poller.Next()
+	if hasSamples(updates) || state.updates == nil {
+		state.updates = updates
+	}
+	return state.updates, nil
+}
+
+func hasSamples(updates *rrd.Updates) bool {
+	for _, reports := range []map[string]*rrd.Report{updates.Hosts, updates.VMs} {
+		for _, report := range reports {
+			for _, series := range report.Metrics {
+				if len(series.Points) > 0 {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// latest returns the most recent sample of s that is a number, or NaN.
+func latest(s *rrd.Series) float64 {
+	if s == nil {
+		return math.NaN()
+	}
+	for i := len(s.Points) - 1; i >= 0; i-- {
+		if v := s.Points[i].Value; !math.IsNaN(v) {
+			return v
+		}
+	}
+	return math.NaN()
+}
+
+func boolValue(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func sortedHosts(hosts map[xenapi.HostRef]xenapi.HostRecord) []xenapi.HostRecord {
+	sorted := make([]xenapi.HostRecord, 0, len(hosts))
+	for _, host := range hosts {
+		sorted = append(sorted, host)
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].NameLabel+sorted[i].UUID < sorted[j].NameLabel+sorted[j].UUID })
+	return sorted
+}
+
+func sortedVMs(vms map[xenapi.VMRef]xenapi.VMRecord) []xenapi.VMRecord {
+	sorted := make([]xenapi.VMRecord, 0, len(vms))
+	for _, vm := range vms {
+		sorted = append(sorted, vm)
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].NameLabel+sorted[i].UUID < sorted[j].NameLabel+sorted[j].UUID })
+	return sorted
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
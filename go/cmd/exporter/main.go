@@ -0,0 +1,90 @@
+// Command exporter serves the metrics of a pool on /metrics for
+// Prometheus to scrape: the host and VM metrics records, and the latest
+// samples of every host's and VM's RRDs, polled from each host's
+// /rrd_updates. Samples carry the pool, host and VM names and UUIDs as
+// labels.
+//
+//	go run ./cmd/exporter -config pools.yaml
+//	go run ./cmd/exporter -config pools.yaml -target primary -listen :9290 -interval 15s
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/xenserver/xenserver-samples/go/config"
+	"github.com/xenserver/xenserver-samples/go/xsutil"
+)
+
+func main() {
+	configPath := flag.String("config", "", "the YAML or TOML file describing the pools (default $XS_CONFIG)")
+	targetName := flag.String("target", "primary", "the target in the config naming the pool to export")
+	listen := flag.String("listen", ":9290", "the address to serve /metrics on")
+	interval := flag.Duration("interval", 30*time.Second, "how often to collect metrics from the pool")
+	flag.Parse()
+
+	targets, err := config.Load(*configPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	target := targets.Target(*targetName)
+	if target == nil {
+		log.Fatalf("target %q is not configured", *targetName)
+	}
+	opts := target.ClientOpts("https")
+	pool, err := xsutil.Connect(opts, target.Credentials("Go sdk samples exporter"))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	err = run(ctx, newExporter(pool, opts, *interval), *listen, *interval)
+	if logoutErr := pool.Logout(); logoutErr != nil {
+		log.Println(logoutErr)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// run collects every interval and serves /metrics on listen until ctx
+// ends.
+func run(ctx context.Context, e *exporter, listen string, interval time.Duration) error {
+	if err := e.collect(ctx); err != nil {
+		log.Println("collecting metrics:", err)
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", e)
+	server := &http.Server{Addr: listen, Handler: mux}
+	served := make(chan error, 1)
+	go func() { served <- server.ListenAndServe() }()
+	log.Printf("serving metrics on %s/metrics", listen)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := e.collect(ctx); err != nil {
+				log.Println("collecting metrics:", err)
+			}
+		case err := <-served:
+			return err
+		case <-ctx.Done():
+			shutdown, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			if err := server.Shutdown(shutdown); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				return err
+			}
+			return nil
+		}
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"xenapi"
+
+	"github.com/xenserver/xenserver-samples/go/fakexapi"
+	"github.com/xenserver/xenserver-samples/go/xsutil"
+)
+
+// serveRRD makes server answer /rrd_updates with three samples from the
+// start asked for, for host and vms, and sends each start to starts.
+func serveRRD(server, coordinator *fakexapi.Server, host string, vms []string, starts chan<- int64) {
+	server.HandleHTTP("/rrd_updates", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !coordinator.ValidSession(r.URL.Query().Get("session_id")) {
+			http.Error(w, "unauthorised", http.StatusUnauthorized)
+			return
+		}
+		start, err := strconv.ParseInt(r.URL.Query().Get("start"), 10, 64)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		starts <- start
+		var legend, values strings.Builder
+		fmt.Fprintf(&legend, "<entry>AVERAGE:host:%s:cpu0</entry><entry>AVERAGE:host:%s:pif_eth0_rx</entry><entry>AVERAGE:host:%s:pif_eth0_tx</entry>", host, host, host)
+		values.WriteString("<v>0.25</v><v>1000</v><v>NaN</v>")
+		for _, vm := range vms {
+			fmt.Fprintf(&legend, "<entry>AVERAGE:vm:%s:cpu0</entry><entry>AVERAGE:vm:%s:memory_internal_free</entry><entry>AVERAGE:vm:%s:vbd_xvda_write</entry>", vm, vm, vm)
+			values.WriteString("<v>0.5</v><v>1024</v><v>4096</v>")
+		}
+		fmt.Fprintf(w, "<xport><meta><start>%d</start><step>5</step><end>%d</end><legend>%s</legend></meta><data>", start, start+10, legend.String())
+		for t := start + 10; t >= start; t -= 5 {
+			fmt.Fprintf(w, "<row><t>%d</t>%s</row>", t, values.String())
+		}
+		fmt.Fprint(w, "</data></xport>")
+	}))
+}
+
+func TestExporter(t *testing.T) {
+	coordinator, supporter := fakexapi.NewPool(t)
+	creds := xsutil.Credentials{Username: coordinator.Username, Password: coordinator.Password, Originator: "exporter test"}
+	opts := &xenapi.ClientOpts{URL: coordinator.URL()}
+	pool, err := xsutil.Connect(opts, creds)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Logout()
+	session := pool.Session()
+	vms, err := xenapi.VM.GetByNameLabel(session, fakexapi.LinuxVM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := xenapi.VM.Start(session, vms[0], false, false); err != nil {
+		t.Fatal(err)
+	}
+	vm, err := xenapi.VM.GetRecord(session, vms[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	hosts, err := xenapi.Host.GetAllRecords(session)
+	if err != nil {
+		t.Fatal(err)
+	}
+	starts := make(chan int64, 4)
+	for _, host := range hosts {
+		switch host.Address {
+		case coordinator.Addr():
+			serveRRD(coordinator, coordinator, host.UUID, []string{vm.UUID}, starts)
+		case supporter.Addr():
+			serveRRD(supporter, coordinator, host.UUID, nil, starts)
+		default:
+			t.Fatal("Unexpected host address", host.Address)
+		}
+	}
+
+	e := newExporter(pool, opts, time.Minute)
+	began := time.Now()
+	if err := e.collect(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	first := []int64{<-starts, <-starts}
+	for _, start := range first {
+		if since := began.Unix() - start; since < 59 || since > 61 {
+			t.Log("Expected the first fetch to go back a minute, it went back", since, "seconds")
+			t.Fail()
+		}
+	}
+
+	recorder := httptest.NewRecorder()
+	e.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	page := recorder.Body.String()
+	host := hosts[vm.ResidentOn]
+	vmLabels := fmt.Sprintf(`pool=%q,host=%q,vm=%q,vm_uuid=%q`, host.NameLabel, host.NameLabel, vm.NameLabel, vm.UUID)
+	for _, want := range []string{
+		"# TYPE xen_up gauge\nxen_up 1\n",
+		fmt.Sprintf(`xen_host_cpu_utilisation{pool=%q,host=%q,host_uuid=%q,cpu="0"} 0.25`, host.NameLabel, host.NameLabel, host.UUID),
+		fmt.Sprintf(`xen_host_network_receive_bytes_per_second{pool=%q,host=%q,host_uuid=%q,interface="eth0"} 1000`, host.NameLabel, host.NameLabel, host.UUID),
+		fmt.Sprintf(`xen_host_memory_total_bytes{pool=%q,host=%q,host_uuid=%q} 6.8719476736e+10`, host.NameLabel, host.NameLabel, host.UUID),
+		`xen_vm_cpu_utilisation{` + vmLabels + `,cpu="0"} 0.5`,
+		`xen_vm_memory_free_bytes{` + vmLabels + `} 1.048576e+06`,
+		`xen_vm_disk_write_bytes_per_second{` + vmLabels + `,device="xvda"} 4096`,
+		`xen_vm_power_state{` + vmLabels + `,state="Running"} 1`,
+		`xen_vm_vcpus{` + vmLabels + `} 2`,
+	} {
+		if !strings.Contains(page, want) {
+			t.Log("Missing from the page:", want)
+			t.Fail()
+		}
+	}
+	if strings.Contains(page, "xen_host_network_transmit_bytes_per_second") {
+		t.Log("Expected NaN samples to be left out")
+		t.Fail()
+	}
+	if got := strings.Count(page, "xen_rrd_up{"); got != 2 || strings.Contains(page, "xen_rrd_up 0") {
+		t.Log("Expected both hosts' RRDs to be up, got", got)
+		t.Fail()
+	}
+	if t.Failed() {
+		t.Log(page)
+	}
+
+	if err := e.collect(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	second := []int64{<-starts, <-starts}
+	for i := range second {
+		if second[i] != first[i]+11 {
+			t.Log("Expected the second fetch to start after the first one ended, got", second[i], "after", first[i])
+			t.Fail()
+		}
+	}
+}
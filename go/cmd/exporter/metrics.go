@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// metric names a family of samples and says what it measures.
+type metric struct {
+	name, help string
+}
+
+var (
+	up             = metric{"xen_up", "Whether the last collection from the pool succeeded."}
+	rrdUp          = metric{"xen_rrd_up", "Whether the last fetch of the host's RRD updates succeeded."}
+	hostLive       = metric{"xen_host_live", "Whether the host is live, according to its metrics record."}
+	hostMemTotal   = metric{"xen_host_memory_total_bytes", "Total memory of the host."}
+	hostMemFree    = metric{"xen_host_memory_free_bytes", "Free memory of the host."}
+	hostCPU        = metric{"xen_host_cpu_utilisation", "Utilisation of a physical CPU, from 0 to 1."}
+	hostNetRX      = metric{"xen_host_network_receive_bytes_per_second", "Bytes received by a physical interface."}
+	hostNetTX      = metric{"xen_host_network_transmit_bytes_per_second", "Bytes sent by a physical interface."}
+	vmPowerState   = metric{"xen_vm_power_state", "The power state of the VM, as a label."}
+	vmMemActual    = metric{"xen_vm_memory_actual_bytes", "Memory allocated to the VM."}
+	vmVCPUs        = metric{"xen_vm_vcpus", "Number of vCPUs of the VM."}
+	vmMemFree      = metric{"xen_vm_memory_free_bytes", "Free memory inside the VM, as its guest tools report it."}
+	vmCPU          = metric{"xen_vm_cpu_utilisation", "Utilisation of a vCPU, from 0 to 1."}
+	vmNetRX        = metric{"xen_vm_network_receive_bytes_per_second", "Bytes received by a VIF."}
+	vmNetTX        = metric{"xen_vm_network_transmit_bytes_per_second", "Bytes sent by a VIF."}
+	vmDiskRead     = metric{"xen_vm_disk_read_bytes_per_second", "Bytes read through a VBD."}
+	vmDiskWrite    = metric{"xen_vm_disk_write_bytes_per_second", "Bytes written through a VBD."}
+	collectSeconds = metric{"xen_collect_duration_seconds", "How long the last collection took."}
+)
+
+// label is a name and value that tell samples of a family apart.
+type label struct {
+	name, value string
+}
+
+type sample struct {
+	labels []label
+	value  float64
+}
+
+// registry gathers the samples of one collection and writes them in the
+// Prometheus text format.
+type registry struct {
+	families map[metric][]sample
+}
+
+func newRegistry() *registry {
+	return &registry{families: make(map[metric][]sample)}
+}
+
+// add records a sample. Samples that are not a number, as RRDs give when
+// a source has no data, are left out.
+func (r *registry) add(m metric, value float64, labels ...label) {
+	if math.IsNaN(value) {
+		return
+	}
+	r.families[m] = append(r.families[m], sample{labels: labels, value: value})
+}
+
+// write writes the families sorted by name, and their samples in the order
+// they were added.
+func (r *registry) write(w io.Writer) error {
+	metrics := make([]metric, 0, len(r.families))
+	for m := range r.families {
+		metrics = append(metrics, m)
+	}
+	sort.Slice(metrics, func(i, j int) bool { return metrics[i].name < metrics[j].name })
+
+	b := bufio.NewWriter(w)
+	for _, m := range metrics {
+		b.WriteString("# HELP " + m.name + " " + m.help + "\n")
+		b.WriteString("# TYPE " + m.name + " gauge\n")
+		for _, s := range r.families[m] {
+			b.WriteString(m.name)
+			if len(s.labels) > 0 {
+				b.WriteByte('{')
+				for i, l := range s.labels {
+					if i > 0 {
+						b.WriteByte(',')
+					}
+					b.WriteString(l.name + `="` + labelEscaper.Replace(l.value) + `"`)
+				}
+				b.WriteByte('}')
+			}
+			b.WriteString(" " + strconv.FormatFloat(s.value, 'g', -1, 64) + "\n")
+		}
+	}
+	return b.Flush()
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
@@ -0,0 +1,339 @@
+// Command fixpbds finds shared SRs whose PBDs are missing or unplugged on
+// some hosts of a pool and plans their repair: a missing PBD is created
+// with the device_config of a host where the SR is plugged, and an
+// unplugged one is plugged as it is. The plan is only printed unless
+// -apply is given.
+//
+// Given -sr and one or more -set options, it also does what
+// python/fixpbds.py does after the SR's storage server moved: every PBD
+// of the SR whose device_config lacks the new keys is unplugged,
+// destroyed and recreated with them, keeping its other keys. A -set
+// option of the form host:key=value changes the key on that host only.
+// If a new PBD cannot be created, the failure gives the device_config of
+// the one it replaced. Passwords are redacted from both.
+//
+//	go run ./cmd/fixpbds -config pools.yaml
+//	go run ./cmd/fixpbds -config pools.yaml -sr 7d2f8c51-... -apply
+//	go run ./cmd/fixpbds -config pools.yaml -sr 7d2f8c51-... -set server=192.0.2.20 -apply
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	"os"
+	"sort"
+	"strings"
+
+	"xenapi"
+
+	"github.com/xenserver/xenserver-samples/go/config"
+	"github.com/xenserver/xenserver-samples/go/xsutil"
+)
+
+// Actions a step of the plan takes on a host.
+const (
+	actionCreate   = "create"
+	actionRecreate = "recreate"
+	actionPlug     = "plug"
+)
+
+// step repairs the PBD of one SR on one host.
+type step struct {
+	Host     xenapi.HostRef
+	HostName string
+	SR       xenapi.SRRef
+	SRName   string
+	Action   string
+	// PBD is the existing PBD to recreate or plug.
+	PBD xenapi.PBDRef
+	// Attached is set when the PBD to recreate is plugged, and has to be
+	// unplugged first.
+	Attached bool
+	// DeviceConfig is the device_config of the PBD to create.
+	DeviceConfig map[string]string
+	// OldDeviceConfig is the device_config of the PBD to recreate, which
+	// is reported if the new PBD cannot be created once it is gone.
+	OldDeviceConfig map[string]string
+}
+
+func (s step) String() string {
+	switch s.Action {
+	case actionCreate:
+		return fmt.Sprintf("create and plug a PBD for SR %q", s.SRName)
+	case actionRecreate:
+		return fmt.Sprintf("recreate and plug PBD %s of SR %q with device_config %v", s.PBD, s.SRName, redact(s.DeviceConfig))
+	}
+	return fmt.Sprintf("plug PBD %s of SR %q", s.PBD, s.SRName)
+}
+
+// redact returns a copy of a device_config with the values of keys that
+// hold credentials, such as the password of a CIFS SR or the CHAP
+// password of an iSCSI one, replaced with xsutil.Redacted.
+func redact(deviceConfig map[string]string) map[string]string {
+	redacted := maps.Clone(deviceConfig)
+	for key := range redacted {
+		if lower := strings.ToLower(key); strings.Contains(lower, "password") || strings.Contains(lower, "secret") {
+			redacted[key] = xsutil.Redacted
+		}
+	}
+	return redacted
+}
+
+// mapping is the device_config keys to change on the PBDs of an SR, by
+// host: the keys under "" are changed on every host, and the keys under a
+// host's name or UUID on that host only.
+type mapping map[string]map[string]string
+
+// String and Set make a mapping a flag taking [host:]key=value.
+func (m mapping) String() string {
+	return fmt.Sprint(map[string]map[string]string(m))
+}
+
+func (m mapping) Set(value string) error {
+	option, v, ok := strings.Cut(value, "=")
+	if !ok {
+		return fmt.Errorf("%q is not of the form [host:]key=value", value)
+	}
+	host, key, ok := strings.Cut(option, ":")
+	if !ok {
+		host, key = "", option
+	}
+	if key == "" {
+		return fmt.Errorf("%q has no key", value)
+	}
+	if m[host] == nil {
+		m[host] = make(map[string]string)
+	}
+	m[host][key] = v
+	return nil
+}
+
+// forHost returns the keys to change on the host: those for every host,
+// overridden by those for the host itself.
+func (m mapping) forHost(host xenapi.HostRecord) map[string]string {
+	keys := maps.Clone(m[""])
+	if keys == nil {
+		keys = make(map[string]string)
+	}
+	maps.Copy(keys, m[host.NameLabel])
+	maps.Copy(keys, m[host.UUID])
+	return keys
+}
+
+// plan lists the steps that give every host a plugged PBD for each shared
+// SR, or for the SR with the given UUID only. Without changes, PBDs are
+// only created or plugged, never recreated. Changes need the SR's UUID,
+// and recreate its PBDs whose device_config lacks them. A missing PBD
+// copies the device_config of a plugged one, changes applied, so SRs
+// plugged on no host get no new PBDs. Steps are sorted by host, then SR.
+func plan(session *xenapi.Session, srUUID string, changes mapping) ([]step, error) {
+	if len(changes) > 0 && srUUID == "" {
+		return nil, errors.New("device_config changes need the SR they are for")
+	}
+	hosts, err := xenapi.Host.GetAllRecords(session)
+	if err != nil {
+		return nil, err
+	}
+	srs, err := xenapi.SR.GetAllRecords(session)
+	if err != nil {
+		return nil, err
+	}
+	pbds, err := xenapi.PBD.GetAllRecords(session)
+	if err != nil {
+		return nil, err
+	}
+	for name := range changes {
+		var found bool
+		for _, host := range hosts {
+			found = found || name == "" || name == host.NameLabel || name == host.UUID
+		}
+		if !found {
+			return nil, fmt.Errorf("no host is named %q or has that UUID", name)
+		}
+	}
+
+	var steps []step
+	for srRef, sr := range srs {
+		if !sr.Shared || (srUUID != "" && sr.UUID != srUUID) {
+			continue
+		}
+		var healthy map[string]string
+		onHost := make(map[xenapi.HostRef]xenapi.PBDRef)
+		for _, pbdRef := range sr.PBDs {
+			pbd := pbds[pbdRef]
+			onHost[pbd.Host] = pbdRef
+			if pbd.CurrentlyAttached && healthy == nil {
+				healthy = pbd.DeviceConfig
+			}
+		}
+		for hostRef, host := range hosts {
+			s := step{Host: hostRef, HostName: host.NameLabel, SR: srRef, SRName: sr.NameLabel}
+			keys := changes.forHost(host)
+			pbdRef, ok := onHost[hostRef]
+			if !ok {
+				if healthy == nil {
+					continue
+				}
+				s.Action, s.DeviceConfig = actionCreate, maps.Clone(healthy)
+				maps.Copy(s.DeviceConfig, keys)
+				steps = append(steps, s)
+				continue
+			}
+			pbd := pbds[pbdRef]
+			deviceConfig := maps.Clone(pbd.DeviceConfig)
+			maps.Copy(deviceConfig, keys)
+			switch {
+			case !maps.Equal(deviceConfig, pbd.DeviceConfig):
+				s.Action, s.PBD, s.Attached, s.DeviceConfig = actionRecreate, pbdRef, pbd.CurrentlyAttached, deviceConfig
+				s.OldDeviceConfig = pbd.DeviceConfig
+			case !pbd.CurrentlyAttached:
+				s.Action, s.PBD = actionPlug, pbdRef
+			default:
+				continue
+			}
+			steps = append(steps, s)
+		}
+	}
+	if srUUID != "" {
+		var found bool
+		for _, sr := range srs {
+			found = found || sr.UUID == srUUID
+		}
+		if !found {
+			return nil, fmt.Errorf("no SR has UUID %s", srUUID)
+		}
+	}
+	sort.Slice(steps, func(i, j int) bool {
+		a, b := steps[i], steps[j]
+		if a.HostName != b.HostName {
+			return a.HostName < b.HostName
+		}
+		if a.Host != b.Host {
+			return a.Host < b.Host
+		}
+		return a.SRName < b.SRName
+	})
+	return steps, nil
+}
+
+// apply carries out the steps host by host, reporting progress to out. A
+// failed step is reported and the host's remaining steps are skipped, but
+// other hosts are still repaired; the failures are returned together.
+func apply(session *xenapi.Session, out io.Writer, steps []step) error {
+	var byHost [][]step
+	for i, s := range steps {
+		if i == 0 || s.Host != steps[i-1].Host {
+			byHost = append(byHost, nil)
+		}
+		byHost[len(byHost)-1] = append(byHost[len(byHost)-1], s)
+	}
+	var errs []error
+	for i, hostSteps := range byHost {
+		fmt.Fprintf(out, "[%d/%d] %s\n", i+1, len(byHost), hostSteps[0].HostName)
+		for _, s := range hostSteps {
+			fmt.Fprintf(out, "  %s ... ", s)
+			if err := applyStep(session, s); err != nil {
+				err = xsutil.Decode(err)
+				fmt.Fprintln(out, "failed:", err)
+				errs = append(errs, fmt.Errorf("host %q, SR %q: %w", s.HostName, s.SRName, err))
+				break
+			}
+			fmt.Fprintln(out, "done")
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func applyStep(session *xenapi.Session, s step) error {
+	pbd := s.PBD
+	if s.Action == actionRecreate {
+		if s.Attached {
+			if err := xenapi.PBD.Unplug(session, pbd); err != nil {
+				return err
+			}
+		}
+		// PBDs are read-only: the only way to change device_config is a
+		// new PBD.
+		if err := xenapi.PBD.Destroy(session, pbd); err != nil {
+			return err
+		}
+	}
+	if s.Action == actionCreate || s.Action == actionRecreate {
+		var err error
+		pbd, err = xenapi.PBD.Create(session, xenapi.PBDRecord{Host: s.Host, SR: s.SR, DeviceConfig: s.DeviceConfig})
+		if err != nil && s.Action == actionRecreate {
+			// The old PBD is gone, so its device_config is only left here.
+			return fmt.Errorf("PBD %s was destroyed, but its replacement could not be created; it had device_config %v: %w", s.PBD, redact(s.OldDeviceConfig), xsutil.Decode(err))
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return xenapi.PBD.Plug(session, pbd)
+}
+
+func report(out io.Writer, steps []step) {
+	host := xenapi.HostRef("")
+	for _, s := range steps {
+		if s.Host != host {
+			fmt.Fprintln(out, s.HostName+":")
+			host = s.Host
+		}
+		fmt.Fprintln(out, "  "+s.String())
+	}
+}
+
+func main() {
+	configPath := flag.String("config", "", "the YAML or TOML file describing the pools (default $XS_CONFIG)")
+	targetName := flag.String("target", "primary", "the target in the config naming the pool to repair")
+	srUUID := flag.String("sr", "", "repair only the SR with this UUID")
+	changes := mapping{}
+	flag.Var(changes, "set", "recreate the SR's PBDs with device_config `[host:]key=value`; may be repeated")
+	doApply := flag.Bool("apply", false, "carry out the plan instead of only printing it")
+	flag.Parse()
+	targets, err := config.Load(*configPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	target := targets.Target(*targetName)
+	if target == nil {
+		log.Fatalf("target %q is not configured", *targetName)
+	}
+
+	session, err := xsutil.Login(target.ClientOpts("https"), target.Credentials("Go sdk samples fixpbds"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = run(session, os.Stdout, *srUUID, changes, *doApply)
+	if logoutErr := session.Logout(); logoutErr != nil {
+		log.Println(logoutErr)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func run(session *xenapi.Session, out io.Writer, srUUID string, changes mapping, doApply bool) error {
+	steps, err := plan(session, srUUID, changes)
+	if err != nil {
+		return xsutil.Decode(err)
+	}
+	if len(steps) == 0 {
+		fmt.Fprintln(out, "Every host has its shared SRs plugged.")
+		return nil
+	}
+	if !doApply {
+		report(out, steps)
+		fmt.Fprintf(out, "Planned %d steps; run again with -apply to carry them out.\n", len(steps))
+		return nil
+	}
+	if err := apply(session, out, steps); err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "Carried out %d steps.\n", len(steps))
+	return nil
+}
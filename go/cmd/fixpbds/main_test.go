@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bytes"
+	"maps"
+	"strings"
+	"testing"
+
+	"xenapi"
+
+	"github.com/xenserver/xenserver-samples/go/fakexapi"
+)
+
+func TestFixPBDs(t *testing.T) {
+	coordinator, _ := fakexapi.NewPool(t)
+	session := coordinator.Login(t)
+	nfs, err := xenapi.SR.GetByNameLabel(session, "NFS virtual disk storage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	nfsUUID, err := xenapi.SR.GetUUID(session, nfs[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	steps, err := plan(session, nfsUUID, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(steps) != 1 || steps[0].Action != actionCreate || steps[0].DeviceConfig["server"] == "" {
+		t.Fatal("Expected the supporter to need a PBD for the NFS SR, got:", steps)
+	}
+	supporter := steps[0].Host
+
+	var out bytes.Buffer
+	if err := run(session, &out, "", nil, false); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "run again with -apply") {
+		t.Log("Unexpected plan:", out.String())
+		t.Fail()
+	}
+	if steps, _ := plan(session, "", nil); len(steps) != 2 {
+		t.Fatal("Expected the plan to be left alone without -apply, got:", steps)
+	}
+
+	out.Reset()
+	if err := run(session, &out, "", nil, true); err != nil {
+		t.Fatal(err, out.String())
+	}
+	if !strings.Contains(out.String(), "[1/1] ") || strings.Count(out.String(), "done") != 2 {
+		t.Log("Unexpected progress:", out.String())
+		t.Fail()
+	}
+
+	// Unplug the new PBD and give it a key of its own: without changes it
+	// is plugged again as it is.
+	var pbd xenapi.PBDRef
+	pbds, err := xenapi.SR.GetPBDs(session, nfs[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, ref := range pbds {
+		record, err := xenapi.PBD.GetRecord(session, ref)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if record.Host == supporter {
+			pbd = ref
+		}
+		if !record.CurrentlyAttached {
+			t.Log("PBD left unplugged:", ref)
+			t.Fail()
+		}
+	}
+	if err := xenapi.PBD.Unplug(session, pbd); err != nil {
+		t.Fatal(err)
+	}
+	coordinator.Do(func(st *fakexapi.Store) {
+		st.Update("PBD", string(pbd), fakexapi.Record{"device_config": map[string]string{"server": "192.0.2.10", "options": "hard"}})
+	})
+	steps, err = plan(session, nfsUUID, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(steps) != 1 || steps[0].Action != actionPlug || steps[0].PBD != pbd {
+		t.Fatal("Expected the unplugged PBD to be plugged, got:", steps)
+	}
+
+	// Move the storage server, and the supporter to another NFS version.
+	supporterName, err := xenapi.Host.GetNameLabel(session, supporter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	changes := mapping{}
+	for _, option := range []string{"server=192.0.2.20", supporterName + ":nfsversion=4"} {
+		if err := changes.Set(option); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := plan(session, "", changes); err == nil {
+		t.Log("Expected changes without an SR to be refused")
+		t.Fail()
+	}
+	steps, err = plan(session, nfsUUID, changes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(steps) != 2 || steps[0].Action != actionRecreate || steps[1].Action != actionRecreate {
+		t.Fatal("Expected both PBDs to be recreated, got:", steps)
+	}
+	if err := apply(session, &out, steps); err != nil {
+		t.Fatal(err)
+	}
+	if valid, _ := xenapi.PBD.GetUUID(session, pbd); valid != "" {
+		t.Log("The old PBD was not destroyed")
+		t.Fail()
+	}
+	pbds, err = xenapi.SR.GetPBDs(session, nfs[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, ref := range pbds {
+		record, err := xenapi.PBD.GetRecord(session, ref)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := map[string]string{"server": "192.0.2.20", "serverpath": "/exports/vms"}
+		if record.Host == supporter {
+			want = map[string]string{"server": "192.0.2.20", "options": "hard", "nfsversion": "4"}
+		}
+		if !maps.Equal(record.DeviceConfig, want) || !record.CurrentlyAttached {
+			t.Log("Unexpected PBD:", record.DeviceConfig, record.CurrentlyAttached)
+			t.Fail()
+		}
+	}
+	if steps, _ := plan(session, "", nil); len(steps) != 0 {
+		t.Log("Expected nothing left to repair, got:", steps)
+		t.Fail()
+	}
+	if _, err := plan(session, nfsUUID, mapping{"no-such-host": {"server": "192.0.2.20"}}); err == nil {
+		t.Log("Expected changes for an unknown host to fail")
+		t.Fail()
+	}
+
+	if _, err := plan(session, "no-such-uuid", nil); err == nil {
+		t.Log("Expected an unknown SR to fail")
+		t.Fail()
+	}
+}
+
+func TestFixPBDsRecreateFailure(t *testing.T) {
+	server := fakexapi.Start(t)
+	session := server.Login(t)
+	nfs, err := xenapi.SR.GetByNameLabel(session, "NFS virtual disk storage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	nfsUUID, err := xenapi.SR.GetUUID(session, nfs[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	pbds, err := xenapi.SR.GetPBDs(session, nfs[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.Do(func(st *fakexapi.Store) {
+		st.Update("PBD", string(pbds[0]), fakexapi.Record{"device_config": map[string]string{"server": "192.0.2.10", "password": "hunter2"}})
+	})
+
+	steps, err := plan(session, nfsUUID, mapping{"": {"server": "192.0.2.20"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(steps) != 1 || steps[0].Action != actionRecreate {
+		t.Fatal("Expected the PBD to be recreated, got:", steps)
+	}
+	if plan := steps[0].String(); strings.Contains(plan, "hunter2") || !strings.Contains(plan, "<redacted>") {
+		t.Log("Expected the password to be redacted:", plan)
+		t.Fail()
+	}
+
+	server.Handle("PBD.create", func(c *fakexapi.Call) (interface{}, error) {
+		return nil, fakexapi.Failure{"INTERNAL_ERROR"}
+	})
+	var out bytes.Buffer
+	err = apply(session, &out, steps)
+	if err == nil {
+		t.Fatal("Expected the recreate to fail")
+	}
+	if !strings.Contains(err.Error(), "192.0.2.10") || strings.Contains(err.Error(), "hunter2") {
+		t.Log("Expected the failure to give the old device_config without the password:", err)
+		t.Fail()
+	}
+}
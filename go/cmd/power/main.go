@@ -0,0 +1,128 @@
+// Command power starts, shuts down, reboots, suspends or resumes every VM
+// of a pool that matches a name glob, tag, appliance or host, several at
+// a time, and reports how each VM fared. Every VM of the pool is picked
+// only with -all. The VMs are only listed unless -apply is given, and an
+// interrupt cancels the operations still running. It is the counterpart
+// of python/shutdown.py and the Java StartAllVMs sample.
+//
+//	go run ./cmd/power -config pools.yaml -op start -tag web
+//	go run ./cmd/power -config pools.yaml -op clean-shutdown -name 'test-*' -parallel 8 -apply
+//	go run ./cmd/power -config pools.yaml -op clean-shutdown -all -apply
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"xenapi"
+
+	"github.com/xenserver/xenserver-samples/go/config"
+	"github.com/xenserver/xenserver-samples/go/power"
+	"github.com/xenserver/xenserver-samples/go/xsutil"
+)
+
+// errFailed is returned by run when some VMs failed; they have already
+// been reported.
+var errFailed = errors.New("some VMs failed")
+
+func opNames() string {
+	names := make([]string, len(power.Ops))
+	for i, op := range power.Ops {
+		names[i] = string(op)
+	}
+	return strings.Join(names, ", ")
+}
+
+func main() {
+	configPath := flag.String("config", "", "the YAML or TOML file describing the pools (default $XS_CONFIG)")
+	targetName := flag.String("target", "primary", "the target in the config naming the pool")
+	opName := flag.String("op", "", "the operation: "+opNames())
+	var sel power.Selector
+	flag.StringVar(&sel.Name, "name", "", "pick VMs whose name matches this glob")
+	flag.StringVar(&sel.Tag, "tag", "", "pick VMs with this tag")
+	flag.StringVar(&sel.Appliance, "appliance", "", "pick VMs of the appliance with this name or UUID")
+	flag.StringVar(&sel.Host, "host", "", "pick VMs on the host with this name or UUID")
+	all := flag.Bool("all", false, "pick every VM of the pool")
+	parallel := flag.Int("parallel", power.DefaultParallel, "how many VMs to handle at once")
+	timeout := flag.Duration("timeout", 10*time.Minute, "give up on a VM after this long")
+	doApply := flag.Bool("apply", false, "carry out the operation instead of only listing the VMs")
+	flag.Parse()
+	op, err := power.ParseOp(*opName)
+	if err != nil {
+		log.Fatalf("%v; -op must be one of %s", err, opNames())
+	}
+	targets, err := config.Load(*configPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	target := targets.Target(*targetName)
+	if target == nil {
+		log.Fatalf("target %q is not configured", *targetName)
+	}
+
+	session, err := xsutil.Login(target.ClientOpts("https"), target.Credentials("Go sdk samples power"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	err = run(ctx, session, os.Stdout, op, sel, *all, power.Options{Parallel: *parallel, Timeout: *timeout}, *doApply)
+	if logoutErr := session.Logout(); logoutErr != nil {
+		log.Println(logoutErr)
+	}
+	if errors.Is(err, errFailed) {
+		os.Exit(1)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func run(ctx context.Context, session *xenapi.Session, out io.Writer, op power.Op, sel power.Selector, all bool, opts power.Options, doApply bool) error {
+	switch {
+	case sel == power.Selector{} && !all:
+		return errors.New("no VMs picked; give -name, -tag, -appliance or -host, or -all for every VM")
+	case sel != power.Selector{} && all:
+		return errors.New("-all picks every VM and cannot be combined with -name, -tag, -appliance or -host")
+	}
+	vms, err := power.Select(session, sel)
+	if err != nil {
+		return err
+	}
+	if len(vms) == 0 {
+		fmt.Fprintln(out, "No VMs match.")
+		return nil
+	}
+	if !doApply {
+		for _, vm := range vms {
+			fmt.Fprintf(out, "%-46s %-10s %s\n", vm.Ref, vm.PowerState, vm.Name)
+		}
+		fmt.Fprintf(out, "%d VMs match; run again with -apply to %s them.\n", len(vms), op)
+		return nil
+	}
+	opts.Done = func(r power.Result) {
+		switch {
+		case r.Err != nil:
+			fmt.Fprintf(out, "%-8s %s: %v\n", "failed", r.VM.Name, r.Err)
+		case r.Skipped:
+			fmt.Fprintf(out, "%-8s %s: already %s\n", "skipped", r.VM.Name, r.VM.PowerState)
+		default:
+			fmt.Fprintf(out, "%-8s %s in %s\n", "done", r.VM.Name, r.Duration.Round(time.Millisecond))
+		}
+	}
+	summary, err := power.Summarize(power.Run(ctx, session, op, vms, opts))
+	fmt.Fprintf(out, "%s: %d done, %d skipped, %d failed.\n", op, summary.Succeeded, summary.Skipped, summary.Failed)
+	if err != nil {
+		return errFailed
+	}
+	return nil
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"xenapi"
+
+	"github.com/xenserver/xenserver-samples/go/fakexapi"
+	"github.com/xenserver/xenserver-samples/go/power"
+)
+
+func TestPower(t *testing.T) {
+	server := fakexapi.Start(t)
+	session := server.Login(t)
+	linux, err := xenapi.VM.GetByNameLabel(session, fakexapi.LinuxVM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var vms []xenapi.VMRef
+	for _, name := range []string{"batch-1", "batch-2", "batch-3"} {
+		vm, err := xenapi.VM.Clone(session, linux[0], name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := xenapi.VM.AddTags(session, vm, "batch"); err != nil {
+			t.Fatal(err)
+		}
+		vms = append(vms, vm)
+	}
+	if err := xenapi.VM.Start(session, vms[2], false, false); err != nil {
+		t.Fatal(err)
+	}
+	sel := power.Selector{Tag: "batch"}
+
+	// Every VM is only picked when asked for.
+	var out bytes.Buffer
+	if err := run(context.Background(), session, &out, power.OpStart, power.Selector{}, false, power.Options{}, true); err == nil {
+		t.Log("Expected a run without a selector or -all to be refused")
+		t.Fail()
+	}
+	if err := run(context.Background(), session, &out, power.OpStart, sel, true, power.Options{}, true); err == nil {
+		t.Log("Expected -all with a selector to be refused")
+		t.Fail()
+	}
+	if err := run(context.Background(), session, &out, power.OpStart, power.Selector{}, true, power.Options{}, false); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "4 VMs match") {
+		t.Log("Expected -all to list every VM, got:", out.String())
+		t.Fail()
+	}
+
+	// Without -apply the VMs are only listed.
+	out.Reset()
+	if err := run(context.Background(), session, &out, power.OpStart, sel, false, power.Options{}, false); err != nil {
+		t.Fatal(err)
+	}
+	t.Log(out.String())
+	if !strings.Contains(out.String(), "3 VMs match") {
+		t.Log("Expected the three tagged VMs to be listed")
+		t.Fail()
+	}
+	if state, _ := xenapi.VM.GetPowerState(session, vms[0]); state != xenapi.VMPowerStateHalted {
+		t.Fatal("A listing started a VM")
+	}
+
+	out.Reset()
+	if err := run(context.Background(), session, &out, power.OpStart, sel, false, power.Options{Parallel: 2}, true); err != nil {
+		t.Fatal(err)
+	}
+	t.Log(out.String())
+	if !strings.Contains(out.String(), "start: 2 done, 1 skipped, 0 failed.") {
+		t.Log("Expected two started and one skipped")
+		t.Fail()
+	}
+
+	// Suspending a paused VM fails and makes the run fail.
+	if err := xenapi.VM.Pause(session, vms[1]); err != nil {
+		t.Fatal(err)
+	}
+	out.Reset()
+	err = run(context.Background(), session, &out, power.OpSuspend, sel, false, power.Options{}, true)
+	t.Log(out.String())
+	if !errors.Is(err, errFailed) || !strings.Contains(out.String(), "failed   batch-2") {
+		t.Log("Expected batch-2 to fail, got:", err)
+		t.Fail()
+	}
+	if !strings.Contains(out.String(), "suspend: 2 done, 0 skipped, 1 failed.") {
+		t.Log("Expected the other two VMs to be suspended")
+		t.Fail()
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// checkpoint is the progress of a run, saved after every step so that an
+// interrupted run resumes where it stopped instead of starting over.
+type checkpoint struct {
+	// Pool is the UUID of the pool the run is for.
+	Pool string `json:"pool"`
+	// Order is the UUIDs of the hosts in the order they are maintained,
+	// fixed when the run starts.
+	Order []string `json:"order"`
+	// Done is the last step completed on each host that was started.
+	Done map[string]string `json:"done"`
+	// BootTimes is the other_config:boot_time each host had before it
+	// was rebooted, which tells the wait that follows when it has
+	// restarted.
+	BootTimes map[string]string `json:"boot_times,omitempty"`
+
+	path string
+}
+
+// loadCheckpoint reads the checkpoint at path, or returns nil if there is
+// none. A checkpoint left by a run on another pool is an error, rather
+// than something to silently start over from.
+func loadCheckpoint(path, pool string) (*checkpoint, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	cp := &checkpoint{path: path}
+	if err := json.Unmarshal(data, cp); err != nil {
+		return nil, fmt.Errorf("reading %s: %w", path, err)
+	}
+	if cp.Pool != pool {
+		return nil, fmt.Errorf("%s is the checkpoint of a run on pool %s, not this one", path, cp.Pool)
+	}
+	if cp.Done == nil {
+		cp.Done = make(map[string]string)
+	}
+	if cp.BootTimes == nil {
+		cp.BootTimes = make(map[string]string)
+	}
+	return cp, nil
+}
+
+// save writes the checkpoint through a temporary file, so that a run
+// interrupted while saving leaves the previous checkpoint intact.
+func (cp *checkpoint) save() error {
+	data, err := json.MarshalIndent(cp, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(cp.path), filepath.Base(cp.path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(append(data, '\n')); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), cp.path)
+}
+
+// remove deletes the checkpoint once the run is complete, so that the
+// next run starts afresh.
+func (cp *checkpoint) remove() error {
+	return os.Remove(cp.path)
+}
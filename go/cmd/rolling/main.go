@@ -0,0 +1,365 @@
+// Command rolling maintains the hosts of a pool one at a time, keeping
+// the pool's VMs running throughout: each host is disabled, evacuated,
+// handed to a hook that patches it or whatever else the maintenance is,
+// rebooted, waited for until it is live again with a new boot time, and
+// re-enabled. The pool coordinator goes last.
+//
+// Progress is saved to a checkpoint after every step. If a step fails, the
+// host is left as it is, usually disabled, and running the command again
+// resumes with that step once the problem is dealt with. The checkpoint
+// is removed when every host is done.
+//
+//	go run ./cmd/rolling -config pools.yaml -hook ./patch.sh
+//	go run ./cmd/rolling -config pools.yaml -target primary -state rolling.json -boot-timeout 45m
+//
+// The hook is run with sh -c, with XS_HOST_UUID, XS_HOST_NAME and
+// XS_HOST_ADDRESS naming the host; a non-zero exit stops the run.
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"slices"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"xenapi"
+
+	"github.com/xenserver/xenserver-samples/go/config"
+	"github.com/xenserver/xenserver-samples/go/xsutil"
+)
+
+// The steps each host goes through, in order. A checkpoint records the
+// last one completed on each host.
+const (
+	stepDisable  = "disable"
+	stepEvacuate = "evacuate"
+	stepHook     = "hook"
+	stepReboot   = "reboot"
+	stepWaitLive = "wait"
+	stepEnable   = "enable"
+)
+
+var steps = []string{stepDisable, stepEvacuate, stepHook, stepReboot, stepWaitLive, stepEnable}
+
+var stepDescriptions = map[string]string{
+	stepDisable:  "disabling",
+	stepEvacuate: "evacuating",
+	stepHook:     "running the hook",
+	stepReboot:   "rebooting",
+	stepWaitLive: "waiting for the host to be live",
+	stepEnable:   "enabling",
+}
+
+// roller runs the maintenance of a pool.
+type roller struct {
+	pool *xsutil.PoolSession
+	out  io.Writer
+	// hook is the shell command run on each host once it is evacuated; it
+	// may be empty.
+	hook string
+	// poll is how often a rebooting host is checked, and bootTimeout how
+	// long it has to come back.
+	poll        time.Duration
+	bootTimeout time.Duration
+}
+
+// host is what the steps need to know of a host.
+type host struct {
+	ref                 xenapi.HostRef
+	uuid, name, address string
+	coordinator         bool
+}
+
+// run maintains every host of the pool, resuming from the checkpoint at
+// statePath if there is one.
+func (r *roller) run(ctx context.Context, statePath string) error {
+	var poolUUID string
+	var hosts map[string]host
+	var order []string
+	err := r.pool.Do(func(session *xenapi.Session) error {
+		var err error
+		poolUUID, hosts, order, err = readHosts(session)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	cp, err := loadCheckpoint(statePath, poolUUID)
+	if err != nil {
+		return err
+	}
+	if cp == nil {
+		cp = &checkpoint{Pool: poolUUID, Order: order, Done: make(map[string]string), BootTimes: make(map[string]string), path: statePath}
+		if err := cp.save(); err != nil {
+			return err
+		}
+	} else {
+		fmt.Fprintf(r.out, "Resuming the run saved in %s\n", statePath)
+	}
+
+	for i, uuid := range cp.Order {
+		h, ok := hosts[uuid]
+		if !ok {
+			fmt.Fprintf(r.out, "[%d/%d] %s: no longer in the pool, skipped\n", i+1, len(cp.Order), uuid)
+			continue
+		}
+		fmt.Fprintf(r.out, "[%d/%d] %s\n", i+1, len(cp.Order), h.name)
+		if cp.Done[uuid] == stepEnable {
+			fmt.Fprintln(r.out, "  already done")
+			continue
+		}
+		next := slices.Index(steps, cp.Done[uuid]) + 1
+		for _, step := range steps[next:] {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			fmt.Fprintf(r.out, "  %s ... ", stepDescriptions[step])
+			if err := r.do(ctx, cp, step, h); err != nil {
+				fmt.Fprintln(r.out, "failed")
+				return fmt.Errorf("host %q: %s: %w; run again to resume", h.name, stepDescriptions[step], err)
+			}
+			fmt.Fprintln(r.out, "done")
+			cp.Done[uuid] = step
+			if err := cp.save(); err != nil {
+				return err
+			}
+		}
+	}
+	fmt.Fprintf(r.out, "All %d hosts are done\n", len(cp.Order))
+	return cp.remove()
+}
+
+// readHosts returns the pool's UUID, its hosts by UUID, and the order to
+// maintain them in: by name, with the coordinator last so that the pool
+// only changes coordinator once everything else is done.
+func readHosts(session *xenapi.Session) (string, map[string]host, []string, error) {
+	pools, err := xenapi.Pool.GetAllRecords(session)
+	if err != nil {
+		return "", nil, nil, err
+	}
+	records, err := xenapi.Host.GetAllRecords(session)
+	if err != nil {
+		return "", nil, nil, err
+	}
+	var poolUUID string
+	var coordinator xenapi.HostRef
+	for _, pool := range pools {
+		poolUUID, coordinator = pool.UUID, pool.Master
+	}
+	hosts := make(map[string]host, len(records))
+	var order []string
+	for ref, record := range records {
+		hosts[record.UUID] = host{ref: ref, uuid: record.UUID, name: record.NameLabel, address: record.Address, coordinator: ref == coordinator}
+		order = append(order, record.UUID)
+	}
+	sort.Slice(order, func(i, j int) bool {
+		a, b := hosts[order[i]], hosts[order[j]]
+		if a.coordinator != b.coordinator {
+			return b.coordinator
+		}
+		if a.name != b.name {
+			return a.name < b.name
+		}
+		return a.uuid < b.uuid
+	})
+	return poolUUID, hosts, order, nil
+}
+
+func (r *roller) do(ctx context.Context, cp *checkpoint, step string, h host) error {
+	switch step {
+	case stepDisable:
+		return r.pool.Do(func(session *xenapi.Session) error {
+			return xenapi.Host.Disable(session, h.ref)
+		})
+	case stepEvacuate:
+		return r.evacuate(ctx, h)
+	case stepHook:
+		return r.runHook(ctx, h)
+	case stepReboot:
+		// A run interrupted after the reboot was asked for has the boot
+		// time saved already: if the host has a new one or is down, the
+		// reboot is under way, and asking again would reboot it twice.
+		if before, ok := cp.BootTimes[h.uuid]; ok {
+			bootTime, live, err := r.hostState(h)
+			if err != nil {
+				return err
+			}
+			if bootTime != before || !live {
+				return nil
+			}
+		}
+		// The boot time is saved first, so that a run interrupted while
+		// the host reboots still knows what to wait for.
+		err := r.pool.Do(func(session *xenapi.Session) error {
+			otherConfig, err := xenapi.Host.GetOtherConfig(session, h.ref)
+			cp.BootTimes[h.uuid] = otherConfig["boot_time"]
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		if err := cp.save(); err != nil {
+			return err
+		}
+		// Not through Do: rebooting the coordinator may cut the call short,
+		// and trying again would reboot it twice.
+		err = xsutil.Decode(xenapi.Host.Reboot(r.pool.Session(), h.ref))
+		var netErr net.Error
+		if h.coordinator && errors.As(err, &netErr) {
+			return nil
+		}
+		return err
+	case stepWaitLive:
+		return r.waitLive(ctx, h, cp.BootTimes[h.uuid])
+	case stepEnable:
+		return r.pool.Do(func(session *xenapi.Session) error {
+			return xenapi.Host.Enable(session, h.ref)
+		})
+	}
+	return fmt.Errorf("unknown step %q", step)
+}
+
+// evacuate checks that every VM on the host can be moved before moving
+// them, so that a VM that cannot go anywhere is reported by name instead
+// of failing the evacuation halfway.
+func (r *roller) evacuate(ctx context.Context, h host) error {
+	var blockers []string
+	err := r.pool.Do(func(session *xenapi.Session) error {
+		prevented, err := xenapi.Host.GetVmsWhichPreventEvacuation(session, h.ref)
+		if err != nil {
+			return err
+		}
+		blockers = blockers[:0]
+		for vm, reason := range prevented {
+			name, err := xenapi.VM.GetNameLabel(session, vm)
+			if err != nil {
+				name = string(vm)
+			}
+			blockers = append(blockers, fmt.Sprintf("%s (%v)", name, xsutil.ParseFailure(reason)))
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if len(blockers) > 0 {
+		sort.Strings(blockers)
+		return fmt.Errorf("VMs prevent the evacuation: %s", strings.Join(blockers, ", "))
+	}
+	return r.pool.Do(func(session *xenapi.Session) error {
+		task, err := xenapi.Host.AsyncEvacuate2(session, h.ref)
+		if err != nil {
+			return err
+		}
+		defer xenapi.Task.Destroy(session, task)
+		_, err = xsutil.WaitForTask(ctx, session, task)
+		return err
+	})
+}
+
+func (r *roller) runHook(ctx context.Context, h host) error {
+	if r.hook == "" {
+		return nil
+	}
+	cmd := exec.CommandContext(ctx, "sh", "-c", r.hook)
+	cmd.Env = append(os.Environ(), "XS_HOST_UUID="+h.uuid, "XS_HOST_NAME="+h.name, "XS_HOST_ADDRESS="+h.address)
+	cmd.Stdout, cmd.Stderr = r.out, os.Stderr
+	return cmd.Run()
+}
+
+// waitLive waits for the host to come back from its reboot: to be live
+// with a boot time other than before, the one it had when it was rebooted.
+// A host's metrics only say it is down once its heartbeat has timed out,
+// so being live says nothing until the host has been seen down or has a
+// new boot time. Failures are expected while the coordinator is
+// rebooting, so they only end the wait once it times out.
+func (r *roller) waitLive(ctx context.Context, h host, before string) error {
+	wait, cancel := context.WithTimeout(ctx, r.bootTimeout)
+	defer cancel()
+	ticker := time.NewTicker(r.poll)
+	defer ticker.Stop()
+	var lastErr error
+	var wentDown bool
+	for {
+		var bootTime string
+		var live bool
+		bootTime, live, lastErr = r.hostState(h)
+		if lastErr == nil {
+			wentDown = wentDown || !live
+			if live && (wentDown || (bootTime != "" && bootTime != before)) {
+				return nil
+			}
+		}
+		select {
+		case <-ticker.C:
+		case <-wait.Done():
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			if lastErr != nil {
+				return fmt.Errorf("not live after %v: %w", r.bootTimeout, lastErr)
+			}
+			return fmt.Errorf("not live after %v", r.bootTimeout)
+		}
+	}
+}
+
+// hostState returns the host's other_config:boot_time and whether its
+// metrics say it is live.
+func (r *roller) hostState(h host) (bootTime string, live bool, err error) {
+	err = r.pool.Do(func(session *xenapi.Session) error {
+		record, err := xenapi.Host.GetRecord(session, h.ref)
+		if err != nil {
+			return err
+		}
+		bootTime = record.OtherConfig["boot_time"]
+		live, err = xenapi.HostMetrics.GetLive(session, record.Metrics)
+		return err
+	})
+	return bootTime, live, err
+}
+
+func main() {
+	configPath := flag.String("config", "", "the YAML or TOML file describing the pools (default $XS_CONFIG)")
+	targetName := flag.String("target", "primary", "the target in the config naming the pool to maintain")
+	hook := flag.String("hook", "", "the shell command to run on each host once it is evacuated")
+	statePath := flag.String("state", "rolling.json", "the checkpoint file to resume from and save progress to")
+	poll := flag.Duration("poll", 10*time.Second, "how often to check whether a rebooting host is back")
+	bootTimeout := flag.Duration("boot-timeout", 30*time.Minute, "how long a host has to come back after rebooting")
+	flag.Parse()
+
+	targets, err := config.Load(*configPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	target := targets.Target(*targetName)
+	if target == nil {
+		log.Fatalf("target %q is not configured", *targetName)
+	}
+	pool, err := xsutil.Connect(target.ClientOpts("https"), target.Credentials("Go sdk samples rolling"))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	r := &roller{pool: pool, out: os.Stdout, hook: *hook, poll: *poll, bootTimeout: *bootTimeout}
+	err = r.run(ctx, *statePath)
+	if logoutErr := pool.Logout(); logoutErr != nil {
+		log.Println(logoutErr)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"xenapi"
+
+	"github.com/xenserver/xenserver-samples/go/fakexapi"
+	"github.com/xenserver/xenserver-samples/go/xsutil"
+)
+
+// newPool returns a session on a pool of two fake hosts, and the
+// coordinator.
+func newPool(t *testing.T) (*xsutil.PoolSession, *fakexapi.Server) {
+	coordinator, _ := fakexapi.NewPool(t)
+	creds := xsutil.Credentials{Username: coordinator.Username, Password: coordinator.Password, Originator: "rolling test"}
+	pool, err := xsutil.Connect(&xenapi.ClientOpts{URL: coordinator.URL()}, creds)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pool.Logout() })
+	return pool, coordinator
+}
+
+func TestRolling(t *testing.T) {
+	pool, coordinator := newPool(t)
+	session := pool.Session()
+	hosts, err := xenapi.Host.GetAllRecords(session)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var coordinatorHost, supporterHost xenapi.HostRef
+	for ref, h := range hosts {
+		if h.Address == coordinator.Addr() {
+			coordinatorHost = ref
+		} else {
+			supporterHost = ref
+		}
+	}
+
+	// A VM without disks can move off the supporter; the Linux VM's disk is
+	// on local storage, so it pins the coordinator.
+	templates, err := xenapi.VM.GetByNameLabel(session, fakexapi.LinuxTemplate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mobile, err := xenapi.VM.Clone(session, templates[0], "rolling test VM")
+	if err != nil {
+		t.Fatal(err)
+	}
+	coordinator.Do(func(st *fakexapi.Store) {
+		st.Update("VM", string(mobile), fakexapi.Record{"is_a_template": false})
+	})
+	if err := xenapi.VM.StartOn(session, mobile, supporterHost, false, false); err != nil {
+		t.Fatal(err)
+	}
+	pinned, err := xenapi.VM.GetByNameLabel(session, fakexapi.LinuxVM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := xenapi.VM.StartOn(session, pinned[0], coordinatorHost, false, false); err != nil {
+		t.Fatal(err)
+	}
+
+	// Long enough for a wait that does not look for the reboot to finish
+	// first.
+	coordinator.RebootDelay, coordinator.HeartbeatTimeout = 400*time.Millisecond, 250*time.Millisecond
+	dir := t.TempDir()
+	statePath, hookLog := filepath.Join(dir, "rolling.json"), filepath.Join(dir, "hooks.txt")
+	var out bytes.Buffer
+	r := &roller{
+		pool:        pool,
+		out:         &out,
+		hook:        `echo "$XS_HOST_NAME" >> ` + hookLog,
+		poll:        5 * time.Millisecond,
+		bootTimeout: 5 * time.Second,
+	}
+	err = r.run(context.Background(), statePath)
+	if err == nil || !strings.Contains(err.Error(), fakexapi.LinuxVM) {
+		t.Fatal("Expected the Linux VM to stop the evacuation of the coordinator, got:", err, "\n", out.String())
+	}
+	if resident, _ := xenapi.VM.GetResidentOn(session, mobile); resident != coordinatorHost {
+		t.Log("Expected the VM to have been moved to the coordinator, it is on", resident)
+		t.Fail()
+	}
+	cp, err := loadCheckpoint(statePath, "")
+	if err == nil {
+		t.Fatal("Expected the checkpoint to belong to the pool")
+	}
+	pools, _ := xenapi.Pool.GetAllRecords(session)
+	for _, p := range pools {
+		if cp, err = loadCheckpoint(statePath, p.UUID); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if cp.Done[hosts[supporterHost].UUID] != stepEnable || cp.Done[hosts[coordinatorHost].UUID] != stepDisable {
+		t.Log("Unexpected checkpoint:", cp.Done)
+		t.Fail()
+	}
+	if enabled, _ := xenapi.Host.GetEnabled(session, coordinatorHost); enabled {
+		t.Log("Expected the coordinator to be left disabled")
+		t.Fail()
+	}
+
+	if err := xenapi.VM.CleanShutdown(session, pinned[0]); err != nil {
+		t.Fatal(err)
+	}
+	if err := xenapi.VM.HardShutdown(session, mobile); err != nil {
+		t.Fatal(err)
+	}
+	out.Reset()
+	if err := r.run(context.Background(), statePath); err != nil {
+		t.Fatal(err, "\n", out.String())
+	}
+	if !strings.Contains(out.String(), "Resuming") || !strings.Contains(out.String(), "already done") {
+		t.Log("Expected the second run to resume:", out.String())
+		t.Fail()
+	}
+	if _, err := os.Stat(statePath); !os.IsNotExist(err) {
+		t.Log("Expected the checkpoint to be removed, got", err)
+		t.Fail()
+	}
+	hooks, err := os.ReadFile(hookLog)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := hosts[supporterHost].NameLabel + "\n" + hosts[coordinatorHost].NameLabel + "\n"
+	if string(hooks) != want {
+		t.Logf("Expected the hook to run on the supporter and then the coordinator, got %q", hooks)
+		t.Fail()
+	}
+	for ref, h := range hosts {
+		enabled, _ := xenapi.Host.GetEnabled(session, ref)
+		live, _ := xenapi.HostMetrics.GetLive(session, h.Metrics)
+		if !enabled || !live {
+			t.Logf("Expected %s to be enabled and live, got enabled %v and live %v", h.NameLabel, enabled, live)
+			t.Fail()
+		}
+		// The hosts still look live right after the reboot, so a wait
+		// that only checked that would have re-enabled them before they
+		// were back.
+		otherConfig, _ := xenapi.Host.GetOtherConfig(session, ref)
+		if otherConfig["boot_time"] == h.OtherConfig["boot_time"] {
+			t.Logf("Expected %s to have been enabled after it had rebooted", h.NameLabel)
+			t.Fail()
+		}
+	}
+}
+
+func TestRollingResumesReboot(t *testing.T) {
+	pool, coordinator := newPool(t)
+	session := pool.Session()
+	hosts, err := xenapi.Host.GetAllRecords(session)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var poolUUID string
+	pools, _ := xenapi.Pool.GetAllRecords(session)
+	for _, p := range pools {
+		poolUUID = p.UUID
+	}
+	var supporter xenapi.HostRef
+	for ref, h := range hosts {
+		if h.Address != coordinator.Addr() {
+			supporter = ref
+		}
+	}
+
+	// A run that was interrupted once it had asked for the reboot: the
+	// boot time is saved, but the step is not done.
+	dir := t.TempDir()
+	cp := &checkpoint{
+		Pool:      poolUUID,
+		Order:     []string{hosts[supporter].UUID},
+		Done:      map[string]string{hosts[supporter].UUID: stepHook},
+		BootTimes: map[string]string{hosts[supporter].UUID: hosts[supporter].OtherConfig["boot_time"]},
+		path:      filepath.Join(dir, "rolling.json"),
+	}
+	if err := cp.save(); err != nil {
+		t.Fatal(err)
+	}
+	coordinator.RebootDelay, coordinator.HeartbeatTimeout = 400*time.Millisecond, 20*time.Millisecond
+	if err := xenapi.Host.Disable(session, supporter); err != nil {
+		t.Fatal(err)
+	}
+	if err := xenapi.Host.Reboot(session, supporter); err != nil {
+		t.Fatal(err)
+	}
+	for live := true; live; {
+		time.Sleep(5 * time.Millisecond)
+		if live, err = xenapi.HostMetrics.GetLive(session, hosts[supporter].Metrics); err != nil {
+			t.Fatal(err)
+		}
+	}
+	coordinator.Handle("host.reboot", func(c *fakexapi.Call) (interface{}, error) {
+		t.Error("Expected the host not to be rebooted again")
+		return nil, nil
+	})
+
+	var out bytes.Buffer
+	r := &roller{pool: pool, out: &out, poll: 5 * time.Millisecond, bootTimeout: 5 * time.Second}
+	if err := r.run(context.Background(), cp.path); err != nil {
+		t.Fatal(err, "\n", out.String())
+	}
+	enabled, _ := xenapi.Host.GetEnabled(session, supporter)
+	live, _ := xenapi.HostMetrics.GetLive(session, hosts[supporter].Metrics)
+	if !enabled || !live {
+		t.Logf("Expected the host to be enabled and live, got enabled %v and live %v", enabled, live)
+		t.Fail()
+	}
+}
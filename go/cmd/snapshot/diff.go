@@ -0,0 +1,227 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/xenserver/xenserver-samples/go/xsutil"
+)
+
+// watchedFields are the fields whose changes the diff reports, by class.
+// Other classes only report objects added and removed.
+var watchedFields = map[string][]string{
+	"VM":      {"name_label", "power_state", "resident_on", "memory_static_max", "VCPUs_max", "is_a_template"},
+	"VDI":     {"name_label", "virtual_size", "SR", "read_only"},
+	"VBD":     {"VDI", "currently_attached"},
+	"VIF":     {"network", "MAC", "currently_attached"},
+	"network": {"name_label", "MTU", "bridge"},
+	"PIF":     {"MTU", "VLAN", "IP", "currently_attached"},
+	"SR":      {"name_label", "physical_size", "shared"},
+	"PBD":     {"currently_attached"},
+	"host":    {"name_label", "enabled", "API_version_major", "API_version_minor", "software_version"},
+	"pool":    {"name_label", "master", "ha_enabled"},
+	"Bond":    {"mode"},
+}
+
+// ignoredClasses come and go on their own and would bury the changes an
+// operator made.
+var ignoredClasses = map[string]bool{
+	"task":             true,
+	"message":          true,
+	"VM_metrics":       true,
+	"VM_guest_metrics": true,
+	"host_metrics":     true,
+	"PIF_metrics":      true,
+}
+
+// change is one difference between two snapshots: an object added or
+// removed, or a watched field that changed.
+type change struct {
+	Class  string      `json:"class"`
+	Ref    string      `json:"ref"`
+	Name   string      `json:"name"`
+	Kind   string      `json:"kind"`
+	Field  string      `json:"field,omitempty"`
+	Before interface{} `json:"before,omitempty"`
+	After  interface{} `json:"after,omitempty"`
+}
+
+// Kinds of change.
+const (
+	added   = "added"
+	removed = "removed"
+	changed = "changed"
+)
+
+// diff is the difference between two snapshots.
+type diff struct {
+	Before  time.Time `json:"before"`
+	After   time.Time `json:"after"`
+	Changes []change  `json:"changes"`
+	// Skipped are the classes only one of the snapshots has, as when the
+	// pool was upgraded in between.
+	Skipped []string `json:"skipped,omitempty"`
+}
+
+// load reads a snapshot written by save. Numbers are kept as json.Number
+// so that sizes beyond 2^53 compare exactly.
+func load(path string) (*xsutil.Snapshot, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	decoder := json.NewDecoder(f)
+	decoder.UseNumber()
+	var snapshot xsutil.Snapshot
+	if err := decoder.Decode(&snapshot); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return &snapshot, nil
+}
+
+// compare lists the changes from before to after, sorted by class, name
+// and field.
+func compare(before, after *xsutil.Snapshot) *diff {
+	d := &diff{Before: before.Taken, After: after.Taken, Changes: []change{}}
+	for class, oldRecords := range before.Records {
+		newRecords, ok := after.Records[class]
+		if !ok {
+			d.Skipped = append(d.Skipped, class)
+			continue
+		}
+		if ignoredClasses[class] {
+			continue
+		}
+		for ref, oldRecord := range oldRecords {
+			newRecord, ok := newRecords[ref]
+			if !ok {
+				d.Changes = append(d.Changes, change{Class: class, Ref: ref, Name: nameOf(oldRecord), Kind: removed})
+				continue
+			}
+			for _, field := range watchedFields[class] {
+				oldValue, newValue := fieldOf(oldRecord, field), fieldOf(newRecord, field)
+				if !reflect.DeepEqual(oldValue, newValue) {
+					d.Changes = append(d.Changes, change{
+						Class: class, Ref: ref, Name: nameOf(newRecord), Kind: changed,
+						Field: field, Before: oldValue, After: newValue,
+					})
+				}
+			}
+		}
+		for ref, newRecord := range newRecords {
+			if _, ok := oldRecords[ref]; !ok {
+				d.Changes = append(d.Changes, change{Class: class, Ref: ref, Name: nameOf(newRecord), Kind: added})
+			}
+		}
+	}
+	for class := range after.Records {
+		if _, ok := before.Records[class]; !ok {
+			d.Skipped = append(d.Skipped, class)
+		}
+	}
+	sort.Strings(d.Skipped)
+	sort.Slice(d.Changes, func(i, j int) bool {
+		a, b := d.Changes[i], d.Changes[j]
+		if a.Class != b.Class {
+			return a.Class < b.Class
+		}
+		if a.Name != b.Name {
+			return a.Name < b.Name
+		}
+		if a.Ref != b.Ref {
+			return a.Ref < b.Ref
+		}
+		return a.Field < b.Field
+	})
+	return d
+}
+
+func fieldOf(record interface{}, field string) interface{} {
+	m, _ := record.(map[string]interface{})
+	return m[field]
+}
+
+// nameOf names a record by its name label, else its UUID.
+func nameOf(record interface{}) string {
+	if name, _ := fieldOf(record, "name_label").(string); name != "" {
+		return name
+	}
+	uuid, _ := fieldOf(record, "uuid").(string)
+	return uuid
+}
+
+// trend says whether a numeric field grew or shrank, or "" if the values
+// are not both numbers.
+func trend(before, after interface{}) string {
+	oldValue, ok1 := number(before)
+	newValue, ok2 := number(after)
+	switch {
+	case !ok1 || !ok2:
+		return ""
+	case newValue > oldValue:
+		return " (grew)"
+	case newValue < oldValue:
+		return " (shrank)"
+	}
+	return ""
+}
+
+func number(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case json.Number:
+		f, err := n.Float64()
+		return f, err == nil
+	case int64:
+		return float64(n), true
+	case float64:
+		return n, true
+	}
+	return 0, false
+}
+
+func (d *diff) writeText(out io.Writer) {
+	fmt.Fprintf(out, "Changes from %s to %s:\n", d.Before.Format(time.RFC3339), d.After.Format(time.RFC3339))
+	if len(d.Changes) == 0 {
+		fmt.Fprintln(out, "No changes.")
+	}
+	for _, c := range d.Changes {
+		switch c.Kind {
+		case changed:
+			fmt.Fprintf(out, "~ %s %q %s: %s -> %s%s\n", c.Class, c.Name, c.Field, show(c.Before), show(c.After), trend(c.Before, c.After))
+		case added:
+			fmt.Fprintf(out, "+ %s %q (%s)\n", c.Class, c.Name, c.Ref)
+		case removed:
+			fmt.Fprintf(out, "- %s %q (%s)\n", c.Class, c.Name, c.Ref)
+		}
+	}
+	if len(d.Skipped) > 0 {
+		fmt.Fprintf(out, "Not compared, as only one snapshot has them: %s\n", strings.Join(d.Skipped, ", "))
+	}
+}
+
+func (d *diff) writeJSON(out io.Writer) error {
+	encoder := json.NewEncoder(out)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(d)
+}
+
+// show formats a field value for the text output.
+func show(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return "(none)"
+	case string:
+		return fmt.Sprintf("%q", v)
+	case map[string]interface{}, []interface{}:
+		data, _ := json.Marshal(v)
+		return string(data)
+	}
+	return fmt.Sprint(v)
+}
@@ -0,0 +1,143 @@
+// Command snapshot saves every record in a pool to a JSON file and diffs
+// two such files, to show what a maintenance window changed: VMs added or
+// removed, power states, VDIs that grew, network MTUs and so on. With
+// -check it looks for dangling references, orphaned VDIs and unplugged
+// PBDs in a saved file instead, and exits with status 1 if it finds any.
+//
+//	go run ./cmd/snapshot -config pools.yaml -o before.json
+//	go run ./cmd/snapshot -config pools.yaml -target primary -o after.json
+//	go run ./cmd/snapshot -diff before.json after.json
+//	go run ./cmd/snapshot -diff -json before.json after.json
+//	go run ./cmd/snapshot -check after.json
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+
+	"xenapi"
+
+	"github.com/xenserver/xenserver-samples/go/config"
+	"github.com/xenserver/xenserver-samples/go/xsutil"
+)
+
+func main() {
+	configPath := flag.String("config", "", "the YAML or TOML file describing the pools (default $XS_CONFIG)")
+	targetName := flag.String("target", "primary", "the target in the config naming the pool to snapshot")
+	output := flag.String("o", "snapshot.json", "the file to save the snapshot to")
+	diffMode := flag.Bool("diff", false, "compare the two snapshot files given as arguments instead of taking one")
+	checkMode := flag.Bool("check", false, "check the integrity of the snapshot file given as argument instead of taking one")
+	asJSON := flag.Bool("json", false, "print the diff or the problems found as JSON")
+	flag.Parse()
+
+	if *checkMode {
+		if flag.NArg() != 1 {
+			log.Fatal("-check needs one snapshot file")
+		}
+		problems, err := runCheck(os.Stdout, flag.Arg(0), *asJSON)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if problems > 0 {
+			os.Exit(1)
+		}
+		return
+	}
+
+	if *diffMode {
+		if flag.NArg() != 2 {
+			log.Fatal("-diff needs two snapshot files: before and after")
+		}
+		if err := runDiff(os.Stdout, flag.Arg(0), flag.Arg(1), *asJSON); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	targets, err := config.Load(*configPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	target := targets.Target(*targetName)
+	if target == nil {
+		log.Fatalf("target %q is not configured", *targetName)
+	}
+	session, err := xsutil.Login(target.ClientOpts("https"), target.Credentials("Go sdk samples snapshot"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = save(session, os.Stdout, *output)
+	if logoutErr := session.Logout(); logoutErr != nil {
+		log.Println(logoutErr)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// save dumps the pool to path. Classes the server does not support are
+// reported but do not fail the snapshot; any other failure does.
+func save(session *xenapi.Session, out io.Writer, path string) error {
+	snapshot, err := xsutil.Dump(session)
+	if err != nil {
+		return err
+	}
+	if err := snapshot.WriteFile(path); err != nil {
+		return err
+	}
+	unsupported := make([]string, 0, len(snapshot.Unsupported))
+	for class := range snapshot.Unsupported {
+		unsupported = append(unsupported, class)
+	}
+	sort.Strings(unsupported)
+	for _, class := range unsupported {
+		fmt.Fprintf(out, "Skipped %s: %s\n", class, snapshot.Unsupported[class])
+	}
+	fmt.Fprintf(out, "Saved %d classes to %s.\n", len(snapshot.Records), path)
+	return nil
+}
+
+func runDiff(out io.Writer, beforePath, afterPath string, asJSON bool) error {
+	before, err := load(beforePath)
+	if err != nil {
+		return err
+	}
+	after, err := load(afterPath)
+	if err != nil {
+		return err
+	}
+	d := compare(before, after)
+	if asJSON {
+		return d.writeJSON(out)
+	}
+	d.writeText(out)
+	return nil
+}
+
+// runCheck reports the integrity problems in the snapshot at path and
+// returns how many there are.
+func runCheck(out io.Writer, path string, asJSON bool) (int, error) {
+	snapshot, err := load(path)
+	if err != nil {
+		return 0, err
+	}
+	problems := xsutil.CheckIntegrity(snapshot)
+	if asJSON {
+		if problems == nil {
+			problems = []xsutil.Problem{}
+		}
+		encoder := json.NewEncoder(out)
+		encoder.SetIndent("", "  ")
+		return len(problems), encoder.Encode(problems)
+	}
+	for _, problem := range problems {
+		fmt.Fprintln(out, problem)
+	}
+	fmt.Fprintf(out, "Found %d problems.\n", len(problems))
+	return len(problems), nil
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"xenapi"
+
+	"github.com/xenserver/xenserver-samples/go/fakexapi"
+)
+
+func login(t *testing.T) *xenapi.Session {
+	server := fakexapi.Start(t)
+	session := server.Login(t)
+	return session
+}
+
+func TestSnapshotDiff(t *testing.T) {
+	session := login(t)
+	linux, err := xenapi.VM.GetByNameLabel(session, fakexapi.LinuxVM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srs, err := xenapi.SR.GetByNameLabel(session, "Local storage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	doomed, err := xenapi.VM.Clone(session, linux[0], "retired VM")
+	if err != nil {
+		t.Fatal(err)
+	}
+	vdi, err := xenapi.VDI.Create(session, xenapi.VDIRecord{
+		NameLabel: "data disk", SR: srs[0], VirtualSize: 1 << 30, Type: xenapi.VdiTypeUser,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	network, err := xenapi.Network.Create(session, xenapi.NetworkRecord{NameLabel: "storage network", MTU: 1500})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	before, after := filepath.Join(dir, "before.json"), filepath.Join(dir, "after.json")
+	var out bytes.Buffer
+	if err := save(session, &out, before); err != nil {
+		t.Fatal(err)
+	}
+
+	// The maintenance window.
+	if _, err := xenapi.VM.Clone(session, linux[0], "new VM"); err != nil {
+		t.Fatal(err)
+	}
+	if err := xenapi.VM.Destroy(session, doomed); err != nil {
+		t.Fatal(err)
+	}
+	if err := xenapi.VM.Start(session, linux[0], false, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := xenapi.VDI.Resize(session, vdi, 4<<30); err != nil {
+		t.Fatal(err)
+	}
+	if err := xenapi.Network.SetMTU(session, network, 9000); err != nil {
+		t.Fatal(err)
+	}
+	if err := save(session, &out, after); err != nil {
+		t.Fatal(err)
+	}
+
+	out.Reset()
+	if err := runDiff(&out, before, after, false); err != nil {
+		t.Fatal(err)
+	}
+	text := out.String()
+	for _, want := range []string{
+		`+ VM "new VM"`,
+		`- VM "retired VM"`,
+		`~ VM "` + fakexapi.LinuxVM + `" power_state: "Halted" -> "Running"`,
+		`~ VDI "data disk" virtual_size: 1073741824 -> 4294967296 (grew)`,
+		`~ network "storage network" MTU: 1500 -> 9000 (grew)`,
+	} {
+		if !strings.Contains(text, want) {
+			t.Log("Missing from the diff:", want)
+			t.Fail()
+		}
+	}
+	if strings.Contains(text, "VM_metrics") {
+		t.Log("The diff reports metrics objects:\n", text)
+		t.Fail()
+	}
+	if t.Failed() {
+		t.Log(text)
+	}
+
+	out.Reset()
+	if err := runDiff(&out, before, after, true); err != nil {
+		t.Fatal(err)
+	}
+	var d diff
+	if err := json.Unmarshal(out.Bytes(), &d); err != nil {
+		t.Fatal(err)
+	}
+	var removedVM bool
+	for _, c := range d.Changes {
+		if c.Class == "VM" && c.Kind == removed && c.Ref == string(doomed) {
+			removedVM = true
+		}
+	}
+	if !removedVM {
+		t.Log("The JSON diff does not report the removed VM:", out.String())
+		t.Fail()
+	}
+
+	out.Reset()
+	if err := runDiff(&out, after, after, false); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "No changes.") {
+		t.Log("Expected no changes between a snapshot and itself:", out.String())
+		t.Fail()
+	}
+}
+
+func TestSnapshotCheck(t *testing.T) {
+	session := login(t)
+	path := filepath.Join(t.TempDir(), "snapshot.json")
+	var out bytes.Buffer
+	if err := save(session, &out, path); err != nil {
+		t.Fatal(err)
+	}
+	out.Reset()
+	problems, err := runCheck(&out, path, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if problems != 0 {
+		t.Log("Expected a fresh pool to have no problems:", out.String())
+		t.Fail()
+	}
+
+	srs, err := xenapi.SR.GetByNameLabel(session, "Local storage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = xenapi.VDI.Create(session, xenapi.VDIRecord{
+		NameLabel: "forgotten disk", SR: srs[0], VirtualSize: 1 << 30, Type: xenapi.VdiTypeUser,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := save(session, &out, path); err != nil {
+		t.Fatal(err)
+	}
+	out.Reset()
+	problems, err = runCheck(&out, path, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if problems != 1 || !strings.Contains(out.String(), `orphaned VDI: VDI "forgotten disk"`) {
+		t.Log("Expected the orphaned VDI to be reported:", out.String())
+		t.Fail()
+	}
+}
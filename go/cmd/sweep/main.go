@@ -0,0 +1,218 @@
+// Command sweep finds the VMs, networks and SRs that sample runs left
+// behind in a pool and, with -delete, removes them. Leftovers are
+// recognised by the other_config tag the samples' object tracker sets,
+// which records when they were tracked, or by the names the samples give
+// them. XAPI keeps no creation time for these objects, so untagged ones
+// found by name are of unknown age: they are only reported unless
+// -by_name is given too.
+//
+//	go run ./cmd/sweep -config pools.yaml
+//	go run ./cmd/sweep -config pools.yaml -target primary -delete
+//	go run ./cmd/sweep -config pools.yaml -delete -by_name
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"xenapi"
+
+	"github.com/xenserver/xenserver-samples/go/config"
+	"github.com/xenserver/xenserver-samples/go/xsutil"
+)
+
+// leftoverNames are the name label prefixes of the objects the samples
+// create.
+var leftoverNames = []string{
+	"GoSDK-TestVM",
+	"GoSDK-SpecVM",
+	"Cloned VM (from ",
+	"TestSR: DO NOT USE",
+	"NFS SR created by sr_nfs_test.go",
+	"Test External Network",
+}
+
+// leftover is an object found by findLeftovers.
+type leftover struct {
+	Class  string
+	Ref    string
+	Name   string
+	Reason string
+	// Kept is set for objects of unknown age, which are reported but not
+	// removed.
+	Kept bool
+}
+
+// match reports why an object with the given name and other_config is a
+// leftover, or "" if it is not one or was tracked after cutoff. Untagged
+// objects named like sample objects may have been created at any time,
+// so they are kept unless byName is set.
+func match(name string, otherConfig map[string]string, cutoff time.Time, byName bool) (reason string, kept bool) {
+	if value, ok := otherConfig[xsutil.TrackedKey]; ok {
+		since, err := time.Parse(time.RFC3339, value)
+		if err == nil && since.After(cutoff) {
+			return "", false
+		}
+		return "tracked since " + value, false
+	}
+	for _, prefix := range leftoverNames {
+		if strings.HasPrefix(name, prefix) {
+			if !byName {
+				return "named like a sample object, of unknown age; kept without -by_name", true
+			}
+			return "named like a sample object", false
+		}
+	}
+	return "", false
+}
+
+// findLeftovers lists the leftovers in the pool, ignoring tagged objects
+// tracked after cutoff since a run may still be using them, and keeping
+// untagged ones unless byName is set. Snapshots of leftover VMs are
+// leftovers too, and are kept with their VM.
+func findLeftovers(session *xenapi.Session, cutoff time.Time, byName bool) ([]leftover, error) {
+	var found []leftover
+	vms, err := xenapi.VM.GetAllRecords(session)
+	if err != nil {
+		return nil, err
+	}
+	for ref, vm := range vms {
+		if vm.IsATemplate || vm.IsControlDomain || vm.IsASnapshot {
+			continue
+		}
+		reason, kept := match(vm.NameLabel, vm.OtherConfig, cutoff, byName)
+		if reason == "" {
+			continue
+		}
+		found = append(found, leftover{"VM", string(ref), vm.NameLabel, reason, kept})
+		for _, snapshot := range vm.Snapshots {
+			found = append(found, leftover{"VM", string(snapshot), vms[snapshot].NameLabel, "snapshot of " + vm.NameLabel, kept})
+		}
+	}
+	networks, err := xenapi.Network.GetAllRecords(session)
+	if err != nil {
+		return nil, err
+	}
+	for ref, network := range networks {
+		if reason, kept := match(network.NameLabel, network.OtherConfig, cutoff, byName); reason != "" {
+			found = append(found, leftover{"network", string(ref), network.NameLabel, reason, kept})
+		}
+	}
+	srs, err := xenapi.SR.GetAllRecords(session)
+	if err != nil {
+		return nil, err
+	}
+	for ref, sr := range srs {
+		if reason, kept := match(sr.NameLabel, sr.OtherConfig, cutoff, byName); reason != "" {
+			found = append(found, leftover{"SR", string(ref), sr.NameLabel, reason, kept})
+		}
+	}
+	sort.Slice(found, func(i, j int) bool {
+		if found[i].Class != found[j].Class {
+			return found[i].Class < found[j].Class
+		}
+		return found[i].Name < found[j].Name
+	})
+	return found, nil
+}
+
+// sweep removes the leftovers that are not kept, together with the disks
+// of the VMs, in dependency order.
+func sweep(session *xenapi.Session, leftovers []leftover) error {
+	tracker := xsutil.NewTracker(session)
+	for _, l := range leftovers {
+		if l.Kept {
+			continue
+		}
+		switch l.Class {
+		case "VM":
+			tracker.VM(xenapi.VMRef(l.Ref))
+			if err := tracker.VMDisks(xenapi.VMRef(l.Ref)); err != nil {
+				return xsutil.Decode(err)
+			}
+		case "network":
+			tracker.Network(xenapi.NetworkRef(l.Ref))
+		case "SR":
+			// An SR without PBDs, as an introduced one may be, cannot be
+			// destroyed, only forgotten.
+			pbds, err := xenapi.SR.GetPBDs(session, xenapi.SRRef(l.Ref))
+			if err != nil {
+				return xsutil.Decode(err)
+			}
+			if len(pbds) == 0 {
+				tracker.IntroducedSR(xenapi.SRRef(l.Ref))
+			} else {
+				tracker.SR(xenapi.SRRef(l.Ref))
+			}
+		}
+	}
+	return tracker.Cleanup()
+}
+
+func report(out io.Writer, leftovers []leftover) {
+	for _, l := range leftovers {
+		fmt.Fprintf(out, "%-8s %-46s %s (%s)\n", l.Class, l.Ref, l.Name, l.Reason)
+	}
+}
+
+func main() {
+	configPath := flag.String("config", "", "the YAML or TOML file describing the pools (default $XS_CONFIG)")
+	targetName := flag.String("target", "primary", "the target in the config naming the pool to sweep")
+	minAge := flag.Duration("min_age", time.Hour, "leave tagged objects younger than this alone")
+	remove := flag.Bool("delete", false, "remove the leftovers instead of only listing them")
+	byName := flag.Bool("by_name", false, "also remove untagged objects named like sample objects, whatever their age")
+	flag.Parse()
+	targets, err := config.Load(*configPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	target := targets.Target(*targetName)
+	if target == nil {
+		log.Fatalf("target %q is not configured", *targetName)
+	}
+
+	session, err := xsutil.Login(target.ClientOpts("https"), target.Credentials("Go sdk samples sweep"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = run(session, os.Stdout, time.Now().Add(-*minAge), *byName, *remove)
+	if logoutErr := session.Logout(); logoutErr != nil {
+		log.Println(logoutErr)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func run(session *xenapi.Session, out io.Writer, cutoff time.Time, byName, remove bool) error {
+	leftovers, err := findLeftovers(session, cutoff, byName)
+	if err != nil {
+		return xsutil.Decode(err)
+	}
+	report(out, leftovers)
+	var n int
+	for _, l := range leftovers {
+		if !l.Kept {
+			n++
+		}
+	}
+	if n == 0 {
+		fmt.Fprintln(out, "Nothing to sweep.")
+		return nil
+	}
+	if !remove {
+		fmt.Fprintf(out, "Found %d leftovers; run again with -delete to remove them.\n", n)
+		return nil
+	}
+	if err := sweep(session, leftovers); err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "Removed %d leftovers.\n", n)
+	return nil
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"xenapi"
+
+	"github.com/xenserver/xenserver-samples/go/fakexapi"
+	"github.com/xenserver/xenserver-samples/go/xsutil"
+)
+
+func TestSweep(t *testing.T) {
+	server := fakexapi.Start(t)
+	session := server.Login(t)
+	linux, err := xenapi.VM.GetByNameLabel(session, fakexapi.LinuxVM)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A VM left by a crashed run, with a snapshot, and one a run is using.
+	leftVM, err := xenapi.VM.Clone(session, linux[0], "GoSDK-TestVM")
+	if err != nil {
+		t.Fatal(err)
+	}
+	snapshot, err := xenapi.VM.Snapshot(session, leftVM, "left snapshot", []xenapi.VDIRef{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	busyVM, err := xenapi.VM.Clone(session, linux[0], "GoSDK-TestVM in use")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = xenapi.VM.AddToOtherConfig(session, busyVM, xsutil.TrackedKey, time.Now().UTC().Format(time.RFC3339))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// An old tagged network whatever its name, and an unrelated one.
+	leftNetwork, err := xenapi.Network.Create(session, xenapi.NetworkRecord{
+		NameLabel:   "renamed network",
+		OtherConfig: map[string]string{xsutil.TrackedKey: "2020-01-01T00:00:00Z"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	keptNetwork, err := xenapi.Network.Create(session, xenapi.NetworkRecord{NameLabel: "Production network"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	cutoff := time.Now().Add(-time.Hour)
+	if err := run(session, &out, cutoff, false, false); err != nil {
+		t.Fatal(err)
+	}
+	t.Log(out.String())
+	for _, ref := range []string{string(leftVM), string(snapshot), string(leftNetwork)} {
+		if !strings.Contains(out.String(), ref) {
+			t.Log("Leftover not reported:", ref)
+			t.Fail()
+		}
+	}
+	for _, ref := range []string{string(busyVM), string(keptNetwork)} {
+		if strings.Contains(out.String(), ref) {
+			t.Log("Object reported wrongly:", ref)
+			t.Fail()
+		}
+	}
+	if _, err := xenapi.VM.GetRecord(session, leftVM); err != nil {
+		t.Fatal("A dry run removed a VM:", err)
+	}
+
+	// The untagged VM may be new, so only the tagged network goes.
+	out.Reset()
+	if err := run(session, &out, cutoff, false, true); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := xenapi.Network.GetRecord(session, leftNetwork); err == nil {
+		t.Log("The sweep left the tagged network")
+		t.Fail()
+	}
+	for _, ref := range []xenapi.VMRef{leftVM, snapshot} {
+		if _, err := xenapi.VM.GetRecord(session, ref); err != nil {
+			t.Log("The sweep removed a VM of unknown age without -by_name:", err)
+			t.Fail()
+		}
+	}
+
+	out.Reset()
+	if err := run(session, &out, cutoff, true, true); err != nil {
+		t.Fatal(err)
+	}
+	left, err := findLeftovers(session, cutoff, true)
+	if err != nil || len(left) != 0 {
+		t.Log("Leftovers remain after the sweep:", left, err)
+		t.Fail()
+	}
+	for _, ref := range []xenapi.VMRef{busyVM, linux[0]} {
+		if _, err := xenapi.VM.GetRecord(session, ref); err != nil {
+			t.Log("The sweep removed a VM it should have kept:", err)
+			t.Fail()
+		}
+	}
+	if _, err := xenapi.Network.GetRecord(session, keptNetwork); err != nil {
+		t.Log("The sweep removed a network it should have kept:", err)
+		t.Fail()
+	}
+}
@@ -0,0 +1,212 @@
+// Package config describes the servers the samples and commands talk to.
+// Servers are named targets, read from a YAML or TOML file and from XS_*
+// environment variables, so that passwords need not be passed on the
+// command line:
+//
+//	targets:
+//	  primary:
+//	    host: 192.0.2.1
+//	    username: root
+//	    password_file: /etc/xs/primary.secret
+//	    ca_cert_path: /etc/xs/ca.pem
+//	  supporter:
+//	    host: 192.0.2.2
+//	    username: root
+//	    password_env: SUPPORTER_PASSWORD
+//	  nfs:
+//	    host: 192.0.2.10
+//	    path: /exports/test
+//
+// Every field can also be set as XS_<TARGET>_<FIELD>, e.g. XS_PRIMARY_HOST
+// or XS_NFS_PATH, which overrides the file. XS_<TARGET>_PASSWORD overrides
+// password_env and password_file as well.
+package config
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+
+	"xenapi"
+
+	"github.com/xenserver/xenserver-samples/go/xsutil"
+)
+
+// EnvConfig names the environment variable holding the path of the file
+// Load reads when it is given none.
+const EnvConfig = "XS_CONFIG"
+
+const envPrefix = "XS_"
+
+// Target is one named server. Host is an address of the form ip[:port].
+// The password is taken from XS_<TARGET>_PASSWORD if it is set, else from
+// the environment variable named by PasswordEnv, else from PasswordFile,
+// else from Password. Path is only used by file servers, such as the
+// export path of an NFS server.
+type Target struct {
+	Host         string `yaml:"host" toml:"host"`
+	Username     string `yaml:"username" toml:"username"`
+	Password     string `yaml:"password" toml:"password"`
+	PasswordFile string `yaml:"password_file" toml:"password_file"`
+	PasswordEnv  string `yaml:"password_env" toml:"password_env"`
+	CACertPath   string `yaml:"ca_cert_path" toml:"ca_cert_path"`
+	Path         string `yaml:"path" toml:"path"`
+
+	// passwordFromEnv is set when XS_<TARGET>_PASSWORD gave the password.
+	passwordFromEnv bool
+}
+
+// Config is the set of targets, keyed by lower-case name.
+type Config struct {
+	Targets map[string]*Target `yaml:"targets" toml:"targets"`
+}
+
+// envFields maps the field part of an XS_* variable to the field it sets.
+// Longer names are matched first, so XS_X_PASSWORD_FILE is not read as a
+// password for a target called "x_password".
+var envFields = map[string]func(t *Target) *string{
+	"HOST":          func(t *Target) *string { return &t.Host },
+	"USERNAME":      func(t *Target) *string { return &t.Username },
+	"PASSWORD":      func(t *Target) *string { return &t.Password },
+	"PASSWORD_FILE": func(t *Target) *string { return &t.PasswordFile },
+	"PASSWORD_ENV":  func(t *Target) *string { return &t.PasswordEnv },
+	"CA_CERT_PATH":  func(t *Target) *string { return &t.CACertPath },
+	"PATH":          func(t *Target) *string { return &t.Path },
+}
+
+// Parse reads a config in the given format, "yaml" or "toml". JSON is
+// read as YAML.
+func Parse(data []byte, format string) (*Config, error) {
+	config := &Config{}
+	var err error
+	switch format {
+	case "yaml", "yml", "json":
+		err = yaml.Unmarshal(data, config)
+	case "toml":
+		err = toml.Unmarshal(data, config)
+	default:
+		return nil, fmt.Errorf("unknown config format %q", format)
+	}
+	if err != nil {
+		return nil, err
+	}
+	targets := make(map[string]*Target, len(config.Targets))
+	for name, target := range config.Targets {
+		if target == nil {
+			target = &Target{}
+		}
+		targets[strings.ToLower(name)] = target
+	}
+	config.Targets = targets
+	return config, nil
+}
+
+// Load reads the config file at path, or at $XS_CONFIG if path is empty,
+// applies the XS_* environment variables and resolves passwords. With
+// neither a path nor $XS_CONFIG the targets come from the environment
+// alone.
+func Load(path string) (*Config, error) {
+	if path == "" {
+		path = os.Getenv(EnvConfig)
+	}
+	config := &Config{Targets: make(map[string]*Target)}
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		config, err = Parse(data, strings.TrimPrefix(filepath.Ext(path), "."))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+	}
+	config.applyEnv(os.Environ())
+	if err := config.resolve(); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+func (c *Config) applyEnv(environ []string) {
+	fields := make([]string, 0, len(envFields))
+	for field := range envFields {
+		fields = append(fields, field)
+	}
+	sort.Slice(fields, func(i, j int) bool { return len(fields[i]) > len(fields[j]) })
+	for _, entry := range environ {
+		key, value, ok := strings.Cut(entry, "=")
+		if !ok || !strings.HasPrefix(key, envPrefix) || key == EnvConfig {
+			continue
+		}
+		key = strings.TrimPrefix(key, envPrefix)
+		for _, field := range fields {
+			name, ok := strings.CutSuffix(key, "_"+field)
+			if !ok || name == "" {
+				continue
+			}
+			name = strings.ToLower(name)
+			target := c.Targets[name]
+			if target == nil {
+				target = &Target{}
+				c.Targets[name] = target
+			}
+			*envFields[field](target) = value
+			target.passwordFromEnv = target.passwordFromEnv || field == "PASSWORD"
+			break
+		}
+	}
+}
+
+// resolve replaces every target's password with the one from its
+// password source, unless the environment gave it.
+func (c *Config) resolve() error {
+	for name, target := range c.Targets {
+		switch {
+		case target.passwordFromEnv:
+		case target.PasswordEnv != "":
+			password, ok := os.LookupEnv(target.PasswordEnv)
+			if !ok {
+				return fmt.Errorf("target %q: %s is not set", name, target.PasswordEnv)
+			}
+			target.Password = password
+		case target.PasswordFile != "":
+			data, err := os.ReadFile(target.PasswordFile)
+			if err != nil {
+				return fmt.Errorf("target %q: %w", name, err)
+			}
+			target.Password = strings.TrimRight(string(data), "\r\n")
+		}
+	}
+	return nil
+}
+
+// Target returns the target with the given name, or nil if there is none.
+func (c *Config) Target(name string) *Target {
+	return c.Targets[strings.ToLower(name)]
+}
+
+// ClientOpts returns the options for reaching the target over the given
+// scheme, "http" or "https", trusting its CA certificate if one is set.
+func (t *Target) ClientOpts(scheme string) *xenapi.ClientOpts {
+	opts := &xenapi.ClientOpts{URL: scheme + "://" + t.Host}
+	if t.CACertPath != "" {
+		opts.SecureOpts = &xenapi.SecureOpts{ServerCert: t.CACertPath}
+	}
+	return opts
+}
+
+// Credentials returns the target's user name and password for logging in
+// as originator.
+func (t *Target) Credentials(originator string) xsutil.Credentials {
+	return xsutil.Credentials{
+		Username:   t.Username,
+		Password:   t.Password,
+		Version:    "1.0",
+		Originator: originator,
+	}
+}
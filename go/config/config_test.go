@@ -0,0 +1,151 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const yamlConfig = `
+targets:
+  Primary:
+    host: 192.0.2.1
+    username: root
+    password: xenroot
+    ca_cert_path: /etc/xs/ca.pem
+  nfs:
+    host: 192.0.2.10
+    path: /exports/test
+`
+
+const tomlConfig = `
+[targets.primary]
+host = "192.0.2.1"
+username = "root"
+password = "xenroot"
+ca_cert_path = "/etc/xs/ca.pem"
+
+[targets.nfs]
+host = "192.0.2.10"
+path = "/exports/test"
+`
+
+func TestParse(t *testing.T) {
+	for format, data := range map[string]string{"yaml": yamlConfig, "toml": tomlConfig} {
+		config, err := Parse([]byte(data), format)
+		if err != nil {
+			t.Fatal(format, err)
+		}
+		primary := config.Target("primary")
+		if primary == nil || *primary != (Target{Host: "192.0.2.1", Username: "root", Password: "xenroot", CACertPath: "/etc/xs/ca.pem"}) {
+			t.Log(format, "unexpected primary target:", primary)
+			t.Fail()
+		}
+		if nfs := config.Target("NFS"); nfs == nil || nfs.Host != "192.0.2.10" || nfs.Path != "/exports/test" {
+			t.Log(format, "unexpected nfs target:", nfs)
+			t.Fail()
+		}
+		if config.Target("supporter") != nil {
+			t.Log(format, "found a target that is not configured")
+			t.Fail()
+		}
+	}
+	if _, err := Parse([]byte(yamlConfig), "ini"); err == nil {
+		t.Log("Expected an unknown format to fail")
+		t.Fail()
+	}
+}
+
+func TestApplyEnv(t *testing.T) {
+	config, err := Parse([]byte(yamlConfig), "yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.applyEnv([]string{
+		"XS_PRIMARY_HOST=198.51.100.1:8443",
+		"XS_PRIMARY_CA_CERT_PATH=/tmp/ca.pem",
+		"XS_SUPPORTER_HOST=198.51.100.2",
+		"XS_SUPPORTER_PASSWORD_FILE=/run/secrets/supporter",
+		"XS_CONFIG=/etc/xs/config.yaml",
+		"XS_UNRELATED=1",
+		"HOME=/root",
+	})
+	primary := config.Target("primary")
+	if primary.Host != "198.51.100.1:8443" || primary.CACertPath != "/tmp/ca.pem" || primary.Path != "" || primary.Username != "root" {
+		t.Log("Unexpected primary target:", primary)
+		t.Fail()
+	}
+	supporter := config.Target("supporter")
+	if supporter == nil || supporter.Host != "198.51.100.2" || supporter.PasswordFile != "/run/secrets/supporter" || supporter.Password != "" {
+		t.Log("Unexpected supporter target:", supporter)
+		t.Fail()
+	}
+	if len(config.Targets) != 3 {
+		t.Log("Unexpected targets:", config.Targets)
+		t.Fail()
+	}
+}
+
+func TestLoadSecrets(t *testing.T) {
+	dir := t.TempDir()
+	secret := filepath.Join(dir, "primary.secret")
+	if err := os.WriteFile(secret, []byte("from-file\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "config.toml")
+	data := `
+[targets.primary]
+host = "192.0.2.1"
+password_file = "` + secret + `"
+
+[targets.supporter]
+host = "192.0.2.2"
+password = "ignored"
+password_env = "SUPPORTER_SECRET"
+`
+	if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv(EnvConfig, path)
+	t.Setenv("SUPPORTER_SECRET", "from-env")
+	t.Setenv("XS_SUPPORTER_USERNAME", "admin")
+
+	config, err := Load("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if password := config.Target("primary").Password; password != "from-file" {
+		t.Log("Unexpected primary password:", password)
+		t.Fail()
+	}
+	supporter := config.Target("supporter")
+	if supporter.Password != "from-env" || supporter.Username != "admin" {
+		t.Log("Unexpected supporter target:", supporter)
+		t.Fail()
+	}
+	if opts := supporter.ClientOpts("https"); opts.URL != "https://192.0.2.2" || opts.SecureOpts != nil {
+		t.Log("Unexpected client options:", opts)
+		t.Fail()
+	}
+
+	// The environment overrides the file's password sources too.
+	t.Setenv("XS_PRIMARY_PASSWORD", "from-override")
+	t.Setenv("XS_SUPPORTER_PASSWORD", "from-override")
+	config, err = Load("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"primary", "supporter"} {
+		if password := config.Target(name).Password; password != "from-override" {
+			t.Log("Unexpected", name, "password:", password)
+			t.Fail()
+		}
+	}
+	os.Unsetenv("XS_SUPPORTER_PASSWORD")
+
+	t.Setenv("XS_SUPPORTER_PASSWORD_ENV", "UNSET_SECRET")
+	if _, err := Load(""); err == nil {
+		t.Log("Expected a missing password variable to fail")
+		t.Fail()
+	}
+}
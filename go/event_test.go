@@ -1,11 +1,14 @@
 package testGoSDK
 
 import (
+	"context"
 	"fmt"
 	"testing"
 	"time"
 
 	"xenapi"
+
+	"github.com/xenserver/xenserver-samples/go/xsutil"
 )
 
 var eventTypes []string
@@ -14,6 +17,7 @@ var timeout = 10.0
 var token = ""
 
 func TestEventFrom(t *testing.T) {
+	Connected(t)
 	eventTypes = append(eventTypes, "*")
 	for i := 0; i < maxTries; i++ {
 		eventBatch, err := xenapi.Event.From(session, eventTypes, token, timeout)
@@ -32,3 +36,52 @@ func TestEventFrom(t *testing.T) {
 		time.Sleep(time.Duration(5) * time.Second)
 	}
 }
+
+func TestEventSubscribe(t *testing.T) {
+	Connected(t)
+	vmRef, err := FindHaltedLinuxVM()
+	if err != nil {
+		t.Log(err)
+		t.Fail()
+		return
+	}
+	oldDescription, err := xenapi.VM.GetNameDescription(session, vmRef)
+	if err != nil {
+		t.Log(err)
+		t.Fail()
+		return
+	}
+	defer xenapi.VM.SetNameDescription(session, vmRef, oldDescription)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	newDescription := fmt.Sprintf("Changed by TestEventSubscribe at %s", time.Now())
+	changed := false
+	sub := xsutil.Subscribe[xenapi.VMRecord](ctx, session, "vm")
+	for event := range sub.Events {
+		if xenapi.VMRef(event.Ref) != vmRef {
+			continue
+		}
+		if event.Err != nil {
+			t.Log(event.Err)
+			continue
+		}
+		t.Log(fmt.Sprintf("%s %s: %q", event.Operation, event.Record.NameLabel, event.Record.NameDescription))
+		if !changed {
+			err = xenapi.VM.SetNameDescription(session, vmRef, newDescription)
+			if err != nil {
+				t.Log(err)
+				t.Fail()
+				return
+			}
+			changed = true
+		} else if event.Record.NameDescription == newDescription {
+			return
+		}
+	}
+	if sub.Err() != nil {
+		t.Log(sub.Err())
+	}
+	t.Log("The description change was not seen")
+	t.Fail()
+}
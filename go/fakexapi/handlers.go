@@ -0,0 +1,1339 @@
+package fakexapi
+
+import (
+	"encoding/xml"
+	"fmt"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+var builtins = map[string]HandlerFunc{}
+
+func register(method string, fn HandlerFunc) {
+	builtins[methodKey(method)] = fn
+}
+
+func init() {
+	register("session.logout", sessionLogout)
+	register("session.get_this_host", sessionGetThisHost)
+
+	register("task.create", taskCreate)
+	register("task.cancel", taskCancel)
+
+	register("VM.clone", vmClone)
+	register("VM.copy", vmCopy)
+	register("VM.provision", vmProvision)
+	register("VM.start", vmStart)
+	register("VM.start_on", vmStartOn)
+	register("VM.pause", vmTransition("pause", []string{"Running"}, "Paused"))
+	register("VM.unpause", vmTransition("unpause", []string{"Paused"}, "Running"))
+	register("VM.clean_shutdown", vmTransition("clean_shutdown", []string{"Running"}, "Halted"))
+	register("VM.hard_shutdown", vmTransition("hard_shutdown", []string{"Running", "Paused", "Suspended"}, "Halted"))
+	register("VM.clean_reboot", vmTransition("clean_reboot", []string{"Running"}, "Running"))
+	register("VM.hard_reboot", vmTransition("hard_reboot", []string{"Running", "Paused"}, "Running"))
+	register("VM.suspend", vmTransition("suspend", []string{"Running"}, "Suspended"))
+	register("VM.resume", vmResume)
+	register("VM.resume_on", vmResumeOn)
+	register("VM.destroy", vmDestroy)
+	register("VM.snapshot", vmSnapshot)
+	register("VM.checkpoint", vmCheckpoint)
+	register("VM.revert", vmRevert)
+	register("VM.assert_can_boot_here", vmAssertCanBootHere)
+	register("VM.set_memory_limits", vmSetMemoryLimits)
+	register("VM.pool_migrate", vmPoolMigrate)
+	register("VM.assert_can_migrate", vmAssertCanMigrate)
+	register("VM.migrate_send", vmMigrateSend)
+
+	register("VBD.plug", setAttached("VBD", true))
+	register("VBD.unplug", setAttached("VBD", false))
+	register("VBD.unplug_force", setAttached("VBD", false))
+	register("VBD.eject", vbdEject)
+	register("VBD.insert", vbdInsert)
+	register("VIF.plug", setAttached("VIF", true))
+	register("VIF.unplug", setAttached("VIF", false))
+	register("VIF.unplug_force", setAttached("VIF", false))
+
+	register("VDI.resize", vdiResize)
+	register("VDI.copy", vdiCopy)
+
+	register("SR.create", srCreate)
+	register("SR.introduce", srIntroduce)
+	register("SR.forget", srForget)
+	register("SR.destroy", srDestroy)
+	register("SR.scan", noop)
+	register("PBD.plug", setAttached("PBD", true))
+	register("PBD.unplug", setAttached("PBD", false))
+	register("PBD.destroy", pbdDestroy)
+
+	register("network.destroy", networkDestroy)
+	register("VLAN.create", vlanCreate)
+	register("VLAN.destroy", vlanDestroy)
+	register("pool.create_VLAN_from_PIF", poolCreateVLANFromPIF)
+	register("pool.join", poolJoin)
+	register("pool.eject", poolEject)
+
+	register("host.disable", hostSetEnabled(false))
+	register("host.enable", hostSetEnabled(true))
+	register("host.get_vms_which_prevent_evacuation", hostGetVMsWhichPreventEvacuation)
+	register("host.evacuate", hostEvacuate)
+	register("host.reboot", hostReboot)
+	register("host.migrate_receive", hostMigrateReceive)
+}
+
+func noop(c *Call) (interface{}, error) {
+	return nil, nil
+}
+
+// generic implements the accessors every class has: get_all, get_record,
+// get_<field>, set_<field> and friends, plus create and destroy.
+func generic(class, op string) HandlerFunc {
+	switch {
+	case op == "get_all":
+		return func(c *Call) (interface{}, error) {
+			refs := c.Store.Refs(class)
+			if refs == nil {
+				refs = []string{}
+			}
+			return refs, nil
+		}
+	case op == "get_all_records":
+		return func(c *Call) (interface{}, error) {
+			records := map[string]interface{}{}
+			for _, ref := range c.Store.Refs(class) {
+				records[ref], _ = c.Store.Get(class, ref)
+			}
+			return records, nil
+		}
+	case op == "get_record":
+		return func(c *Call) (interface{}, error) {
+			return lookup(c.Store, class, c.String(0))
+		}
+	case op == "get_by_uuid":
+		return func(c *Call) (interface{}, error) {
+			ref, ok := c.Store.ByUUID(class, c.String(0))
+			if !ok {
+				return nil, Failure{"UUID_INVALID", class, c.String(0)}
+			}
+			return ref, nil
+		}
+	case op == "get_by_name_label":
+		return func(c *Call) (interface{}, error) {
+			refs := c.Store.Find(class, func(_ string, r Record) bool {
+				return r.String("name_label") == c.String(0)
+			})
+			if refs == nil {
+				refs = []string{}
+			}
+			return refs, nil
+		}
+	case op == "create":
+		return func(c *Call) (interface{}, error) {
+			return create(c.Store, class, c.Record(0)), nil
+		}
+	case op == "destroy":
+		return func(c *Call) (interface{}, error) {
+			if _, err := lookup(c.Store, class, c.String(0)); err != nil {
+				return nil, err
+			}
+			c.Store.Destroy(class, c.String(0))
+			return nil, nil
+		}
+	case strings.HasPrefix(op, "get_"):
+		return fieldHandler(class, strings.TrimPrefix(op, "get_"), func(c *Call, r Record, field string) (interface{}, error) {
+			return r[field], nil
+		})
+	case strings.HasPrefix(op, "set_"):
+		return fieldHandler(class, strings.TrimPrefix(op, "set_"), func(c *Call, r Record, field string) (interface{}, error) {
+			c.Store.Update(class, c.String(0), Record{field: c.arg(1)})
+			return nil, nil
+		})
+	case strings.HasPrefix(op, "add_to_"):
+		return fieldHandler(class, strings.TrimPrefix(op, "add_to_"), func(c *Call, r Record, field string) (interface{}, error) {
+			m := r.Map(field)
+			if _, ok := m[c.String(1)]; ok {
+				return nil, Failure{"MAP_DUPLICATE_KEY", class, field, c.String(0), c.String(1)}
+			}
+			m[c.String(1)] = c.String(2)
+			c.Store.Update(class, c.String(0), Record{field: m})
+			return nil, nil
+		})
+	case strings.HasPrefix(op, "remove_from_"):
+		return fieldHandler(class, strings.TrimPrefix(op, "remove_from_"), func(c *Call, r Record, field string) (interface{}, error) {
+			m := r.Map(field)
+			delete(m, c.String(1))
+			c.Store.Update(class, c.String(0), Record{field: m})
+			return nil, nil
+		})
+	case strings.HasPrefix(op, "add_"):
+		return fieldHandler(class, strings.TrimPrefix(op, "add_"), func(c *Call, r Record, field string) (interface{}, error) {
+			set := r.Refs(field)
+			if !slices.Contains(set, c.String(1)) {
+				set = append(set, c.String(1))
+			}
+			c.Store.Update(class, c.String(0), Record{field: set})
+			return nil, nil
+		})
+	case strings.HasPrefix(op, "remove_"):
+		return fieldHandler(class, strings.TrimPrefix(op, "remove_"), func(c *Call, r Record, field string) (interface{}, error) {
+			set := []string{}
+			for _, item := range r.Refs(field) {
+				if item != c.String(1) {
+					set = append(set, item)
+				}
+			}
+			c.Store.Update(class, c.String(0), Record{field: set})
+			return nil, nil
+		})
+	}
+	return nil
+}
+
+func fieldHandler(class, field string, fn func(c *Call, r Record, field string) (interface{}, error)) HandlerFunc {
+	return func(c *Call) (interface{}, error) {
+		r, err := lookup(c.Store, class, c.String(0))
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := r[field]; !ok {
+			return nil, Failure{"MESSAGE_METHOD_UNKNOWN", c.Method}
+		}
+		return fn(c, r, field)
+	}
+}
+
+func lookup(st *Store, class, ref string) (Record, error) {
+	r, ok := st.Get(class, ref)
+	if !ok {
+		return nil, Failure{"HANDLE_INVALID", class, ref}
+	}
+	return r, nil
+}
+
+// create fills in the fields XAPI would default before inserting a record
+// sent by a client.
+func create(st *Store, class string, fields Record) string {
+	record := copyRecord(fields)
+	if record == nil {
+		record = Record{}
+	}
+	for k, v := range defaults(st, classKey(class)) {
+		if current, ok := record[k]; !ok || current == nil || current == "" {
+			record[k] = v
+		}
+	}
+	return st.Create(class, record)
+}
+
+func defaults(st *Store, class string) Record {
+	switch class {
+	case "vm":
+		return vmRecord("")
+	case "vbd":
+		return Record{
+			"VDI": NullRef, "device": "", "bootable": false, "mode": "RW", "type": "Disk",
+			"unpluggable": true, "empty": false, "currently_attached": false,
+			"qos_algorithm_type": "", "qos_algorithm_params": map[string]string{},
+			"other_config": map[string]string{},
+		}
+	case "vif":
+		return Record{
+			"MAC": randomMAC(), "MTU": 1500, "currently_attached": false,
+			"locking_mode": "network_default", "qos_algorithm_type": "",
+			"qos_algorithm_params": map[string]string{}, "other_config": map[string]string{},
+		}
+	case "vdi":
+		return Record{
+			"VBDs": []string{}, "physical_utilisation": 0, "type": "user", "sharable": false,
+			"read_only": false, "is_a_snapshot": false, "snapshot_of": NullRef, "managed": true,
+			"location": uuid.NewString(), "sm_config": map[string]string{},
+			"other_config": map[string]string{}, "tags": []string{},
+		}
+	case "pbd":
+		return Record{
+			"device_config": map[string]string{}, "currently_attached": false,
+			"other_config": map[string]string{},
+		}
+	case "network":
+		return Record{
+			"VIFs": []string{}, "PIFs": []string{}, "MTU": 1500,
+			"bridge":  "xapi" + strconv.Itoa(len(st.Refs("network"))),
+			"managed": true, "other_config": map[string]string{}, "tags": []string{},
+		}
+	}
+	return Record{}
+}
+
+func randomMAC() string {
+	id := uuid.New()
+	return fmt.Sprintf("aa:%02x:%02x:%02x:%02x:%02x", id[0], id[1], id[2], id[3], id[4])
+}
+
+func sessionLogout(c *Call) (interface{}, error) {
+	p := c.Server.currentPool()
+	delete(p.sessions, c.Session)
+	return nil, nil
+}
+
+func sessionGetThisHost(c *Call) (interface{}, error) {
+	return c.Server.host, nil
+}
+
+func taskCreate(c *Call) (interface{}, error) {
+	task := newTask(c.String(0), c.Server.host)
+	task["name_description"] = c.String(1)
+	return c.Store.Create("task", task), nil
+}
+
+func taskCancel(c *Call) (interface{}, error) {
+	r, err := lookup(c.Store, "task", c.String(0))
+	if err != nil {
+		return nil, err
+	}
+	if r.String("status") == "pending" {
+		c.Store.Update("task", c.String(0), Record{"status": "cancelling"})
+	}
+	return nil, nil
+}
+
+func badPowerState(ref string, expected []string, actual string) error {
+	return Failure{"VM_BAD_POWER_STATE", ref, strings.ToLower(strings.Join(expected, "|")), strings.ToLower(actual)}
+}
+
+func vmLookup(c *Call) (Record, error) {
+	return lookup(c.Store, "VM", c.String(0))
+}
+
+// vmTransition moves a VM between power states, attaching or detaching its
+// devices on the way.
+func vmTransition(op string, from []string, to string) HandlerFunc {
+	return func(c *Call) (interface{}, error) {
+		vm, err := vmLookup(c)
+		if err != nil {
+			return nil, err
+		}
+		if !slices.Contains(from, vm.String("power_state")) {
+			return nil, badPowerState(c.String(0), from, vm.String("power_state"))
+		}
+		host := vm.String("resident_on")
+		if to != "Running" && to != "Paused" {
+			host = NullRef
+		}
+		setPowerState(c.Store, c.String(0), to, host)
+		return nil, nil
+	}
+}
+
+func setPowerState(st *Store, ref, state, host string) {
+	running := state == "Running" || state == "Paused"
+	update := Record{"power_state": state, "resident_on": host}
+	if running {
+		update["domid"] = 1 + len(st.Refs("vm"))
+	} else {
+		update["domid"] = -1
+	}
+	vm, _ := st.Get("VM", ref)
+	for _, vbd := range vm.Refs("VBDs") {
+		st.Update("VBD", vbd, Record{"currently_attached": running})
+	}
+	for _, vif := range vm.Refs("VIFs") {
+		st.Update("VIF", vif, Record{"currently_attached": running})
+	}
+	if running {
+		metrics, ok := st.Get("VM_guest_metrics", vm.String("guest_metrics"))
+		if !ok {
+			update["guest_metrics"] = st.Create("VM_guest_metrics", guestMetricsRecord())
+		} else {
+			metrics["live"] = true
+			st.Update("VM_guest_metrics", vm.String("guest_metrics"), metrics)
+		}
+		st.Update("VM_metrics", vm.String("metrics"), Record{"start_time": timestamp(time.Now())})
+	}
+	st.Update("VM", ref, update)
+}
+
+func startVM(c *Call, host string, paused bool) (interface{}, error) {
+	vm, err := vmLookup(c)
+	if err != nil {
+		return nil, err
+	}
+	if vm.Bool("is_a_template") {
+		return nil, Failure{"VM_IS_TEMPLATE", c.String(0)}
+	}
+	if vm.String("power_state") != "Halted" {
+		return nil, badPowerState(c.String(0), []string{"Halted"}, vm.String("power_state"))
+	}
+	state := "Running"
+	if paused {
+		state = "Paused"
+	}
+	setPowerState(c.Store, c.String(0), state, host)
+	return nil, nil
+}
+
+func vmStart(c *Call) (interface{}, error) {
+	return startVM(c, c.Server.currentPool().master.host, c.Bool(1))
+}
+
+func vmStartOn(c *Call) (interface{}, error) {
+	if _, err := lookup(c.Store, "host", c.String(1)); err != nil {
+		return nil, err
+	}
+	return startVM(c, c.String(1), c.Bool(2))
+}
+
+func resumeVM(c *Call, host string, paused bool) (interface{}, error) {
+	vm, err := vmLookup(c)
+	if err != nil {
+		return nil, err
+	}
+	if vm.String("power_state") != "Suspended" {
+		return nil, badPowerState(c.String(0), []string{"Suspended"}, vm.String("power_state"))
+	}
+	state := "Running"
+	if paused {
+		state = "Paused"
+	}
+	setPowerState(c.Store, c.String(0), state, host)
+	return nil, nil
+}
+
+func vmResume(c *Call) (interface{}, error) {
+	return resumeVM(c, c.Server.currentPool().master.host, c.Bool(1))
+}
+
+func vmResumeOn(c *Call) (interface{}, error) {
+	if _, err := lookup(c.Store, "host", c.String(1)); err != nil {
+		return nil, err
+	}
+	return resumeVM(c, c.String(1), c.Bool(2))
+}
+
+func vmAssertCanBootHere(c *Call) (interface{}, error) {
+	if _, err := vmLookup(c); err != nil {
+		return nil, err
+	}
+	host, err := lookup(c.Store, "host", c.String(1))
+	if err != nil {
+		return nil, err
+	}
+	if !host.Bool("enabled") {
+		return nil, Failure{"HOST_DISABLED", c.String(1)}
+	}
+	return nil, nil
+}
+
+func vmSetMemoryLimits(c *Call) (interface{}, error) {
+	if _, err := vmLookup(c); err != nil {
+		return nil, err
+	}
+	c.Store.Update("VM", c.String(0), Record{
+		"memory_static_min":  c.Int(1),
+		"memory_static_max":  c.Int(2),
+		"memory_dynamic_min": c.Int(3),
+		"memory_dynamic_max": c.Int(4),
+	})
+	return nil, nil
+}
+
+// cloneVM copies a VM record with its VIFs and VBDs. Disks are copied
+// into sr, or next to the original when sr is empty.
+func cloneVM(st *Store, ref, name, sr string, fields Record) string {
+	vm, _ := st.Get("VM", ref)
+	clone := copyRecord(vm)
+	reset := Record{
+		"uuid": "", "name_label": name, "is_default_template": false, "snapshots": []string{},
+		"snapshot_of": NullRef, "resident_on": NullRef, "power_state": "Halted", "domid": -1,
+		"VBDs": []string{}, "VIFs": []string{}, "VGPUs": []string{}, "VTPMs": []string{},
+		"guest_metrics": NullRef, "metrics": st.Create("VM_metrics", vmMetricsRecord()),
+		"is_a_snapshot": false, "children": []string{}, "parent": NullRef,
+	}
+	for k, v := range reset {
+		clone[k] = v
+	}
+	for k, v := range fields {
+		clone[k] = v
+	}
+	newRef := st.Create("VM", clone)
+	for _, vbdRef := range vm.Refs("VBDs") {
+		vbd, _ := st.Get("VBD", vbdRef)
+		vbd["uuid"], vbd["VM"], vbd["currently_attached"] = "", newRef, false
+		if vdi, ok := st.Get("VDI", vbd.String("VDI")); ok && vbd.String("type") != "CD" {
+			vdi["uuid"], vdi["VBDs"], vdi["location"] = "", []string{}, uuid.NewString()
+			if sr != "" {
+				vdi["SR"] = sr
+			}
+			vbd["VDI"] = st.Create("VDI", vdi)
+		}
+		st.Create("VBD", vbd)
+	}
+	for _, vifRef := range vm.Refs("VIFs") {
+		vif, _ := st.Get("VIF", vifRef)
+		vif["uuid"], vif["VM"], vif["MAC"], vif["currently_attached"] = "", newRef, randomMAC(), false
+		st.Create("VIF", vif)
+	}
+	return newRef
+}
+
+func vmClone(c *Call) (interface{}, error) {
+	vm, err := vmLookup(c)
+	if err != nil {
+		return nil, err
+	}
+	if !vm.Bool("is_a_template") && vm.String("power_state") != "Halted" {
+		return nil, badPowerState(c.String(0), []string{"Halted"}, vm.String("power_state"))
+	}
+	return cloneVM(c.Store, c.String(0), c.String(1), "", nil), nil
+}
+
+func vmCopy(c *Call) (interface{}, error) {
+	if _, err := vmLookup(c); err != nil {
+		return nil, err
+	}
+	sr := c.String(2)
+	if !isNull(sr) {
+		if _, err := lookup(c.Store, "SR", sr); err != nil {
+			return nil, err
+		}
+	} else {
+		sr = ""
+	}
+	return cloneVM(c.Store, c.String(0), c.String(1), sr, nil), nil
+}
+
+func snapshotVM(c *Call, state string) (interface{}, error) {
+	vm, err := vmLookup(c)
+	if err != nil {
+		return nil, err
+	}
+	if vm.Bool("is_a_template") {
+		return nil, Failure{"VM_IS_TEMPLATE", c.String(0)}
+	}
+	snapshot := cloneVM(c.Store, c.String(0), c.String(1), "", Record{
+		"is_a_snapshot": true,
+		"is_a_template": true,
+		"snapshot_of":   c.String(0),
+		"snapshot_time": timestamp(time.Now()),
+	})
+	c.Store.Update("VM", snapshot, Record{"power_state": state})
+	return snapshot, nil
+}
+
+func vmSnapshot(c *Call) (interface{}, error) {
+	return snapshotVM(c, "Halted")
+}
+
+func vmCheckpoint(c *Call) (interface{}, error) {
+	vm, err := vmLookup(c)
+	if err != nil {
+		return nil, err
+	}
+	state := "Halted"
+	if vm.String("power_state") != "Halted" {
+		state = "Suspended"
+	}
+	return snapshotVM(c, state)
+}
+
+func vmRevert(c *Call) (interface{}, error) {
+	snapshot, err := vmLookup(c)
+	if err != nil {
+		return nil, err
+	}
+	if !snapshot.Bool("is_a_snapshot") {
+		return nil, Failure{"VM_NOT_A_SNAPSHOT", c.String(0)}
+	}
+	target := snapshot.String("snapshot_of")
+	if !c.Store.Exists("VM", target) {
+		return nil, Failure{"VM_REVERT_FAILED", c.String(0), target}
+	}
+	setPowerState(c.Store, target, snapshot.String("power_state"), NullRef)
+	return nil, nil
+}
+
+func vmDestroy(c *Call) (interface{}, error) {
+	vm, err := vmLookup(c)
+	if err != nil {
+		return nil, err
+	}
+	if vm.Bool("is_control_domain") {
+		return nil, Failure{"OPERATION_NOT_ALLOWED", "Cannot destroy the control domain"}
+	}
+	if state := vm.String("power_state"); state != "Halted" && !vm.Bool("is_a_snapshot") {
+		return nil, badPowerState(c.String(0), []string{"Halted"}, state)
+	}
+	for _, vbd := range vm.Refs("VBDs") {
+		c.Store.Destroy("VBD", vbd)
+	}
+	for _, vif := range vm.Refs("VIFs") {
+		c.Store.Destroy("VIF", vif)
+	}
+	c.Store.Destroy("VM_metrics", vm.String("metrics"))
+	c.Store.Destroy("VM_guest_metrics", vm.String("guest_metrics"))
+	for _, snapshot := range vm.Refs("snapshots") {
+		c.Store.Update("VM", snapshot, Record{"snapshot_of": NullRef})
+	}
+	c.Store.Destroy("VM", c.String(0))
+	return nil, nil
+}
+
+type provisionDisk struct {
+	Device   string `xml:"device,attr"`
+	Size     string `xml:"size,attr"`
+	SR       string `xml:"sr,attr"`
+	Bootable string `xml:"bootable,attr"`
+	Type     string `xml:"type,attr"`
+}
+
+// vmProvision creates the disks listed in other_config:disks and turns the
+// VM into a regular VM, as XAPI does.
+func vmProvision(c *Call) (interface{}, error) {
+	vm, err := vmLookup(c)
+	if err != nil {
+		return nil, err
+	}
+	otherConfig := vm.Map("other_config")
+	var doc struct {
+		Disks []provisionDisk `xml:"disk"`
+	}
+	if disks, ok := otherConfig["disks"]; ok {
+		if err := xml.Unmarshal([]byte(disks), &doc); err != nil {
+			return nil, Failure{"PROVISION_FAILED_OUT_OF_SPACE"}
+		}
+	}
+	for _, disk := range doc.Disks {
+		sr, ok := c.Store.ByUUID("SR", disk.SR)
+		if disk.SR == "" {
+			pools := c.Store.Refs("pool")
+			if len(pools) > 0 {
+				p, _ := c.Store.Get("pool", pools[0])
+				sr = p.String("default_SR")
+				ok = c.Store.Exists("SR", sr)
+			}
+		}
+		if !ok {
+			return nil, Failure{"UUID_INVALID", "SR", disk.SR}
+		}
+		size, _ := strconv.Atoi(disk.Size)
+		vdi := create(c.Store, "VDI", Record{
+			"name_label":   vm.String("name_label") + " " + disk.Device,
+			"SR":           sr,
+			"virtual_size": size,
+			"type":         disk.Type,
+		})
+		create(c.Store, "VBD", Record{
+			"VM":         c.String(0),
+			"VDI":        vdi,
+			"userdevice": disk.Device,
+			"bootable":   disk.Bootable == "true",
+			"mode":       "RW",
+			"type":       "Disk",
+		})
+	}
+	delete(otherConfig, "disks")
+	c.Store.Update("VM", c.String(0), Record{"is_a_template": false, "other_config": otherConfig})
+	return nil, nil
+}
+
+func setAttached(class string, attached bool) HandlerFunc {
+	return func(c *Call) (interface{}, error) {
+		if _, err := lookup(c.Store, class, c.String(0)); err != nil {
+			return nil, err
+		}
+		c.Store.Update(class, c.String(0), Record{"currently_attached": attached})
+		return nil, nil
+	}
+}
+
+func vbdEject(c *Call) (interface{}, error) {
+	vbd, err := lookup(c.Store, "VBD", c.String(0))
+	if err != nil {
+		return nil, err
+	}
+	if vbd.Bool("empty") {
+		return nil, Failure{"VBD_IS_EMPTY", c.String(0)}
+	}
+	c.Store.Update("VBD", c.String(0), Record{"empty": true, "VDI": NullRef})
+	return nil, nil
+}
+
+func vbdInsert(c *Call) (interface{}, error) {
+	vbd, err := lookup(c.Store, "VBD", c.String(0))
+	if err != nil {
+		return nil, err
+	}
+	if _, err := lookup(c.Store, "VDI", c.String(1)); err != nil {
+		return nil, err
+	}
+	if !vbd.Bool("empty") {
+		return nil, Failure{"VBD_NOT_EMPTY", c.String(0)}
+	}
+	c.Store.Update("VBD", c.String(0), Record{"empty": false, "VDI": c.String(1)})
+	return nil, nil
+}
+
+func vdiResize(c *Call) (interface{}, error) {
+	if _, err := lookup(c.Store, "VDI", c.String(0)); err != nil {
+		return nil, err
+	}
+	c.Store.Update("VDI", c.String(0), Record{"virtual_size": c.Int(1)})
+	return nil, nil
+}
+
+func vdiCopy(c *Call) (interface{}, error) {
+	vdi, err := lookup(c.Store, "VDI", c.String(0))
+	if err != nil {
+		return nil, err
+	}
+	if _, err := lookup(c.Store, "SR", c.String(1)); err != nil {
+		return nil, err
+	}
+	vdi["uuid"], vdi["VBDs"], vdi["SR"], vdi["location"] = "", []string{}, c.String(1), uuid.NewString()
+	return c.Store.Create("VDI", vdi), nil
+}
+
+func srCreate(c *Call) (interface{}, error) {
+	host, deviceConfig, srType, shared := c.String(0), c.Map(1), c.String(5), c.Bool(7)
+	if _, err := lookup(c.Store, "host", host); err != nil {
+		return nil, err
+	}
+	if len(c.Store.Find("SM", func(_ string, r Record) bool { return r.String("type") == srType })) == 0 {
+		return nil, Failure{"SR_UNKNOWN_DRIVER", srType}
+	}
+	if srType == "nfs" {
+		if deviceConfig["server"] == "" {
+			return nil, Failure{"SR_BACKEND_FAILURE_37", "", "The request is missing the server parameter", ""}
+		}
+		if deviceConfig["serverpath"] == "" {
+			return nil, Failure{"SR_BACKEND_FAILURE_38", "", "The request is missing the serverpath parameter", ""}
+		}
+	}
+	sr := c.Store.Create("SR", srRecord(c.String(3), c.String(4), srType, c.String(6), shared, c.Int(2)))
+	c.Store.Update("SR", sr, Record{"sm_config": c.Map(8)})
+	hosts := []string{host}
+	if shared {
+		hosts = c.Store.Refs("host")
+	}
+	for _, h := range hosts {
+		c.Store.Create("PBD", pbdRecord(h, sr, deviceConfig, true))
+	}
+	return sr, nil
+}
+
+func srIntroduce(c *Call) (interface{}, error) {
+	record := srRecord(c.String(1), c.String(2), c.String(3), c.String(4), c.Bool(5), 0)
+	record["uuid"] = c.String(0)
+	record["sm_config"] = c.Map(6)
+	return c.Store.Create("SR", record), nil
+}
+
+func detachSR(c *Call) (Record, error) {
+	sr, err := lookup(c.Store, "SR", c.String(0))
+	if err != nil {
+		return nil, err
+	}
+	for _, pbd := range sr.Refs("PBDs") {
+		if r, _ := c.Store.Get("PBD", pbd); r.Bool("currently_attached") {
+			return nil, Failure{"SR_HAS_PBD", c.String(0)}
+		}
+	}
+	for _, pbd := range sr.Refs("PBDs") {
+		c.Store.Destroy("PBD", pbd)
+	}
+	return sr, nil
+}
+
+func srForget(c *Call) (interface{}, error) {
+	sr, err := detachSR(c)
+	if err != nil {
+		return nil, err
+	}
+	for _, vdi := range sr.Refs("VDIs") {
+		c.Store.Destroy("VDI", vdi)
+	}
+	c.Store.Destroy("SR", c.String(0))
+	return nil, nil
+}
+
+// srDestroy destroys an SR through its PBDs, so an SR without any, such
+// as one just introduced, can only be forgotten.
+func srDestroy(c *Call) (interface{}, error) {
+	sr, err := lookup(c.Store, "SR", c.String(0))
+	if err != nil {
+		return nil, err
+	}
+	if len(sr.Refs("PBDs")) == 0 {
+		return nil, Failure{"SR_HAS_NO_PBDS", c.String(0)}
+	}
+	for _, vdi := range sr.Refs("VDIs") {
+		if r, _ := c.Store.Get("VDI", vdi); len(r.Refs("VBDs")) > 0 {
+			return nil, Failure{"SR_NOT_EMPTY"}
+		}
+	}
+	return srForget(c)
+}
+
+func pbdDestroy(c *Call) (interface{}, error) {
+	pbd, err := lookup(c.Store, "PBD", c.String(0))
+	if err != nil {
+		return nil, err
+	}
+	if pbd.Bool("currently_attached") {
+		return nil, Failure{"OPERATION_NOT_ALLOWED", "PBD is currently attached"}
+	}
+	c.Store.Destroy("PBD", c.String(0))
+	return nil, nil
+}
+
+func networkDestroy(c *Call) (interface{}, error) {
+	network, err := lookup(c.Store, "network", c.String(0))
+	if err != nil {
+		return nil, err
+	}
+	if pifs := network.Refs("PIFs"); len(pifs) > 0 {
+		return nil, Failure{"NETWORK_CONTAINS_PIF", strings.Join(pifs, ",")}
+	}
+	for _, vif := range network.Refs("VIFs") {
+		if r, _ := c.Store.Get("VIF", vif); r.Bool("currently_attached") {
+			return nil, Failure{"NETWORK_CONTAINS_VIF", vif}
+		}
+	}
+	c.Store.Destroy("network", c.String(0))
+	return nil, nil
+}
+
+func createVLAN(st *Store, tagged string, tag int, network string) (string, string) {
+	pif, _ := st.Get("PIF", tagged)
+	vlan := newRef()
+	untagged := st.Create("PIF", Record{
+		"device": pif.String("device"), "network": network, "host": pif.String("host"),
+		"MAC": pif.String("MAC"), "MTU": pif.Int("MTU"), "VLAN": tag, "physical": false,
+		"currently_attached": false, "IP": "", "management": false, "bond_slave_of": NullRef,
+		"VLAN_master_of": vlan, "VLAN_slave_of": []string{}, "metrics": NullRef,
+		"other_config": map[string]string{},
+	})
+	st.Insert("VLAN", vlan, Record{
+		"tagged_PIF": tagged, "untagged_PIF": untagged, "tag": tag,
+		"other_config": map[string]string{},
+	})
+	st.Update("PIF", tagged, Record{"VLAN_slave_of": append(pif.Refs("VLAN_slave_of"), vlan)})
+	return vlan, untagged
+}
+
+func checkVLAN(c *Call, pif string, tag int, network string) error {
+	if _, err := lookup(c.Store, "PIF", pif); err != nil {
+		return err
+	}
+	if _, err := lookup(c.Store, "network", network); err != nil {
+		return err
+	}
+	if tag < 0 || tag > 4094 {
+		return Failure{"VLAN_TAG_INVALID", strconv.Itoa(tag)}
+	}
+	return nil
+}
+
+func vlanCreate(c *Call) (interface{}, error) {
+	if err := checkVLAN(c, c.String(0), c.Int(1), c.String(2)); err != nil {
+		return nil, err
+	}
+	vlan, _ := createVLAN(c.Store, c.String(0), c.Int(1), c.String(2))
+	return vlan, nil
+}
+
+func poolCreateVLANFromPIF(c *Call) (interface{}, error) {
+	if err := checkVLAN(c, c.String(0), c.Int(2), c.String(1)); err != nil {
+		return nil, err
+	}
+	pif, _ := c.Store.Get("PIF", c.String(0))
+	pifs := []string{}
+	for _, tagged := range c.Store.Find("PIF", func(_ string, r Record) bool {
+		return r.Bool("physical") && r.String("device") == pif.String("device")
+	}) {
+		_, untagged := createVLAN(c.Store, tagged, c.Int(2), c.String(1))
+		pifs = append(pifs, untagged)
+	}
+	return pifs, nil
+}
+
+func vlanDestroy(c *Call) (interface{}, error) {
+	vlan, err := lookup(c.Store, "VLAN", c.String(0))
+	if err != nil {
+		return nil, err
+	}
+	c.Store.Destroy("PIF", vlan.String("untagged_PIF"))
+	if tagged, ok := c.Store.Get("PIF", vlan.String("tagged_PIF")); ok {
+		slaves := []string{}
+		for _, ref := range tagged.Refs("VLAN_slave_of") {
+			if ref != c.String(0) {
+				slaves = append(slaves, ref)
+			}
+		}
+		c.Store.Update("PIF", vlan.String("tagged_PIF"), Record{"VLAN_slave_of": slaves})
+	}
+	c.Store.Destroy("VLAN", c.String(0))
+	return nil, nil
+}
+
+// hostObjects lists, by class, the objects that belong to a single host and
+// move with it when it joins or leaves a pool.
+func hostObjects(st *Store, host string) map[string][]string {
+	r, _ := st.Get("host", host)
+	objects := map[string][]string{
+		"host":         {host},
+		"host_metrics": {r.String("metrics")},
+		"PIF":          r.Refs("PIFs"),
+		"PBD":          r.Refs("PBDs"),
+		"host_cpu":     r.Refs("host_CPUs"),
+	}
+	for _, pbd := range r.Refs("PBDs") {
+		p, _ := st.Get("PBD", pbd)
+		if sr, ok := st.Get("SR", p.String("SR")); ok && !sr.Bool("shared") {
+			objects["SR"] = append(objects["SR"], p.String("SR"))
+			objects["VDI"] = append(objects["VDI"], sr.Refs("VDIs")...)
+		}
+	}
+	return objects
+}
+
+// poolJoin runs on the joining host. It copies the host and its local
+// objects into the master's pool and from then on the server answers
+// logins with HOST_IS_SLAVE.
+func poolJoin(c *Call) (interface{}, error) {
+	master := lookupServer(c.String(0))
+	if master == nil || master == c.Server {
+		return nil, Failure{"HOST_CANNOT_CONTACT_MASTER", c.String(0)}
+	}
+	if c.String(1) != master.Username || c.String(2) != master.Password {
+		return nil, Failure{"SESSION_AUTHENTICATION_FAILED", c.String(1), "Authentication failure"}
+	}
+	if len(c.Store.Refs("host")) > 1 {
+		return nil, Failure{"JOINING_HOST_CANNOT_BE_MASTER_OF_OTHER_HOSTS"}
+	}
+	for _, sr := range c.Store.Refs("SR") {
+		if r, _ := c.Store.Get("SR", sr); r.Bool("shared") && len(r.Refs("PBDs")) > 0 {
+			return nil, Failure{"JOINING_HOST_CANNOT_CONTAIN_SHARED_SRS"}
+		}
+	}
+	target := master.currentPool()
+	target.mu.Lock()
+	defer target.mu.Unlock()
+	objects := hostObjects(c.Store, c.Server.host)
+	networks := map[string]string{}
+	for _, pif := range objects["PIF"] {
+		r, _ := c.Store.Get("PIF", pif)
+		local, _ := c.Store.Get("network", r.String("network"))
+		for _, n := range target.store.Refs("network") {
+			if nr, _ := target.store.Get("network", n); nr.String("bridge") == local.String("bridge") {
+				networks[r.String("network")] = n
+			}
+		}
+	}
+	for _, class := range []string{"host_metrics", "host", "SR", "VDI", "PBD", "PIF", "host_cpu"} {
+		for _, ref := range objects[class] {
+			r, ok := c.Store.Get(class, ref)
+			if !ok {
+				continue
+			}
+			if class == "PIF" {
+				if n, ok := networks[r.String("network")]; ok {
+					r["network"] = n
+				}
+			}
+			for _, field := range []string{"PBDs", "PIFs", "VDIs", "host_CPUs", "resident_VMs"} {
+				if _, ok := r[field]; ok {
+					r[field] = []string{}
+				}
+			}
+			target.store.Insert(class, ref, r)
+		}
+	}
+	c.Server.mu.Lock()
+	c.Server.pool = target
+	c.Server.mu.Unlock()
+	return nil, nil
+}
+
+// poolEject removes a supporter from the pool and turns it back into a
+// freshly installed standalone host.
+func poolEject(c *Call) (interface{}, error) {
+	if _, err := lookup(c.Store, "host", c.String(0)); err != nil {
+		return nil, err
+	}
+	p := c.Server.currentPool()
+	if c.String(0) == p.master.host {
+		return nil, Failure{"POOL_CANNOT_EJECT_MASTER"}
+	}
+	objects := hostObjects(c.Store, c.String(0))
+	for _, class := range []string{"PBD", "PIF", "VDI", "SR", "host_cpu", "host", "host_metrics"} {
+		for _, ref := range objects[class] {
+			c.Store.Destroy(class, ref)
+		}
+	}
+	for _, vm := range c.Store.Find("VM", func(_ string, r Record) bool {
+		return r.String("resident_on") == c.String(0)
+	}) {
+		c.Store.Destroy("VM", vm)
+	}
+	registry.Lock()
+	var ejected *Server
+	for _, s := range registry.servers {
+		if s.host == c.String(0) && s.currentPool() == p {
+			ejected = s
+		}
+	}
+	registry.Unlock()
+	if ejected != nil {
+		ejected.reset()
+	}
+	return nil, nil
+}
+
+func hostSetEnabled(enabled bool) HandlerFunc {
+	return func(c *Call) (interface{}, error) {
+		if _, err := lookup(c.Store, "host", c.String(0)); err != nil {
+			return nil, err
+		}
+		c.Store.Update("host", c.String(0), Record{"enabled": enabled})
+		return nil, nil
+	}
+}
+
+// guestsOn returns the running or paused VMs on host, other than its
+// control domain.
+func guestsOn(st *Store, host string) []string {
+	return st.Find("VM", func(_ string, r Record) bool {
+		state := r.String("power_state")
+		return r.String("resident_on") == host && !r.Bool("is_control_domain") && (state == "Running" || state == "Paused")
+	})
+}
+
+// evacuationTargets returns the hosts other than host that are enabled
+// and live.
+func evacuationTargets(st *Store, host string) []string {
+	return st.Find("host", func(ref string, r Record) bool {
+		metrics, _ := st.Get("host_metrics", r.String("metrics"))
+		return ref != host && r.Bool("enabled") && metrics.Bool("live")
+	})
+}
+
+// preventEvacuation says why each VM on host that cannot be moved cannot:
+// there is no host to move it to, or it has a disk on an SR that is not
+// shared.
+func preventEvacuation(st *Store, host string) map[string][]string {
+	prevented := map[string][]string{}
+	targets := evacuationTargets(st, host)
+	for _, vm := range guestsOn(st, host) {
+		if len(targets) == 0 {
+			prevented[vm] = []string{"NO_HOSTS_AVAILABLE"}
+			continue
+		}
+		r, _ := st.Get("VM", vm)
+		for _, vbd := range r.Refs("VBDs") {
+			vbdRecord, _ := st.Get("VBD", vbd)
+			vdi, ok := st.Get("VDI", vbdRecord.String("VDI"))
+			if !ok {
+				continue
+			}
+			if sr, _ := st.Get("SR", vdi.String("SR")); !sr.Bool("shared") {
+				prevented[vm] = []string{"VM_REQUIRES_SR", vm, vdi.String("SR")}
+				break
+			}
+		}
+	}
+	return prevented
+}
+
+func hostGetVMsWhichPreventEvacuation(c *Call) (interface{}, error) {
+	if _, err := lookup(c.Store, "host", c.String(0)); err != nil {
+		return nil, err
+	}
+	return preventEvacuation(c.Store, c.String(0)), nil
+}
+
+// hostEvacuate migrates every VM off a host, spreading them over the
+// others, or fails without moving any if one of them cannot be moved.
+func hostEvacuate(c *Call) (interface{}, error) {
+	if _, err := lookup(c.Store, "host", c.String(0)); err != nil {
+		return nil, err
+	}
+	for _, reason := range preventEvacuation(c.Store, c.String(0)) {
+		return nil, Failure(reason)
+	}
+	targets := evacuationTargets(c.Store, c.String(0))
+	for i, vm := range guestsOn(c.Store, c.String(0)) {
+		c.Store.Update("VM", vm, Record{"resident_on": targets[i%len(targets)]})
+	}
+	return nil, nil
+}
+
+// hostReboot takes a disabled host with no VMs down. Its metrics still
+// say it is live until HeartbeatTimeout has passed, and it is back after
+// RebootDelay with a new other_config:boot_time.
+func hostReboot(c *Call) (interface{}, error) {
+	host, err := lookup(c.Store, "host", c.String(0))
+	if err != nil {
+		return nil, err
+	}
+	if host.Bool("enabled") {
+		return nil, Failure{"HOST_NOT_DISABLED"}
+	}
+	if vms := guestsOn(c.Store, c.String(0)); len(vms) > 0 {
+		return nil, Failure{"HOST_IN_USE", c.String(0), "VM", vms[0]}
+	}
+	ref, metrics := c.String(0), host.String("metrics")
+	p, s := c.Server.currentPool(), c.Server
+	heartbeat, reboot := s.HeartbeatTimeout, s.RebootDelay
+	go func() {
+		down := time.After(heartbeat)
+		up := time.After(reboot)
+		for down != nil || up != nil {
+			select {
+			case <-down:
+				down = nil
+				p.mu.Lock()
+				p.store.Update("host_metrics", metrics, Record{"live": false})
+				p.mu.Unlock()
+			case <-up:
+				up = nil
+				// A host that comes back before its heartbeat has timed
+				// out was never seen to go down.
+				down = nil
+				p.mu.Lock()
+				record, _ := p.store.Get("host", ref)
+				config := record.Map("other_config")
+				config["boot_time"] = bootTime()
+				p.store.Update("host", ref, Record{"other_config": config})
+				p.store.Update("host_metrics", metrics, Record{"live": true, "last_updated": timestamp(time.Now())})
+				p.mu.Unlock()
+			case <-s.done:
+				return
+			}
+		}
+	}()
+	return nil, nil
+}
+
+// vmPoolMigrate moves a running VM to another host of the pool. Its disks
+// must be on shared SRs.
+func vmPoolMigrate(c *Call) (interface{}, error) {
+	vm, err := vmLookup(c)
+	if err != nil {
+		return nil, err
+	}
+	if vm.String("power_state") != "Running" {
+		return nil, badPowerState(c.String(0), []string{"Running"}, vm.String("power_state"))
+	}
+	host, err := lookup(c.Store, "host", c.String(1))
+	if err != nil {
+		return nil, err
+	}
+	if !host.Bool("enabled") {
+		return nil, Failure{"HOST_DISABLED", c.String(1)}
+	}
+	for _, vdi := range vmDisks(c.Store, vm) {
+		r, _ := c.Store.Get("VDI", vdi)
+		if sr, _ := c.Store.Get("SR", r.String("SR")); !sr.Bool("shared") {
+			return nil, Failure{"VM_REQUIRES_SR", c.String(0), r.String("SR")}
+		}
+	}
+	c.Store.Update("VM", c.String(0), Record{"resident_on": c.String(1)})
+	return nil, nil
+}
+
+// vmDisks lists the VDIs of a VM's disks, leaving out CD drives.
+func vmDisks(st *Store, vm Record) []string {
+	var vdis []string
+	for _, vbd := range vm.Refs("VBDs") {
+		r, _ := st.Get("VBD", vbd)
+		if r.String("type") != "CD" && !isNull(r.String("VDI")) {
+			vdis = append(vdis, r.String("VDI"))
+		}
+	}
+	return vdis
+}
+
+// hostMigrateReceive hands out the destination map VM.migrate_send needs
+// to reach the host, naming the pool's master so that the sending side
+// can find the fake server behind it.
+func hostMigrateReceive(c *Call) (interface{}, error) {
+	if _, err := lookup(c.Store, "host", c.String(0)); err != nil {
+		return nil, err
+	}
+	if _, err := lookup(c.Store, "network", c.String(1)); err != nil {
+		return nil, err
+	}
+	master := "http://" + c.Server.currentPool().master.addr + "/"
+	return map[string]string{
+		"host":       c.String(0),
+		"master":     master,
+		"session_id": c.Session,
+		"SM":         master + "services/SM?session_id=" + c.Session,
+		"xenops":     master + "services/xenops?session_id=" + c.Session,
+	}, nil
+}
+
+// migration is a VM.migrate_send or VM.assert_can_migrate call resolved
+// against both pools.
+type migration struct {
+	vm     Record
+	host   string
+	target *Store
+	cross  bool
+	vdis   map[string]string
+	vifs   map[string]string
+}
+
+// checkMigration resolves the destination of a migration and refuses it
+// the way XAPI would. It returns with the destination pool locked if it is
+// another pool; unlock must then be called.
+func checkMigration(c *Call) (m *migration, unlock func(), err error) {
+	vm, err := vmLookup(c)
+	if err != nil {
+		return nil, nil, err
+	}
+	if vm.Bool("is_a_template") || vm.Bool("is_control_domain") {
+		return nil, nil, Failure{"VM_IS_TEMPLATE", c.String(0)}
+	}
+	dest, live := c.Map(1), c.Bool(2)
+	if live && vm.String("power_state") != "Running" {
+		return nil, nil, badPowerState(c.String(0), []string{"Running"}, vm.String("power_state"))
+	}
+	master, err := url.Parse(dest["master"])
+	if err != nil || lookupServer(master.Host) == nil {
+		return nil, nil, Failure{"CANNOT_CONTACT_HOST", dest["master"]}
+	}
+	m = &migration{vm: vm, host: dest["host"], target: c.Store, vdis: c.Map(3), vifs: c.Map(4)}
+	release := func() {}
+	if p := lookupServer(master.Host).currentPool(); p != c.Server.currentPool() {
+		p.mu.Lock()
+		m.target, m.cross, release = p.store, true, p.mu.Unlock
+	}
+	defer func() {
+		if err != nil {
+			release()
+		}
+	}()
+	host, err := lookup(m.target, "host", m.host)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !host.Bool("enabled") {
+		return nil, nil, Failure{"HOST_DISABLED", m.host}
+	}
+	for vdi, sr := range m.vdis {
+		if _, err := lookup(c.Store, "VDI", vdi); err != nil {
+			return nil, nil, err
+		}
+		if _, err := lookup(m.target, "SR", sr); err != nil {
+			return nil, nil, err
+		}
+	}
+	for vif, network := range m.vifs {
+		if _, err := lookup(c.Store, "VIF", vif); err != nil {
+			return nil, nil, err
+		}
+		if _, err := lookup(m.target, "network", network); err != nil {
+			return nil, nil, err
+		}
+	}
+	for _, vdi := range vmDisks(c.Store, vm) {
+		if _, ok := m.vdis[vdi]; ok {
+			continue
+		}
+		if m.cross {
+			return nil, nil, Failure{"VDI_NOT_IN_MAP", vdi}
+		}
+		r, _ := c.Store.Get("VDI", vdi)
+		if sr, _ := c.Store.Get("SR", r.String("SR")); !sr.Bool("shared") {
+			return nil, nil, Failure{"VM_REQUIRES_SR", c.String(0), r.String("SR")}
+		}
+	}
+	if m.cross {
+		for _, vif := range vm.Refs("VIFs") {
+			if _, ok := m.vifs[vif]; !ok {
+				return nil, nil, Failure{"VIF_NOT_IN_MAP", vif}
+			}
+		}
+	}
+	return m, release, nil
+}
+
+func vmAssertCanMigrate(c *Call) (interface{}, error) {
+	_, unlock, err := checkMigration(c)
+	if err != nil {
+		return nil, err
+	}
+	unlock()
+	return nil, nil
+}
+
+// vmMigrateSend copies the VM's mapped disks into their new SRs and moves
+// the VM to the destination host. Across pools the VM and all its devices
+// are recreated in the destination pool and removed from this one.
+func vmMigrateSend(c *Call) (interface{}, error) {
+	m, unlock, err := checkMigration(c)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	resident := NullRef
+	if state := m.vm.String("power_state"); state == "Running" || state == "Paused" {
+		resident = m.host
+	}
+	if !m.cross {
+		for _, vbdRef := range m.vm.Refs("VBDs") {
+			vbd, _ := c.Store.Get("VBD", vbdRef)
+			sr, ok := m.vdis[vbd.String("VDI")]
+			if !ok {
+				continue
+			}
+			vdi, _ := c.Store.Get("VDI", vbd.String("VDI"))
+			vdi["uuid"], vdi["VBDs"], vdi["SR"], vdi["location"] = "", []string{}, sr, uuid.NewString()
+			c.Store.Update("VBD", vbdRef, Record{"VDI": c.Store.Create("VDI", vdi)})
+			c.Store.Destroy("VDI", vbd.String("VDI"))
+		}
+		for vif, network := range m.vifs {
+			c.Store.Update("VIF", vif, Record{"network": network})
+		}
+		c.Store.Update("VM", c.String(0), Record{"resident_on": resident})
+		return c.String(0), nil
+	}
+
+	vm := copyRecord(m.vm)
+	metrics, _ := c.Store.Get("VM_metrics", vm.String("metrics"))
+	vm["metrics"] = m.target.Create("VM_metrics", metrics)
+	vm["guest_metrics"], vm["resident_on"] = NullRef, resident
+	vm["VBDs"], vm["VIFs"], vm["VGPUs"], vm["VTPMs"] = []string{}, []string{}, []string{}, []string{}
+	vm["snapshots"], vm["appliance"] = []string{}, NullRef
+	ref := m.target.Create("VM", vm)
+	for _, vbdRef := range m.vm.Refs("VBDs") {
+		vbd, _ := c.Store.Get("VBD", vbdRef)
+		vbd["uuid"], vbd["VM"] = "", ref
+		if sr, ok := m.vdis[vbd.String("VDI")]; ok {
+			source := vbd.String("VDI")
+			vdi, _ := c.Store.Get("VDI", source)
+			vdi["uuid"], vdi["VBDs"], vdi["SR"], vdi["location"] = "", []string{}, sr, uuid.NewString()
+			vbd["VDI"] = m.target.Create("VDI", vdi)
+			c.Store.Destroy("VDI", source)
+		} else {
+			// A CD whose ISO was not mapped arrives empty.
+			vbd["VDI"], vbd["empty"] = NullRef, true
+		}
+		m.target.Create("VBD", vbd)
+		c.Store.Destroy("VBD", vbdRef)
+	}
+	for _, vifRef := range m.vm.Refs("VIFs") {
+		vif, _ := c.Store.Get("VIF", vifRef)
+		vif["uuid"], vif["VM"], vif["network"] = "", ref, m.vifs[vifRef]
+		m.target.Create("VIF", vif)
+		c.Store.Destroy("VIF", vifRef)
+	}
+	c.Store.Destroy("VM_metrics", m.vm.String("metrics"))
+	c.Store.Destroy("VM", c.String(0))
+	return ref, nil
+}
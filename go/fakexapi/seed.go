@@ -0,0 +1,230 @@
+package fakexapi
+
+import (
+	"fmt"
+	"strings"
+	"sync/atomic"
+)
+
+const (
+	gib = 1 << 30
+	mib = 1 << 20
+)
+
+var hostCount int32
+
+// WindowsTemplate and LinuxVM name objects every fresh server contains.
+const (
+	WindowsTemplate = "Windows 10 (64-bit)"
+	LinuxTemplate   = "Debian Bookworm 12"
+	LinuxVM         = "Debian Linux VM"
+)
+
+func provisionXML(size int) string {
+	return fmt.Sprintf(`<provision><disk device="0" size="%d" sr="" bootable="true" type="system"/></provision>`, size)
+}
+
+func vmRecord(name string) Record {
+	return Record{
+		"name_label":          name,
+		"name_description":    "",
+		"power_state":         "Halted",
+		"allowed_operations":  []string{},
+		"is_a_template":       false,
+		"is_default_template": false,
+		"is_control_domain":   false,
+		"is_a_snapshot":       false,
+		"snapshot_of":         NullRef,
+		"snapshots":           []string{},
+		"snapshot_time":       "19700101T00:00:00Z",
+		"resident_on":         NullRef,
+		"affinity":            NullRef,
+		"memory_static_max":   2 * gib,
+		"memory_dynamic_max":  2 * gib,
+		"memory_dynamic_min":  2 * gib,
+		"memory_static_min":   512 * mib,
+		"VCPUs_max":           2,
+		"VCPUs_at_startup":    2,
+		"VBDs":                []string{},
+		"VIFs":                []string{},
+		"VGPUs":               []string{},
+		"VTPMs":               []string{},
+		"domid":               -1,
+		"HVM_boot_policy":     "BIOS order",
+		"PV_bootloader":       "",
+		"appliance":           NullRef,
+		"guest_metrics":       NullRef,
+		"metrics":             NullRef,
+		"parent":              NullRef,
+		"children":            []string{},
+		"suspend_VDI":         NullRef,
+		"suspend_SR":          NullRef,
+		"blocked_operations":  map[string]string{},
+		"other_config":        map[string]string{},
+		"tags":                []string{},
+	}
+}
+
+func guestMetricsRecord() Record {
+	return Record{
+		"os_version":            map[string]string{"name": "Debian GNU/Linux 12", "distro": "debian"},
+		"PV_drivers_up_to_date": true,
+		"networks":              map[string]string{"0/ip": "192.0.2.100"},
+		"other":                 map[string]string{"feature-suspend": "1", "feature-shutdown": "1"},
+		"live":                  true,
+		"last_updated":          "20240101T00:00:00Z",
+		"other_config":          map[string]string{},
+	}
+}
+
+func vmMetricsRecord() Record {
+	return Record{
+		"memory_actual":     2 * gib,
+		"VCPUs_number":      2,
+		"VCPUs_utilisation": map[string]float64{"0": 0},
+		"start_time":        "19700101T00:00:00Z",
+		"last_updated":      "19700101T00:00:00Z",
+		"other_config":      map[string]string{},
+	}
+}
+
+func srRecord(name, description, srType, contentType string, shared bool, size int) Record {
+	return Record{
+		"name_label":           name,
+		"name_description":     description,
+		"allowed_operations":   []string{"scan", "destroy", "forget", "plug", "unplug", "vdi_create", "vdi_destroy"},
+		"VDIs":                 []string{},
+		"PBDs":                 []string{},
+		"virtual_allocation":   0,
+		"physical_utilisation": 0,
+		"physical_size":        size,
+		"type":                 srType,
+		"content_type":         contentType,
+		"shared":               shared,
+		"sm_config":            map[string]string{},
+		"other_config":         map[string]string{},
+		"tags":                 []string{},
+	}
+}
+
+func pbdRecord(host, sr string, deviceConfig map[string]string, attached bool) Record {
+	return Record{
+		"host":               host,
+		"SR":                 sr,
+		"device_config":      deviceConfig,
+		"currently_attached": attached,
+		"other_config":       map[string]string{},
+	}
+}
+
+func smRecord(smType string, vdiCreate bool) Record {
+	features := map[string]int{"SR_PROBE": 1, "SR_UPDATE": 1, "VDI_ATTACH": 1, "VDI_DETACH": 1}
+	if vdiCreate {
+		features["VDI_CREATE"] = 1
+		features["VDI_DELETE"] = 1
+		features["VDI_SNAPSHOT"] = 1
+		features["VDI_CLONE"] = 1
+	}
+	return Record{
+		"name_label":       strings.ToUpper(smType),
+		"name_description": smType + " storage driver",
+		"type":             smType,
+		"vendor":           "fakexapi",
+		"capabilities":     []string{},
+		"features":         features,
+		"configuration":    map[string]string{},
+		"other_config":     map[string]string{},
+	}
+}
+
+// seed populates an empty store with a standalone host and returns the
+// host reference.
+func seed(st *Store, addr string) string {
+	n := atomic.AddInt32(&hostCount, 1)
+	name := fmt.Sprintf("fakehost-%d", n)
+
+	metrics := st.Create("host_metrics", Record{
+		"memory_total": 64 * gib, "memory_free": 48 * gib, "live": true,
+		"last_updated": "20240101T00:00:00Z", "other_config": map[string]string{},
+	})
+	host := st.Create("host", Record{
+		"name_label":        name,
+		"name_description":  "Fake XenServer host",
+		"address":           addr,
+		"hostname":          name,
+		"enabled":           true,
+		"API_version_major": 2,
+		"API_version_minor": 21,
+		"software_version": map[string]string{
+			"product_version": "8.4.0", "platform_version": "3.4.0", "xapi": "24.19", "xapi_build": "24.19.1",
+		},
+		"cpu_info":        map[string]string{"cpu_count": "8", "vendor": "GenuineIntel", "features": "1fcbfbff-f7fa3223-2d93fbff-00000023"},
+		"edition":         "xenserver-premium",
+		"license_params":  map[string]string{"sku_type": "xenserver-premium"},
+		"metrics":         metrics,
+		"PBDs":            []string{},
+		"PIFs":            []string{},
+		"resident_VMs":    []string{},
+		"host_CPUs":       []string{},
+		"memory_overhead": 0,
+		"other_config":    map[string]string{"boot_time": bootTime()},
+		"tags":            []string{},
+	})
+
+	for smType, vdiCreate := range map[string]bool{"lvm": true, "ext": true, "nfs": true, "iso": false, "udev": false, "dummy": true} {
+		st.Create("SM", smRecord(smType, vdiCreate))
+	}
+	local := st.Create("SR", srRecord("Local storage", "", "lvm", "user", false, 500*gib))
+	st.Create("PBD", pbdRecord(host, local, map[string]string{"device": "/dev/sda3"}, true))
+	nfs := st.Create("SR", srRecord("NFS virtual disk storage", "", "nfs", "", true, 2048*gib))
+	st.Create("PBD", pbdRecord(host, nfs, map[string]string{"server": "192.0.2.10", "serverpath": "/exports/vms"}, true))
+	tools := st.Create("SR", srRecord("XenServer Tools", "XenServer Tools ISOs", "iso", "iso", true, 0))
+	st.Create("PBD", pbdRecord(host, tools, map[string]string{"location": "/opt/xensource/packages/iso"}, true))
+	toolsISO := create(st, "VDI", Record{"name_label": "guest-tools.iso", "SR": tools, "virtual_size": 100 * mib, "read_only": true})
+
+	st.Create("pool", Record{
+		"name_label": "", "name_description": "", "master": host, "default_SR": local,
+		"suspend_image_SR": local, "ha_enabled": false, "other_config": map[string]string{}, "tags": []string{},
+	})
+
+	network := create(st, "network", Record{
+		"name_label":       "Pool-wide network associated with eth0",
+		"name_description": "",
+		"bridge":           "xenbr0",
+	})
+	st.Create("PIF", Record{
+		"device": "eth0", "network": network, "host": host, "MAC": randomMAC(), "MTU": 1500, "VLAN": -1,
+		"physical": true, "currently_attached": true, "IP": strings.Split(addr, ":")[0], "management": true,
+		"bond_slave_of": NullRef, "VLAN_master_of": NullRef, "VLAN_slave_of": []string{}, "metrics": NullRef,
+		"other_config": map[string]string{},
+	})
+
+	dom0 := vmRecord("Control domain on host: " + name)
+	dom0["is_control_domain"] = true
+	dom0["metrics"] = st.Create("VM_metrics", vmMetricsRecord())
+	dom0Ref := st.Create("VM", dom0)
+	setPowerState(st, dom0Ref, "Running", host)
+	st.Update("VM", dom0Ref, Record{"domid": 0})
+
+	for _, t := range []struct {
+		name string
+		disk int
+	}{{WindowsTemplate, 32 * gib}, {LinuxTemplate, 10 * gib}} {
+		template := vmRecord(t.name)
+		template["is_a_template"] = true
+		template["is_default_template"] = true
+		template["other_config"] = map[string]string{"disks": provisionXML(t.disk), "install-methods": "cdrom"}
+		ref := st.Create("VM", template)
+		create(st, "VBD", Record{"VM": ref, "userdevice": "3", "mode": "RO", "type": "CD", "empty": true})
+	}
+
+	linux := vmRecord(LinuxVM)
+	linux["metrics"] = st.Create("VM_metrics", vmMetricsRecord())
+	linux["guest_metrics"] = st.Create("VM_guest_metrics", guestMetricsRecord())
+	linuxRef := st.Create("VM", linux)
+	disk := create(st, "VDI", Record{"name_label": LinuxVM + " 0", "SR": local, "virtual_size": 10 * gib, "type": "system"})
+	create(st, "VBD", Record{"VM": linuxRef, "VDI": disk, "userdevice": "0", "bootable": true})
+	create(st, "VBD", Record{"VM": linuxRef, "VDI": toolsISO, "userdevice": "3", "mode": "RO", "type": "CD"})
+	create(st, "VIF", Record{"VM": linuxRef, "network": network, "device": "0"})
+	return host
+}
@@ -0,0 +1,592 @@
+// Package fakexapi is an in-process stand-in for a XenServer host. It speaks
+// the JSON-RPC protocol used by the Go SDK over an httptest server, keeps the
+// pool in an in-memory object store and serves event.from from a log of
+// every change, so the samples can run without real hardware.
+package fakexapi
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Failure is an XAPI failure: the error code followed by its parameters,
+// e.g. Failure{"HOST_IS_SLAVE", "10.0.0.1"}.
+type Failure []string
+
+func (f Failure) Error() string {
+	return fmt.Sprintf("%v", []string(f))
+}
+
+// Call is a single API invocation as seen by a handler. Args excludes the
+// session reference.
+type Call struct {
+	Server  *Server
+	Store   *Store
+	Method  string
+	Session string
+	Args    []interface{}
+}
+
+func (c *Call) arg(i int) interface{} {
+	if i < len(c.Args) {
+		return c.Args[i]
+	}
+	return nil
+}
+
+func (c *Call) String(i int) string {
+	s, _ := c.arg(i).(string)
+	return s
+}
+
+func (c *Call) Bool(i int) bool {
+	b, _ := c.arg(i).(bool)
+	return b
+}
+
+func (c *Call) Int(i int) int {
+	f, _ := c.arg(i).(float64)
+	return int(f)
+}
+
+func (c *Call) Float(i int) float64 {
+	f, _ := c.arg(i).(float64)
+	return f
+}
+
+func (c *Call) Strings(i int) []string {
+	return Record{"v": c.arg(i)}.Refs("v")
+}
+
+func (c *Call) Map(i int) map[string]string {
+	return Record{"v": c.arg(i)}.Map("v")
+}
+
+func (c *Call) Record(i int) Record {
+	m, _ := c.arg(i).(map[string]interface{})
+	return Record(m)
+}
+
+// HandlerFunc implements one API method. Returning a Failure reports that
+// failure to the client; any other error becomes INTERNAL_ERROR.
+type HandlerFunc func(c *Call) (interface{}, error)
+
+// pool is the state shared by every fake host that belongs to one pool.
+type pool struct {
+	mu       sync.Mutex
+	store    *Store
+	sessions map[string]bool
+	master   *Server
+}
+
+// Server is one fake host. A new server is the master of its own
+// single-host pool; Pool.Join against another server's address makes it a
+// supporter of that server's pool.
+type Server struct {
+	Username  string
+	Password  string
+	TaskDelay time.Duration
+	// RebootDelay is how long a host rebooted with host.reboot stays down.
+	RebootDelay time.Duration
+	// HeartbeatTimeout is how long a rebooted host still looks live: as
+	// with XAPI, its metrics only say it is gone once its heartbeat has
+	// timed out.
+	HeartbeatTimeout time.Duration
+
+	ts      *httptest.Server
+	certPEM []byte
+	addr    string
+	host    string
+	done    chan struct{}
+
+	mu       sync.Mutex
+	pool     *pool
+	handlers map[string]HandlerFunc
+	mux      *http.ServeMux
+}
+
+var registry = struct {
+	sync.Mutex
+	servers map[string]*Server
+}{servers: make(map[string]*Server)}
+
+func lookupServer(addr string) *Server {
+	registry.Lock()
+	defer registry.Unlock()
+	return registry.servers[addr]
+}
+
+// NewServer starts a fake host listening on a local port, seeded with a
+// small pool: storage, a network, templates and a halted Linux VM. The
+// port answers both plain HTTP and HTTPS.
+func NewServer() *Server {
+	s := &Server{
+		Username:         "root",
+		Password:         "xenroot",
+		TaskDelay:        10 * time.Millisecond,
+		RebootDelay:      50 * time.Millisecond,
+		HeartbeatTimeout: 20 * time.Millisecond,
+		done:             make(chan struct{}),
+		handlers:         make(map[string]HandlerFunc),
+		mux:              http.NewServeMux(),
+	}
+	cert, certPEM := newCertificate()
+	s.certPEM = certPEM
+	s.ts = httptest.NewUnstartedServer(s)
+	s.ts.Listener = &sniffListener{
+		Listener: s.ts.Listener,
+		config:   &tls.Config{Certificates: []tls.Certificate{cert}},
+	}
+	s.ts.Start()
+	s.addr = s.ts.Listener.Addr().String()
+	s.reset()
+
+	registry.Lock()
+	registry.servers[s.addr] = s
+	registry.Unlock()
+	return s
+}
+
+// reset makes the server the master of a freshly seeded pool of its own.
+func (s *Server) reset() {
+	p := &pool{store: newStore(), sessions: make(map[string]bool), master: s}
+	s.host = seed(p.store, s.addr)
+	s.mu.Lock()
+	s.pool = p
+	s.mu.Unlock()
+}
+
+func (s *Server) currentPool() *pool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.pool
+}
+
+// Addr is the host:port the server listens on. It is also the address
+// recorded in the host object and reported by HOST_IS_SLAVE.
+func (s *Server) Addr() string {
+	return s.addr
+}
+
+// URL is the plain HTTP URL of the server.
+func (s *Server) URL() string {
+	return "http://" + s.addr
+}
+
+// CACert returns the PEM encoded certificate the server presents on HTTPS.
+func (s *Server) CACert() []byte {
+	return s.certPEM
+}
+
+// Host returns the reference of the host object this server represents.
+func (s *Server) Host() string {
+	return s.host
+}
+
+// Close shuts the server down, releasing any pending event.from calls.
+func (s *Server) Close() {
+	registry.Lock()
+	delete(registry.servers, s.addr)
+	registry.Unlock()
+	close(s.done)
+	s.ts.Close()
+}
+
+// Handle installs or overrides the implementation of an API method, e.g.
+// "VM.start". Class names are matched case-insensitively.
+func (s *Server) Handle(method string, fn HandlerFunc) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.handlers[methodKey(method)] = fn
+}
+
+// HandleHTTP serves pattern on the same port as the API, for the HTTP
+// handlers a real host exposes next to /jsonrpc.
+func (s *Server) HandleHTTP(pattern string, h http.Handler) {
+	s.mux.Handle(pattern, h)
+}
+
+// Do runs fn with the server's pool locked, so tests can inspect or
+// rearrange the object store between API calls.
+func (s *Server) Do(fn func(st *Store)) {
+	p := s.currentPool()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	fn(p.store)
+}
+
+// ValidSession reports whether ref is a live session of the server's pool.
+func (s *Server) ValidSession(ref string) bool {
+	p := s.currentPool()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.sessions[ref]
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost && (r.URL.Path == "/jsonrpc" || r.URL.Path == "/") {
+		s.serveJSONRPC(w, r)
+		return
+	}
+	s.mux.ServeHTTP(w, r)
+}
+
+func (s *Server) serveJSONRPC(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Method string        `json:"method"`
+		Params []interface{} `json:"params"`
+		ID     interface{}   `json:"id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	resp := map[string]interface{}{"jsonrpc": "2.0", "id": req.ID}
+	result, err := s.call(req.Method, req.Params)
+	if err != nil {
+		failure := toFailure(err)
+		resp["error"] = map[string]interface{}{
+			"code":    1,
+			"message": failure[0],
+			"data":    []string(failure),
+		}
+	} else {
+		if result == nil {
+			result = ""
+		}
+		resp["result"] = result
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+func toFailure(err error) Failure {
+	if f, ok := err.(Failure); ok && len(f) > 0 {
+		return f
+	}
+	return Failure{"INTERNAL_ERROR", err.Error()}
+}
+
+func methodKey(method string) string {
+	class, op, _ := strings.Cut(method, ".")
+	return classKey(class) + "." + op
+}
+
+func (s *Server) call(method string, params []interface{}) (interface{}, error) {
+	switch method {
+	case "session.login_with_password":
+		return s.login(params)
+	case "event.from":
+		return s.eventFrom(params)
+	}
+	name := strings.TrimPrefix(method, "Async.")
+	async := name != method
+	p := s.currentPool()
+	p.mu.Lock()
+	var session string
+	if len(params) > 0 {
+		session, _ = params[0].(string)
+		params = params[1:]
+	}
+	if !p.sessions[session] {
+		p.mu.Unlock()
+		return nil, Failure{"SESSION_INVALID", session}
+	}
+	c := &Call{Server: s, Store: p.store, Method: name, Session: session, Args: params}
+	handler := s.lookup(name)
+	if handler == nil {
+		p.mu.Unlock()
+		return nil, Failure{"MESSAGE_METHOD_UNKNOWN", method}
+	}
+	if !async {
+		defer p.mu.Unlock()
+		return handler(c)
+	}
+	task := p.store.Create("task", newTask("Async."+name, s.host))
+	p.mu.Unlock()
+	go s.runTask(p, task, handler, c)
+	return task, nil
+}
+
+func (s *Server) lookup(method string) HandlerFunc {
+	key := methodKey(method)
+	s.mu.Lock()
+	h, ok := s.handlers[key]
+	s.mu.Unlock()
+	if ok {
+		return h
+	}
+	if h, ok := builtins[key]; ok {
+		return h
+	}
+	class, op, _ := strings.Cut(method, ".")
+	return generic(class, op)
+}
+
+func (s *Server) runTask(p *pool, task string, handler HandlerFunc, c *Call) {
+	select {
+	case <-time.After(s.TaskDelay):
+	case <-s.done:
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	record, ok := p.store.Get("task", task)
+	if !ok {
+		return
+	}
+	finished := Record{"finished": timestamp(time.Now())}
+	if record.String("status") != "pending" {
+		finished["status"] = "cancelled"
+		finished["error_info"] = []string{"TASK_CANCELLED", task}
+		p.store.Update("task", task, finished)
+		return
+	}
+	result, err := handler(c)
+	if err != nil {
+		finished["status"] = "failure"
+		finished["error_info"] = []string(toFailure(err))
+	} else {
+		finished["status"] = "success"
+		finished["progress"] = 1.0
+		finished["result"] = taskResult(result)
+	}
+	p.store.Update("task", task, finished)
+}
+
+func (s *Server) login(params []interface{}) (interface{}, error) {
+	p := s.currentPool()
+	if p.master != s {
+		return nil, Failure{"HOST_IS_SLAVE", p.master.addr}
+	}
+	var user, password string
+	if len(params) >= 2 {
+		user, _ = params[0].(string)
+		password, _ = params[1].(string)
+	}
+	if user != s.Username || password != s.Password {
+		return nil, Failure{"SESSION_AUTHENTICATION_FAILED", user, "Authentication failure"}
+	}
+	ref := newRef()
+	p.mu.Lock()
+	p.sessions[ref] = true
+	p.mu.Unlock()
+	return ref, nil
+}
+
+func (s *Server) eventFrom(params []interface{}) (interface{}, error) {
+	p := s.currentPool()
+	c := &Call{Server: s, Args: params}
+	if len(params) > 0 {
+		c.Session, _ = params[0].(string)
+		c.Args = params[1:]
+	}
+	sub := newSubscription(c.Strings(0))
+	token := c.String(1)
+	deadline := time.After(time.Duration(c.Float(2) * float64(time.Second)))
+	for {
+		p.mu.Lock()
+		if !p.sessions[c.Session] {
+			p.mu.Unlock()
+			return nil, Failure{"SESSION_INVALID", c.Session}
+		}
+		events, err := p.store.since(sub, token)
+		current := p.store.token()
+		changed := p.store.changed
+		p.mu.Unlock()
+		if err != nil {
+			return nil, err
+		}
+		if len(events) > 0 {
+			return eventBatch(events, current), nil
+		}
+		if token == "" {
+			token = current
+		}
+		select {
+		case <-changed:
+		case <-deadline:
+			return eventBatch(nil, current), nil
+		case <-s.done:
+			return eventBatch(nil, current), nil
+		}
+	}
+}
+
+func eventBatch(events []Event, token string) map[string]interface{} {
+	list := []interface{}{}
+	for _, e := range events {
+		list = append(list, map[string]interface{}{
+			"id":        e.ID,
+			"timestamp": timestamp(e.Timestamp),
+			"class":     e.Class,
+			"operation": e.Operation,
+			"ref":       e.Ref,
+			"snapshot":  map[string]interface{}(e.Snapshot),
+		})
+	}
+	return map[string]interface{}{
+		"events":           list,
+		"valid_ref_counts": map[string]interface{}{},
+		"token":            token,
+	}
+}
+
+func timestamp(t time.Time) string {
+	return t.UTC().Format("20060102T15:04:05Z")
+}
+
+// bootTime is what XAPI puts in a host's other_config:boot_time when it
+// starts: the time in seconds since the epoch.
+func bootTime() string {
+	return strconv.FormatFloat(float64(time.Now().UnixNano())/1e9, 'f', 6, 64)
+}
+
+// taskResult renders a handler result the way XAPI stores it in
+// task.result: as an XML-RPC <value>.
+func taskResult(result interface{}) string {
+	switch v := result.(type) {
+	case nil:
+		return ""
+	case string:
+		if v == "" {
+			return ""
+		}
+		return "<value>" + v + "</value>"
+	case []string:
+		var b strings.Builder
+		b.WriteString("<value><array><data>")
+		for _, item := range v {
+			b.WriteString("<value>" + item + "</value>")
+		}
+		b.WriteString("</data></array></value>")
+		return b.String()
+	}
+	return fmt.Sprintf("<value>%v</value>", result)
+}
+
+func newTask(name, host string) Record {
+	now := timestamp(time.Now())
+	return Record{
+		"name_label":         name,
+		"name_description":   "",
+		"allowed_operations": []string{"cancel"},
+		"created":            now,
+		"finished":           "19700101T00:00:00Z",
+		"status":             "pending",
+		"resident_on":        host,
+		"progress":           0.0,
+		"type":               "<none/>",
+		"result":             "",
+		"error_info":         []string{},
+		"other_config":       map[string]string{},
+		"subtask_of":         NullRef,
+		"subtasks":           []string{},
+	}
+}
+
+// sniffListener lets one port speak both HTTP and HTTPS by peeking at the
+// first byte of each connection for a TLS handshake record.
+type sniffListener struct {
+	net.Listener
+	config *tls.Config
+}
+
+func (l *sniffListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &sniffConn{Conn: conn, config: l.config}, nil
+}
+
+type sniffConn struct {
+	net.Conn
+	config *tls.Config
+	once   sync.Once
+	reader *bufio.Reader
+	tls    *tls.Conn
+}
+
+func (c *sniffConn) detect() {
+	c.once.Do(func() {
+		c.reader = bufio.NewReader(c.Conn)
+		first, err := c.reader.Peek(1)
+		if err == nil && first[0] == 0x16 {
+			c.tls = tls.Server(&prefixConn{Conn: c.Conn, reader: c.reader}, c.config)
+		}
+	})
+}
+
+func (c *sniffConn) Read(b []byte) (int, error) {
+	c.detect()
+	if c.tls != nil {
+		return c.tls.Read(b)
+	}
+	return c.reader.Read(b)
+}
+
+func (c *sniffConn) Write(b []byte) (int, error) {
+	c.detect()
+	if c.tls != nil {
+		return c.tls.Write(b)
+	}
+	return c.Conn.Write(b)
+}
+
+func (c *sniffConn) Close() error {
+	if c.tls != nil {
+		return c.tls.Close()
+	}
+	return c.Conn.Close()
+}
+
+type prefixConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *prefixConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
+
+func newCertificate() (tls.Certificate, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		panic(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "fakexapi"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1"), net.IPv6loopback},
+		DNSNames:              []string{"localhost"},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		panic(err)
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, certPEM
+}
@@ -0,0 +1,197 @@
+package fakexapi
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"xenapi"
+)
+
+func TestLoginFailure(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+	session := xenapi.NewSession(&xenapi.ClientOpts{URL: s.URL()})
+	_, err := session.LoginWithPassword(s.Username, "wrong", "1.0", "fakexapi test")
+	if err == nil || !strings.Contains(err.Error(), "SESSION_AUTHENTICATION_FAILED") {
+		t.Log("Expected an authentication failure, got:", err)
+		t.Fail()
+	}
+}
+
+func TestSeededPool(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+	session := s.Login(t)
+	if session.APIVersion != xenapi.APIVersion2_21 {
+		t.Log("Unexpected API version:", session.APIVersion)
+		t.Fail()
+	}
+	vms, err := xenapi.VM.GetByNameLabel(session, LinuxVM)
+	if err != nil || len(vms) != 1 {
+		t.Log("Seeded Linux VM not found:", err)
+		t.Fail()
+		return
+	}
+	record, err := xenapi.VM.GetRecord(session, vms[0])
+	if err != nil {
+		t.Log(err)
+		t.Fail()
+		return
+	}
+	if record.PowerState != xenapi.VMPowerStateHalted || len(record.VBDs) != 2 || len(record.VIFs) != 1 {
+		t.Log("Unexpected seeded VM:", record)
+		t.Fail()
+	}
+}
+
+func TestAsyncTaskFailure(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+	session := s.Login(t)
+	vms, err := xenapi.VM.GetByNameLabel(session, LinuxVM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	taskRef, err := xenapi.VM.AsyncUnpause(session, vms[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	batch, err := xenapi.Event.From(session, []string{"task/" + string(taskRef)}, "", 1.0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		status, err := xenapi.Task.GetStatus(session, taskRef)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status != xenapi.TaskStatusTypePending {
+			break
+		}
+		batch, err = xenapi.Event.From(session, []string{"task/" + string(taskRef)}, batch.Token, 1.0)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	record, err := xenapi.Task.GetRecord(session, taskRef)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if record.Status != xenapi.TaskStatusTypeFailure || len(record.ErrorInfo) == 0 || record.ErrorInfo[0] != "VM_BAD_POWER_STATE" {
+		t.Log("Expected VM_BAD_POWER_STATE, got:", record.Status, record.ErrorInfo)
+		t.Fail()
+	}
+}
+
+func TestEventsLost(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+	session := s.Login(t)
+	batch, err := xenapi.Event.From(session, []string{"vm"}, "", 1.0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Do(func(st *Store) {
+		st.SetEventLimit(1)
+		st.Create("VM", vmRecord("one"))
+		st.Create("VM", vmRecord("two"))
+	})
+	_, err = xenapi.Event.From(session, []string{"vm"}, batch.Token, 1.0)
+	if err == nil || !strings.Contains(err.Error(), "EVENTS_LOST") {
+		t.Log("Expected EVENTS_LOST, got:", err)
+		t.Fail()
+	}
+}
+
+func TestJoinMakesSupporter(t *testing.T) {
+	master, supporter := NewPool(t)
+	_, err := xenapi.NewSession(&xenapi.ClientOpts{URL: supporter.URL()}).LoginWithPassword(master.Username, master.Password, "1.0", "fakexapi test")
+	if err == nil || !strings.Contains(err.Error(), master.Addr()) {
+		t.Log("Expected HOST_IS_SLAVE naming the master, got:", err)
+		t.Fail()
+	}
+	hosts, err := xenapi.Host.GetAll(master.Login(t))
+	if err != nil || len(hosts) != 2 {
+		t.Log("Expected two hosts after join:", hosts, err)
+		t.Fail()
+	}
+}
+
+func TestHandleOverride(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+	s.Handle("VM.start", func(c *Call) (interface{}, error) {
+		return nil, Failure{"NO_HOSTS_AVAILABLE"}
+	})
+	session := s.Login(t)
+	vms, err := xenapi.VM.GetByNameLabel(session, LinuxVM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = xenapi.VM.Start(session, vms[0], false, false)
+	if err == nil || !strings.Contains(err.Error(), "NO_HOSTS_AVAILABLE") {
+		t.Log("Expected the overridden handler to fail, got:", err)
+		t.Fail()
+	}
+}
+
+func TestHostReboot(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+	session := s.Login(t)
+	hosts, err := xenapi.Host.GetAll(session)
+	if err != nil {
+		t.Fatal(err)
+	}
+	host := hosts[0]
+	if err := xenapi.Host.Reboot(session, host); err == nil || !strings.Contains(err.Error(), "HOST_NOT_DISABLED") {
+		t.Log("Expected an enabled host not to reboot, got:", err)
+		t.Fail()
+	}
+	if err := xenapi.Host.Disable(session, host); err != nil {
+		t.Fatal(err)
+	}
+	vms, _ := xenapi.VM.GetByNameLabel(session, LinuxVM)
+	if err := xenapi.VM.Start(session, vms[0], false, false); err != nil {
+		t.Fatal(err)
+	}
+	prevented, err := xenapi.Host.GetVmsWhichPreventEvacuation(session, host)
+	if err != nil || len(prevented[vms[0]]) == 0 || prevented[vms[0]][0] != "NO_HOSTS_AVAILABLE" {
+		t.Log("Expected the Linux VM to have nowhere to go, got:", prevented, err)
+		t.Fail()
+	}
+	if err := xenapi.Host.Reboot(session, host); err == nil || !strings.Contains(err.Error(), "HOST_IN_USE") {
+		t.Log("Expected a host running VMs not to reboot, got:", err)
+		t.Fail()
+	}
+	if err := xenapi.VM.HardShutdown(session, vms[0]); err != nil {
+		t.Fatal(err)
+	}
+
+	s.RebootDelay, s.HeartbeatTimeout = 200*time.Millisecond, 50*time.Millisecond
+	before, _ := xenapi.Host.GetOtherConfig(session, host)
+	if err := xenapi.Host.Reboot(session, host); err != nil {
+		t.Fatal(err)
+	}
+	metrics, _ := xenapi.Host.GetMetrics(session, host)
+	if live, _ := xenapi.HostMetrics.GetLive(session, metrics); !live {
+		t.Log("Expected the host to look live until its heartbeat times out")
+		t.Fail()
+	}
+	time.Sleep(2 * s.HeartbeatTimeout)
+	if live, _ := xenapi.HostMetrics.GetLive(session, metrics); live {
+		t.Log("Expected the host not to be live while rebooting")
+		t.Fail()
+	}
+	time.Sleep(2 * s.RebootDelay)
+	if live, _ := xenapi.HostMetrics.GetLive(session, metrics); !live {
+		t.Log("Expected the host to be live again")
+		t.Fail()
+	}
+	after, _ := xenapi.Host.GetOtherConfig(session, host)
+	if after["boot_time"] == "" || after["boot_time"] == before["boot_time"] {
+		t.Log("Expected a new boot time, got:", before["boot_time"], after["boot_time"])
+		t.Fail()
+	}
+}
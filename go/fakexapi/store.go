@@ -0,0 +1,391 @@
+package fakexapi
+
+import (
+	"encoding/json"
+	"fmt"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const NullRef = "OpaqueRef:NULL"
+
+// Record is an object in wire format: field names as XAPI sends them
+// (name_label, power_state, VBDs, ...) mapped to JSON-compatible values.
+type Record map[string]interface{}
+
+func (r Record) String(field string) string {
+	s, _ := r[field].(string)
+	return s
+}
+
+func (r Record) Bool(field string) bool {
+	b, _ := r[field].(bool)
+	return b
+}
+
+func (r Record) Int(field string) int {
+	switch v := r[field].(type) {
+	case float64:
+		return int(v)
+	case int:
+		return v
+	}
+	return 0
+}
+
+func (r Record) Refs(field string) []string {
+	var refs []string
+	list, _ := r[field].([]interface{})
+	for _, item := range list {
+		if s, ok := item.(string); ok {
+			refs = append(refs, s)
+		}
+	}
+	return refs
+}
+
+func (r Record) Map(field string) map[string]string {
+	m := make(map[string]string)
+	raw, _ := r[field].(map[string]interface{})
+	for k, v := range raw {
+		m[k] = fmt.Sprint(v)
+	}
+	return m
+}
+
+// Event is one entry of the event log served through event.from.
+type Event struct {
+	ID        int
+	Timestamp time.Time
+	Class     string
+	Operation string
+	Ref       string
+	Snapshot  Record
+}
+
+// A relation keeps a set field on a parent object in step with a
+// reference field on its children, e.g. VBD.VM and VM.VBDs.
+type relation struct {
+	child, childField   string
+	parent, parentField string
+}
+
+var relations = []relation{
+	{"vbd", "VM", "vm", "VBDs"},
+	{"vbd", "VDI", "vdi", "VBDs"},
+	{"vif", "VM", "vm", "VIFs"},
+	{"vif", "network", "network", "VIFs"},
+	{"vdi", "SR", "sr", "VDIs"},
+	{"pbd", "SR", "sr", "PBDs"},
+	{"pbd", "host", "host", "PBDs"},
+	{"pif", "network", "network", "PIFs"},
+	{"pif", "host", "host", "PIFs"},
+	{"vm", "snapshot_of", "vm", "snapshots"},
+	{"vm", "resident_on", "host", "resident_VMs"},
+	{"vm", "appliance", "vm_appliance", "VMs"},
+	{"vgpu", "VM", "vm", "VGPUs"},
+	{"vtpm", "VM", "vm", "VTPMs"},
+	{"host_cpu", "host", "host", "host_CPUs"},
+}
+
+// Store is the object database of one fake pool together with its event
+// log. Its methods do no locking of their own: handlers are called with the
+// pool locked, and everything else should go through Server.Do.
+type Store struct {
+	objects    map[string]map[string]Record
+	events     []Event
+	lastID     int
+	eventLimit int
+	changed    chan struct{}
+}
+
+func newStore() *Store {
+	return &Store{
+		objects:    make(map[string]map[string]Record),
+		eventLimit: 10000,
+		changed:    make(chan struct{}),
+	}
+}
+
+func classKey(class string) string {
+	return strings.ToLower(class)
+}
+
+// normalize converts a Go value into the types encoding/json would decode
+// it to, so that records always hold float64, []interface{} and
+// map[string]interface{} regardless of how they were built.
+func normalize(v interface{}) interface{} {
+	data, err := json.Marshal(v)
+	if err != nil {
+		panic(err)
+	}
+	var out interface{}
+	if err := json.Unmarshal(data, &out); err != nil {
+		panic(err)
+	}
+	return out
+}
+
+func copyRecord(r Record) Record {
+	if r == nil {
+		return nil
+	}
+	return Record(normalize(map[string]interface{}(r)).(map[string]interface{}))
+}
+
+func newRef() string {
+	return "OpaqueRef:" + uuid.NewString()
+}
+
+func isNull(ref string) bool {
+	return ref == "" || ref == NullRef
+}
+
+// Create adds a new object of the given class and returns its reference.
+// A uuid is generated unless the record already carries one.
+func (s *Store) Create(class string, fields Record) string {
+	ref := newRef()
+	s.Insert(class, ref, fields)
+	return ref
+}
+
+// Insert adds an object under a caller-chosen reference.
+func (s *Store) Insert(class, ref string, fields Record) {
+	class = classKey(class)
+	record := copyRecord(fields)
+	if record == nil {
+		record = Record{}
+	}
+	if record.String("uuid") == "" {
+		record["uuid"] = uuid.NewString()
+	}
+	if s.objects[class] == nil {
+		s.objects[class] = make(map[string]Record)
+	}
+	s.objects[class][ref] = record
+	s.link(class, ref, record)
+	s.emit(class, "add", ref, record)
+}
+
+// Get returns a copy of the object, or false if it does not exist.
+func (s *Store) Get(class, ref string) (Record, bool) {
+	record, ok := s.objects[classKey(class)][ref]
+	if !ok {
+		return nil, false
+	}
+	return copyRecord(record), true
+}
+
+// Exists reports whether ref names a live object of class.
+func (s *Store) Exists(class, ref string) bool {
+	_, ok := s.objects[classKey(class)][ref]
+	return ok
+}
+
+// Update merges fields into an existing object.
+func (s *Store) Update(class, ref string, fields Record) {
+	class = classKey(class)
+	record, ok := s.objects[class][ref]
+	if !ok {
+		return
+	}
+	old := copyRecord(record)
+	for k, v := range copyRecord(fields) {
+		record[k] = v
+	}
+	for _, rel := range relations {
+		if rel.child == class && old.String(rel.childField) != record.String(rel.childField) {
+			s.detach(rel, old.String(rel.childField), ref)
+			s.attach(rel, record.String(rel.childField), ref)
+		}
+	}
+	s.emit(class, "mod", ref, record)
+}
+
+// Destroy removes an object; it is a no-op if the object is already gone.
+func (s *Store) Destroy(class, ref string) {
+	class = classKey(class)
+	record, ok := s.objects[class][ref]
+	if !ok {
+		return
+	}
+	s.unlink(class, ref, record)
+	delete(s.objects[class], ref)
+	s.emit(class, "del", ref, record)
+}
+
+// Refs lists the references of a class in a stable order.
+func (s *Store) Refs(class string) []string {
+	var refs []string
+	for ref := range s.objects[classKey(class)] {
+		refs = append(refs, ref)
+	}
+	sort.Strings(refs)
+	return refs
+}
+
+// Find returns the references of every object of class that match.
+func (s *Store) Find(class string, match func(ref string, r Record) bool) []string {
+	var refs []string
+	for _, ref := range s.Refs(class) {
+		if match(ref, s.objects[classKey(class)][ref]) {
+			refs = append(refs, ref)
+		}
+	}
+	return refs
+}
+
+// ByUUID looks an object up by its uuid field.
+func (s *Store) ByUUID(class, id string) (string, bool) {
+	refs := s.Find(class, func(_ string, r Record) bool { return r.String("uuid") == id })
+	if len(refs) == 0 {
+		return "", false
+	}
+	return refs[0], true
+}
+
+func (s *Store) link(class, ref string, record Record) {
+	for _, rel := range relations {
+		if rel.child == class {
+			s.attach(rel, record.String(rel.childField), ref)
+		}
+	}
+}
+
+func (s *Store) unlink(class, ref string, record Record) {
+	for _, rel := range relations {
+		if rel.child == class {
+			s.detach(rel, record.String(rel.childField), ref)
+		}
+	}
+}
+
+func (s *Store) attach(rel relation, parentRef, ref string) {
+	parent, ok := s.objects[rel.parent][parentRef]
+	if isNull(parentRef) || !ok {
+		return
+	}
+	set := parent.Refs(rel.parentField)
+	if slices.Contains(set, ref) {
+		return
+	}
+	parent[rel.parentField] = normalize(append(set, ref))
+	s.emit(rel.parent, "mod", parentRef, parent)
+}
+
+func (s *Store) detach(rel relation, parentRef, ref string) {
+	parent, ok := s.objects[rel.parent][parentRef]
+	if isNull(parentRef) || !ok {
+		return
+	}
+	set := []string{}
+	for _, r := range parent.Refs(rel.parentField) {
+		if r != ref {
+			set = append(set, r)
+		}
+	}
+	parent[rel.parentField] = normalize(set)
+	s.emit(rel.parent, "mod", parentRef, parent)
+}
+
+func (s *Store) emit(class, operation, ref string, record Record) {
+	s.lastID++
+	s.events = append(s.events, Event{
+		ID:        s.lastID,
+		Timestamp: time.Now().UTC(),
+		Class:     class,
+		Operation: operation,
+		Ref:       ref,
+		Snapshot:  copyRecord(record),
+	})
+	if len(s.events) > s.eventLimit {
+		s.events = s.events[len(s.events)-s.eventLimit:]
+	}
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+// SetEventLimit bounds how many events are retained. Clients whose token
+// points before the oldest retained event get EVENTS_LOST.
+func (s *Store) SetEventLimit(n int) {
+	s.eventLimit = n
+	if len(s.events) > n {
+		s.events = s.events[len(s.events)-n:]
+	}
+}
+
+func (s *Store) token() string {
+	return strconv.Itoa(s.lastID)
+}
+
+type subscription struct {
+	all     bool
+	classes map[string]bool
+	objects map[string]bool
+}
+
+func newSubscription(classes []string) subscription {
+	sub := subscription{classes: make(map[string]bool), objects: make(map[string]bool)}
+	for _, c := range classes {
+		c = classKey(c)
+		if c == "*" {
+			sub.all = true
+		} else if class, ref, ok := strings.Cut(c, "/"); ok {
+			sub.objects[class+"/"+strings.ToLower(ref)] = true
+		} else {
+			sub.classes[c] = true
+		}
+	}
+	return sub
+}
+
+func (sub subscription) matches(class, ref string) bool {
+	return sub.all || sub.classes[class] || sub.objects[class+"/"+strings.ToLower(ref)]
+}
+
+// since returns the events after token that match the subscription. An
+// empty token yields the current state of every matching object.
+func (s *Store) since(sub subscription, token string) ([]Event, error) {
+	if token == "" {
+		var events []Event
+		var classes []string
+		for class := range s.objects {
+			classes = append(classes, class)
+		}
+		sort.Strings(classes)
+		for _, class := range classes {
+			for _, ref := range s.Refs(class) {
+				if sub.matches(class, ref) {
+					events = append(events, Event{
+						ID:        s.lastID,
+						Timestamp: time.Now().UTC(),
+						Class:     class,
+						Operation: "add",
+						Ref:       ref,
+						Snapshot:  copyRecord(s.objects[class][ref]),
+					})
+				}
+			}
+		}
+		return events, nil
+	}
+	last, err := strconv.Atoi(token)
+	if err != nil {
+		return nil, Failure{"EVENTS_LOST"}
+	}
+	if last < s.lastID && (len(s.events) == 0 || s.events[0].ID > last+1) {
+		return nil, Failure{"EVENTS_LOST"}
+	}
+	var events []Event
+	for _, e := range s.events {
+		if e.ID > last && sub.matches(e.Class, e.Ref) {
+			events = append(events, e)
+		}
+	}
+	return events, nil
+}
@@ -0,0 +1,64 @@
+package fakexapi
+
+import (
+	"testing"
+
+	"xenapi"
+)
+
+// Start starts a server for the length of a test, closing it when the test
+// ends.
+func Start(t testing.TB) *Server {
+	t.Helper()
+	s := NewServer()
+	t.Cleanup(s.Close)
+	return s
+}
+
+// Login logs in to s as its user, failing the test if it cannot. s must be
+// the master of its pool, as a supporter answers HOST_IS_SLAVE.
+func (s *Server) Login(t testing.TB) *xenapi.Session {
+	t.Helper()
+	session := xenapi.NewSession(&xenapi.ClientOpts{URL: s.URL()})
+	if _, err := session.LoginWithPassword(s.Username, s.Password, "1.0", t.Name()); err != nil {
+		t.Fatal(err)
+	}
+	return session
+}
+
+// NewPool starts two servers for the length of a test and joins the
+// supporter to the coordinator's pool with Join.
+func NewPool(t testing.TB) (coordinator, supporter *Server) {
+	t.Helper()
+	coordinator, supporter = Start(t), Start(t)
+	supporter.Join(t, coordinator)
+	return coordinator, supporter
+}
+
+// Join makes s a supporter of coordinator's pool. s forgets its shared SRs
+// first, as pool.join requires, so it joins without PBDs for the
+// coordinator's.
+func (s *Server) Join(t testing.TB, coordinator *Server) {
+	t.Helper()
+	session := s.Login(t)
+	srs, err := xenapi.SR.GetAllRecords(session)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for ref, sr := range srs {
+		if !sr.Shared {
+			continue
+		}
+		for _, pbd := range sr.PBDs {
+			if err := xenapi.PBD.Unplug(session, pbd); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := xenapi.SR.Forget(session, ref); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := xenapi.Pool.Join(session, coordinator.Addr(), coordinator.Username, coordinator.Password); err != nil {
+		t.Fatal(err)
+	}
+}
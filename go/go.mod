@@ -5,6 +5,8 @@ go 1.22.2
 replace xenapi => ./goSDK
 
 require (
+	github.com/BurntSushi/toml v1.5.0
 	github.com/google/uuid v1.6.0
+	gopkg.in/yaml.v3 v3.0.1
 	xenapi v0.0.0-00010101000000-000000000000
 )
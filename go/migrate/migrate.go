@@ -0,0 +1,393 @@
+// Package migrate moves VMs between hosts, the Go counterpart of
+// c/test_vm_async_migrate.c. Within a pool a VM on shared storage moves
+// with VM.pool_migrate; storage motion copies its disks to other SRs on
+// the way, within the pool or into another pool, with Host.migrate_receive
+// and VM.migrate_send.
+package migrate
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+
+	"xenapi"
+
+	"github.com/xenserver/xenserver-samples/go/xsutil"
+)
+
+// Mode is how a VM is moved.
+type Mode string
+
+const (
+	// ModePool moves a running VM to another host of its pool with
+	// VM.pool_migrate. The disks stay where they are, so they must be on
+	// SRs the destination host can reach.
+	ModePool Mode = "pool"
+	// ModeStorage moves the VM within its pool with storage motion,
+	// copying the disks that are mapped to another SR.
+	ModeStorage Mode = "storage"
+	// ModeCrossPool moves the VM, with every disk, to a host of another
+	// pool.
+	ModeCrossPool Mode = "cross-pool"
+)
+
+// Options say where Migrate takes a VM.
+type Options struct {
+	// Mode is ModeCrossPool if Destination is set, ModeStorage if any disk
+	// is mapped and ModePool otherwise, unless set.
+	Mode Mode
+	// Destination is logged in to the pool the VM goes to in
+	// ModeCrossPool.
+	Destination *xenapi.Session
+	// Host is the host the VM goes to.
+	Host xenapi.HostRef
+	// Network is the network Host receives the VM on, which carries the
+	// disks in storage motion; the management network of Host if empty.
+	Network xenapi.NetworkRef
+	// VDIs and SRs map disks, by VDI or by the SR they are on, to the SR
+	// they are copied to. DefaultSR takes the disks neither maps; in
+	// ModeCrossPool it is the destination pool's default SR if empty.
+	// Disks left unmapped within a pool stay where they are.
+	VDIs      map[xenapi.VDIRef]xenapi.SRRef
+	SRs       map[xenapi.SRRef]xenapi.SRRef
+	DefaultSR xenapi.SRRef
+	// VIFs and Networks map NICs, by VIF or by the network they are on,
+	// to a destination network. In ModeCrossPool a NIC neither maps goes
+	// to the network with the same name in the destination pool; within a
+	// pool it stays where it is.
+	VIFs     map[xenapi.VIFRef]xenapi.NetworkRef
+	Networks map[xenapi.NetworkRef]xenapi.NetworkRef
+	// Options are passed to XAPI, e.g. "force": "true".
+	Options map[string]string
+	// Progress, if set, is called with the task's progress from 0 to 1.
+	Progress func(float64)
+}
+
+// DiskMove is where one of the VM's disks is and where it goes. VDI and
+// SR are only known once the disk has moved.
+type DiskMove struct {
+	// Device is the VBD's userdevice, which the disk keeps.
+	Device  string
+	FromVDI xenapi.VDIRef
+	FromSR  xenapi.SRRef
+	// ToSR is the SR the disk is copied to, or FromSR if it stays.
+	ToSR   xenapi.SRRef
+	VDI    xenapi.VDIRef
+	SR     xenapi.SRRef
+	SRName string
+}
+
+// NICMove is where one of the VM's NICs is and where it goes.
+type NICMove struct {
+	// Device is the VIF's device, which the NIC keeps.
+	Device      string
+	MAC         string
+	FromVIF     xenapi.VIFRef
+	FromNetwork xenapi.NetworkRef
+	// ToNetwork is the network the NIC goes to, or FromNetwork if it
+	// stays.
+	ToNetwork   xenapi.NetworkRef
+	VIF         xenapi.VIFRef
+	Network     xenapi.NetworkRef
+	NetworkName string
+}
+
+// Report is a migration, planned or done. VM, the disks' VDI and SR and
+// the NICs' VIF and Network are filled in by Migrate once the VM has
+// arrived; across pools the VM has a new reference.
+type Report struct {
+	Mode Mode
+	From xenapi.HostRef
+	Host xenapi.HostRef
+	Live bool
+	VM   xenapi.VMRef
+	// Disks and NICs are sorted by device.
+	Disks []DiskMove
+	NICs  []NICMove
+}
+
+// Plan works out how Migrate would move vm without checking with XAPI
+// that it can.
+func Plan(session *xenapi.Session, vm xenapi.VMRef, opts Options) (*Report, error) {
+	record, err := xenapi.VM.GetRecord(session, vm)
+	if err != nil {
+		return nil, xsutil.Decode(err)
+	}
+	if opts.Host == "" {
+		return nil, errors.New("no destination host")
+	}
+	report := &Report{Mode: opts.Mode, From: record.ResidentOn, Host: opts.Host, Live: record.PowerState == xenapi.VMPowerStateRunning}
+	if report.Mode == "" {
+		switch {
+		case opts.Destination != nil:
+			report.Mode = ModeCrossPool
+		case len(opts.VDIs) > 0 || len(opts.SRs) > 0 || opts.DefaultSR != "":
+			report.Mode = ModeStorage
+		default:
+			report.Mode = ModePool
+		}
+	}
+	dest := session
+	switch report.Mode {
+	case ModePool, ModeStorage:
+		if opts.Destination != nil {
+			return nil, fmt.Errorf("a destination pool was given for %s migration", report.Mode)
+		}
+	case ModeCrossPool:
+		if opts.Destination == nil {
+			return nil, errors.New("cross-pool migration needs a session for the destination pool")
+		}
+		dest = opts.Destination
+	default:
+		return nil, fmt.Errorf("unknown migration mode %q", report.Mode)
+	}
+	if report.Mode == ModePool && !report.Live {
+		return nil, fmt.Errorf("VM %q is %s; only running VMs move with pool migration", record.NameLabel, record.PowerState)
+	}
+
+	defaultSR := opts.DefaultSR
+	if defaultSR == "" && report.Mode == ModeCrossPool {
+		if defaultSR, err = poolDefaultSR(dest); err != nil {
+			return nil, err
+		}
+	}
+	for _, vbd := range record.VBDs {
+		vbdRecord, err := xenapi.VBD.GetRecord(session, vbd)
+		if err != nil {
+			return nil, xsutil.Decode(err)
+		}
+		if vbdRecord.Type == xenapi.VbdTypeCD || vbdRecord.Empty {
+			continue
+		}
+		sr, err := xenapi.VDI.GetSR(session, vbdRecord.VDI)
+		if err != nil {
+			return nil, xsutil.Decode(err)
+		}
+		move := DiskMove{Device: vbdRecord.Userdevice, FromVDI: vbdRecord.VDI, FromSR: sr, ToSR: opts.VDIs[vbdRecord.VDI]}
+		if move.ToSR == "" {
+			move.ToSR = opts.SRs[sr]
+		}
+		if move.ToSR == "" {
+			move.ToSR = defaultSR
+		}
+		if move.ToSR == "" {
+			if report.Mode == ModeCrossPool {
+				return nil, fmt.Errorf("disk %s of VM %q has no destination SR", move.Device, record.NameLabel)
+			}
+			move.ToSR = sr
+		}
+		if report.Mode == ModePool && move.ToSR != sr {
+			return nil, fmt.Errorf("disk %s of VM %q is mapped to another SR, which pool migration cannot do", move.Device, record.NameLabel)
+		}
+		report.Disks = append(report.Disks, move)
+	}
+
+	var networks map[xenapi.NetworkRef]xenapi.NetworkRecord
+	if report.Mode == ModeCrossPool {
+		if networks, err = xenapi.Network.GetAllRecords(dest); err != nil {
+			return nil, xsutil.Decode(err)
+		}
+	}
+	for _, vif := range record.VIFs {
+		vifRecord, err := xenapi.VIF.GetRecord(session, vif)
+		if err != nil {
+			return nil, xsutil.Decode(err)
+		}
+		move := NICMove{Device: vifRecord.Device, MAC: vifRecord.MAC, FromVIF: vif, FromNetwork: vifRecord.Network, ToNetwork: opts.VIFs[vif]}
+		if move.ToNetwork == "" {
+			move.ToNetwork = opts.Networks[vifRecord.Network]
+		}
+		if move.ToNetwork == "" && report.Mode == ModeCrossPool {
+			name, err := xenapi.Network.GetNameLabel(session, vifRecord.Network)
+			if err != nil {
+				return nil, xsutil.Decode(err)
+			}
+			if move.ToNetwork = networkNamed(networks, name); move.ToNetwork == "" {
+				return nil, fmt.Errorf("NIC %s of VM %q is on network %q, which the destination pool does not have", move.Device, record.NameLabel, name)
+			}
+		}
+		if move.ToNetwork == "" {
+			move.ToNetwork = move.FromNetwork
+		}
+		report.NICs = append(report.NICs, move)
+	}
+	sort.Slice(report.Disks, func(i, j int) bool { return report.Disks[i].Device < report.Disks[j].Device })
+	sort.Slice(report.NICs, func(i, j int) bool { return report.NICs[i].Device < report.NICs[j].Device })
+	return report, nil
+}
+
+func poolDefaultSR(session *xenapi.Session) (xenapi.SRRef, error) {
+	pools, err := xenapi.Pool.GetAllRecords(session)
+	if err != nil {
+		return "", xsutil.Decode(err)
+	}
+	for _, pool := range pools {
+		if pool.DefaultSR != "" && pool.DefaultSR != xsutil.NullRef {
+			return pool.DefaultSR, nil
+		}
+	}
+	return "", nil
+}
+
+// networkNamed returns the only network called name, or "" if there is
+// none or more than one.
+func networkNamed(networks map[xenapi.NetworkRef]xenapi.NetworkRecord, name string) xenapi.NetworkRef {
+	var found []xenapi.NetworkRef
+	for ref, network := range networks {
+		if network.NameLabel == name {
+			found = append(found, ref)
+		}
+	}
+	if len(found) != 1 {
+		return ""
+	}
+	return found[0]
+}
+
+// Migrate moves vm as opts say, after asking XAPI with
+// VM.assert_can_migrate whether it can. It follows the migration task to
+// the end and reports where the VM, its disks and its NICs ended up. If
+// ctx ends first, the task is cancelled and destroyed.
+func Migrate(ctx context.Context, session *xenapi.Session, vm xenapi.VMRef, opts Options) (*Report, error) {
+	report, err := Plan(session, vm, opts)
+	if err != nil {
+		return nil, err
+	}
+	dest := session
+	if report.Mode == ModeCrossPool {
+		dest = opts.Destination
+	}
+	// The VM keeps its UUID wherever it goes, and is found again by it.
+	uuid, err := xenapi.VM.GetUUID(session, vm)
+	if err != nil {
+		return nil, xsutil.Decode(err)
+	}
+	options := opts.Options
+	if options == nil {
+		options = map[string]string{}
+	}
+
+	network := opts.Network
+	if network == "" {
+		if network, err = managementNetwork(dest, report.Host); err != nil {
+			return nil, err
+		}
+	}
+	token, err := xenapi.Host.MigrateReceive(dest, report.Host, network, options)
+	if err != nil {
+		return nil, xsutil.Decode(err)
+	}
+	vdiMap, vifMap := report.maps()
+	vgpuMap := map[xenapi.VGPURef]xenapi.GPUGroupRef{}
+	if err := xenapi.VM.AssertCanMigrate(session, vm, token, report.Live, vdiMap, vifMap, options, vgpuMap); err != nil {
+		return nil, xsutil.Decode(err)
+	}
+	var task xenapi.TaskRef
+	if report.Mode == ModePool {
+		task, err = xenapi.VM.AsyncPoolMigrate(session, vm, report.Host, options)
+	} else {
+		task, err = xenapi.VM.AsyncMigrateSend(session, vm, token, report.Live, vdiMap, vifMap, options, vgpuMap)
+	}
+	if err != nil {
+		return nil, xsutil.Decode(err)
+	}
+	_, err = xsutil.FollowTask(ctx, session, task, opts.Progress)
+	if ctx.Err() != nil {
+		xenapi.Task.Cancel(session, task)
+		xenapi.Task.Destroy(session, task)
+		return nil, ctx.Err()
+	}
+	xenapi.Task.Destroy(session, task)
+	if err != nil {
+		return nil, err
+	}
+	if report.VM, err = xenapi.VM.GetByUUID(dest, uuid); err != nil {
+		return nil, xsutil.Decode(err)
+	}
+	return report, report.arrived(dest)
+}
+
+// maps builds the VDI and VIF maps of VM.migrate_send, which leave out
+// what stays where it is.
+func (r *Report) maps() (map[xenapi.VDIRef]xenapi.SRRef, map[xenapi.VIFRef]xenapi.NetworkRef) {
+	vdis := map[xenapi.VDIRef]xenapi.SRRef{}
+	for _, disk := range r.Disks {
+		if disk.ToSR != disk.FromSR || r.Mode == ModeCrossPool {
+			vdis[disk.FromVDI] = disk.ToSR
+		}
+	}
+	vifs := map[xenapi.VIFRef]xenapi.NetworkRef{}
+	for _, nic := range r.NICs {
+		if nic.ToNetwork != nic.FromNetwork || r.Mode == ModeCrossPool {
+			vifs[nic.FromVIF] = nic.ToNetwork
+		}
+	}
+	return vdis, vifs
+}
+
+// arrived fills in where the VM's disks and NICs are now, matching them
+// by device.
+func (r *Report) arrived(session *xenapi.Session) error {
+	record, err := xenapi.VM.GetRecord(session, r.VM)
+	if err != nil {
+		return xsutil.Decode(err)
+	}
+	if record.ResidentOn != "" && record.ResidentOn != xsutil.NullRef {
+		r.Host = record.ResidentOn
+	}
+	for _, vbd := range record.VBDs {
+		vbdRecord, err := xenapi.VBD.GetRecord(session, vbd)
+		if err != nil {
+			return xsutil.Decode(err)
+		}
+		for i := range r.Disks {
+			disk := &r.Disks[i]
+			if disk.Device != vbdRecord.Userdevice {
+				continue
+			}
+			disk.VDI = vbdRecord.VDI
+			if disk.SR, err = xenapi.VDI.GetSR(session, disk.VDI); err != nil {
+				return xsutil.Decode(err)
+			}
+			if disk.SRName, err = xenapi.SR.GetNameLabel(session, disk.SR); err != nil {
+				return xsutil.Decode(err)
+			}
+		}
+	}
+	for _, vif := range record.VIFs {
+		vifRecord, err := xenapi.VIF.GetRecord(session, vif)
+		if err != nil {
+			return xsutil.Decode(err)
+		}
+		for i := range r.NICs {
+			nic := &r.NICs[i]
+			if nic.Device != vifRecord.Device {
+				continue
+			}
+			nic.VIF, nic.Network = vif, vifRecord.Network
+			if nic.NetworkName, err = xenapi.Network.GetNameLabel(session, nic.Network); err != nil {
+				return xsutil.Decode(err)
+			}
+		}
+	}
+	return nil
+}
+
+// managementNetwork returns the network of host's management interface.
+func managementNetwork(session *xenapi.Session, host xenapi.HostRef) (xenapi.NetworkRef, error) {
+	pifs, err := xenapi.Host.GetPIFs(session, host)
+	if err != nil {
+		return "", xsutil.Decode(err)
+	}
+	for _, pif := range pifs {
+		record, err := xenapi.PIF.GetRecord(session, pif)
+		if err != nil {
+			return "", xsutil.Decode(err)
+		}
+		if record.Management {
+			return record.Network, nil
+		}
+	}
+	return "", fmt.Errorf("host %s has no management interface", host)
+}
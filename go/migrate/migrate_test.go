@@ -0,0 +1,187 @@
+package migrate
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"xenapi"
+
+	"github.com/xenserver/xenserver-samples/go/fakexapi"
+	"github.com/xenserver/xenserver-samples/go/xsutil"
+)
+
+const networkName = "Pool-wide network associated with eth0"
+
+func findSR(t *testing.T, session *xenapi.Session, name string) xenapi.SRRef {
+	srs, err := xenapi.SR.GetByNameLabel(session, name)
+	if err != nil || len(srs) != 1 {
+		t.Fatal("SR not found:", name, err)
+	}
+	return srs[0]
+}
+
+// runningVM starts the fake's Linux VM, copying it to sr first unless sr
+// is empty.
+func runningVM(t *testing.T, session *xenapi.Session, sr xenapi.SRRef) xenapi.VMRef {
+	vms, err := xenapi.VM.GetByNameLabel(session, fakexapi.LinuxVM)
+	if err != nil || len(vms) == 0 {
+		t.Fatal("VM not found:", err)
+	}
+	vm := vms[0]
+	if sr != "" {
+		if vm, err = xenapi.VM.Copy(session, vm, "migrate test", sr); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := xenapi.VM.Start(session, vm, false, false); err != nil {
+		t.Fatal(err)
+	}
+	return vm
+}
+
+func TestMigrateStorage(t *testing.T) {
+	server := fakexapi.Start(t)
+	session := server.Login(t)
+	vm := runningVM(t, session, "")
+	nfs := findSR(t, session, "NFS virtual disk storage")
+
+	var progress []float64
+	report, err := Migrate(context.Background(), session, vm, Options{
+		Host:     xenapi.HostRef(server.Host()),
+		SRs:      map[xenapi.SRRef]xenapi.SRRef{findSR(t, session, "Local storage"): nfs},
+		Progress: func(p float64) { progress = append(progress, p) },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Mode != ModeStorage || report.VM != vm || !report.Live {
+		t.Log("Expected live storage motion of the same VM, got:", report.Mode, report.VM, report.Live)
+		t.Fail()
+	}
+	if len(report.Disks) != 1 || report.Disks[0].SR != nfs || report.Disks[0].VDI == report.Disks[0].FromVDI {
+		t.Fatal("Expected the disk to be copied to the NFS SR, got:", report.Disks)
+	}
+	if report.Disks[0].SRName != "NFS virtual disk storage" {
+		t.Log("Expected the SR's name, got:", report.Disks[0].SRName)
+		t.Fail()
+	}
+	if len(report.NICs) != 1 || report.NICs[0].Network != report.NICs[0].FromNetwork || report.NICs[0].NetworkName != networkName {
+		t.Log("Expected the NIC to stay on its network, got:", report.NICs)
+		t.Fail()
+	}
+	if len(progress) == 0 || progress[len(progress)-1] != 1 {
+		t.Log("Expected progress to end at 1, got:", progress)
+		t.Fail()
+	}
+}
+
+func TestMigratePool(t *testing.T) {
+	master, member := fakexapi.NewPool(t)
+	coordinator := master.Login(t)
+	target := xenapi.HostRef(member.Host())
+
+	// The VM's disk on local storage keeps it on its host, which
+	// VM.assert_can_migrate says before anything starts.
+	local := runningVM(t, coordinator, "")
+	_, err := Migrate(context.Background(), coordinator, local, Options{Host: target})
+	var failure *xsutil.Failure
+	if !errors.As(err, &failure) || failure.Code != "VM_REQUIRES_SR" {
+		t.Fatal("Expected a VM on local storage not to move, got:", err)
+	}
+
+	vm := runningVM(t, coordinator, findSR(t, coordinator, "NFS virtual disk storage"))
+	report, err := Migrate(context.Background(), coordinator, vm, Options{Host: target})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Mode != ModePool || report.Host != target || report.From != xenapi.HostRef(master.Host()) {
+		t.Log("Expected a pool migration to the member, got:", report.Mode, report.From, report.Host)
+		t.Fail()
+	}
+	if len(report.Disks) != 1 || report.Disks[0].VDI != report.Disks[0].FromVDI {
+		t.Log("Expected the disk to stay where it was, got:", report.Disks)
+		t.Fail()
+	}
+}
+
+func TestMigrateCrossPool(t *testing.T) {
+	session := fakexapi.Start(t).Login(t)
+	destServer := fakexapi.Start(t)
+	dest := destServer.Login(t)
+	vm := runningVM(t, session, "")
+
+	report, err := Migrate(context.Background(), session, vm, Options{
+		Destination: dest,
+		Host:        xenapi.HostRef(destServer.Host()),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Mode != ModeCrossPool || report.VM == vm {
+		t.Log("Expected the VM to arrive in the other pool, got:", report.Mode, report.VM)
+		t.Fail()
+	}
+	if _, err := xenapi.VM.GetRecord(session, vm); !errors.Is(xsutil.Decode(err), xsutil.ErrHandleInvalid) {
+		t.Log("Expected the VM to be gone from the source pool:", err)
+		t.Fail()
+	}
+	local := findSR(t, dest, "Local storage")
+	if len(report.Disks) != 1 || report.Disks[0].SR != local {
+		t.Fatal("Expected the disk on the destination's default SR, got:", report.Disks)
+	}
+	if _, err := xenapi.VDI.GetRecord(session, report.Disks[0].FromVDI); !errors.Is(xsutil.Decode(err), xsutil.ErrHandleInvalid) {
+		t.Log("Expected the source disk to be gone from the source pool:", err)
+		t.Fail()
+	}
+	if len(report.NICs) != 1 || report.NICs[0].NetworkName != networkName || report.NICs[0].Network == report.NICs[0].FromNetwork {
+		t.Log("Expected the NIC on the destination's network of the same name, got:", report.NICs)
+		t.Fail()
+	}
+	powerState, err := xenapi.VM.GetPowerState(dest, report.VM)
+	if err != nil || powerState != xenapi.VMPowerStateRunning {
+		t.Log("Expected the VM to be running in the other pool:", powerState, err)
+		t.Fail()
+	}
+}
+
+func TestMigrateRefused(t *testing.T) {
+	server := fakexapi.Start(t)
+	session := server.Login(t)
+	destServer := fakexapi.Start(t)
+	dest := destServer.Login(t)
+	vm := runningVM(t, session, "")
+
+	// XAPI is asked before anything moves.
+	if err := xenapi.Host.Disable(dest, xenapi.HostRef(destServer.Host())); err != nil {
+		t.Fatal(err)
+	}
+	_, err := Migrate(context.Background(), session, vm, Options{Destination: dest, Host: xenapi.HostRef(destServer.Host())})
+	var failure *xsutil.Failure
+	if !errors.As(err, &failure) || failure.Code != "HOST_DISABLED" {
+		t.Fatal("Expected HOST_DISABLED, got:", err)
+	}
+	if _, err := xenapi.VM.GetRecord(session, vm); err != nil {
+		t.Fatal("Expected the VM to stay:", err)
+	}
+
+	// A halted VM cannot move with pool migration.
+	if err := xenapi.VM.HardShutdown(session, vm); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Plan(session, vm, Options{Host: xenapi.HostRef(server.Host())}); err == nil {
+		t.Log("Expected a halted VM to be refused pool migration")
+		t.Fail()
+	}
+
+	// Across pools, a NIC needs a network to go to.
+	destServer.Do(func(st *fakexapi.Store) {
+		for _, network := range st.Refs("network") {
+			st.Update("network", network, fakexapi.Record{"name_label": "renamed"})
+		}
+	})
+	if _, err := Plan(session, vm, Options{Destination: dest, Host: xenapi.HostRef(destServer.Host())}); err == nil {
+		t.Log("Expected a NIC without a destination network to be refused")
+		t.Fail()
+	}
+}
@@ -9,6 +9,8 @@ import (
 )
 
 func TestNetworkCreateAndDestroy(t *testing.T) {
+	Connected(t)
+	objects := TrackObjects(t)
 	var networkRecord xenapi.NetworkRecord
 	networkRecord.NameLabel = "Test External Network"
 	networkRecord.NameDescription = fmt.Sprintf("Created by network_test.go at %s", time.Now().String())
@@ -21,6 +23,7 @@ func TestNetworkCreateAndDestroy(t *testing.T) {
 		t.Fail()
 		return
 	}
+	objects.Network(networkRef)
 	networkRecord, err = xenapi.Network.GetRecord(session, networkRef)
 	if err != nil {
 		t.Log(err)
@@ -60,6 +63,7 @@ func TestNetworkCreateAndDestroy(t *testing.T) {
 		t.Fail()
 		return
 	}
+	objects.VLAN(pifRecord.VLANMasterOf)
 	vlanRecord, err := xenapi.VLAN.GetRecord(session, pifRecord.VLANMasterOf)
 	if err != nil {
 		t.Log(err)
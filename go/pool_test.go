@@ -1,107 +1,71 @@
 package testGoSDK
 
 import (
+	"context"
+	"errors"
 	"testing"
-	"time"
 
 	"xenapi"
+
+	"github.com/xenserver/xenserver-samples/go/xsutil"
 )
 
 func TestPoolJoinAndEject(t *testing.T) {
-	if *IP1_FLAG == "" || *USERNAME1_FLAG == "" || *PASSWORD1_FLAG == "" {
-		t.Log("Supporter host ip, username or password is not provided, skipping pool test")
-		t.Fail()
-		return
-	}
-	// get current Pool
-	poolRefs, err := xenapi.Pool.GetAll(session)
-	if err != nil {
-		t.Log(err)
-		t.Fail()
-		return
-	}
-	if len(poolRefs) == 0 {
-		t.Log("No pool found")
-		t.Fail()
-		return
-	}
-	poolRecord, err := xenapi.Pool.GetRecord(session, poolRefs[0])
-	if err != nil {
-		t.Log(err)
-		t.Fail()
-		return
-	}
+	Connected(t)
+	Require(t, NeedSupporter)
+	primary, supporter := GetTarget(PRIMARY_TARGET), GetTarget(SUPPORTER_TARGET)
 
 	// create another session
-	session2 := xenapi.NewSession(&xenapi.ClientOpts{
-		URL: "http://" + *IP1_FLAG,
-	})
-	_, err = session2.LoginWithPassword(*USERNAME1_FLAG, *PASSWORD1_FLAG, "1.0", "Go sdk test")
+	session2, err := xsutil.Login(&xenapi.ClientOpts{
+		URL: "http://" + supporter.Host,
+	}, supporter.Credentials("Go sdk test"))
 	if err != nil {
 		t.Log(err)
 		t.Fail()
 		return
 	}
 
-	srRefs, err := xenapi.SR.GetAll(session2)
+	// add the host to the pool, forgetting its shared SRs first
+	report, err := xsutil.CheckJoin(session2, session)
 	if err != nil {
 		t.Log(err)
 		t.Fail()
 		return
 	}
-	for _, srRef := range srRefs {
-		srRecord, err := xenapi.SR.GetRecord(session2, srRef)
-		if err != nil {
-			t.Log(err)
-			t.Fail()
-			return
-		}
-		if srRecord.Shared {
-			pbdRefs, err := xenapi.PBD.GetAll(session2)
-			if err != nil {
-				t.Log(err)
-				t.Fail()
-				return
-			}
-			for _, pbdRef := range pbdRefs {
-				pbdSRRef, err := xenapi.PBD.GetSR(session2, pbdRef)
-				if err != nil {
-					t.Log(err)
-					t.Fail()
-					return
-				}
-				if srRef == pbdSRRef {
-					err = xenapi.PBD.Unplug(session2, pbdRef)
-					if err != nil {
-						t.Log(err)
-						t.Fail()
-						return
-					}
-					err = xenapi.PBD.Destroy(session2, pbdRef)
-					if err != nil {
-						t.Log(err)
-					}
-				}
-			}
-			err = xenapi.SR.Forget(session2, srRef)
-			if err != nil {
-				t.Log(err)
-				t.Fail()
-				return
-			}
+	for _, warning := range report.Warnings {
+		t.Log(warning)
+	}
+	for _, sr := range report.SharedSRs {
+		t.Log(sr)
+	}
+	hostRefSupporter, err := xsutil.JoinPool(context.Background(), session2, session, xsutil.JoinOptions{
+		Address:         primary.Host,
+		Username:        primary.Username,
+		Password:        primary.Password,
+		DetachSharedSRs: true,
+	})
+	// A failed check is a misconfigured supporter, which is reported
+	// rather than skipped.
+	var joinErr *xsutil.JoinError
+	if errors.As(err, &joinErr) {
+		t.Logf("Host %q cannot join the pool:", joinErr.Host)
+		for _, problem := range joinErr.Problems {
+			t.Log(problem)
 		}
+		t.Fail()
+		return
 	}
-
-	// add the host to the pool
-	_, err = xenapi.Pool.AsyncJoin(session2, *IP_FLAG, *USERNAME_FLAG, *PASSWORD_FLAG)
 	if err != nil {
 		t.Log(err)
 		t.Fail()
 		return
 	}
-	time.Sleep(time.Duration(60) * time.Second)
 
-	hostRefs, err := xenapi.Host.GetAll(session)
+	var hostRefs []xenapi.HostRef
+	err = poolSession.Do(func(session *xenapi.Session) (err error) {
+		hostRefs, err = xenapi.Host.GetAll(session)
+		return
+	})
 	if err != nil {
 		t.Log(err)
 		t.Fail()
@@ -112,12 +76,6 @@ func TestPoolJoinAndEject(t *testing.T) {
 		t.Fail()
 		return
 	}
-	var hostRefSupporter xenapi.HostRef
-	for _, hostRef := range hostRefs {
-		if hostRef != poolRecord.Master {
-			hostRefSupporter = hostRef
-		}
-	}
 
 	// eject the host from the pool
 	taskRef, err := xenapi.Pool.AsyncEject(session, hostRefSupporter)
@@ -126,13 +84,16 @@ func TestPoolJoinAndEject(t *testing.T) {
 		t.Fail()
 		return
 	}
-	err = WaitForTask(taskRef, 1)
+	err = WaitForTask(taskRef)
 	if err != nil {
 		t.Log(err)
 		t.Fail()
 		return
 	}
-	hostRefs, err = xenapi.Host.GetAll(session)
+	err = poolSession.Do(func(session *xenapi.Session) (err error) {
+		hostRefs, err = xenapi.Host.GetAll(session)
+		return
+	})
 	if err != nil {
 		t.Log(err)
 		t.Fail()
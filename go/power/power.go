@@ -0,0 +1,290 @@
+// Package power runs a power operation on many VMs at once, the Go
+// counterpart of python/shutdown.py and the Java StartAllVMs sample. VMs are
+// picked by a Selector and handled by a bounded number of workers, each
+// starting the operation's Async call and following its task, and every
+// VM gets a Result of its own.
+package power
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"xenapi"
+
+	"github.com/xenserver/xenserver-samples/go/xsutil"
+)
+
+// Op is a power operation.
+type Op string
+
+const (
+	OpStart         Op = "start"
+	OpCleanShutdown Op = "clean-shutdown"
+	OpHardShutdown  Op = "hard-shutdown"
+	OpReboot        Op = "reboot"
+	OpSuspend       Op = "suspend"
+	OpResume        Op = "resume"
+)
+
+// Ops lists every operation, in the order they are documented.
+var Ops = []Op{OpStart, OpCleanShutdown, OpHardShutdown, OpReboot, OpSuspend, OpResume}
+
+// done returns the power state an operation leaves a VM in, or "" if a VM
+// is never already done, as with a reboot.
+func (op Op) done() xenapi.VMPowerState {
+	switch op {
+	case OpStart, OpResume:
+		return xenapi.VMPowerStateRunning
+	case OpCleanShutdown, OpHardShutdown:
+		return xenapi.VMPowerStateHalted
+	case OpSuspend:
+		return xenapi.VMPowerStateSuspended
+	}
+	return ""
+}
+
+// async starts the operation on vm.
+func (op Op) async(session *xenapi.Session, vm xenapi.VMRef) (xenapi.TaskRef, error) {
+	switch op {
+	case OpStart:
+		return xenapi.VM.AsyncStart(session, vm, false, false)
+	case OpCleanShutdown:
+		return xenapi.VM.AsyncCleanShutdown(session, vm)
+	case OpHardShutdown:
+		return xenapi.VM.AsyncHardShutdown(session, vm)
+	case OpReboot:
+		return xenapi.VM.AsyncCleanReboot(session, vm)
+	case OpSuspend:
+		return xenapi.VM.AsyncSuspend(session, vm)
+	case OpResume:
+		return xenapi.VM.AsyncResume(session, vm, false, false)
+	}
+	return "", fmt.Errorf("unknown power operation %q", op)
+}
+
+// ParseOp returns the operation named s.
+func ParseOp(s string) (Op, error) {
+	if slices.Contains(Ops, Op(s)) {
+		return Op(s), nil
+	}
+	return "", fmt.Errorf("unknown power operation %q", s)
+}
+
+// Selector picks VMs. Every field that is set must match; a Selector with
+// none set picks every VM. Templates, snapshots and control domains are
+// never picked.
+type Selector struct {
+	// Name is a glob, as path.Match takes, on the VM's name.
+	Name string
+	// Tag is one of the VM's tags.
+	Tag string
+	// Appliance is the name or UUID of the VM's appliance.
+	Appliance string
+	// Host is the name or UUID of the host the VM runs on or, for a VM
+	// that is not running, the host it has affinity for.
+	Host string
+}
+
+// VM is a VM a Selector picked.
+type VM struct {
+	Ref        xenapi.VMRef
+	Name       string
+	PowerState xenapi.VMPowerState
+}
+
+// Select returns the VMs sel picks, sorted by name.
+func Select(session *xenapi.Session, sel Selector) ([]VM, error) {
+	if _, err := path.Match(sel.Name, ""); err != nil {
+		return nil, fmt.Errorf("name pattern %q: %w", sel.Name, err)
+	}
+	vms, err := xenapi.VM.GetAllRecords(session)
+	if err != nil {
+		return nil, xsutil.Decode(err)
+	}
+	appliances := map[xenapi.VMApplianceRef]bool{}
+	if sel.Appliance != "" {
+		records, err := xenapi.VMAppliance.GetAllRecords(session)
+		if err != nil {
+			return nil, xsutil.Decode(err)
+		}
+		for ref, appliance := range records {
+			appliances[ref] = appliance.NameLabel == sel.Appliance || appliance.UUID == sel.Appliance
+		}
+	}
+	hosts := map[xenapi.HostRef]bool{}
+	if sel.Host != "" {
+		records, err := xenapi.Host.GetAllRecords(session)
+		if err != nil {
+			return nil, xsutil.Decode(err)
+		}
+		for ref, host := range records {
+			hosts[ref] = host.NameLabel == sel.Host || host.UUID == sel.Host
+		}
+	}
+
+	var picked []VM
+	for ref, vm := range vms {
+		if vm.IsATemplate || vm.IsASnapshot || vm.IsControlDomain {
+			continue
+		}
+		if sel.Name != "" {
+			if ok, _ := path.Match(sel.Name, vm.NameLabel); !ok {
+				continue
+			}
+		}
+		if sel.Tag != "" && !slices.Contains(vm.Tags, sel.Tag) {
+			continue
+		}
+		if sel.Appliance != "" && !appliances[vm.Appliance] {
+			continue
+		}
+		host := vm.ResidentOn
+		if vm.PowerState != xenapi.VMPowerStateRunning && vm.PowerState != xenapi.VMPowerStatePaused {
+			host = vm.Affinity
+		}
+		if sel.Host != "" && !hosts[host] {
+			continue
+		}
+		picked = append(picked, VM{Ref: ref, Name: vm.NameLabel, PowerState: vm.PowerState})
+	}
+	sort.Slice(picked, func(i, j int) bool {
+		if picked[i].Name != picked[j].Name {
+			return picked[i].Name < picked[j].Name
+		}
+		return picked[i].Ref < picked[j].Ref
+	})
+	return picked, nil
+}
+
+// DefaultParallel is how many VMs Run handles at once unless told
+// otherwise.
+const DefaultParallel = 4
+
+// Options adjust Run.
+type Options struct {
+	// Parallel bounds how many operations run at once; it is
+	// DefaultParallel if 0.
+	Parallel int
+	// Timeout bounds each VM's operation; there is no bound if 0.
+	Timeout time.Duration
+	// Done, if set, is called with each VM's result as it comes in. It
+	// is called from one goroutine at a time.
+	Done func(Result)
+}
+
+// Result is what became of one VM.
+type Result struct {
+	// VM has the power state the VM was in before the operation.
+	VM VM
+	// Skipped is set when the VM was already in the state the operation
+	// leaves it in, and nothing was done.
+	Skipped bool
+	// Err is why the operation failed, or nil.
+	Err      error
+	Duration time.Duration
+}
+
+// Run carries out op on every VM, at most opts.Parallel at a time, and
+// returns their results in the order of vms. A VM whose operation fails
+// does not stop the others. If ctx ends, the tasks still running are
+// cancelled and destroyed, and VMs not yet started fail with ctx's error.
+func Run(ctx context.Context, session *xenapi.Session, op Op, vms []VM, opts Options) []Result {
+	parallel := opts.Parallel
+	if parallel <= 0 {
+		parallel = DefaultParallel
+	}
+	results := make([]Result, len(vms))
+	jobs := make(chan int)
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for w := 0; w < parallel && w < len(vms); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				result := runOne(ctx, session, op, vms[i], opts.Timeout)
+				mu.Lock()
+				results[i] = result
+				if opts.Done != nil {
+					opts.Done(result)
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	for i := range vms {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+	return results
+}
+
+func runOne(ctx context.Context, session *xenapi.Session, op Op, vm VM, timeout time.Duration) (result Result) {
+	result.VM = vm
+	if err := ctx.Err(); err != nil {
+		result.Err = err
+		return result
+	}
+	start := time.Now()
+	defer func() { result.Duration = time.Since(start) }()
+	state, err := xenapi.VM.GetPowerState(session, vm.Ref)
+	if err != nil {
+		result.Err = xsutil.Decode(err)
+		return result
+	}
+	result.VM.PowerState = state
+	if state == op.done() {
+		result.Skipped = true
+		return result
+	}
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	task, err := op.async(session, vm.Ref)
+	if err != nil {
+		result.Err = xsutil.Decode(err)
+		return result
+	}
+	_, result.Err = xsutil.WaitForTask(ctx, session, task)
+	if ctx.Err() != nil {
+		xenapi.Task.Cancel(session, task)
+		xenapi.Task.Destroy(session, task)
+		result.Err = ctx.Err()
+		return result
+	}
+	xenapi.Task.Destroy(session, task)
+	return result
+}
+
+// Summary counts results by outcome.
+type Summary struct {
+	Succeeded, Skipped, Failed int
+}
+
+// Summarize counts the results and joins the errors of the failed ones,
+// each naming its VM, or returns nil if none failed.
+func Summarize(results []Result) (Summary, error) {
+	var s Summary
+	var errs []error
+	for _, r := range results {
+		switch {
+		case r.Err != nil:
+			s.Failed++
+			errs = append(errs, fmt.Errorf("VM %q: %w", r.VM.Name, r.Err))
+		case r.Skipped:
+			s.Skipped++
+		default:
+			s.Succeeded++
+		}
+	}
+	return s, errors.Join(errs...)
+}
@@ -0,0 +1,182 @@
+package power
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+	"time"
+
+	"xenapi"
+
+	"github.com/xenserver/xenserver-samples/go/fakexapi"
+	"github.com/xenserver/xenserver-samples/go/xsutil"
+)
+
+// cloneVMs clones the fake's Linux VM under each name.
+func cloneVMs(t *testing.T, session *xenapi.Session, names ...string) map[string]xenapi.VMRef {
+	linux, err := xenapi.VM.GetByNameLabel(session, fakexapi.LinuxVM)
+	if err != nil || len(linux) == 0 {
+		t.Fatal("VM not found:", err)
+	}
+	vms := map[string]xenapi.VMRef{}
+	for _, name := range names {
+		if vms[name], err = xenapi.VM.Clone(session, linux[0], name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return vms
+}
+
+func names(vms []VM) []string {
+	var picked []string
+	for _, vm := range vms {
+		picked = append(picked, vm.Name)
+	}
+	return picked
+}
+
+func TestSelect(t *testing.T) {
+	server := fakexapi.Start(t)
+	session := server.Login(t)
+	vms := cloneVMs(t, session, "web-1", "web-2", "db-1")
+	if err := xenapi.VM.AddTags(session, vms["web-2"], "frontend"); err != nil {
+		t.Fatal(err)
+	}
+	if err := xenapi.VM.AddTags(session, vms["db-1"], "frontend"); err != nil {
+		t.Fatal(err)
+	}
+	server.Do(func(st *fakexapi.Store) {
+		appliance := st.Create("VM_appliance", fakexapi.Record{"name_label": "shop", "VMs": []string{}})
+		st.Update("VM", string(vms["web-1"]), fakexapi.Record{"appliance": appliance})
+		st.Update("VM", string(vms["db-1"]), fakexapi.Record{"appliance": appliance})
+	})
+	if err := xenapi.VM.Start(session, vms["db-1"], false, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := xenapi.VM.SetAffinity(session, vms["web-2"], xenapi.HostRef(server.Host())); err != nil {
+		t.Fatal(err)
+	}
+	hostName, err := xenapi.Host.GetNameLabel(session, xenapi.HostRef(server.Host()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		sel  Selector
+		want []string
+	}{
+		{Selector{Name: "web-*"}, []string{"web-1", "web-2"}},
+		{Selector{Tag: "frontend"}, []string{"db-1", "web-2"}},
+		{Selector{Appliance: "shop"}, []string{"db-1", "web-1"}},
+		{Selector{Appliance: "shop", Tag: "frontend"}, []string{"db-1"}},
+		{Selector{Host: hostName}, []string{"db-1", "web-2"}},
+		{Selector{Name: "nothing-*"}, nil},
+		{Selector{}, []string{fakexapi.LinuxVM, "db-1", "web-1", "web-2"}},
+	} {
+		picked, err := Select(session, c.sel)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := names(picked); !slices.Equal(got, c.want) {
+			t.Errorf("Select(%+v) = %v, want %v", c.sel, got, c.want)
+		}
+	}
+	if _, err := Select(session, Selector{Name: "["}); err == nil {
+		t.Log("Expected a bad pattern to be refused")
+		t.Fail()
+	}
+}
+
+func TestRun(t *testing.T) {
+	server := fakexapi.Start(t)
+	session := server.Login(t)
+	server.TaskDelay = 50 * time.Millisecond
+	vms := cloneVMs(t, session, "vm-1", "vm-2", "vm-3", "vm-4", "vm-5", "vm-6")
+	if err := xenapi.VM.Start(session, vms["vm-6"], false, false); err != nil {
+		t.Fatal(err)
+	}
+	picked, err := Select(session, Selector{Name: "vm-*"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var done []string
+	start := time.Now()
+	results := Run(context.Background(), session, OpStart, picked, Options{
+		Parallel: 2,
+		Done:     func(r Result) { done = append(done, r.VM.Name) },
+	})
+	// Five tasks, two at a time, take at least three task delays.
+	if elapsed := time.Since(start); elapsed < 3*server.TaskDelay {
+		t.Log("Expected at most two VMs to start at once, took", elapsed)
+		t.Fail()
+	}
+	if len(done) != 6 {
+		t.Log("Expected a result for every VM as it came in, got:", done)
+		t.Fail()
+	}
+	summary, err := Summarize(results)
+	if err != nil || summary != (Summary{Succeeded: 5, Skipped: 1}) {
+		t.Fatal("Expected five started and one skipped, got:", summary, err)
+	}
+	if results[5].VM.Name != "vm-6" || !results[5].Skipped {
+		t.Log("Expected the running VM to be skipped, got:", results[5])
+		t.Fail()
+	}
+	for name, vm := range vms {
+		state, err := xenapi.VM.GetPowerState(session, vm)
+		if err != nil || state != xenapi.VMPowerStateRunning {
+			t.Log("Expected", name, "to be running:", state, err)
+			t.Fail()
+		}
+	}
+
+	// Resuming skips the VMs that are already running.
+	if err := xenapi.VM.Suspend(session, vms["vm-1"]); err != nil {
+		t.Fatal(err)
+	}
+	results = Run(context.Background(), session, OpResume, picked[:3], Options{})
+	summary, err = Summarize(results)
+	if summary != (Summary{Succeeded: 1, Skipped: 2}) || err != nil {
+		t.Fatal("Expected one resumed and two skipped, got:", summary, err)
+	}
+	results = Run(context.Background(), session, OpSuspend, picked[:2], Options{})
+	if summary, _ := Summarize(results); summary.Succeeded != 2 {
+		t.Fatal("Expected two suspended, got:", summary)
+	}
+	// Suspended VMs cannot shut down cleanly, which does not stop the
+	// running one.
+	results = Run(context.Background(), session, OpCleanShutdown, picked[:3], Options{})
+	summary, err = Summarize(results)
+	if summary != (Summary{Succeeded: 1, Failed: 2}) || !errors.Is(err, xsutil.ErrBadPowerState) {
+		t.Fatal("Expected the suspended VMs to fail to shut down cleanly, got:", summary, err)
+	}
+	if results[2].Err != nil {
+		t.Log("Expected the running VM to shut down:", results[2].Err)
+		t.Fail()
+	}
+}
+
+func TestRunContext(t *testing.T) {
+	server := fakexapi.Start(t)
+	session := server.Login(t)
+	server.TaskDelay = time.Hour
+	vms := cloneVMs(t, session, "slow-1", "slow-2")
+	picked, err := Select(session, Selector{Name: "slow-*"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	results := Run(context.Background(), session, OpStart, picked, Options{Parallel: 1, Timeout: 50 * time.Millisecond})
+	for _, r := range results {
+		if !errors.Is(r.Err, context.DeadlineExceeded) {
+			t.Log("Expected", r.VM.Name, "to time out, got:", r.Err)
+			t.Fail()
+		}
+	}
+	state, err := xenapi.VM.GetPowerState(session, vms["slow-1"])
+	if err != nil || state != xenapi.VMPowerStateHalted {
+		t.Log("Expected the VM to stay halted:", state, err)
+		t.Fail()
+	}
+}
@@ -0,0 +1,200 @@
+package testGoSDK
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+
+	"xenapi"
+
+	"github.com/xenserver/xenserver-samples/go/xsutil"
+)
+
+// Need is something a test requires of the pool or the config. Tests
+// declare their needs with Require, which skips them when one is not met.
+type Need struct {
+	// What describes the need in skip messages, e.g. "an NFS server".
+	What string
+	// probe returns why the need is not met, or "" if it is. It returns an
+	// error only when it cannot tell, such as when the pool cannot be
+	// reached.
+	probe func() (string, error)
+}
+
+var (
+	probeMu sync.Mutex
+	probed  = make(map[string]string)
+)
+
+// Require skips the test unless every need is met, and fails it if a need
+// cannot be probed. Each need is probed only once per run; later tests
+// reuse the answer.
+func Require(t testing.TB, needs ...Need) {
+	t.Helper()
+	for _, need := range needs {
+		reason, err := check(need)
+		if err != nil {
+			t.Fatalf("cannot tell whether there is %s: %v", need.What, err)
+		}
+		if reason != "" {
+			t.Skipf("skipping: needs %s, but %s", need.What, reason)
+		}
+	}
+}
+
+func check(need Need) (string, error) {
+	probeMu.Lock()
+	defer probeMu.Unlock()
+	if reason, ok := probed[need.What]; ok {
+		return reason, nil
+	}
+	reason, err := need.probe()
+	if err != nil {
+		// Not remembered: the next test may find the pool reachable.
+		return "", err
+	}
+	probed[need.What] = reason
+	return reason, nil
+}
+
+// needsSession wraps a probe of the pool so that it fails until TestLogin
+// has succeeded.
+func needsSession(probe func() (string, error)) func() (string, error) {
+	return func() (string, error) {
+		if session == nil {
+			return "", fmt.Errorf("not logged in")
+		}
+		return probe()
+	}
+}
+
+// missing returns reason if err says a lookup found nothing, and err
+// itself if the lookup failed.
+func missing(err error, reason string) (string, error) {
+	var nothing notFound
+	if errors.As(err, &nothing) {
+		return reason, nil
+	}
+	return "", err
+}
+
+// NeedSupporter is a second host, configured as the supporter target, to
+// join to the pool.
+var NeedSupporter = Need{
+	What: "a supporter host",
+	probe: func() (string, error) {
+		supporter := GetTarget(SUPPORTER_TARGET)
+		if supporter == nil || supporter.Host == "" || supporter.Username == "" || supporter.Password == "" {
+			return "the supporter target's host, username or password is not configured", nil
+		}
+		return "", nil
+	},
+}
+
+// NeedNFS is an NFS server, configured as the nfs target.
+var NeedNFS = Need{
+	What: "an NFS server",
+	probe: func() (string, error) {
+		nfs := GetTarget(NFS_TARGET)
+		if nfs == nil || nfs.Host == "" || nfs.Path == "" {
+			return "the nfs target's host or path is not configured", nil
+		}
+		return "", nil
+	},
+}
+
+// NeedCACert is the CA certificate of the primary target.
+var NeedCACert = Need{
+	What: "the primary's CA certificate",
+	probe: func() (string, error) {
+		primary := GetTarget(PRIMARY_TARGET)
+		if primary == nil || primary.CACertPath == "" {
+			return "the primary target's ca_cert_path is not configured", nil
+		}
+		return "", nil
+	},
+}
+
+// NeedHaltedVM is a halted Linux VM, as FindHaltedLinuxVM returns.
+var NeedHaltedVM = Need{
+	What: "a halted Linux VM",
+	probe: needsSession(func() (string, error) {
+		if _, err := FindHaltedLinuxVM(); err != nil {
+			return missing(err, "the pool has no halted Linux VM")
+		}
+		return "", nil
+	}),
+}
+
+// NeedHaltedVMWithTools is a halted Linux VM whose guest tools have
+// reported in, as FindHaltedLinuxVM returns.
+var NeedHaltedVMWithTools = Need{
+	What: "a halted Linux VM with guest tools",
+	probe: needsSession(func() (string, error) {
+		vmRef, err := FindHaltedLinuxVM()
+		if err != nil {
+			return missing(err, "the pool has no halted Linux VM")
+		}
+		c, err := objectCache()
+		if err != nil {
+			return "", err
+		}
+		if !hasTools(c, vmRef) {
+			return "no halted Linux VM has reported guest tools", nil
+		}
+		return "", nil
+	}),
+}
+
+// NeedVDICreateSR is an SR, as GetStorage returns, whose driver can
+// create VDIs.
+var NeedVDICreateSR = Need{
+	What: "an SR that can create VDIs",
+	probe: needsSession(func() (string, error) {
+		srRef, err := GetStorage()
+		if err != nil {
+			return missing(err, "the pool has no usable SR")
+		}
+		c, err := objectCache()
+		if err != nil {
+			return "", err
+		}
+		sr, _ := xsutil.Record[xenapi.SRRef, xenapi.SRRecord](c, "sr", srRef)
+		if !canCreateVdi(c, sr.Type) {
+			return fmt.Sprintf("the %s SR %q does not support VDI_CREATE", sr.Type, sr.NameLabel), nil
+		}
+		return "", nil
+	}),
+}
+
+// NeedSecondVDICreateSR is an SR, besides the one GetStorage returns,
+// whose driver can create VDIs, as GetOtherStorage returns.
+var NeedSecondVDICreateSR = Need{
+	What: "a second SR that can create VDIs",
+	probe: needsSession(func() (string, error) {
+		srRef, err := GetStorage()
+		if err != nil {
+			return missing(err, "the pool has no usable SR")
+		}
+		if _, err := GetOtherStorage(srRef); err != nil {
+			return missing(err, "the pool has only one SR that can create VDIs")
+		}
+		return "", nil
+	}),
+}
+
+// NeedFeature is a pool whose API version has the given feature.
+func NeedFeature(feature xsutil.Feature) Need {
+	return Need{
+		What: string(feature),
+		probe: needsSession(func() (string, error) {
+			var unsupported *xsutil.UnsupportedFeatureError
+			err := xsutil.CheckFeature(session, feature)
+			if errors.As(err, &unsupported) {
+				return fmt.Sprintf("the pool speaks API version %s, not %s or later", unsupported.Actual, unsupported.Required), nil
+			}
+			return "", err
+		}),
+	}
+}
@@ -0,0 +1,553 @@
+package provision
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+
+	"xenapi"
+
+	"github.com/xenserver/xenserver-samples/go/xsutil"
+)
+
+// Result reports what Apply did. Changes is empty when the VM already
+// matched the spec.
+type Result struct {
+	VM      xenapi.VMRef
+	Created bool
+	Changes []string
+}
+
+func (r *Result) changed(format string, args ...interface{}) {
+	r.Changes = append(r.Changes, fmt.Sprintf(format, args...))
+}
+
+// Apply makes the VM named in spec match it, cloning and provisioning the
+// template if no such VM exists yet. Applying the same spec again changes
+// nothing. Settings that can only change while the VM is halted make Apply
+// fail if it is running; disks are grown but never shrunk, moved or
+// removed. The result lists the changes made, even when Apply fails part
+// way through.
+func Apply(session *xenapi.Session, spec *Spec) (*Result, error) {
+	if err := spec.Validate(); err != nil {
+		return nil, err
+	}
+	result := &Result{}
+	vm, err := findVM(session, spec.Name)
+	if err != nil {
+		return result, err
+	}
+	if vm == "" {
+		vm, err = create(session, spec, result)
+		if err != nil {
+			return result, err
+		}
+	}
+	result.VM = vm
+
+	a := &applier{session: session, spec: spec, vm: vm, result: result}
+	for _, step := range []func() error{a.description, a.memory, a.vcpus, a.disks, a.networks, a.cd} {
+		if err := step(); err != nil {
+			return result, xsutil.Decode(err)
+		}
+	}
+	return result, nil
+}
+
+func findVM(session *xenapi.Session, name string) (xenapi.VMRef, error) {
+	refs, err := xenapi.VM.GetByNameLabel(session, name)
+	if err != nil {
+		return "", err
+	}
+	var found []xenapi.VMRef
+	for _, ref := range refs {
+		record, err := xenapi.VM.GetRecord(session, ref)
+		if err != nil {
+			return "", err
+		}
+		if !record.IsATemplate && !record.IsASnapshot && !record.IsControlDomain {
+			found = append(found, ref)
+		}
+	}
+	if len(found) > 1 {
+		return "", fmt.Errorf("%d VMs are named %q", len(found), name)
+	}
+	if len(found) == 0 {
+		return "", nil
+	}
+	return found[0], nil
+}
+
+func findTemplate(session *xenapi.Session, name string) (xenapi.VMRef, error) {
+	refs, err := xenapi.VM.GetByNameLabel(session, name)
+	if err != nil {
+		return "", err
+	}
+	for _, ref := range refs {
+		isTemplate, err := xenapi.VM.GetIsATemplate(session, ref)
+		if err != nil {
+			return "", err
+		}
+		if isTemplate {
+			return ref, nil
+		}
+	}
+	return "", fmt.Errorf("no template named %q", name)
+}
+
+// create clones the template and provisions it. When the spec lists its
+// own disks they replace the template's provisioning document, so that
+// VM.provision creates them. A clone that fails to provision is removed
+// with its disks: it is still a template, which findVM skips, so a retry
+// would otherwise leave another template named after the VM.
+func create(session *xenapi.Session, spec *Spec, result *Result) (xenapi.VMRef, error) {
+	template, err := findTemplate(session, spec.Template)
+	if err != nil {
+		return "", err
+	}
+	vm, err := xenapi.VM.Clone(session, template, spec.Name)
+	if err != nil {
+		return "", xsutil.Decode(err)
+	}
+	if err := provisionClone(session, spec, vm); err != nil {
+		tracker := xsutil.NewTracker(session)
+		tracker.VM(vm)
+		cleanupErr := errors.Join(tracker.VMDisks(vm), tracker.Cleanup())
+		if cleanupErr != nil {
+			result.VM = vm
+			result.changed("cloned VM %q from template %q", spec.Name, spec.Template)
+			return vm, errors.Join(err, fmt.Errorf("cannot remove the clone: %w", xsutil.Decode(cleanupErr)))
+		}
+		return "", err
+	}
+	result.VM = vm
+	result.Created = true
+	result.changed("cloned VM %q from template %q", spec.Name, spec.Template)
+	result.changed("provisioned VM %q", spec.Name)
+	return vm, nil
+}
+
+func provisionClone(session *xenapi.Session, spec *Spec, vm xenapi.VMRef) error {
+	if len(spec.Disks) > 0 {
+		disks := &Disks{}
+		for _, disk := range spec.Disks {
+			templateDisk, err := provisionDisk(session, disk)
+			if err != nil {
+				return err
+			}
+			if err := disks.Add(templateDisk); err != nil {
+				return err
+			}
+		}
+		if err := SetDisks(session, vm, disks); err != nil {
+			return xsutil.Decode(err)
+		}
+	}
+	return xsutil.Decode(xenapi.VM.Provision(session, vm))
+}
+
+// provisionDisk turns a spec disk into an entry of a provisioning
+// document, which names its SR by uuid.
+func provisionDisk(session *xenapi.Session, disk Disk) (TemplateDisk, error) {
+	sr, err := resolveSR(session, disk.SR)
+	if err != nil {
+		return TemplateDisk{}, err
+	}
+	srUUID, err := xenapi.SR.GetUUID(session, sr)
+	if err != nil {
+		return TemplateDisk{}, xsutil.Decode(err)
+	}
+	diskType := "user"
+	if disk.Bootable {
+		diskType = "system"
+	}
+	return TemplateDisk{Device: disk.Device, Size: disk.Size, SR: srUUID, Bootable: disk.Bootable, Type: diskType}, nil
+}
+
+type applier struct {
+	session *xenapi.Session
+	spec    *Spec
+	vm      xenapi.VMRef
+	result  *Result
+}
+
+func (a *applier) record() (xenapi.VMRecord, error) {
+	return xenapi.VM.GetRecord(a.session, a.vm)
+}
+
+// requireHalted fails unless the VM is halted, naming the change that
+// could not be made.
+func (a *applier) requireHalted(record xenapi.VMRecord, change string) error {
+	if record.PowerState != xenapi.VMPowerStateHalted {
+		return fmt.Errorf("cannot %s while VM %q is %s", change, a.spec.Name, record.PowerState)
+	}
+	return nil
+}
+
+func (a *applier) description() error {
+	if a.spec.Description == "" {
+		return nil
+	}
+	record, err := a.record()
+	if err != nil || record.NameDescription == a.spec.Description {
+		return err
+	}
+	err = xenapi.VM.SetNameDescription(a.session, a.vm, a.spec.Description)
+	if err == nil {
+		a.result.changed("set description to %q", a.spec.Description)
+	}
+	return err
+}
+
+func (a *applier) memory() error {
+	size := int(a.spec.MemorySize)
+	if size == 0 {
+		return nil
+	}
+	record, err := a.record()
+	if err != nil {
+		return err
+	}
+	if record.MemoryStaticMax == size && record.MemoryDynamicMax == size && record.MemoryDynamicMin == size {
+		return nil
+	}
+	if err := a.requireHalted(record, "change memory"); err != nil {
+		return err
+	}
+	staticMin := record.MemoryStaticMin
+	if staticMin > size {
+		staticMin = size
+	}
+	err = xenapi.VM.SetMemoryLimits(a.session, a.vm, staticMin, size, size, size)
+	if err == nil {
+		a.result.changed("set memory to %s", a.spec.MemorySize)
+	}
+	return err
+}
+
+func (a *applier) vcpus() error {
+	n := a.spec.VCPUs
+	if n == 0 {
+		return nil
+	}
+	record, err := a.record()
+	if err != nil {
+		return err
+	}
+	if record.VCPUsMax == n && record.VCPUsAtStartup == n {
+		return nil
+	}
+	if err := a.requireHalted(record, "change vCPUs"); err != nil {
+		return err
+	}
+	// VCPUs_at_startup may never exceed VCPUs_max, so the order matters.
+	if n > record.VCPUsMax {
+		err = xenapi.VM.SetVCPUsMax(a.session, a.vm, n)
+		if err == nil {
+			err = xenapi.VM.SetVCPUsAtStartup(a.session, a.vm, n)
+		}
+	} else {
+		err = xenapi.VM.SetVCPUsAtStartup(a.session, a.vm, n)
+		if err == nil {
+			err = xenapi.VM.SetVCPUsMax(a.session, a.vm, n)
+		}
+	}
+	if err == nil {
+		a.result.changed("set vCPUs to %d", n)
+	}
+	return err
+}
+
+// vbds maps userdevice to VBD for the VM's VBDs of the given type.
+func (a *applier) vbds(vbdType xenapi.VbdType) (map[string]xenapi.VBDRef, map[string]xenapi.VBDRecord, error) {
+	record, err := a.record()
+	if err != nil {
+		return nil, nil, err
+	}
+	refs := make(map[string]xenapi.VBDRef)
+	records := make(map[string]xenapi.VBDRecord)
+	for _, ref := range record.VBDs {
+		vbd, err := xenapi.VBD.GetRecord(a.session, ref)
+		if err != nil {
+			return nil, nil, err
+		}
+		if vbd.Type == vbdType {
+			refs[vbd.Userdevice] = ref
+			records[vbd.Userdevice] = vbd
+		}
+	}
+	return refs, records, nil
+}
+
+func (a *applier) disks() error {
+	if len(a.spec.Disks) == 0 {
+		return nil
+	}
+	_, existing, err := a.vbds(xenapi.VbdTypeDisk)
+	if err != nil {
+		return err
+	}
+	for _, disk := range a.spec.Disks {
+		vbd, ok := existing[disk.Device]
+		if !ok {
+			if err := a.createDisk(disk); err != nil {
+				return err
+			}
+			continue
+		}
+		vdi, err := xenapi.VDI.GetRecord(a.session, vbd.VDI)
+		if err != nil {
+			return err
+		}
+		if vdi.VirtualSize >= int(disk.Size) {
+			continue
+		}
+		record, err := a.record()
+		if err != nil {
+			return err
+		}
+		if err := a.requireHalted(record, "resize disk "+disk.Device); err != nil {
+			return err
+		}
+		if err := xenapi.VDI.Resize(a.session, vbd.VDI, int(disk.Size)); err != nil {
+			return err
+		}
+		a.result.changed("resized disk %s to %s", disk.Device, disk.Size)
+	}
+	return nil
+}
+
+func (a *applier) createDisk(disk Disk) error {
+	sr, err := resolveSR(a.session, disk.SR)
+	if err != nil {
+		return err
+	}
+	name := disk.Name
+	if name == "" {
+		name = fmt.Sprintf("%s %s", a.spec.Name, disk.Device)
+	}
+	vdiType := xenapi.VdiTypeUser
+	if disk.Bootable {
+		vdiType = xenapi.VdiTypeSystem
+	}
+	vdi, err := xenapi.VDI.Create(a.session, xenapi.VDIRecord{
+		NameLabel:   name,
+		SR:          sr,
+		VirtualSize: int(disk.Size),
+		Type:        vdiType,
+		OtherConfig: map[string]string{},
+	})
+	if err != nil {
+		return err
+	}
+	_, err = xenapi.VBD.Create(a.session, xenapi.VBDRecord{
+		VM:                 a.vm,
+		VDI:                vdi,
+		Userdevice:         disk.Device,
+		Bootable:           disk.Bootable,
+		Mode:               xenapi.VbdModeRW,
+		Type:               xenapi.VbdTypeDisk,
+		QosAlgorithmParams: map[string]string{},
+		OtherConfig:        map[string]string{},
+	})
+	if err != nil {
+		return err
+	}
+	a.result.changed("created %s disk %s", disk.Size, disk.Device)
+	return nil
+}
+
+func (a *applier) networks() error {
+	if len(a.spec.Networks) == 0 {
+		return nil
+	}
+	record, err := a.record()
+	if err != nil {
+		return err
+	}
+	existing := make(map[string]xenapi.VIFRef)
+	vifs := make(map[string]xenapi.VIFRecord)
+	for _, ref := range record.VIFs {
+		vif, err := xenapi.VIF.GetRecord(a.session, ref)
+		if err != nil {
+			return err
+		}
+		existing[vif.Device] = ref
+		vifs[vif.Device] = vif
+	}
+	wanted := make(map[string]bool)
+	for _, nic := range a.spec.Networks {
+		wanted[nic.Device] = true
+		network, err := resolveNetwork(a.session, nic.Network)
+		if err != nil {
+			return err
+		}
+		vif, ok := existing[nic.Device]
+		if ok && vifs[nic.Device].Network == network && vifs[nic.Device].MTU == nic.MTU {
+			continue
+		}
+		if err := a.requireHalted(record, "change VIF "+nic.Device); err != nil {
+			return err
+		}
+		if ok {
+			if err := xenapi.VIF.Destroy(a.session, vif); err != nil {
+				return err
+			}
+		}
+		_, err = xenapi.VIF.Create(a.session, xenapi.VIFRecord{
+			VM:                 a.vm,
+			Network:            network,
+			Device:             nic.Device,
+			MTU:                nic.MTU,
+			LockingMode:        xenapi.VifLockingModeNetworkDefault,
+			QosAlgorithmParams: map[string]string{},
+			OtherConfig:        map[string]string{},
+		})
+		if err != nil {
+			return err
+		}
+		a.result.changed("connected VIF %s to network %q with MTU %d", nic.Device, nic.Network, nic.MTU)
+	}
+	var extra []string
+	for device := range existing {
+		if !wanted[device] {
+			extra = append(extra, device)
+		}
+	}
+	sort.Strings(extra)
+	for _, device := range extra {
+		if err := a.requireHalted(record, "remove VIF "+device); err != nil {
+			return err
+		}
+		if err := xenapi.VIF.Destroy(a.session, existing[device]); err != nil {
+			return err
+		}
+		a.result.changed("removed VIF %s", device)
+	}
+	return nil
+}
+
+func (a *applier) cd() error {
+	if a.spec.CD == nil {
+		return nil
+	}
+	refs, existing, err := a.vbds(xenapi.VbdTypeCD)
+	if err != nil {
+		return err
+	}
+	var iso xenapi.VDIRef
+	if a.spec.CD.ISO != "" {
+		iso, err = resolveISO(a.session, a.spec.CD.ISO)
+		if err != nil {
+			return err
+		}
+	}
+	device := a.spec.CD.Device
+	vbd, ok := existing[device]
+	if !ok {
+		record := xenapi.VBDRecord{
+			VM:                 a.vm,
+			VDI:                iso,
+			Userdevice:         device,
+			Mode:               xenapi.VbdModeRO,
+			Type:               xenapi.VbdTypeCD,
+			Empty:              iso == "",
+			QosAlgorithmParams: map[string]string{},
+			OtherConfig:        map[string]string{},
+		}
+		if iso == "" {
+			record.VDI = "OpaqueRef:NULL"
+		}
+		if _, err := xenapi.VBD.Create(a.session, record); err != nil {
+			return err
+		}
+		a.result.changed("created CD drive %s", device)
+		return nil
+	}
+	if (iso == "" && vbd.Empty) || (!vbd.Empty && vbd.VDI == iso) {
+		return nil
+	}
+	if !vbd.Empty {
+		if err := xenapi.VBD.Eject(a.session, refs[device]); err != nil {
+			return err
+		}
+		a.result.changed("ejected CD drive %s", device)
+	}
+	if iso != "" {
+		if err := xenapi.VBD.Insert(a.session, refs[device], iso); err != nil {
+			return err
+		}
+		a.result.changed("inserted %q into CD drive %s", a.spec.CD.ISO, device)
+	}
+	return nil
+}
+
+// resolveSR finds an SR by uuid or name label; "" means the pool's
+// default SR.
+func resolveSR(session *xenapi.Session, name string) (xenapi.SRRef, error) {
+	if name == "" {
+		pools, err := xenapi.Pool.GetAll(session)
+		if err != nil {
+			return "", err
+		}
+		if len(pools) == 0 {
+			return "", fmt.Errorf("no pool found")
+		}
+		sr, err := xenapi.Pool.GetDefaultSR(session, pools[0])
+		if err != nil {
+			return "", err
+		}
+		if sr == "" || sr == "OpaqueRef:NULL" {
+			return "", fmt.Errorf("the pool has no default SR")
+		}
+		return sr, nil
+	}
+	if sr, err := xenapi.SR.GetByUUID(session, name); err == nil {
+		return sr, nil
+	}
+	srs, err := xenapi.SR.GetByNameLabel(session, name)
+	if err != nil {
+		return "", err
+	}
+	if len(srs) != 1 {
+		return "", fmt.Errorf("found %d SRs named %q", len(srs), name)
+	}
+	return srs[0], nil
+}
+
+func resolveNetwork(session *xenapi.Session, name string) (xenapi.NetworkRef, error) {
+	if network, err := xenapi.Network.GetByUUID(session, name); err == nil {
+		return network, nil
+	}
+	networks, err := xenapi.Network.GetByNameLabel(session, name)
+	if err != nil {
+		return "", err
+	}
+	if len(networks) != 1 {
+		return "", fmt.Errorf("found %d networks named %q", len(networks), name)
+	}
+	return networks[0], nil
+}
+
+// resolveISO finds a VDI by name label among those on ISO SRs, so that a
+// disk that happens to share the name is not put in the CD drive.
+func resolveISO(session *xenapi.Session, name string) (xenapi.VDIRef, error) {
+	vdis, err := xenapi.VDI.GetByNameLabel(session, name)
+	if err != nil {
+		return "", err
+	}
+	for _, vdi := range vdis {
+		sr, err := xenapi.VDI.GetSR(session, vdi)
+		if err != nil {
+			return "", err
+		}
+		contentType, err := xenapi.SR.GetContentType(session, sr)
+		if err != nil {
+			return "", err
+		}
+		if contentType == "iso" {
+			return vdi, nil
+		}
+	}
+	return "", fmt.Errorf("no ISO named %q", name)
+}
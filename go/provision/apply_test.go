@@ -0,0 +1,188 @@
+package provision
+
+import (
+	"errors"
+	"testing"
+
+	"xenapi"
+
+	"github.com/xenserver/xenserver-samples/go/fakexapi"
+	"github.com/xenserver/xenserver-samples/go/xsutil"
+)
+
+func testSpec(t *testing.T) *Spec {
+	spec, err := ParseSpec([]byte(yamlSpec))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return spec
+}
+
+func TestApplyCreatesVM(t *testing.T) {
+	session := fakexapi.Start(t).Login(t)
+	result, err := Apply(session, testSpec(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.Created || len(result.Changes) == 0 {
+		t.Log("Expected a new VM, got:", result)
+		t.Fail()
+	}
+	record, err := xenapi.VM.GetRecord(session, result.VM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if record.IsATemplate || record.MemoryStaticMax != 4<<30 || record.VCPUsMax != 2 || record.VCPUsAtStartup != 2 {
+		t.Log("Unexpected VM:", record.IsATemplate, record.MemoryStaticMax, record.VCPUsMax)
+		t.Fail()
+	}
+	// Two disks and the template's CD drive, now holding the tools ISO.
+	if len(record.VBDs) != 3 || len(record.VIFs) != 1 {
+		t.Log("Unexpected devices:", len(record.VBDs), "VBDs,", len(record.VIFs), "VIFs")
+		t.Fail()
+	}
+	for _, ref := range record.VBDs {
+		vbd, err := xenapi.VBD.GetRecord(session, ref)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if vbd.Type == xenapi.VbdTypeCD && vbd.Empty {
+			t.Log("The ISO was not inserted")
+			t.Fail()
+		}
+		if vbd.Userdevice == "0" && !vbd.Bootable {
+			t.Log("Disk 0 should be bootable")
+			t.Fail()
+		}
+	}
+}
+
+func TestApplyIsIdempotent(t *testing.T) {
+	session := fakexapi.Start(t).Login(t)
+	first, err := Apply(session, testSpec(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := Apply(session, testSpec(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if second.Created || second.VM != first.VM || len(second.Changes) != 0 {
+		t.Log("Reapplying the spec changed something:", second.Changes)
+		t.Fail()
+	}
+}
+
+func TestApplyReconciles(t *testing.T) {
+	session := fakexapi.Start(t).Login(t)
+	spec := testSpec(t)
+	first, err := Apply(session, spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	spec.VCPUs = 1
+	spec.Disks[1].Size = 2 << 30
+	spec.CD.ISO = ""
+	spec.Networks[0].MTU = 9000
+	result, err := Apply(session, spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Changes) != 4 {
+		t.Log("Expected four changes, got:", result.Changes)
+		t.Fail()
+	}
+	record, err := xenapi.VM.GetRecord(session, first.VM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if record.VCPUsMax != 1 || record.VCPUsAtStartup != 1 {
+		t.Log("vCPUs were not reduced:", record.VCPUsMax, record.VCPUsAtStartup)
+		t.Fail()
+	}
+	if len(record.VIFs) != 1 {
+		t.Fatal("Expected one VIF, got", len(record.VIFs))
+	}
+	if mtu, _ := xenapi.VIF.GetMTU(session, record.VIFs[0]); mtu != 9000 {
+		t.Log("The VIF's MTU was not changed:", mtu)
+		t.Fail()
+	}
+}
+
+func TestApplyRemovesFailedClone(t *testing.T) {
+	session := fakexapi.Start(t).Login(t)
+	vdis, err := xenapi.VDI.GetAll(session)
+	if err != nil {
+		t.Fatal(err)
+	}
+	spec := testSpec(t)
+	spec.Disks[1].SR = "no such SR"
+	if _, err := Apply(session, spec); err == nil {
+		t.Fatal("Expected an unknown SR to fail")
+	}
+	if vms, _ := xenapi.VM.GetByNameLabel(session, spec.Name); len(vms) != 0 {
+		t.Log("Expected the clone to be removed, found", len(vms), "VMs")
+		t.Fail()
+	}
+	if after, _ := xenapi.VDI.GetAll(session); len(after) != len(vdis) {
+		t.Log("Expected the clone's disks to be removed, got", len(after)-len(vdis), "more VDIs")
+		t.Fail()
+	}
+
+	spec.Disks[1].SR = ""
+	if _, err := Apply(session, spec); err != nil {
+		t.Fatal(err)
+	}
+	if vms, _ := xenapi.VM.GetByNameLabel(session, spec.Name); len(vms) != 1 {
+		t.Log("Expected a single VM after the retry, found", len(vms))
+		t.Fail()
+	}
+}
+
+func TestApplyInsertsISOFromISOSR(t *testing.T) {
+	session := fakexapi.Start(t).Login(t)
+	spec := testSpec(t)
+	// Disks sharing the ISO's name, so that one of them most likely comes
+	// first when looking it up by name.
+	sr, err := resolveSR(session, "Local storage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 8; i++ {
+		_, err := xenapi.VDI.Create(session, xenapi.VDIRecord{NameLabel: spec.CD.ISO, SR: sr, VirtualSize: 1 << 20, Type: xenapi.VdiTypeUser, OtherConfig: map[string]string{}})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	iso, err := resolveISO(session, spec.CD.ISO)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := xenapi.VDI.GetSR(session, iso); got == sr {
+		t.Log("Expected the ISO, got a disk of the same name")
+		t.Fail()
+	}
+}
+
+func TestApplyRefusesRunningVM(t *testing.T) {
+	session := fakexapi.Start(t).Login(t)
+	spec := testSpec(t)
+	result, err := Apply(session, spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := xenapi.VM.Start(session, result.VM, false, false); err != nil {
+		t.Fatal(err)
+	}
+	spec.MemorySize = 8 << 30
+	_, err = Apply(session, spec)
+	if err == nil {
+		t.Log("Expected changing the memory of a running VM to fail")
+		t.Fail()
+	}
+	var failure *xsutil.Failure
+	if errors.As(err, &failure) {
+		t.Log("Expected the applier to refuse before calling the server, got:", failure)
+		t.Fail()
+	}
+}
@@ -0,0 +1,148 @@
+package provision
+
+import (
+	"encoding/xml"
+	"fmt"
+	"sort"
+	"strconv"
+
+	"xenapi"
+)
+
+// DisksKey is the other_config key under which a template lists the disks
+// VM.provision creates.
+const DisksKey = "disks"
+
+// Disks is the provisioning document of a template:
+//
+//	<provision><disk device="0" size="34359738368" sr="" bootable="true" type="system"/></provision>
+type Disks struct {
+	XMLName xml.Name       `xml:"provision"`
+	Disks   []TemplateDisk `xml:"disk"`
+}
+
+// TemplateDisk is one disk of a provisioning document. SR is the uuid of
+// the SR to create the disk on, or empty for the pool's default SR. Any
+// attributes not modelled here are kept in Other and written back.
+type TemplateDisk struct {
+	Device   string     `xml:"device,attr"`
+	Size     Size       `xml:"size,attr"`
+	SR       string     `xml:"sr,attr"`
+	Bootable bool       `xml:"bootable,attr"`
+	Type     string     `xml:"type,attr"`
+	Other    []xml.Attr `xml:",any,attr"`
+}
+
+func (s Size) MarshalXMLAttr(name xml.Name) (xml.Attr, error) {
+	return xml.Attr{Name: name, Value: strconv.FormatInt(int64(s), 10)}, nil
+}
+
+func (s *Size) UnmarshalXMLAttr(attr xml.Attr) error {
+	n, err := strconv.ParseInt(attr.Value, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid disk size %q", attr.Value)
+	}
+	*s = Size(n)
+	return nil
+}
+
+// ParseDisks decodes a provisioning document. An empty string is an empty
+// document.
+func ParseDisks(doc string) (*Disks, error) {
+	disks := &Disks{}
+	if doc == "" {
+		return disks, nil
+	}
+	if err := xml.Unmarshal([]byte(doc), disks); err != nil {
+		return nil, fmt.Errorf("cannot parse provisioning XML: %w", err)
+	}
+	return disks, nil
+}
+
+// String encodes the document in the form VM.provision expects.
+func (d *Disks) String() string {
+	data, err := xml.Marshal(d)
+	if err != nil {
+		// Only the types above are marshalled, and they always encode.
+		panic(err)
+	}
+	return string(data)
+}
+
+// Disk returns the disk with the given device, or nil.
+func (d *Disks) Disk(device string) *TemplateDisk {
+	for i := range d.Disks {
+		if d.Disks[i].Device == device {
+			return &d.Disks[i]
+		}
+	}
+	return nil
+}
+
+// Add appends a disk. If its device is empty the lowest unused device
+// number is chosen.
+func (d *Disks) Add(disk TemplateDisk) error {
+	if disk.Device == "" {
+		for n := 0; ; n++ {
+			if d.Disk(strconv.Itoa(n)) == nil {
+				disk.Device = strconv.Itoa(n)
+				break
+			}
+		}
+	}
+	if d.Disk(disk.Device) != nil {
+		return fmt.Errorf("device %s is already provisioned", disk.Device)
+	}
+	if disk.Type == "" {
+		disk.Type = "user"
+	}
+	d.Disks = append(d.Disks, disk)
+	sort.SliceStable(d.Disks, func(i, j int) bool { return deviceLess(d.Disks[i].Device, d.Disks[j].Device) })
+	return nil
+}
+
+// Remove drops the disk with the given device and reports whether there
+// was one.
+func (d *Disks) Remove(device string) bool {
+	for i := range d.Disks {
+		if d.Disks[i].Device == device {
+			d.Disks = append(d.Disks[:i], d.Disks[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// SetSR points every disk at the SR with the given uuid.
+func (d *Disks) SetSR(srUUID string) {
+	for i := range d.Disks {
+		d.Disks[i].SR = srUUID
+	}
+}
+
+func deviceLess(a, b string) bool {
+	na, errA := strconv.Atoi(a)
+	nb, errB := strconv.Atoi(b)
+	if errA == nil && errB == nil {
+		return na < nb
+	}
+	return a < b
+}
+
+// GetDisks reads the provisioning document of a template or fresh clone.
+func GetDisks(session *xenapi.Session, vm xenapi.VMRef) (*Disks, error) {
+	otherConfig, err := xenapi.VM.GetOtherConfig(session, vm)
+	if err != nil {
+		return nil, err
+	}
+	return ParseDisks(otherConfig[DisksKey])
+}
+
+// SetDisks stores the provisioning document for the next VM.provision.
+func SetDisks(session *xenapi.Session, vm xenapi.VMRef, disks *Disks) error {
+	err := xenapi.VM.RemoveFromOtherConfig(session, vm, DisksKey)
+	if err != nil {
+		return err
+	}
+	return xenapi.VM.AddToOtherConfig(session, vm, DisksKey, disks.String())
+}
@@ -0,0 +1,164 @@
+package provision
+
+import (
+	"strings"
+	"testing"
+
+	"xenapi"
+
+	"github.com/xenserver/xenserver-samples/go/fakexapi"
+)
+
+const templateDisks = `<provision>` +
+	`<disk device="0" size="34359738368" sr="" bootable="true" type="system" ionice="4"/>` +
+	`<disk device="1" size="1073741824" sr="9a7c1a14-7a8b-4c5d-8e1f-0d2a3b4c5d6e" bootable="false" type="user"/>` +
+	`</provision>`
+
+func TestParseDisks(t *testing.T) {
+	disks, err := ParseDisks(templateDisks)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(disks.Disks) != 2 {
+		t.Fatal("Expected 2 disks, got", len(disks.Disks))
+	}
+	root := disks.Disk("0")
+	if root == nil || root.Size != 32<<30 || !root.Bootable || root.Type != "system" || root.SR != "" {
+		t.Log("Unexpected root disk:", root)
+		t.Fail()
+	}
+	if data := disks.Disk("1"); data == nil || data.SR != "9a7c1a14-7a8b-4c5d-8e1f-0d2a3b4c5d6e" {
+		t.Log("Unexpected data disk:", data)
+		t.Fail()
+	}
+	if disks.Disk("2") != nil {
+		t.Log("Found a disk that does not exist")
+		t.Fail()
+	}
+
+	empty, err := ParseDisks("")
+	if err != nil || len(empty.Disks) != 0 {
+		t.Log("Expected an empty document, got:", empty, err)
+		t.Fail()
+	}
+	if _, err := ParseDisks(`<provision><disk device="0" size="big"/></provision>`); err == nil {
+		t.Log("Expected an invalid size to fail")
+		t.Fail()
+	}
+}
+
+func TestDisksEdit(t *testing.T) {
+	disks, err := ParseDisks(templateDisks)
+	if err != nil {
+		t.Fatal(err)
+	}
+	disks.SetSR("0f1e2d3c-4b5a-6978-8796-a5b4c3d2e1f0")
+	disks.Disk("0").Size = 64 << 30
+	if !disks.Remove("1") || disks.Remove("1") {
+		t.Log("Expected to remove device 1 exactly once")
+		t.Fail()
+	}
+	if err := disks.Add(TemplateDisk{Size: 8 << 30}); err != nil {
+		t.Fatal(err)
+	}
+	if err := disks.Add(TemplateDisk{Device: "0", Size: 1 << 30}); err == nil {
+		t.Log("Expected adding device 0 twice to fail")
+		t.Fail()
+	}
+	if err := disks.Add(TemplateDisk{Device: "10", Size: 1 << 30}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Reparsing the encoded document shows what VM.provision will see.
+	reparsed, err := ParseDisks(disks.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var devices []string
+	for _, disk := range reparsed.Disks {
+		devices = append(devices, disk.Device)
+	}
+	if strings.Join(devices, ",") != "0,1,10" {
+		t.Log("Unexpected devices:", devices)
+		t.Fail()
+	}
+	root, added := reparsed.Disk("0"), reparsed.Disk("1")
+	if root.Size != 64<<30 || root.SR != "0f1e2d3c-4b5a-6978-8796-a5b4c3d2e1f0" {
+		t.Log("Unexpected root disk:", root)
+		t.Fail()
+	}
+	if added.Size != 8<<30 || added.Type != "user" || added.Bootable {
+		t.Log("Unexpected added disk:", added)
+		t.Fail()
+	}
+	if !strings.Contains(disks.String(), `ionice="4"`) {
+		t.Log("Unknown attribute was dropped:", disks.String())
+		t.Fail()
+	}
+}
+
+func TestSetDisksProvision(t *testing.T) {
+	session := fakexapi.Start(t).Login(t)
+	template, err := findTemplate(session, fakexapi.LinuxTemplate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	vm, err := xenapi.VM.Clone(session, template, "provision disks test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srs, err := xenapi.SR.GetByNameLabel(session, "NFS virtual disk storage")
+	if err != nil || len(srs) != 1 {
+		t.Fatal("Cannot find the NFS SR:", err)
+	}
+	srUUID, err := xenapi.SR.GetUUID(session, srs[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	disks, err := GetDisks(session, vm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(disks.Disks) == 0 {
+		t.Fatal("The template has no disks")
+	}
+	if err := disks.Add(TemplateDisk{Size: 1 << 30}); err != nil {
+		t.Fatal(err)
+	}
+	disks.SetSR(srUUID)
+	if err := SetDisks(session, vm, disks); err != nil {
+		t.Fatal(err)
+	}
+	if err := xenapi.VM.Provision(session, vm); err != nil {
+		t.Fatal(err)
+	}
+
+	vbds, err := xenapi.VM.GetVBDs(session, vm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	created := 0
+	for _, ref := range vbds {
+		vbd, err := xenapi.VBD.GetRecord(session, ref)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if vbd.Type != xenapi.VbdTypeDisk {
+			continue
+		}
+		created++
+		sr, err := xenapi.VDI.GetSR(session, vbd.VDI)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if sr != srs[0] {
+			t.Log("Disk", vbd.Userdevice, "was not created on the NFS SR")
+			t.Fail()
+		}
+	}
+	if created != len(disks.Disks) {
+		t.Log("Expected", len(disks.Disks), "disks, got", created)
+		t.Fail()
+	}
+}
@@ -0,0 +1,196 @@
+// Package provision creates and reconciles VMs from a declarative
+// description instead of a sequence of clone, VIF, VBD and provision
+// calls.
+package provision
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Spec describes a VM. Fields left at their zero value are not managed:
+// an empty Disks list keeps the disks the template provisions, an empty
+// Networks list keeps the template's VIFs, and a zero MemorySize or VCPUs
+// keeps the template's setting.
+type Spec struct {
+	Name        string `yaml:"name" json:"name"`
+	Description string `yaml:"description,omitempty" json:"description,omitempty"`
+	// Template is the name label of the template new VMs are cloned from.
+	Template   string `yaml:"template" json:"template"`
+	MemorySize Size   `yaml:"memory,omitempty" json:"memory,omitempty"`
+	VCPUs      int    `yaml:"vcpus,omitempty" json:"vcpus,omitempty"`
+	Disks      []Disk `yaml:"disks,omitempty" json:"disks,omitempty"`
+	Networks   []NIC  `yaml:"networks,omitempty" json:"networks,omitempty"`
+	CD         *CD    `yaml:"cd,omitempty" json:"cd,omitempty"`
+}
+
+// Disk is a virtual disk. SR is the name label or uuid of the SR to create
+// it on, or empty for the pool's default SR. Device is the VBD userdevice
+// and defaults to the disk's position in the list.
+type Disk struct {
+	Name     string `yaml:"name,omitempty" json:"name,omitempty"`
+	SR       string `yaml:"sr,omitempty" json:"sr,omitempty"`
+	Size     Size   `yaml:"size" json:"size"`
+	Device   string `yaml:"device,omitempty" json:"device,omitempty"`
+	Bootable bool   `yaml:"bootable,omitempty" json:"bootable,omitempty"`
+}
+
+// NIC is a VIF on the network with the given name label or uuid. Device
+// defaults to the NIC's position in the list.
+type NIC struct {
+	Network string `yaml:"network" json:"network"`
+	Device  string `yaml:"device,omitempty" json:"device,omitempty"`
+	MTU     int    `yaml:"mtu,omitempty" json:"mtu,omitempty"`
+}
+
+// CD is a CD drive, with the named ISO inserted or empty if ISO is "".
+type CD struct {
+	ISO    string `yaml:"iso,omitempty" json:"iso,omitempty"`
+	Device string `yaml:"device,omitempty" json:"device,omitempty"`
+}
+
+// Size is a number of bytes. In a spec it may be written as a plain number
+// or with a binary unit suffix, e.g. "512MiB" or "20GiB".
+type Size int64
+
+var sizeUnits = []struct {
+	suffix string
+	scale  int64
+}{
+	{"TiB", 1 << 40}, {"GiB", 1 << 30}, {"MiB", 1 << 20}, {"KiB", 1 << 10}, {"B", 1},
+}
+
+// ParseSize parses a size written as in a spec.
+func ParseSize(s string) (Size, error) {
+	s = strings.TrimSpace(s)
+	scale := int64(1)
+	for _, unit := range sizeUnits {
+		if strings.HasSuffix(s, unit.suffix) {
+			s = strings.TrimSpace(strings.TrimSuffix(s, unit.suffix))
+			scale = unit.scale
+			break
+		}
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return Size(n * scale), nil
+}
+
+func (s Size) String() string {
+	for _, unit := range sizeUnits {
+		if int64(s) >= unit.scale && int64(s)%unit.scale == 0 {
+			return strconv.FormatInt(int64(s)/unit.scale, 10) + unit.suffix
+		}
+	}
+	return strconv.FormatInt(int64(s), 10)
+}
+
+func (s *Size) UnmarshalText(text []byte) error {
+	size, err := ParseSize(string(text))
+	if err != nil {
+		return err
+	}
+	*s = size
+	return nil
+}
+
+func (s Size) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// UnmarshalJSON accepts both numbers and strings with a unit.
+func (s *Size) UnmarshalJSON(data []byte) error {
+	var text string
+	if err := json.Unmarshal(data, &text); err != nil {
+		text = string(data)
+	}
+	return s.UnmarshalText([]byte(text))
+}
+
+// ParseSpec reads a spec written in YAML or JSON.
+func ParseSpec(data []byte) (*Spec, error) {
+	var spec Spec
+	if err := yaml.Unmarshal(data, &spec); err != nil {
+		return nil, err
+	}
+	if err := spec.Validate(); err != nil {
+		return nil, err
+	}
+	return &spec, nil
+}
+
+// LoadSpec reads a spec from a YAML or JSON file.
+func LoadSpec(path string) (*Spec, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	spec, err := ParseSpec(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return spec, nil
+}
+
+// Validate checks that the spec is complete and fills in default devices.
+func (spec *Spec) Validate() error {
+	if spec.Name == "" {
+		return fmt.Errorf("spec has no name")
+	}
+	if spec.Template == "" {
+		return fmt.Errorf("spec %q has no template", spec.Name)
+	}
+	devices := make(map[string]bool)
+	claim := func(device string) error {
+		if devices[device] {
+			return fmt.Errorf("spec %q uses device %s twice", spec.Name, device)
+		}
+		devices[device] = true
+		return nil
+	}
+	for i := range spec.Disks {
+		disk := &spec.Disks[i]
+		if disk.Size == 0 {
+			return fmt.Errorf("spec %q: disk %d has no size", spec.Name, i)
+		}
+		if disk.Device == "" {
+			disk.Device = strconv.Itoa(i)
+		}
+		if err := claim(disk.Device); err != nil {
+			return err
+		}
+	}
+	if spec.CD != nil {
+		if spec.CD.Device == "" {
+			spec.CD.Device = "3"
+		}
+		if err := claim(spec.CD.Device); err != nil {
+			return err
+		}
+	}
+	nics := make(map[string]bool)
+	for i := range spec.Networks {
+		nic := &spec.Networks[i]
+		if nic.Network == "" {
+			return fmt.Errorf("spec %q: NIC %d has no network", spec.Name, i)
+		}
+		if nic.Device == "" {
+			nic.Device = strconv.Itoa(i)
+		}
+		if nics[nic.Device] {
+			return fmt.Errorf("spec %q uses VIF device %s twice", spec.Name, nic.Device)
+		}
+		nics[nic.Device] = true
+		if nic.MTU == 0 {
+			nic.MTU = 1500
+		}
+	}
+	return nil
+}
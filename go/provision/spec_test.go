@@ -0,0 +1,79 @@
+package provision
+
+import "testing"
+
+const yamlSpec = `
+name: web-01
+template: Debian Bookworm 12
+memory: 4GiB
+vcpus: 2
+disks:
+  - size: 20GiB
+    bootable: true
+  - sr: Local storage
+    size: 1073741824
+    device: "4"
+networks:
+  - network: Pool-wide network associated with eth0
+cd:
+  iso: guest-tools.iso
+`
+
+func TestParseSpecYAML(t *testing.T) {
+	spec, err := ParseSpec([]byte(yamlSpec))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if spec.MemorySize != 4<<30 || spec.VCPUs != 2 || len(spec.Disks) != 2 {
+		t.Log("Unexpected spec:", spec)
+		t.Fail()
+	}
+	if spec.Disks[0].Size != 20<<30 || spec.Disks[0].Device != "0" || spec.Disks[1].Size != 1<<30 || spec.Disks[1].Device != "4" {
+		t.Log("Unexpected disks:", spec.Disks)
+		t.Fail()
+	}
+	if spec.Networks[0].Device != "0" || spec.Networks[0].MTU != 1500 || spec.CD.Device != "3" {
+		t.Log("Defaults were not filled in:", spec.Networks, spec.CD)
+		t.Fail()
+	}
+}
+
+func TestParseSpecJSON(t *testing.T) {
+	spec, err := ParseSpec([]byte(`{"name": "db-01", "template": "Debian Bookworm 12", "memory": "512MiB", "disks": [{"size": 1048576}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if spec.MemorySize != 512<<20 || spec.Disks[0].Size != 1<<20 {
+		t.Log("Unexpected sizes:", spec.MemorySize, spec.Disks[0].Size)
+		t.Fail()
+	}
+}
+
+func TestParseSpecInvalid(t *testing.T) {
+	for _, doc := range []string{
+		`template: Debian Bookworm 12`,
+		`name: vm`,
+		`{name: vm, template: t, memory: lots}`,
+		`{name: vm, template: t, disks: [{size: 1GiB, device: "3"}], cd: {}}`,
+		`{name: vm, template: t, networks: [{device: "0"}]}`,
+	} {
+		if _, err := ParseSpec([]byte(doc)); err == nil {
+			t.Log("Expected an error for:", doc)
+			t.Fail()
+		}
+	}
+}
+
+func TestSizeString(t *testing.T) {
+	for size, want := range map[Size]string{0: "0", 1000: "1000B", 1536: "1536B", 20 << 30: "20GiB", 3 << 40: "3TiB"} {
+		if got := size.String(); got != want {
+			t.Log("Expected", want, "got", got)
+			t.Fail()
+		}
+		parsed, err := ParseSize(size.String())
+		if err != nil || parsed != size {
+			t.Log("Size", size, "did not round-trip:", parsed, err)
+			t.Fail()
+		}
+	}
+}
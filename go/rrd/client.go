@@ -0,0 +1,155 @@
+package rrd
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"xenapi"
+
+	"github.com/xenserver/xenserver-samples/go/xsutil"
+)
+
+// Client fetches metrics from the host a session is logged in to.
+type Client struct {
+	ref     xenapi.SessionRef
+	base    *url.URL
+	headers map[string]string
+	http    *http.Client
+}
+
+// NewClient returns a client for the host that the session with the given
+// reference, such as PoolSession.Current returns, is logged in to. opts
+// must be the options the session was created with.
+func NewClient(ref xenapi.SessionRef, opts *xenapi.ClientOpts) (*Client, error) {
+	base, err := url.Parse(opts.URL)
+	if err != nil {
+		return nil, err
+	}
+	client, err := xsutil.HTTPClient(opts)
+	if err != nil {
+		return nil, err
+	}
+	return &Client{ref: ref, base: base, headers: opts.Headers, http: client}, nil
+}
+
+// Query selects the updates to fetch.
+type Query struct {
+	// Start is the time of the oldest sample wanted.
+	Start time.Time
+	// Interval is the resolution wanted, such as 5s, 1m, 1h or 1d; the
+	// server picks one from Start if it is 0.
+	Interval time.Duration
+	// CF is the consolidation function, Average if empty.
+	CF string
+	// Host adds the host's own metrics to the VMs'.
+	Host bool
+	// VMUUID limits the updates to one VM.
+	VMUUID string
+	// JSON asks for the JSON form rather than XML.
+	JSON bool
+}
+
+func (q Query) values() url.Values {
+	values := url.Values{"start": {strconv.FormatInt(q.Start.Unix(), 10)}}
+	cf := q.CF
+	if cf == "" {
+		cf = Average
+	}
+	values.Set("cf", cf)
+	if q.Interval > 0 {
+		values.Set("interval", strconv.FormatInt(int64(q.Interval/time.Second), 10))
+	}
+	if q.Host {
+		values.Set("host", "true")
+	}
+	if q.VMUUID != "" {
+		values.Set("vm_uuid", q.VMUUID)
+	}
+	if q.JSON {
+		values.Set("json", "true")
+	}
+	return values
+}
+
+// Updates fetches the samples q selects from /rrd_updates.
+func (c *Client) Updates(ctx context.Context, q Query) (*Updates, error) {
+	data, err := c.get(ctx, "/rrd_updates", q.values())
+	if err != nil {
+		return nil, err
+	}
+	if q.JSON {
+		return ParseUpdatesJSON(data)
+	}
+	return ParseUpdates(bytes.NewReader(data))
+}
+
+// HostRRD fetches the host's whole database from /host_rrd.
+func (c *Client) HostRRD(ctx context.Context) (*RRD, error) {
+	data, err := c.get(ctx, "/host_rrd", url.Values{})
+	if err != nil {
+		return nil, err
+	}
+	return ParseRRD(bytes.NewReader(data))
+}
+
+func (c *Client) get(ctx context.Context, path string, query url.Values) ([]byte, error) {
+	query.Set("session_id", string(c.ref))
+	u := *c.base
+	u.Path = strings.TrimSuffix(u.Path, "/") + path
+	u.RawQuery = query.Encode()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	for key, value := range c.headers {
+		req.Header.Set(key, value)
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		message := data[:min(len(data), 512)]
+		return nil, fmt.Errorf("GET %s: %s: %s", path, resp.Status, strings.TrimSpace(string(message)))
+	}
+	return data, nil
+}
+
+// Poller fetches updates repeatedly, each time starting where the last
+// one ended so that no sample is fetched twice.
+type Poller struct {
+	client *Client
+	query  Query
+}
+
+// Poller returns a poller whose first fetch is q.
+func (c *Client) Poller(q Query) *Poller {
+	return &Poller{client: c, query: q}
+}
+
+// Poll fetches the samples taken since the last poll.
+func (p *Poller) Poll(ctx context.Context) (*Updates, error) {
+	updates, err := p.client.Updates(ctx, p.query)
+	if err != nil {
+		return nil, err
+	}
+	p.query.Start = updates.End.Add(time.Second)
+	return updates, nil
+}
+
+// Next is the time the next poll starts from.
+func (p *Poller) Next() time.Time {
+	return p.query.Start
+}
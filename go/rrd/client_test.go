@@ -0,0 +1,109 @@
+package rrd
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"xenapi"
+
+	"github.com/xenserver/xenserver-samples/go/fakexapi"
+	"github.com/xenserver/xenserver-samples/go/xsutil"
+)
+
+func TestClient(t *testing.T) {
+	server := fakexapi.NewServer()
+	t.Cleanup(server.Close)
+	queries := make(chan url.Values, 3)
+	serve := func(xmlFile, jsonFile string) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			query := r.URL.Query()
+			queries <- query
+			if !server.ValidSession(query.Get("session_id")) {
+				http.Error(w, "unauthorised", http.StatusUnauthorized)
+				return
+			}
+			file := xmlFile
+			if query.Get("json") == "true" {
+				file = jsonFile
+			}
+			http.ServeFile(w, r, file)
+		})
+	}
+	server.HandleHTTP("/rrd_updates", serve("testdata/rrd_updates.xml", "testdata/rrd_updates.json"))
+	server.HandleHTTP("/host_rrd", serve("testdata/host_rrd.xml", ""))
+
+	opts := &xenapi.ClientOpts{URL: server.URL()}
+	pool, err := xsutil.Connect(opts, xsutil.Credentials{Username: server.Username, Password: server.Password})
+	if err != nil {
+		t.Fatal(err)
+	}
+	session, ref := pool.Current()
+	client, err := NewClient(ref, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	poller := client.Poller(Query{Start: time.Unix(1699999990, 0), Interval: 5 * time.Second, Host: true})
+	updates, err := poller.Poll(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	query := <-queries
+	for key, want := range map[string]string{"start": "1699999990", "interval": "5", "cf": "AVERAGE", "host": "true"} {
+		if got := query.Get(key); got != want {
+			t.Logf("got %s=%q, expected %q", key, got, want)
+			t.Fail()
+		}
+	}
+	if len(updates.VMs) != 1 || len(updates.Hosts) != 1 {
+		t.Log("got VMs", updates.VMs, "and hosts", updates.Hosts)
+		t.Fail()
+	}
+	if next := poller.Next().Unix(); next != 1700000011 {
+		t.Log("expected the next poll to start after the last sample, got", next)
+		t.Fail()
+	}
+	if _, err := poller.Poll(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if start := (<-queries).Get("start"); start != "1700000011" {
+		t.Log("second poll started at", start)
+		t.Fail()
+	}
+
+	updates, err = client.Updates(ctx, Query{Start: time.Unix(1699999990, 0), CF: Max, VMUUID: vmUUID, JSON: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	query = <-queries
+	if query.Get("json") != "true" || query.Get("vm_uuid") != vmUUID || query.Get("cf") != Max || query.Has("host") || query.Has("interval") {
+		t.Log("got JSON query", query)
+		t.Fail()
+	}
+	if updates.VMs[vmUUID] == nil {
+		t.Log("JSON updates lack the VM")
+		t.Fail()
+	}
+
+	rrd, err := client.HostRRD(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-queries
+	if len(rrd.Archives) != 3 {
+		t.Log("got", len(rrd.Archives), "archives")
+		t.Fail()
+	}
+
+	if err := session.Logout(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.HostRRD(ctx); err == nil {
+		t.Log("fetched the database after logging out")
+		t.Fail()
+	}
+}
@@ -0,0 +1,132 @@
+package rrd
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// RRD is a host's whole round-robin database, as /host_rrd returns it.
+type RRD struct {
+	Step        time.Duration
+	LastUpdate  time.Time
+	DataSources []DataSource
+	Archives    []*Archive
+}
+
+// DataSource describes a metric the database records.
+type DataSource struct {
+	Name string
+	// Type is GAUGE, ABSOLUTE or DERIVE.
+	Type     string
+	Min, Max float64
+	// Value is the latest sample.
+	Value float64
+}
+
+// Archive is the history of every metric at one resolution. Its report
+// gives the typed views, such as CPUs and Memory, of that history.
+type Archive struct {
+	CF         string
+	Resolution time.Duration
+	Report
+}
+
+// Archive returns the archive with the given consolidation function and
+// the finest resolution no finer than resolution, or nil if there is none.
+func (r *RRD) Archive(cf string, resolution time.Duration) *Archive {
+	var best *Archive
+	for _, a := range r.Archives {
+		if a.CF == cf && a.Resolution >= resolution && (best == nil || a.Resolution < best.Resolution) {
+			best = a
+		}
+	}
+	return best
+}
+
+// rrdDoc is the XML document /host_rrd returns, in the layout of
+// rrdtool dump.
+type rrdDoc struct {
+	Step       int64 `xml:"step"`
+	LastUpdate int64 `xml:"lastupdate"`
+	DS         []struct {
+		Name  string `xml:"name"`
+		Type  string `xml:"type"`
+		Min   string `xml:"min"`
+		Max   string `xml:"max"`
+		Value string `xml:"value"`
+	} `xml:"ds"`
+	RRA []struct {
+		CF        string `xml:"cf"`
+		PDPPerRow int64  `xml:"pdp_per_row"`
+		Rows      []struct {
+			Values []string `xml:"v"`
+		} `xml:"database>row"`
+	} `xml:"rra"`
+}
+
+// ParseRRD reads the XML document /host_rrd returns.
+func ParseRRD(r io.Reader) (*RRD, error) {
+	var doc rrdDoc
+	if err := xml.NewDecoder(r).Decode(&doc); err != nil {
+		return nil, fmt.Errorf("parsing RRD: %w", err)
+	}
+	if doc.Step <= 0 {
+		return nil, fmt.Errorf("parsing RRD: step %d is not positive", doc.Step)
+	}
+	rrd := &RRD{
+		Step:       time.Duration(doc.Step) * time.Second,
+		LastUpdate: time.Unix(doc.LastUpdate, 0).UTC(),
+	}
+	for _, ds := range doc.DS {
+		source := DataSource{Name: strings.TrimSpace(ds.Name), Type: strings.TrimSpace(ds.Type)}
+		for _, field := range []struct {
+			text string
+			into *float64
+		}{{ds.Min, &source.Min}, {ds.Max, &source.Max}, {ds.Value, &source.Value}} {
+			value, err := parseValue(strings.TrimSpace(field.text))
+			if err != nil {
+				return nil, fmt.Errorf("data source %s: %w", source.Name, err)
+			}
+			*field.into = value
+		}
+		rrd.DataSources = append(rrd.DataSources, source)
+	}
+
+	for _, rra := range doc.RRA {
+		if rra.PDPPerRow <= 0 {
+			return nil, fmt.Errorf("parsing RRD: %s archive: pdp_per_row %d is not positive", strings.TrimSpace(rra.CF), rra.PDPPerRow)
+		}
+		seconds := doc.Step * rra.PDPPerRow
+		archive := &Archive{
+			CF:         strings.TrimSpace(rra.CF),
+			Resolution: time.Duration(seconds) * time.Second,
+			Report:     Report{Metrics: make(map[string]*Series)},
+		}
+		series := make([]*Series, len(rrd.DataSources))
+		for i, ds := range rrd.DataSources {
+			series[i] = &Series{Name: ds.Name, CF: archive.CF}
+			archive.Metrics[ds.Name] = series[i]
+		}
+		// Rows run from oldest to newest, the last one ending at the last
+		// update rounded down to the archive's resolution.
+		last := doc.LastUpdate - doc.LastUpdate%seconds
+		for i, row := range rra.Rows {
+			if len(row.Values) != len(series) {
+				return nil, fmt.Errorf("%s archive: row %d has %d values for %d data sources", archive.CF, i, len(row.Values), len(series))
+			}
+			t := time.Unix(last-int64(len(rra.Rows)-1-i)*seconds, 0).UTC()
+			for j, v := range row.Values {
+				value, err := parseValue(strings.TrimSpace(v))
+				if err != nil {
+					return nil, fmt.Errorf("%s archive: row %d: %w", archive.CF, i, err)
+				}
+				series[j].Points = append(series[j].Points, Point{Time: t, Value: value})
+			}
+		}
+		rrd.Archives = append(rrd.Archives, archive)
+	}
+	return rrd, nil
+}
@@ -0,0 +1,153 @@
+// Package rrd reads the performance metrics XAPI keeps in round-robin
+// databases: the updates of a host and its VMs since a given time, from
+// /rrd_updates, and a host's whole database, from /host_rrd. It is the Go
+// counterpart of misc/parse_rrd.py; misc/using_rrd.md explains the data.
+package rrd
+
+import (
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Consolidation functions, which say how an archive combines samples.
+const (
+	Average = "AVERAGE"
+	Min     = "MIN"
+	Max     = "MAX"
+)
+
+// Point is one sample of a series.
+type Point struct {
+	Time  time.Time
+	Value float64
+}
+
+// Series is a metric over time, oldest sample first.
+type Series struct {
+	Name string
+	// CF is the consolidation function the samples were made with.
+	CF     string
+	Points []Point
+}
+
+// Latest returns the most recent sample, or false if there is none.
+func (s *Series) Latest() (Point, bool) {
+	if s == nil || len(s.Points) == 0 {
+		return Point{}, false
+	}
+	return s.Points[len(s.Points)-1], true
+}
+
+// scaled returns a copy of s with every value multiplied by factor.
+func (s *Series) scaled(factor float64) *Series {
+	if s == nil {
+		return nil
+	}
+	scaled := &Series{Name: s.Name, CF: s.CF, Points: make([]Point, len(s.Points))}
+	for i, p := range s.Points {
+		scaled.Points[i] = Point{Time: p.Time, Value: p.Value * factor}
+	}
+	return scaled
+}
+
+func (s *Series) sort() {
+	sort.Slice(s.Points, func(i, j int) bool { return s.Points[i].Time.Before(s.Points[j].Time) })
+}
+
+// Report is the metrics of one host or VM, by name, such as "cpu0" or
+// "vif_0_rx".
+type Report struct {
+	UUID    string
+	Metrics map[string]*Series
+}
+
+// Series returns the named metric, or nil if there is none.
+func (r *Report) Series(name string) *Series {
+	return r.Metrics[name]
+}
+
+var (
+	cpuMetric = regexp.MustCompile(`^cpu(\d+)$`)
+	vifMetric = regexp.MustCompile(`^(?:vif|pif)_([^_]+)_(rx|tx)$`)
+	vbdMetric = regexp.MustCompile(`^vbd_([^_]+)_(read|write)$`)
+)
+
+// CPUs returns the utilisation of each CPU, from 0 to 1, by number: the
+// vCPUs of a VM, or the physical CPUs of a host.
+func (r *Report) CPUs() map[int]*Series {
+	cpus := make(map[int]*Series)
+	for name, series := range r.Metrics {
+		if m := cpuMetric.FindStringSubmatch(name); m != nil {
+			n, _ := strconv.Atoi(m[1])
+			cpus[n] = series
+		}
+	}
+	return cpus
+}
+
+// Memory returns the total and free memory in bytes. VMs report the
+// total in bytes and the free memory their tools see in KiB; hosts report
+// both in KiB. Either is nil if the report lacks it.
+func (r *Report) Memory() (total, free *Series) {
+	if r.Metrics["memory_total_kib"] != nil || r.Metrics["memory_free_kib"] != nil {
+		return r.Metrics["memory_total_kib"].scaled(1024), r.Metrics["memory_free_kib"].scaled(1024)
+	}
+	return r.Metrics["memory"], r.Metrics["memory_internal_free"].scaled(1024)
+}
+
+// Traffic is the throughput of a network interface in bytes per second.
+type Traffic struct {
+	RX, TX *Series
+}
+
+// Interfaces returns the traffic of each network interface: the VIFs of a
+// VM by device number, or the PIFs of a host by device name, e.g. "eth0".
+func (r *Report) Interfaces() map[string]Traffic {
+	interfaces := make(map[string]Traffic)
+	for name, series := range r.Metrics {
+		m := vifMetric.FindStringSubmatch(name)
+		if m == nil {
+			continue
+		}
+		traffic := interfaces[m[1]]
+		if m[2] == "rx" {
+			traffic.RX = series
+		} else {
+			traffic.TX = series
+		}
+		interfaces[m[1]] = traffic
+	}
+	return interfaces
+}
+
+// DiskIO is the throughput of a disk in bytes per second.
+type DiskIO struct {
+	Read, Write *Series
+}
+
+// Disks returns the throughput of each of a VM's VBDs, by device, e.g.
+// "xvda".
+func (r *Report) Disks() map[string]DiskIO {
+	disks := make(map[string]DiskIO)
+	for name, series := range r.Metrics {
+		m := vbdMetric.FindStringSubmatch(name)
+		if m == nil {
+			continue
+		}
+		io := disks[m[1]]
+		if m[2] == "read" {
+			io.Read = series
+		} else {
+			io.Write = series
+		}
+		disks[m[1]] = io
+	}
+	return disks
+}
+
+// parseValue reads a sample, which may be NaN or infinite.
+func parseValue(s string) (float64, error) {
+	return strconv.ParseFloat(s, 64)
+}
@@ -0,0 +1,161 @@
+package rrd
+
+import (
+	"math"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	vmUUID   = "8c7b2f3e-52a1-4a3b-9d0e-6f1c2b3a4d5e"
+	hostUUID = "1d3a4f6b-0c2e-4e5f-8a9b-7c6d5e4f3a2b"
+)
+
+func latest(t *testing.T, s *Series) float64 {
+	t.Helper()
+	p, ok := s.Latest()
+	if !ok {
+		t.Fatal("series has no samples")
+	}
+	return p.Value
+}
+
+func TestParseUpdates(t *testing.T) {
+	f, err := os.Open("testdata/rrd_updates.xml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	updates, err := ParseUpdates(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if updates.Start != time.Unix(1700000000, 0).UTC() || updates.End != time.Unix(1700000010, 0).UTC() || updates.Step != 5*time.Second {
+		t.Fatalf("got %v to %v every %v", updates.Start, updates.End, updates.Step)
+	}
+	vm, host := updates.VMs[vmUUID], updates.Hosts[hostUUID]
+	if vm == nil || host == nil || len(updates.VMs) != 1 || len(updates.Hosts) != 1 {
+		t.Fatalf("got VMs %v and hosts %v", updates.VMs, updates.Hosts)
+	}
+
+	cpus := vm.CPUs()
+	if len(cpus) != 2 {
+		t.Fatalf("got %d vCPUs, expected 2", len(cpus))
+	}
+	points := cpus[0].Points
+	if len(points) != 3 || points[0].Time.Unix() != 1700000000 || points[0].Value != 0.01 || points[2].Value != 0.03 {
+		t.Log("vCPU 0 samples are not oldest first:", points)
+		t.Fail()
+	}
+	if v := cpus[1].Points[1].Value; !math.IsNaN(v) {
+		t.Log("expected NaN for the missing sample, got", v)
+		t.Fail()
+	}
+	if total, free := vm.Memory(); latest(t, total) != 2<<30 || latest(t, free) != 1<<30 {
+		t.Log("got VM memory", latest(t, total), "free", latest(t, free))
+		t.Fail()
+	}
+	if total, free := host.Memory(); latest(t, total) != 16<<30 || latest(t, free) != 8<<30 {
+		t.Log("got host memory", latest(t, total), "free", latest(t, free))
+		t.Fail()
+	}
+
+	vifs := vm.Interfaces()
+	if len(vifs) != 1 || latest(t, vifs["0"].RX) != 1200 || latest(t, vifs["0"].TX) != 800 {
+		t.Log("got VIFs", vifs)
+		t.Fail()
+	}
+	pifs := host.Interfaces()
+	if len(pifs) != 1 || latest(t, pifs["eth0"].RX) != 5000 || latest(t, pifs["eth0"].TX) != 2500 {
+		t.Log("got PIFs", pifs)
+		t.Fail()
+	}
+	disks := vm.Disks()
+	if len(disks) != 1 || latest(t, disks["xvda"].Read) != 4096 || latest(t, disks["xvda"].Write) != 8192 {
+		t.Log("got disks", disks)
+		t.Fail()
+	}
+}
+
+func TestParseUpdatesJSON(t *testing.T) {
+	data, err := os.ReadFile("testdata/rrd_updates.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	updates, err := ParseUpdatesJSON(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	vm, host := updates.VMs[vmUUID], updates.Hosts[hostUUID]
+	if vm == nil || host == nil {
+		t.Fatalf("got VMs %v and hosts %v", updates.VMs, updates.Hosts)
+	}
+	cpu := vm.CPUs()[0]
+	if len(cpu.Points) != 3 || cpu.Points[0].Value != 0.01 || !math.IsNaN(cpu.Points[1].Value) || cpu.CF != Average {
+		t.Log("got vCPU 0", cpu)
+		t.Fail()
+	}
+	if _, free := host.Memory(); latest(t, free) != 8<<30 {
+		t.Log("got free host memory", latest(t, free))
+		t.Fail()
+	}
+}
+
+func TestParseRRD(t *testing.T) {
+	f, err := os.Open("testdata/host_rrd.xml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	rrd, err := ParseRRD(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rrd.Step != 5*time.Second || len(rrd.DataSources) != 2 || len(rrd.Archives) != 3 {
+		t.Fatalf("got step %v, %d data sources and %d archives", rrd.Step, len(rrd.DataSources), len(rrd.Archives))
+	}
+	if ds := rrd.DataSources[1]; ds.Name != "memory_free_kib" || ds.Type != "GAUGE" || !math.IsInf(ds.Max, 1) {
+		t.Log("got data source", ds)
+		t.Fail()
+	}
+
+	fine := rrd.Archive(Average, 0)
+	if fine == nil || fine.Resolution != 5*time.Second {
+		t.Fatal("expected the 5s archive, got", fine)
+	}
+	points := fine.CPUs()[0].Points
+	if len(points) != 3 || points[2].Time.Unix() != 1700000010 || points[0].Time.Unix() != 1700000000 || points[2].Value != 0.15 {
+		t.Log("got 5s samples", points)
+		t.Fail()
+	}
+
+	coarse := rrd.Archive(Average, time.Minute)
+	if coarse == nil || coarse.Resolution != time.Minute {
+		t.Fatal("expected the 1m archive, got", coarse)
+	}
+	if _, free := coarse.Memory(); len(free.Points) != 2 || free.Points[0].Time.Unix() != 1699999920 || free.Points[0].Value != 4<<30 {
+		t.Log("got 1m samples", free.Points)
+		t.Fail()
+	}
+	if max := rrd.Archive(Max, 0); max == nil || latest(t, max.CPUs()[0]) != 0.8 {
+		t.Log("got MAX archive", max)
+		t.Fail()
+	}
+	if rrd.Archive(Min, 0) != nil {
+		t.Log("found a MIN archive that does not exist")
+		t.Fail()
+	}
+}
+
+func TestParseRRDRejectsBadArchives(t *testing.T) {
+	for _, pdpPerRow := range []string{"0", "-12"} {
+		doc := `<rrd><step>5</step><lastupdate>1700000010</lastupdate>
+<rra><cf>AVERAGE</cf><pdp_per_row>` + pdpPerRow + `</pdp_per_row><database></database></rra></rrd>`
+		if _, err := ParseRRD(strings.NewReader(doc)); err == nil || !strings.Contains(err.Error(), "pdp_per_row") {
+			t.Log("expected pdp_per_row", pdpPerRow, "to be refused, got", err)
+			t.Fail()
+		}
+	}
+}
@@ -0,0 +1,139 @@
+package rrd
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Updates is what /rrd_updates returns: the samples taken between Start
+// and End, every Step, of one host and the VMs running on it.
+type Updates struct {
+	Start, End time.Time
+	Step       time.Duration
+	// Hosts has the host's report if the query asked for it.
+	Hosts map[string]*Report
+	VMs   map[string]*Report
+}
+
+// xport is the XML document /rrd_updates returns.
+type xport struct {
+	Meta struct {
+		Start   int64    `xml:"start" json:"start"`
+		Step    int64    `xml:"step" json:"step"`
+		End     int64    `xml:"end" json:"end"`
+		Rows    int      `xml:"rows" json:"rows"`
+		Columns int      `xml:"columns" json:"columns"`
+		Legend  []string `xml:"legend>entry" json:"legend"`
+	} `xml:"meta" json:"meta"`
+	Data []struct {
+		Time   int64         `xml:"t" json:"t"`
+		Values []sampleValue `xml:"v" json:"values"`
+	} `xml:"data>row" json:"data"`
+}
+
+// sampleValue is a sample as text, which JSON may also give as a number.
+type sampleValue string
+
+func (v *sampleValue) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err == nil {
+		*v = sampleValue(s)
+		return nil
+	}
+	var n json.Number
+	if err := json.Unmarshal(data, &n); err != nil {
+		return err
+	}
+	*v = sampleValue(n)
+	return nil
+}
+
+// ParseUpdates reads the XML document /rrd_updates returns.
+func ParseUpdates(r io.Reader) (*Updates, error) {
+	var doc xport
+	if err := xml.NewDecoder(r).Decode(&doc); err != nil {
+		return nil, fmt.Errorf("parsing RRD updates: %w", err)
+	}
+	return doc.updates()
+}
+
+var (
+	// bareKey and bareNumber find what older servers leave unquoted in the
+	// JSON form: keys, and samples that JSON has no numbers for.
+	bareKey    = regexp.MustCompile(`([{,]\s*)([A-Za-z_][A-Za-z0-9_]*)\s*:`)
+	bareNumber = regexp.MustCompile(`([\[,:]\s*)([-+]?(?i:nan|inf|infinity))(\s*[,\]}])`)
+)
+
+// ParseUpdatesJSON reads the JSON form of /rrd_updates, as returned with
+// json=true.
+func ParseUpdatesJSON(data []byte) (*Updates, error) {
+	text := bareKey.ReplaceAllString(string(data), `$1"$2":`)
+	// Twice, since neighbouring samples share the comma between them.
+	for i := 0; i < 2; i++ {
+		text = bareNumber.ReplaceAllString(text, `$1"$2"$3`)
+	}
+	var doc xport
+	if err := json.Unmarshal([]byte(text), &doc); err != nil {
+		return nil, fmt.Errorf("parsing RRD updates: %w", err)
+	}
+	return doc.updates()
+}
+
+func (doc *xport) updates() (*Updates, error) {
+	meta := doc.Meta
+	updates := &Updates{
+		Start: time.Unix(meta.Start, 0).UTC(),
+		End:   time.Unix(meta.End, 0).UTC(),
+		Step:  time.Duration(meta.Step) * time.Second,
+		Hosts: make(map[string]*Report),
+		VMs:   make(map[string]*Report),
+	}
+	series := make([]*Series, len(meta.Legend))
+	for i, entry := range meta.Legend {
+		// Each entry is CF:kind:uuid:metric; the control domain counts as
+		// a VM.
+		parts := strings.SplitN(entry, ":", 4)
+		if len(parts) != 4 {
+			return nil, fmt.Errorf("malformed legend entry %q", entry)
+		}
+		var reports map[string]*Report
+		switch parts[1] {
+		case "host":
+			reports = updates.Hosts
+		case "vm":
+			reports = updates.VMs
+		default:
+			return nil, fmt.Errorf("legend entry %q is neither for a host nor a VM", entry)
+		}
+		report := reports[parts[2]]
+		if report == nil {
+			report = &Report{UUID: parts[2], Metrics: make(map[string]*Series)}
+			reports[parts[2]] = report
+		}
+		series[i] = &Series{Name: parts[3], CF: parts[0]}
+		report.Metrics[parts[3]] = series[i]
+	}
+	for _, row := range doc.Data {
+		if len(row.Values) != len(series) {
+			return nil, fmt.Errorf("row at %d has %d values for %d columns", row.Time, len(row.Values), len(series))
+		}
+		t := time.Unix(row.Time, 0).UTC()
+		for i, v := range row.Values {
+			value, err := parseValue(string(v))
+			if err != nil {
+				return nil, fmt.Errorf("row at %d: %w", row.Time, err)
+			}
+			series[i].Points = append(series[i].Points, Point{Time: t, Value: value})
+		}
+	}
+	// The server sends the newest row first.
+	for _, s := range series {
+		s.sort()
+	}
+	return updates, nil
+}
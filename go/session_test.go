@@ -4,20 +4,19 @@ import (
 	"testing"
 
 	"xenapi"
+
+	"github.com/xenserver/xenserver-samples/go/xsutil"
 )
 
 func TestHTTPSConnection(t *testing.T) {
-	if *CA_CERT_PATH_FLAG == "" {
-		t.Log("CA certificate is not provided, skipping https connection test")
-		t.Fail()
-		return
-	}
+	Require(t, NeedCACert)
+	primary := GetTarget(PRIMARY_TARGET)
 	// Test HTTPS connection without certificate verification
 	session1 := xenapi.NewSession(&xenapi.ClientOpts{
-		URL: "https://" + *IP_FLAG,
+		URL: "https://" + primary.Host,
 	})
 
-	_, err := session1.LoginWithPassword(*USERNAME_FLAG, *PASSWORD_FLAG, "1.0", "Go sdk samples")
+	_, err := session1.LoginWithPassword(primary.Username, primary.Password, "1.0", "Go sdk samples")
 	if err != nil {
 		t.Log(err)
 		t.Fail()
@@ -32,30 +31,26 @@ func TestHTTPSConnection(t *testing.T) {
 	}
 
 	// Test HTTPS connection with server certificate verification
-	if session.APIVersion >= xenapi.APIVersion2_21 {
+	t.Run("Verified", func(t *testing.T) {
 		/* the CA cert in yangtze servers is missing fields, which will cause x509 error:
 		   "cannot validate certificate for x.x.x.x because it doesn't contain any IP SANs"
 		   skip this test case.
-		*/ 
-		session2 := xenapi.NewSession(&xenapi.ClientOpts{
-			URL: "https://" + *IP_FLAG,
-			SecureOpts: &xenapi.SecureOpts{
-				ServerCert: *CA_CERT_PATH_FLAG,
-			},
-		})
-	
-		_, err = session2.LoginWithPassword(*USERNAME_FLAG, *PASSWORD_FLAG, "1.0", "Go sdk samples")
+		*/
+		Require(t, NeedFeature(xsutil.FeatureCertificateVerification))
+		session2 := xenapi.NewSession(primary.ClientOpts("https"))
+
+		_, err := session2.LoginWithPassword(primary.Username, primary.Password, "1.0", "Go sdk samples")
 		if err != nil {
 			t.Log(err)
 			t.Fail()
 			return
 		}
-	
+
 		err = session2.Logout()
 		if err != nil {
 			t.Log(err)
 			t.Fail()
 			return
 		}
-	}
+	})
 }
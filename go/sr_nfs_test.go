@@ -1,20 +1,21 @@
 package testGoSDK
 
 import (
+	"errors"
 	"fmt"
-	"strings"
 	"testing"
 	"time"
 
 	"xenapi"
+
+	"github.com/xenserver/xenserver-samples/go/xsutil"
 )
 
 func TestNFSSRCreateAndDestroy(t *testing.T) {
-	if *NFS_SERVER_FLAG == "" || *NFS_PATH_FLAG == "" {
-		t.Log("NFS server or path is not provided, skipping NFS SR test")
-		t.Fail()
-		return
-	}
+	Connected(t)
+	Require(t, NeedNFS)
+	nfs := GetTarget(NFS_TARGET)
+	objects := TrackObjects(t)
 
 	// Choose the first host
 	hostRefs, err := xenapi.Host.GetAll(session)
@@ -33,19 +34,20 @@ func TestNFSSRCreateAndDestroy(t *testing.T) {
 
 	// Create config parameter for shared storage on nfs server
 	var deviceConfig = make(map[string]string)
-	deviceConfig["server"] = *NFS_SERVER_FLAG
-	deviceConfig["serverpath"] = *NFS_PATH_FLAG
+	deviceConfig["server"] = nfs.Host
+	deviceConfig["serverpath"] = nfs.Path
 
 	t.Log("Creating a shared storage SR ...")
 	var srRefNew xenapi.SRRef
 	srRefNew, err = xenapi.SR.Create(session, hostRefs[0], deviceConfig, 100000, "NFS SR created by sr_nfs_test.go",
-		fmt.Sprintf("[%s:%s] Created at %s", *NFS_SERVER_FLAG, *NFS_PATH_FLAG, time.Now().String()), "nfs", "unused",
+		fmt.Sprintf("[%s:%s] Created at %s", nfs.Host, nfs.Path, time.Now().String()), "nfs", "unused",
 		true, make(map[string]string))
 	if err != nil {
 		t.Log(err)
 		t.Fail()
 		return
 	}
+	objects.SR(srRefNew)
 	err = WaitForSRReady(session, srRefNew)
 	if err != nil {
 		t.Log(err)
@@ -96,16 +98,19 @@ func TestNFSSRCreateAndDestroy(t *testing.T) {
 	t.Log("Trying to create one with bad device_config")
 	_, err = xenapi.SR.Create(session, hostRefs[0], make(map[string]string), 100000, "bad_device_config",
 		"description", "nfs", "contenttype", true, make(map[string]string))
-	if err == nil || !strings.Contains(err.Error(), "missing") {
-		t.Log(err)
+	var backendErr *xsutil.BackendFailureError
+	if !errors.As(xsutil.Decode(err), &backendErr) || backendErr.Number != 37 {
+		t.Log("Expected SR_BACKEND_FAILURE_37, got:", err)
 		t.Fail()
 		return
 	}
+	t.Log("Got expected failure:", backendErr.Stdout)
 	t.Log("Trying to create one with a bad 'type' field")
 	_, err = xenapi.SR.Create(session, hostRefs[0], make(map[string]string), 100000, "bad_sr_type",
 		"description", "made_up", "", true, make(map[string]string))
-	if err == nil || !strings.Contains(err.Error(), "made_up") {
-		t.Log(err)
+	var failure *xsutil.Failure
+	if !errors.As(xsutil.Decode(err), &failure) || !errors.Is(failure, xsutil.ErrUnknownDriver) || len(failure.Params) == 0 || failure.Params[0] != "made_up" {
+		t.Log("Expected SR_UNKNOWN_DRIVER, got:", err)
 		t.Fail()
 		return
 	}
@@ -8,6 +8,8 @@ import (
 )
 
 func TestSRBase(t *testing.T) {
+	Connected(t)
+	objects := TrackObjects(t)
 	var deviceConfig = make(map[string]string)
 	var smConfig = make(map[string]string)
 	var testSRName = "TestSR: DO NOT USE (created by sr_test.go)"
@@ -28,6 +30,7 @@ func TestSRBase(t *testing.T) {
 		t.Fail()
 		return
 	}
+	objects.SR(srRefNew)
 	err = WaitForSRReady(session, srRefNew)
 	if err != nil {
 		t.Log(err)
@@ -40,7 +43,7 @@ func TestSRBase(t *testing.T) {
 		t.Fail()
 		return
 	}
-	err = WaitForTask(taskRef, 5)
+	err = WaitForTask(taskRef)
 	if err != nil {
 		t.Log(err)
 		t.Fail()
@@ -53,6 +56,7 @@ func TestSRBase(t *testing.T) {
 		return
 	}
 	for _, srRef := range srRefs {
+		objects.SR(srRef)
 		pbdRefs, err := xenapi.SR.GetPBDs(session, srRef)
 		if err != nil {
 			t.Log(err)
@@ -98,7 +102,7 @@ func TestSRBase(t *testing.T) {
 		t.Fail()
 		return
 	}
-	err = WaitForTask(taskRef, 1)
+	err = WaitForTask(taskRef)
 	if err != nil {
 		t.Log(err)
 		t.Fail()
@@ -110,6 +114,9 @@ func TestSRBase(t *testing.T) {
 		t.Fail()
 		return
 	}
+	for _, srRef := range srRefs {
+		objects.IntroducedSR(srRef)
+	}
 	err = xenapi.SR.Forget(session, srRefs[0])
 	if err != nil {
 		t.Log(err)
@@ -122,7 +129,7 @@ func TestSRBase(t *testing.T) {
 		t.Fail()
 		return
 	}
-	err = WaitForTask(taskRef, 1)
+	err = WaitForTask(taskRef)
 	if err != nil {
 		t.Log(err)
 		t.Fail()
@@ -0,0 +1,311 @@
+package transfer
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// DefaultChunkSize is the chunk size NewChunkWriter uses when given 0.
+const DefaultChunkSize = 64 << 20
+
+// ManifestName is the file in a chunk directory that lists the chunks in
+// order with their SHA-256 sums, in the format of sha256sum.
+const ManifestName = "SHA256SUMS"
+
+// ChunkWriter stores a stream, such as an export, as numbered files of a
+// fixed size, listing each in the manifest as soon as it is complete. A
+// transfer cut short leaves every complete chunk listed and checkable, so
+// copying or verifying the image can pick up at the first chunk that is
+// missing or damaged instead of starting again, with ResumeChunkWriter.
+type ChunkWriter struct {
+	dir      string
+	size     int64
+	manifest *os.File
+	chunk    *os.File
+	index    int
+	written  int64
+	sum      hash.Hash
+	// kept holds the sums of the chunks a resumed writer found intact;
+	// the start of the stream is checked against them instead of being
+	// written again.
+	kept [][]byte
+}
+
+// NewChunkWriter starts writing chunks of size bytes to dir, creating it
+// if need be and replacing any manifest there.
+func NewChunkWriter(dir string, size int64) (*ChunkWriter, error) {
+	if size <= 0 {
+		size = DefaultChunkSize
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	manifest, err := os.Create(filepath.Join(dir, ManifestName))
+	if err != nil {
+		return nil, err
+	}
+	return &ChunkWriter{dir: dir, size: size, manifest: manifest}, nil
+}
+
+// ResumeChunkWriter continues a transfer to dir that was cut short. The
+// chunks the manifest lists are checked in order, and the manifest is cut
+// back to those before the first that is missing, damaged or short. The
+// stream must then be written again from its start, as the export handlers
+// cannot start part way: the part the intact chunks hold is checked against
+// them instead of being stored, and writing picks up at the first chunk
+// that was not intact. A stream that differs from the intact chunks fails
+// with ErrChecksumMismatch. size must be the size the chunks were written
+// with; without a manifest in dir, ResumeChunkWriter is NewChunkWriter.
+func ResumeChunkWriter(dir string, size int64) (*ChunkWriter, error) {
+	if size <= 0 {
+		size = DefaultChunkSize
+	}
+	entries, err := parseManifest(dir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return NewChunkWriter(dir, size)
+	}
+	if err != nil {
+		return nil, err
+	}
+	var kept [][]byte
+	var lines strings.Builder
+	for i, entry := range entries {
+		info, err := os.Stat(filepath.Join(dir, entry.name))
+		if err != nil || info.Size() != size || entry.name != chunkName(i) || verifyChunk(dir, entry) != nil {
+			break
+		}
+		kept = append(kept, entry.sum)
+		fmt.Fprintf(&lines, "%x  %s\n", entry.sum, entry.name)
+	}
+	manifest, err := os.Create(filepath.Join(dir, ManifestName))
+	if err != nil {
+		return nil, err
+	}
+	if _, err := manifest.WriteString(lines.String()); err != nil {
+		manifest.Close()
+		return nil, err
+	}
+	return &ChunkWriter{dir: dir, size: size, manifest: manifest, kept: kept}, nil
+}
+
+// Resumed returns how many chunks a writer from ResumeChunkWriter found
+// intact and does not write again.
+func (w *ChunkWriter) Resumed() int {
+	return len(w.kept)
+}
+
+func chunkName(index int) string {
+	return fmt.Sprintf("chunk-%06d", index)
+}
+
+func (w *ChunkWriter) Write(p []byte) (int, error) {
+	var total int
+	for len(p) > 0 {
+		if w.sum == nil {
+			if w.index >= len(w.kept) {
+				chunk, err := os.Create(filepath.Join(w.dir, chunkName(w.index)))
+				if err != nil {
+					return total, err
+				}
+				w.chunk = chunk
+			}
+			w.written, w.sum = 0, sha256.New()
+		}
+		part := p
+		if int64(len(part)) > w.size-w.written {
+			part = part[:w.size-w.written]
+		}
+		n, err := len(part), error(nil)
+		if w.chunk != nil {
+			n, err = w.chunk.Write(part)
+		}
+		w.sum.Write(part[:n])
+		w.written += int64(n)
+		total += n
+		p = p[n:]
+		if err != nil {
+			return total, err
+		}
+		if w.written == w.size {
+			if err := w.finishChunk(); err != nil {
+				return total, err
+			}
+		}
+	}
+	return total, nil
+}
+
+// finishChunk closes the current chunk and adds it to the manifest, or
+// checks it against the kept chunk it stands for.
+func (w *ChunkWriter) finishChunk() error {
+	sum := w.sum.Sum(nil)
+	w.sum = nil
+	if w.index < len(w.kept) {
+		if !bytes.Equal(sum, w.kept[w.index]) {
+			return fmt.Errorf("%s: the stream differs from the chunk already written: %w", chunkName(w.index), ErrChecksumMismatch)
+		}
+		w.index++
+		return nil
+	}
+	if err := w.chunk.Close(); err != nil {
+		return err
+	}
+	_, err := fmt.Fprintf(w.manifest, "%x  %s\n", sum, chunkName(w.index))
+	w.chunk = nil
+	w.index++
+	return err
+}
+
+// Close completes the last chunk and the manifest.
+func (w *ChunkWriter) Close() error {
+	var err error
+	if w.sum != nil {
+		err = w.finishChunk()
+	}
+	return errors.Join(err, w.manifest.Close())
+}
+
+// chunkEntry is a line of the manifest.
+type chunkEntry struct {
+	name string
+	sum  []byte
+	size int64
+}
+
+// readManifest returns the manifest's entries with the sizes of their
+// chunks.
+func readManifest(dir string) ([]chunkEntry, error) {
+	entries, err := parseManifest(dir)
+	if err != nil {
+		return nil, err
+	}
+	for i, entry := range entries {
+		info, err := os.Stat(filepath.Join(dir, entry.name))
+		if err != nil {
+			return nil, err
+		}
+		entries[i].size = info.Size()
+	}
+	return entries, nil
+}
+
+// parseManifest returns the manifest's entries without their sizes.
+func parseManifest(dir string) ([]chunkEntry, error) {
+	data, err := os.ReadFile(filepath.Join(dir, ManifestName))
+	if err != nil {
+		return nil, err
+	}
+	var entries []chunkEntry
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		digest, name, ok := strings.Cut(scanner.Text(), "  ")
+		sum, err := hex.DecodeString(digest)
+		if !ok || err != nil || filepath.Base(name) != name {
+			return nil, fmt.Errorf("%s: malformed line %q", ManifestName, scanner.Text())
+		}
+		entries = append(entries, chunkEntry{name: name, sum: sum})
+	}
+	return entries, scanner.Err()
+}
+
+// VerifyChunks checks the chunks in dir against the manifest in order and
+// returns how many are intact, with an error describing the first that is
+// not.
+func VerifyChunks(dir string) (int, error) {
+	entries, err := readManifest(dir)
+	if err != nil {
+		return 0, err
+	}
+	for i, entry := range entries {
+		if err := verifyChunk(dir, entry); err != nil {
+			return i, err
+		}
+	}
+	return len(entries), nil
+}
+
+func verifyChunk(dir string, entry chunkEntry) error {
+	f, err := os.Open(filepath.Join(dir, entry.name))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	sum := sha256.New()
+	if _, err := io.Copy(sum, f); err != nil {
+		return err
+	}
+	if !bytes.Equal(sum.Sum(nil), entry.sum) {
+		return fmt.Errorf("%s: %w", entry.name, ErrChecksumMismatch)
+	}
+	return nil
+}
+
+// OpenChunks returns the stream stored in dir and its size, for ImportVM.
+// Each chunk is checked against the manifest as it is read; a damaged one
+// fails the read that would complete it.
+func OpenChunks(dir string) (io.ReadCloser, int64, error) {
+	entries, err := readManifest(dir)
+	if err != nil {
+		return nil, 0, err
+	}
+	var size int64
+	for _, entry := range entries {
+		size += entry.size
+	}
+	return &chunkReader{dir: dir, entries: entries}, size, nil
+}
+
+// chunkReader reads the chunks of a manifest one after another.
+type chunkReader struct {
+	dir     string
+	entries []chunkEntry
+	current *os.File
+	reader  *verifyingReader
+}
+
+func (r *chunkReader) Read(p []byte) (int, error) {
+	for {
+		if r.reader == nil {
+			if len(r.entries) == 0 {
+				return 0, io.EOF
+			}
+			entry := r.entries[0]
+			r.entries = r.entries[1:]
+			f, err := os.Open(filepath.Join(r.dir, entry.name))
+			if err != nil {
+				return 0, err
+			}
+			r.current = f
+			r.reader = &verifyingReader{r: f, left: entry.size, want: entry.sum, sum: sha256.New()}
+		}
+		n, err := r.reader.Read(p)
+		if err == io.EOF {
+			r.current.Close()
+			r.current, r.reader = nil, nil
+			continue
+		}
+		if err != nil {
+			return n, fmt.Errorf("%s: %w", r.current.Name(), err)
+		}
+		return n, nil
+	}
+}
+
+func (r *chunkReader) Close() error {
+	if r.current == nil {
+		return nil
+	}
+	err := r.current.Close()
+	r.current, r.reader = nil, nil
+	return err
+}
@@ -0,0 +1,185 @@
+package transfer
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/xenserver/xenserver-samples/go/fakexapi"
+)
+
+func TestChunks(t *testing.T) {
+	dir := t.TempDir()
+	data := make([]byte, 2500)
+	rand.New(rand.NewSource(2)).Read(data)
+	w, err := NewChunkWriter(dir, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Odd-sized writes that straddle chunk boundaries.
+	for rest := data; len(rest) > 0; {
+		n := min(len(rest), 700)
+		if _, err := w.Write(rest[:n]); err != nil {
+			t.Fatal(err)
+		}
+		rest = rest[n:]
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if intact, err := VerifyChunks(dir); intact != 3 || err != nil {
+		t.Fatal("Expected three intact chunks:", intact, err)
+	}
+	r, size, err := OpenChunks(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	read, err := io.ReadAll(r)
+	r.Close()
+	if err != nil || size != int64(len(data)) || !bytes.Equal(read, data) {
+		t.Fatal("The chunks do not read back as written:", size, err)
+	}
+
+	// Damage the second chunk.
+	if err := os.WriteFile(filepath.Join(dir, chunkName(1)), make([]byte, 1000), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if intact, err := VerifyChunks(dir); intact != 1 || !errors.Is(err, ErrChecksumMismatch) {
+		t.Log("Expected the second chunk to fail:", intact, err)
+		t.Fail()
+	}
+	r, _, err = OpenChunks(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if _, err := io.ReadAll(r); !errors.Is(err, ErrChecksumMismatch) {
+		t.Log("Expected reading a damaged chunk to fail, got:", err)
+		t.Fail()
+	}
+}
+
+func TestExportToChunks(t *testing.T) {
+	s, client, session := newStandIn(t)
+	dir := t.TempDir()
+	w, err := NewChunkWriter(dir, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	digest, err := client.ExportVM(context.Background(), findVM(t, session, fakexapi.LinuxTemplate), w, ExportOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	r, size, err := OpenChunks(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	vms, err := client.ImportVM(context.Background(), r, ImportOptions{Size: size, SHA256: digest})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if imported := <-s.imports; len(vms) != 1 || !bytes.Equal(imported, s.image) {
+		t.Log("Unexpected import:", vms, len(imported))
+		t.Fail()
+	}
+}
+
+// cutWriter fails once it has passed on left bytes, as a dropped
+// connection would.
+type cutWriter struct {
+	w    io.Writer
+	left int
+}
+
+var errCut = errors.New("connection cut")
+
+func (c *cutWriter) Write(p []byte) (int, error) {
+	if len(p) <= c.left {
+		c.left -= len(p)
+		return c.w.Write(p)
+	}
+	n, _ := c.w.Write(p[:c.left])
+	c.left = 0
+	return n, errCut
+}
+
+func TestResumeExportToChunks(t *testing.T) {
+	s, client, session := newStandIn(t)
+	vm := findVM(t, session, fakexapi.LinuxTemplate)
+	dir := t.TempDir()
+	w, err := NewChunkWriter(dir, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Cut the export part way through the third chunk, and leave the
+	// writer as a crash would.
+	_, err = client.ExportVM(context.Background(), vm, &cutWriter{w: w, left: 5 << 19}, ExportOptions{})
+	if !errors.Is(err, errCut) {
+		t.Fatal("Expected the export to be cut, got:", err)
+	}
+	w.manifest.Close()
+	w.chunk.Close()
+	if intact, err := VerifyChunks(dir); intact != 2 || err != nil {
+		t.Fatal("Expected two intact chunks:", intact, err)
+	}
+	// Damage the second chunk, and mark the first to see it is kept.
+	if err := os.WriteFile(filepath.Join(dir, chunkName(1)), make([]byte, 1<<20), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	old := time.Now().Add(-time.Hour).Truncate(time.Second)
+	if err := os.Chtimes(filepath.Join(dir, chunkName(0)), old, old); err != nil {
+		t.Fatal(err)
+	}
+
+	w, err = ResumeChunkWriter(dir, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w.Resumed() != 1 {
+		t.Log("Expected to resume after the first chunk, got:", w.Resumed())
+		t.Fail()
+	}
+	if _, err := client.ExportVM(context.Background(), vm, w, ExportOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if info, err := os.Stat(filepath.Join(dir, chunkName(0))); err != nil || !info.ModTime().Equal(old) {
+		t.Log("Expected the intact chunk not to be written again:", err)
+		t.Fail()
+	}
+	if intact, err := VerifyChunks(dir); intact != 4 || err != nil {
+		t.Fatal("Expected four intact chunks:", intact, err)
+	}
+	r, size, err := OpenChunks(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	read, err := io.ReadAll(r)
+	r.Close()
+	if err != nil || size != int64(len(s.image)) || !bytes.Equal(read, s.image) {
+		t.Fatal("The resumed chunks do not read back as the export:", size, err)
+	}
+
+	// A stream other than the one the chunks hold is refused.
+	w, err = ResumeChunkWriter(dir, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	if _, err := w.Write(make([]byte, 1<<20)); !errors.Is(err, ErrChecksumMismatch) {
+		t.Log("Expected a different stream to be refused, got:", err)
+		t.Fail()
+	}
+}
@@ -0,0 +1,208 @@
+// Package transfer streams VM and disk images to and from the HTTP
+// handlers XAPI serves next to its API: /export and /import for VMs, and
+// /export_raw_vdi and /import_raw_vdi for disks. Every transfer runs
+// under a task of its own: the client polls it for progress, cancels it
+// when the transfer is abandoned, and waits on it for the server's verdict,
+// since the HTTP status is sent before the stream is processed.
+//
+// XAPI serves VMs as XVA only; OVA packages are built by client tools and
+// are not covered here.
+package transfer
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"xenapi"
+
+	"github.com/xenserver/xenserver-samples/go/xsutil"
+)
+
+// DefaultPollInterval is how often a transfer reads its task's progress
+// unless the client says otherwise.
+const DefaultPollInterval = time.Second
+
+// Progress is how far a transfer has got.
+type Progress struct {
+	// Bytes is how much has been sent or received so far.
+	Bytes int64
+	// Total is the size of the stream, or 0 if it is not known.
+	Total int64
+	// Task is the progress the server reports, from 0 to 1.
+	Task float64
+}
+
+// ProgressFunc is called from a single goroutine as a transfer goes, and
+// once more when it ends.
+type ProgressFunc func(Progress)
+
+// Client makes transfers on behalf of a logged-in session.
+type Client struct {
+	session *xenapi.Session
+	ref     xenapi.SessionRef
+	base    *url.URL
+	headers map[string]string
+	http    *http.Client
+	// PollInterval is how often a transfer reads its task's progress.
+	PollInterval time.Duration
+}
+
+// NewClient returns a client for the server session is logged in to, with
+// ref the reference it is logged in with, such as PoolSession.Current
+// returns. opts must be the options the session was created with: the SDK
+// keeps its HTTP transport to itself, so the client sets up its own the
+// same way.
+func NewClient(session *xenapi.Session, ref xenapi.SessionRef, opts *xenapi.ClientOpts) (*Client, error) {
+	base, err := url.Parse(opts.URL)
+	if err != nil {
+		return nil, err
+	}
+	client, err := xsutil.HTTPClient(opts)
+	if err != nil {
+		return nil, err
+	}
+	return &Client{
+		session:      session,
+		ref:          ref,
+		base:         base,
+		headers:      opts.Headers,
+		http:         client,
+		PollInterval: DefaultPollInterval,
+	}, nil
+}
+
+// request describes one transfer.
+type request struct {
+	method string
+	path   string
+	query  url.Values
+	// label names the task, e.g. "export VM".
+	label string
+	// body is what to send, and size its length; XAPI does not accept
+	// HTTP's chunked transfer encoding.
+	body io.Reader
+	size int64
+	// receive reads the response to a successful request.
+	receive  func(io.Reader) error
+	progress ProgressFunc
+}
+
+// do runs a transfer under a new task and returns the task's result. If
+// ctx ends, or sending or receiving fails, the task is cancelled so that
+// the server abandons the transfer.
+func (c *Client) do(ctx context.Context, r request) (string, error) {
+	task, err := xenapi.Task.Create(c.session, r.label, "")
+	if err != nil {
+		return "", xsutil.Decode(err)
+	}
+	defer xenapi.Task.Destroy(c.session, task)
+
+	var bytes atomic.Int64
+	stop := c.watch(task, &bytes, r.size, r.progress)
+	result, err := c.run(ctx, task, r, &bytes)
+	stop()
+	if err != nil {
+		// Best effort: the task may already have failed on its own.
+		xenapi.Task.Cancel(c.session, task)
+		return "", err
+	}
+	return result, nil
+}
+
+func (c *Client) run(ctx context.Context, task xenapi.TaskRef, r request, bytes *atomic.Int64) (string, error) {
+	query := url.Values{}
+	for key, values := range r.query {
+		query[key] = values
+	}
+	query.Set("session_id", string(c.ref))
+	query.Set("task_id", string(task))
+	u := *c.base
+	u.Path = strings.TrimSuffix(u.Path, "/") + r.path
+	u.RawQuery = query.Encode()
+
+	var body io.Reader
+	if r.body != nil {
+		body = &countingReader{r: r.body, n: bytes}
+	}
+	req, err := http.NewRequestWithContext(ctx, r.method, u.String(), body)
+	if err != nil {
+		return "", err
+	}
+	if r.body != nil {
+		req.ContentLength = r.size
+	}
+	for key, value := range c.headers {
+		req.Header.Set(key, value)
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		if errorInfo, _ := xenapi.Task.GetErrorInfo(c.session, task); len(errorInfo) > 0 {
+			return "", xsutil.ParseFailure(errorInfo)
+		}
+		return "", fmt.Errorf("%s %s: %s: %s", r.method, r.path, resp.Status, strings.TrimSpace(string(message)))
+	}
+	if r.receive != nil {
+		if err := r.receive(&countingReader{r: resp.Body, n: bytes}); err != nil {
+			return "", err
+		}
+	}
+	return xsutil.WaitForTask(ctx, c.session, task)
+}
+
+// watch calls progress every PollInterval with the bytes counted so far
+// and the task's progress, until the returned function is called.
+func (c *Client) watch(task xenapi.TaskRef, bytes *atomic.Int64, total int64, progress ProgressFunc) func() {
+	if progress == nil {
+		return func() {}
+	}
+	done := make(chan struct{})
+	finished := make(chan struct{})
+	go func() {
+		defer close(finished)
+		ticker := time.NewTicker(c.PollInterval)
+		defer ticker.Stop()
+		var taskProgress float64
+		report := func() {
+			if p, err := xenapi.Task.GetProgress(c.session, task); err == nil {
+				taskProgress = p
+			}
+			progress(Progress{Bytes: bytes.Load(), Total: total, Task: taskProgress})
+		}
+		for {
+			select {
+			case <-ticker.C:
+				report()
+			case <-done:
+				report()
+				return
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		<-finished
+	}
+}
+
+// countingReader adds the bytes read through it to n.
+type countingReader struct {
+	r io.Reader
+	n *atomic.Int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.n.Add(int64(n))
+	return n, err
+}
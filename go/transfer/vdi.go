@@ -0,0 +1,227 @@
+package transfer
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+
+	"xenapi"
+)
+
+// Formats of a disk image.
+const (
+	FormatRaw = "raw"
+	FormatVHD = "vhd"
+)
+
+// SparseBlockSize is the granularity at which a sparse upload looks for
+// blocks of zeros to leave out.
+const SparseBlockSize = 1 << 20
+
+// chunkHeaderSize is the size of the header XAPI's chunked upload puts in
+// front of each run of data: its offset as a little-endian uint64, then
+// its length as a little-endian uint32. A header of length 0 ends the
+// upload.
+const chunkHeaderSize = 12
+
+// VDIExportOptions adjust ExportVDI.
+type VDIExportOptions struct {
+	// Format is FormatRaw, the default, or FormatVHD.
+	Format string
+	// Base, if set, makes the export differential: only the blocks that
+	// differ from Base, typically an older snapshot of the same disk, are
+	// included. It is meant for FormatVHD.
+	Base     xenapi.VDIRef
+	Progress ProgressFunc
+}
+
+// ExportVDI streams the contents of vdi to w and returns the SHA-256 of
+// what was written, in hex.
+func (c *Client) ExportVDI(ctx context.Context, vdi xenapi.VDIRef, w io.Writer, opts VDIExportOptions) (string, error) {
+	format, err := checkFormat(opts.Format)
+	if err != nil {
+		return "", err
+	}
+	query := url.Values{"vdi": {string(vdi)}, "format": {format}}
+	if opts.Base != "" {
+		query.Set("base", string(opts.Base))
+	}
+	sum := sha256.New()
+	_, err = c.do(ctx, request{
+		method: http.MethodGet,
+		path:   "/export_raw_vdi",
+		query:  query,
+		label:  "export " + string(vdi),
+		receive: func(r io.Reader) error {
+			_, err := io.Copy(io.MultiWriter(w, sum), r)
+			return err
+		},
+		progress: opts.Progress,
+	})
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(sum.Sum(nil)), nil
+}
+
+// VDIImportOptions adjust ImportVDI.
+type VDIImportOptions struct {
+	// Format is FormatRaw, the default, or FormatVHD.
+	Format string
+	// Size is the length of the image. It may be left out when importing
+	// from an *os.File.
+	Size int64
+	// SHA256, if set, is the hex digest the image must have, as ExportVDI
+	// returns it. A sparse upload checks it before sending anything; any
+	// other is cut off before its last byte if it does not match.
+	SHA256 string
+	// Sparse leaves out the blocks of a raw image that are all zeros,
+	// which suits a freshly created VDI. It needs the image to be an
+	// io.ReaderAt, such as an *os.File, as it is read twice.
+	Sparse   bool
+	Progress ProgressFunc
+}
+
+// ImportVDI overwrites the contents of vdi with the image read from r.
+func (c *Client) ImportVDI(ctx context.Context, vdi xenapi.VDIRef, r io.Reader, opts VDIImportOptions) error {
+	format, err := checkFormat(opts.Format)
+	if err != nil {
+		return err
+	}
+	size, err := streamSize(r, opts.Size)
+	if err != nil {
+		return err
+	}
+	query := url.Values{"vdi": {string(vdi)}, "format": {format}}
+	body, bodySize := r, size
+	switch {
+	case opts.Sparse:
+		if format != FormatRaw {
+			return fmt.Errorf("sparse uploads need a raw image, not %s", format)
+		}
+		at, ok := r.(io.ReaderAt)
+		if !ok {
+			return errors.New("sparse uploads need an io.ReaderAt to read the image from")
+		}
+		blocks, err := dataBlocks(at, size, opts.SHA256)
+		if err != nil {
+			return err
+		}
+		body, bodySize = newSparseReader(at, blocks), sparseSize(blocks)
+		query.Set("chunked", "true")
+	case opts.SHA256 != "":
+		body, err = newVerifyingReader(r, size, opts.SHA256)
+		if err != nil {
+			return err
+		}
+	}
+	_, err = c.do(ctx, request{
+		method:   http.MethodPut,
+		path:     "/import_raw_vdi",
+		query:    query,
+		label:    "import " + string(vdi),
+		body:     body,
+		size:     bodySize,
+		progress: opts.Progress,
+	})
+	return err
+}
+
+func checkFormat(format string) (string, error) {
+	switch format {
+	case "":
+		return FormatRaw, nil
+	case FormatRaw, FormatVHD:
+		return format, nil
+	}
+	return "", fmt.Errorf("unknown disk format %q", format)
+}
+
+// block is a run of data in a sparse image.
+type block struct {
+	offset int64
+	length int64
+}
+
+// dataBlocks reads the image and returns the runs of blocks that are not
+// all zeros, merging neighbours. If digest is set, the image must have it.
+func dataBlocks(r io.ReaderAt, size int64, digest string) ([]block, error) {
+	var want []byte
+	if digest != "" {
+		var err error
+		if want, err = hex.DecodeString(digest); err != nil || len(want) != sha256.Size {
+			return nil, fmt.Errorf("%q is not a SHA-256 digest", digest)
+		}
+	}
+	sum := sha256.New()
+	buf := make([]byte, SparseBlockSize)
+	zeros := make([]byte, SparseBlockSize)
+	var blocks []block
+	for offset := int64(0); offset < size; offset += SparseBlockSize {
+		n := min(size-offset, SparseBlockSize)
+		if read, err := r.ReadAt(buf[:n], offset); err != nil && !(err == io.EOF && int64(read) == n) {
+			return nil, err
+		}
+		sum.Write(buf[:n])
+		if bytes.Equal(buf[:n], zeros[:n]) {
+			continue
+		}
+		if last := len(blocks) - 1; last >= 0 && blocks[last].offset+blocks[last].length == offset {
+			blocks[last].length += n
+		} else {
+			blocks = append(blocks, block{offset: offset, length: n})
+		}
+	}
+	if want != nil && !bytes.Equal(sum.Sum(nil), want) {
+		return nil, fmt.Errorf("%w: got %x, expected %x", ErrChecksumMismatch, sum.Sum(nil), want)
+	}
+	return splitBlocks(blocks), nil
+}
+
+// splitBlocks cuts runs longer than a chunk header can describe.
+func splitBlocks(blocks []block) []block {
+	const maxChunk = 1 << 30
+	var split []block
+	for _, b := range blocks {
+		for b.length > maxChunk {
+			split = append(split, block{offset: b.offset, length: maxChunk})
+			b.offset, b.length = b.offset+maxChunk, b.length-maxChunk
+		}
+		split = append(split, b)
+	}
+	return split
+}
+
+// sparseSize is the length of the chunked upload of blocks.
+func sparseSize(blocks []block) int64 {
+	size := int64(chunkHeaderSize)
+	for _, b := range blocks {
+		size += chunkHeaderSize + b.length
+	}
+	return size
+}
+
+// newSparseReader returns the chunked upload of blocks of r: each block
+// behind its header, then the empty header that ends the upload.
+func newSparseReader(r io.ReaderAt, blocks []block) io.Reader {
+	var parts []io.Reader
+	for _, b := range blocks {
+		parts = append(parts, bytes.NewReader(chunkHeader(b.offset, b.length)), io.NewSectionReader(r, b.offset, b.length))
+	}
+	parts = append(parts, bytes.NewReader(chunkHeader(0, 0)))
+	return io.MultiReader(parts...)
+}
+
+func chunkHeader(offset, length int64) []byte {
+	header := make([]byte, chunkHeaderSize)
+	binary.LittleEndian.PutUint64(header, uint64(offset))
+	binary.LittleEndian.PutUint32(header[8:], uint32(length))
+	return header
+}
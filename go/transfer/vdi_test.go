@@ -0,0 +1,187 @@
+package transfer
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"xenapi"
+
+	"github.com/xenserver/xenserver-samples/go/fakexapi"
+)
+
+func (s *standIn) exportVDI(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	s.queries <- query
+	var exists bool
+	s.server.Do(func(st *fakexapi.Store) { exists = st.Exists("VDI", query.Get("vdi")) })
+	if !s.server.ValidSession(query.Get("session_id")) || !exists {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+	w.Write(s.image)
+	s.finish(query.Get("task_id"), fakexapi.Record{"status": "success", "progress": 1.0})
+}
+
+// importVDI takes a raw image, or with chunked=true the chunks of one,
+// which it lays out over a disk of the VDI's size.
+func (s *standIn) importVDI(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	task := query.Get("task_id")
+	var vdi fakexapi.Record
+	var exists bool
+	s.server.Do(func(st *fakexapi.Store) { vdi, exists = st.Get("VDI", query.Get("vdi")) })
+	if !s.server.ValidSession(query.Get("session_id")) || !exists {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+	data, err := io.ReadAll(r.Body)
+	if err == nil && int64(len(data)) != r.ContentLength {
+		err = io.ErrUnexpectedEOF
+	}
+	if err == nil && query.Get("chunked") == "true" {
+		disk := make([]byte, vdi.Int("virtual_size"))
+		for rest := data; ; {
+			offset, length := binary.LittleEndian.Uint64(rest), binary.LittleEndian.Uint32(rest[8:])
+			if length == 0 {
+				break
+			}
+			copy(disk[offset:], rest[12:12+length])
+			rest = rest[12+length:]
+		}
+		s.imports <- disk
+	} else {
+		s.imports <- data
+	}
+	if err != nil {
+		s.finish(task, fakexapi.Record{"status": "failure", "error_info": []string{"IMPORT_ERROR", err.Error()}})
+		return
+	}
+	s.finish(task, fakexapi.Record{"status": "success", "progress": 1.0})
+}
+
+func newVDI(t *testing.T, session *xenapi.Session, size int64) xenapi.VDIRef {
+	srs, err := xenapi.SR.GetByNameLabel(session, "Local storage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	vdi, err := xenapi.VDI.Create(session, xenapi.VDIRecord{
+		NameLabel: "golden image", SR: srs[0], VirtualSize: int(size), Type: xenapi.VdiTypeUser,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return vdi
+}
+
+func TestExportVDI(t *testing.T) {
+	s, client, session := newStandIn(t)
+	vdi := newVDI(t, session, int64(len(s.image)))
+	base := newVDI(t, session, int64(len(s.image)))
+
+	var out bytes.Buffer
+	digest, err := client.ExportVDI(context.Background(), vdi, &out, VDIExportOptions{Format: FormatVHD, Base: base})
+	if err != nil {
+		t.Fatal(err)
+	}
+	query := <-s.queries
+	if query.Get("format") != FormatVHD || query.Get("base") != string(base) || query.Get("vdi") != string(vdi) {
+		t.Log("Unexpected query:", query)
+		t.Fail()
+	}
+	want := sha256.Sum256(s.image)
+	if digest != hex.EncodeToString(want[:]) || !bytes.Equal(out.Bytes(), s.image) {
+		t.Log("The export does not match the image")
+		t.Fail()
+	}
+
+	if _, err := client.ExportVDI(context.Background(), vdi, &out, VDIExportOptions{Format: "qcow2"}); err == nil {
+		t.Log("Expected an unknown format to fail")
+		t.Fail()
+	}
+}
+
+func TestImportVDI(t *testing.T) {
+	s, client, session := newStandIn(t)
+	vdi := newVDI(t, session, int64(len(s.image)))
+	digest := sha256.Sum256(s.image)
+
+	err := client.ImportVDI(context.Background(), vdi, bytes.NewReader(s.image), VDIImportOptions{
+		Size: int64(len(s.image)), SHA256: hex.EncodeToString(digest[:]),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if imported := <-s.imports; !bytes.Equal(imported, s.image) {
+		t.Log("The import does not match the image")
+		t.Fail()
+	}
+
+	wrong := sha256.Sum256(nil)
+	err = client.ImportVDI(context.Background(), vdi, bytes.NewReader(s.image), VDIImportOptions{
+		Size: int64(len(s.image)), SHA256: hex.EncodeToString(wrong[:]),
+	})
+	if !errors.Is(err, ErrChecksumMismatch) {
+		t.Log("Expected a checksum mismatch, got:", err)
+		t.Fail()
+	}
+	if imported := <-s.imports; len(imported) >= len(s.image) {
+		t.Log("The server received the whole damaged image")
+		t.Fail()
+	}
+}
+
+func TestImportVDISparse(t *testing.T) {
+	s, client, session := newStandIn(t)
+	// Four blocks of which the second and the last are empty, and a tail.
+	image := make([]byte, 4*SparseBlockSize+100)
+	copy(image, s.image[:SparseBlockSize])
+	copy(image[2*SparseBlockSize:], s.image[SparseBlockSize:2*SparseBlockSize])
+	copy(image[4*SparseBlockSize:], s.image[:100])
+	path := filepath.Join(t.TempDir(), "disk.raw")
+	if err := os.WriteFile(path, image, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	vdi := newVDI(t, session, int64(len(image)))
+	digest := sha256.Sum256(image)
+
+	var last Progress
+	err = client.ImportVDI(context.Background(), vdi, f, VDIImportOptions{
+		Sparse: true, SHA256: hex.EncodeToString(digest[:]), Progress: func(p Progress) { last = p },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if imported := <-s.imports; !bytes.Equal(imported, image) {
+		t.Log("The sparse import does not rebuild the image")
+		t.Fail()
+	}
+	if sent := int64(2*SparseBlockSize + 100 + 4*chunkHeaderSize); last.Bytes != sent || last.Total != sent {
+		t.Log("Expected the zero blocks to be left out, sent:", last)
+		t.Fail()
+	}
+
+	wrong := sha256.Sum256(nil)
+	err = client.ImportVDI(context.Background(), vdi, f, VDIImportOptions{Sparse: true, SHA256: hex.EncodeToString(wrong[:])})
+	if !errors.Is(err, ErrChecksumMismatch) {
+		t.Log("Expected a checksum mismatch before sending, got:", err)
+		t.Fail()
+	}
+	if err := client.ImportVDI(context.Background(), vdi, f, VDIImportOptions{Sparse: true, Format: FormatVHD}); err == nil {
+		t.Log("Expected a sparse VHD upload to fail")
+		t.Fail()
+	}
+}
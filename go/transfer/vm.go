@@ -0,0 +1,188 @@
+package transfer
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+
+	"xenapi"
+)
+
+// Compression of an exported XVA.
+const (
+	CompressionNone = ""
+	CompressionGzip = "gzip"
+	CompressionZstd = "zstd"
+)
+
+// ExportOptions adjust ExportVM.
+type ExportOptions struct {
+	// Compression is one of the Compression constants.
+	Compression string
+	Progress    ProgressFunc
+}
+
+// ExportVM streams vm, which must be halted or a snapshot, to w as an XVA
+// and returns the SHA-256 of what was written, in hex. Nothing is held in
+// memory beyond the copy buffer.
+func (c *Client) ExportVM(ctx context.Context, vm xenapi.VMRef, w io.Writer, opts ExportOptions) (string, error) {
+	query := url.Values{"ref": {string(vm)}}
+	switch opts.Compression {
+	case CompressionNone:
+	case CompressionGzip:
+		query.Set("use_compression", "true")
+	case CompressionZstd:
+		query.Set("use_compression", "zstd")
+	default:
+		return "", fmt.Errorf("unknown compression %q", opts.Compression)
+	}
+	sum := sha256.New()
+	_, err := c.do(ctx, request{
+		method: http.MethodGet,
+		path:   "/export",
+		query:  query,
+		label:  "export " + string(vm),
+		receive: func(r io.Reader) error {
+			_, err := io.Copy(io.MultiWriter(w, sum), r)
+			return err
+		},
+		progress: opts.Progress,
+	})
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(sum.Sum(nil)), nil
+}
+
+// ImportOptions adjust ImportVM.
+type ImportOptions struct {
+	// SR receives the VM's disks; the pool's default SR if empty.
+	SR xenapi.SRRef
+	// Size is the length of the XVA. It may be left out when importing
+	// from an *os.File.
+	Size int64
+	// SHA256, if set, is the hex digest the XVA must have, as ExportVM
+	// returns it. A stream that does not match is cut off before its last
+	// byte, so the server never completes the import.
+	SHA256 string
+	// Restore keeps the VM's identity, such as its MAC addresses, for
+	// restoring a backup rather than making a copy.
+	Restore bool
+	// Force imports even if the XVA's checksums do not match.
+	Force    bool
+	Progress ProgressFunc
+}
+
+// ErrChecksumMismatch is returned when an import's stream does not have
+// the SHA-256 the options asked for.
+var ErrChecksumMismatch = errors.New("checksum mismatch")
+
+// opaqueRef finds references in a task result, which XAPI formats as an
+// XML-RPC value.
+var opaqueRef = regexp.MustCompile(`OpaqueRef:[0-9A-Za-z-]+`)
+
+// ImportVM streams an XVA from r to the server and returns the VMs it
+// created.
+func (c *Client) ImportVM(ctx context.Context, r io.Reader, opts ImportOptions) ([]xenapi.VMRef, error) {
+	size, err := streamSize(r, opts.Size)
+	if err != nil {
+		return nil, err
+	}
+	if opts.SHA256 != "" {
+		r, err = newVerifyingReader(r, size, opts.SHA256)
+		if err != nil {
+			return nil, err
+		}
+	}
+	query := url.Values{}
+	if opts.SR != "" {
+		query.Set("sr_id", string(opts.SR))
+	}
+	if opts.Restore {
+		query.Set("restore", "true")
+	}
+	if opts.Force {
+		query.Set("force", "true")
+	}
+	result, err := c.do(ctx, request{
+		method:   http.MethodPut,
+		path:     "/import",
+		query:    query,
+		label:    "import VM",
+		body:     r,
+		size:     size,
+		progress: opts.Progress,
+	})
+	if err != nil {
+		return nil, err
+	}
+	var vms []xenapi.VMRef
+	for _, ref := range opaqueRef.FindAllString(result, -1) {
+		vms = append(vms, xenapi.VMRef(ref))
+	}
+	return vms, nil
+}
+
+// streamSize returns size, or if it is 0 the size of r if r is a file.
+func streamSize(r io.Reader, size int64) (int64, error) {
+	if size > 0 {
+		return size, nil
+	}
+	if f, ok := r.(*os.File); ok {
+		info, err := f.Stat()
+		if err != nil {
+			return 0, err
+		}
+		return info.Size(), nil
+	}
+	return 0, errors.New("the size of the stream is needed, as XAPI does not accept chunked transfer encoding")
+}
+
+// verifyingReader passes size bytes through, hashing them as they come,
+// and fails instead of passing on the read that completes the stream if
+// the hash is wrong.
+type verifyingReader struct {
+	r    io.Reader
+	left int64
+	want []byte
+	sum  hash.Hash
+}
+
+func newVerifyingReader(r io.Reader, size int64, digest string) (*verifyingReader, error) {
+	want, err := hex.DecodeString(digest)
+	if err != nil || len(want) != sha256.Size {
+		return nil, fmt.Errorf("%q is not a SHA-256 digest", digest)
+	}
+	return &verifyingReader{r: r, left: size, want: want, sum: sha256.New()}, nil
+}
+
+func (v *verifyingReader) Read(p []byte) (int, error) {
+	if v.left <= 0 {
+		return 0, io.EOF
+	}
+	if int64(len(p)) > v.left {
+		p = p[:v.left]
+	}
+	n, err := io.ReadFull(v.r, p)
+	if err == io.ErrUnexpectedEOF || err == io.EOF {
+		return 0, fmt.Errorf("stream ended %d bytes early", v.left-int64(n))
+	}
+	if err != nil {
+		return 0, err
+	}
+	v.sum.Write(p[:n])
+	v.left -= int64(n)
+	if v.left == 0 && !bytes.Equal(v.sum.Sum(nil), v.want) {
+		return 0, fmt.Errorf("%w: got %x, expected %x", ErrChecksumMismatch, v.sum.Sum(nil), v.want)
+	}
+	return n, nil
+}
@@ -0,0 +1,209 @@
+package transfer
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"xenapi"
+
+	"github.com/xenserver/xenserver-samples/go/fakexapi"
+	"github.com/xenserver/xenserver-samples/go/xsutil"
+)
+
+// standIn serves /export and /import the way XAPI does, closely enough
+// for the client: the session and task come as query parameters, and the
+// task carries the outcome once the stream is done.
+type standIn struct {
+	server *fakexapi.Server
+	// image is what /export sends; slow makes it send the first MiB and
+	// then wait for the client to go away.
+	image []byte
+	slow  bool
+	// imports gets what each /import or /import_raw_vdi received, and
+	// queries the query of each /export_raw_vdi.
+	imports chan []byte
+	queries chan url.Values
+}
+
+func newStandIn(t *testing.T) (*standIn, *Client, *xenapi.Session) {
+	server := fakexapi.NewServer()
+	t.Cleanup(server.Close)
+	image := make([]byte, 3<<20+17)
+	rand.New(rand.NewSource(1)).Read(image)
+	s := &standIn{server: server, image: image, imports: make(chan []byte, 1), queries: make(chan url.Values, 1)}
+	server.HandleHTTP("/export", http.HandlerFunc(s.export))
+	server.HandleHTTP("/import", http.HandlerFunc(s.importVM))
+	server.HandleHTTP("/export_raw_vdi", http.HandlerFunc(s.exportVDI))
+	server.HandleHTTP("/import_raw_vdi", http.HandlerFunc(s.importVDI))
+
+	opts := &xenapi.ClientOpts{URL: server.URL()}
+	pool, err := xsutil.Connect(opts, xsutil.Credentials{Username: server.Username, Password: server.Password})
+	if err != nil {
+		t.Fatal(err)
+	}
+	session, ref := pool.Current()
+	client, err := NewClient(session, ref, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.PollInterval = 5 * time.Millisecond
+	return s, client, session
+}
+
+func (s *standIn) finish(task string, fields fakexapi.Record) {
+	s.server.Do(func(st *fakexapi.Store) {
+		st.Update("task", task, fields)
+	})
+}
+
+func (s *standIn) export(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	task := query.Get("task_id")
+	var exists bool
+	s.server.Do(func(st *fakexapi.Store) { exists = st.Exists("VM", query.Get("ref")) })
+	if !s.server.ValidSession(query.Get("session_id")) || !exists {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+	if s.slow {
+		w.Write(s.image[:1<<20])
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+		s.finish(task, fakexapi.Record{"status": "failure", "error_info": []string{"CLIENT_ERROR"}})
+		return
+	}
+	s.finish(task, fakexapi.Record{"progress": 0.5})
+	w.Write(s.image)
+	s.finish(task, fakexapi.Record{"status": "success", "progress": 1.0})
+}
+
+func (s *standIn) importVM(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	task := query.Get("task_id")
+	if !s.server.ValidSession(query.Get("session_id")) {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+	data, err := io.ReadAll(r.Body)
+	defer func() { s.imports <- data }()
+	if err != nil || int64(len(data)) != r.ContentLength {
+		s.finish(task, fakexapi.Record{"status": "failure", "error_info": []string{"IMPORT_ERROR", "truncated"}})
+		return
+	}
+	var vm string
+	s.server.Do(func(st *fakexapi.Store) {
+		vm = st.Create("VM", fakexapi.Record{"name_label": "imported"})
+		st.Update("task", task, fakexapi.Record{
+			"status": "success", "progress": 1.0,
+			"result": "<value><array><data><value>" + vm + "</value></data></array></value>",
+		})
+	})
+}
+
+func findVM(t *testing.T, session *xenapi.Session, name string) xenapi.VMRef {
+	vms, err := xenapi.VM.GetByNameLabel(session, name)
+	if err != nil || len(vms) == 0 {
+		t.Fatal("VM not found:", name, err)
+	}
+	return vms[0]
+}
+
+func TestExportImport(t *testing.T) {
+	s, client, session := newStandIn(t)
+	vm := findVM(t, session, fakexapi.LinuxTemplate)
+
+	var out bytes.Buffer
+	var last Progress
+	digest, err := client.ExportVM(context.Background(), vm, &out, ExportOptions{Progress: func(p Progress) { last = p }})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := sha256.Sum256(s.image)
+	if digest != hex.EncodeToString(want[:]) || !bytes.Equal(out.Bytes(), s.image) {
+		t.Fatal("The export does not match the image")
+	}
+	if last.Bytes != int64(len(s.image)) || last.Task != 1 {
+		t.Log("Unexpected final progress:", last)
+		t.Fail()
+	}
+
+	vms, err := client.ImportVM(context.Background(), bytes.NewReader(out.Bytes()), ImportOptions{
+		Size: int64(out.Len()), SHA256: digest,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if imported := <-s.imports; len(vms) != 1 || !bytes.Equal(imported, s.image) {
+		t.Fatal("Unexpected import:", vms, len(imported))
+	}
+	if name, err := xenapi.VM.GetNameLabel(session, vms[0]); err != nil || name != "imported" {
+		t.Log("The imported VM was not found:", name, err)
+		t.Fail()
+	}
+
+	if _, err := client.ImportVM(context.Background(), &out, ImportOptions{}); err == nil {
+		t.Log("Expected an import of unknown size to fail")
+		t.Fail()
+	}
+}
+
+func TestImportChecksumMismatch(t *testing.T) {
+	s, client, session := newStandIn(t)
+	before, err := xenapi.VM.GetAll(session)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wrong := sha256.Sum256([]byte("something else"))
+	_, err = client.ImportVM(context.Background(), bytes.NewReader(s.image), ImportOptions{
+		Size: int64(len(s.image)), SHA256: hex.EncodeToString(wrong[:]),
+	})
+	if !errors.Is(err, ErrChecksumMismatch) {
+		t.Fatal("Expected a checksum mismatch, got:", err)
+	}
+	if imported := <-s.imports; len(imported) >= len(s.image) {
+		t.Log("The server received the whole stream")
+		t.Fail()
+	}
+	after, err := xenapi.VM.GetAll(session)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(after) != len(before) {
+		t.Log("A VM was imported from a damaged stream")
+		t.Fail()
+	}
+}
+
+func TestExportCancel(t *testing.T) {
+	s, client, session := newStandIn(t)
+	s.slow = true
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	_, err := client.ExportVM(ctx, findVM(t, session, fakexapi.LinuxTemplate), io.Discard, ExportOptions{
+		Progress: func(p Progress) {
+			if p.Bytes >= 1<<20 {
+				cancel()
+			}
+		},
+	})
+	if !errors.Is(err, context.Canceled) {
+		t.Fatal("Expected the export to be cancelled, got:", err)
+	}
+	tasks, err := xenapi.Task.GetAll(session)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tasks) != 0 {
+		t.Log("The export left its task behind:", tasks)
+		t.Fail()
+	}
+}
@@ -1,106 +1,165 @@
 package testGoSDK
 
 import (
+	"context"
+	"errors"
 	"fmt"
-	"log"
 	"strings"
+	"testing"
 	"time"
 
 	"xenapi"
+
+	"github.com/xenserver/xenserver-samples/go/xsutil"
 )
 
+var cache *xsutil.Cache
+
+// cacheSession is the session cache was built with.
+var cacheSession *xenapi.Session
+
+// notFound is the error the lookups below return when the pool has
+// nothing that fits, as opposed to when they cannot tell.
+type notFound string
+
+func (e notFound) Error() string { return string(e) }
+
+// objectCache returns the mirror of pool state that the helpers below
+// query, creating it on first use and bringing it up to date. The cache is
+// built again after poolSession logs in anew, and after it fails to sync,
+// so that one failure does not leave the helpers with a broken mirror.
+func objectCache() (*xsutil.Cache, error) {
+	current := session
+	if poolSession != nil {
+		current = poolSession.Session()
+	}
+	if cache != nil && cacheSession != current {
+		resetCache()
+	}
+	if cache == nil {
+		c, err := xsutil.NewCache(context.Background(), current, "pool", "host", "sm", "sr", "pbd", "vm", "vm_guest_metrics")
+		if err != nil {
+			return nil, err
+		}
+		cache, cacheSession = c, current
+	}
+	if err := cache.Sync(context.Background()); err != nil {
+		resetCache()
+		return nil, err
+	}
+	return cache, nil
+}
+
+// resetCache stops the cache so that the next objectCache builds a new one.
+func resetCache() {
+	cache.Close()
+	cache, cacheSession = nil, nil
+}
+
+// TrackObjects returns a tracker for the objects a test creates. Whatever
+// is still there when the test ends is removed, whether it passed or not.
+// The objects are marked so that cmd/sweep can find them if the test run
+// dies before cleaning up.
+func TrackObjects(t testing.TB) *xsutil.Tracker {
+	tracker := xsutil.NewTracker(session)
+	tracker.Mark()
+	t.Cleanup(func() {
+		if err := tracker.Cleanup(); err != nil {
+			t.Log(err)
+			t.Fail()
+		}
+	})
+	return tracker
+}
+
 func GetFirstTemplate(templateName string) (xenapi.VMRef, string, error) {
-	records, err := xenapi.VM.GetAllRecords(session)
+	c, err := objectCache()
 	if err != nil {
 		return "", "", err
 	}
 	// Get the first VM template
-	for ref, record := range records {
-		if record.IsATemplate && strings.Contains(record.NameLabel, templateName) {
-			return ref, record.NameLabel, nil
-		}
-	}
-	return "", "", fmt.Errorf("No VM template found.")
+	refs := xsutil.Find(c, "vm", func(ref xenapi.VMRef, record xenapi.VMRecord) bool {
+		return record.IsATemplate && strings.Contains(record.NameLabel, templateName)
+	})
+	if len(refs) == 0 {
+		return "", "", notFound("No VM template found.")
+	}
+	record, _ := xsutil.Record[xenapi.VMRef, xenapi.VMRecord](c, "vm", refs[0])
+	return refs[0], record.NameLabel, nil
 }
 
 func GetStorage() (xenapi.SRRef, error) {
-	pools, err := xenapi.Pool.GetAll(session)
+	c, err := objectCache()
 	if err != nil {
 		return "", err
 	}
-	defaultSRRef, err := xenapi.Pool.GetDefaultSR(session, pools[0])
-	if err != nil {
-		return "", err
-	}
-	if defaultSRRef != "" {
-		return defaultSRRef, nil
+	pools := xsutil.Records[xenapi.PoolRef, xenapi.PoolRecord](c, "pool")
+	for _, pool := range pools {
+		if pool.DefaultSR != "" {
+			return pool.DefaultSR, nil
+		}
 	}
 
-	srRecords, err := xenapi.SR.GetAllRecords(session)
-	if err != nil {
-		return "", err
-	}
-	hostRecords, err := xenapi.Host.GetAllRecords(session)
-	if err != nil {
-		return "", err
-	}
-	for srRef, srRecord := range srRecords {
-		flag, err := CanCreateVdi(srRecord.Type)
-		if err != nil {
-			return "", err
-		}
-		if srRecord.Shared || strings.Compare(srRecord.ContentType, "iso") == 0 || !flag {
-			continue
+	srRefs := xsutil.Find(c, "sr", func(ref xenapi.SRRef, srRecord xenapi.SRRecord) bool {
+		if srRecord.Shared || strings.Compare(srRecord.ContentType, "iso") == 0 || !canCreateVdi(c, srRecord.Type) {
+			return false
 		}
 		for _, pbdRef := range srRecord.PBDs {
-			attached, err := xenapi.PBD.GetCurrentlyAttached(session, pbdRef)
-			if err != nil {
-				return "", err
-			}
-			if !attached {
+			pbdRecord, ok := xsutil.Record[xenapi.PBDRef, xenapi.PBDRecord](c, "pbd", pbdRef)
+			if !ok || !pbdRecord.CurrentlyAttached {
 				continue
 			}
-			for _, hostRecord := range hostRecords {
-				ref, err := xenapi.PBD.GetHost(session, pbdRef)
-				if err != nil {
-					return "", err
-				}
-				uuid, err := xenapi.Host.GetUUID(session, ref)
-				if err != nil {
-					return "", err
-				}
-				if uuid == hostRecord.UUID {
-					return srRef, nil
-				}
+			if _, ok := xsutil.Record[xenapi.HostRef, xenapi.HostRecord](c, "host", pbdRecord.Host); ok {
+				return true
 			}
 		}
+		return false
+	})
+	if len(srRefs) == 0 {
+		return "", notFound("No SR found.")
 	}
-
-	return "", fmt.Errorf("No SR found.")
+	return srRefs[0], nil
 }
 
-func CanCreateVdi(srType string) (bool, error) {
-	smRefs, err := xenapi.SM.GetAll(session)
+// GetOtherStorage returns an SR other than srRef that can create VDIs and
+// is plugged on a host, for moving disks to.
+func GetOtherStorage(srRef xenapi.SRRef) (xenapi.SRRef, error) {
+	c, err := objectCache()
 	if err != nil {
-		return false, err
+		return "", err
 	}
-	for _, smRef := range smRefs {
-		smType, err := xenapi.SM.GetType(session, smRef)
-		if err != nil {
-			return false, err
+	srRefs := xsutil.Find(c, "sr", func(ref xenapi.SRRef, srRecord xenapi.SRRecord) bool {
+		if ref == srRef || srRecord.ContentType == "iso" || !canCreateVdi(c, srRecord.Type) {
+			return false
 		}
-		if strings.Compare(smType, srType) == 0 {
-			features, err := xenapi.SM.GetFeatures(session, smRef)
-			if err != nil {
-				return false, err
-			}
-			_, ok := features["VDI_CREATE"]
-			if ok {
-				return true, nil
+		for _, pbdRef := range srRecord.PBDs {
+			pbdRecord, ok := xsutil.Record[xenapi.PBDRef, xenapi.PBDRecord](c, "pbd", pbdRef)
+			if ok && pbdRecord.CurrentlyAttached {
+				return true
 			}
 		}
+		return false
+	})
+	if len(srRefs) == 0 {
+		return "", notFound("No other SR found.")
+	}
+	return srRefs[0], nil
+}
+
+func CanCreateVdi(srType string) (bool, error) {
+	c, err := objectCache()
+	if err != nil {
+		return false, err
 	}
-	return false, nil
+	return canCreateVdi(c, srType), nil
+}
+
+func canCreateVdi(c *xsutil.Cache, srType string) bool {
+	smRefs := xsutil.Find(c, "sm", func(ref xenapi.SMRef, smRecord xenapi.SMRecord) bool {
+		_, ok := smRecord.Features["VDI_CREATE"]
+		return strings.Compare(smRecord.Type, srType) == 0 && ok
+	})
+	return len(smRefs) > 0
 }
 
 func GetFirstNetwork() (xenapi.NetworkRef, error) {
@@ -109,83 +168,59 @@ func GetFirstNetwork() (xenapi.NetworkRef, error) {
 		return "", err
 	}
 	if len(networkRefs) == 0 {
-		return "", fmt.Errorf("No network found.")
+		return "", notFound("No network found.")
 	}
 	return networkRefs[0], nil
 }
 
 func FindHaltedLinuxVM() (xenapi.VMRef, error) {
-	vmRecords, err := xenapi.VM.GetAllRecords(session)
+	c, err := objectCache()
 	if err != nil {
 		return "", err
 	}
-	var vmRefTest xenapi.VMRef
-	for ref, record := range vmRecords {
-		if !record.IsATemplate && !record.IsControlDomain && !strings.Contains(strings.ToLower(record.NameLabel), "windows") && record.PowerState == xenapi.VMPowerStateHalted {
-			vmRefTest = ref
-			break
-		}
+	vmRefs := xsutil.Find(c, "vm", func(ref xenapi.VMRef, record xenapi.VMRecord) bool {
+		return !record.IsATemplate && !record.IsControlDomain && !strings.Contains(strings.ToLower(record.NameLabel), "windows") && record.PowerState == xenapi.VMPowerStateHalted
+	})
+	if len(vmRefs) == 0 {
+		return "", notFound("Cannot find a halted linux VM. Please create one.")
 	}
-	if vmRefTest == "" {
-		return "", fmt.Errorf("Cannot find a halted linux VM. Please create one.")
+	// Prefer a VM with guest tools, which the power cycle test needs
+	for _, vmRef := range vmRefs {
+		if hasTools(c, vmRef) {
+			return vmRef, nil
+		}
 	}
-	return vmRefTest, nil
+	return vmRefs[0], nil
 }
 
-func WaitForTask(taskRef xenapi.TaskRef, delay int) error {
-	for {
-		status, err := xenapi.Task.GetStatus(session, taskRef)
-		if err != nil {
-			return err
-		}
-		if status == xenapi.TaskStatusTypePending || status == xenapi.TaskStatusTypeCancelling {
-			process, err := xenapi.Task.GetProgress(session, taskRef)
-			if err != nil {
-				return err
-			}
-			log.Printf("%.1f%% done", process*100.0)
-		}
-		if status == xenapi.TaskStatusTypeSuccess || status == xenapi.TaskStatusTypeFailure {
-			log.Printf("100%% done")
-			return nil
-		}
-		if status == xenapi.TaskStatusTypeCancelled {
-			return fmt.Errorf("Task was cancelled.")
-		}
+// hasTools reports whether the guest tools of the VM reported in when it
+// last ran.
+func hasTools(c *xsutil.Cache, vmRef xenapi.VMRef) bool {
+	record, _ := xsutil.Record[xenapi.VMRef, xenapi.VMRecord](c, "vm", vmRef)
+	metrics, ok := xsutil.Record[xenapi.VMGuestMetricsRef, xenapi.VMGuestMetricsRecord](c, "vm_guest_metrics", record.GuestMetrics)
+	return ok && (metrics.PVDriversUpToDate || metrics.Other["feature-suspend"] == "1")
+}
 
-		time.Sleep(time.Duration(delay) * time.Second)
-	}
-	return nil
+var TASK_TIMEOUT = 30 * time.Minute
+
+func WaitForTask(taskRef xenapi.TaskRef) error {
+	ctx, cancel := context.WithTimeout(context.Background(), TASK_TIMEOUT)
+	defer cancel()
+	_, err := xsutil.WaitForTask(ctx, session, taskRef)
+	return err
 }
 
+var SR_READY_TIMEOUT = 45 * time.Second
+
 func WaitForSRReady(session *xenapi.Session, srRefNew xenapi.SRRef) error {
-	IsSRCreated := func(event xenapi.EventRecord) bool {
-		if event.Class == "pbd"  {
-			pbdRecord := event.Snapshot.(map[string]interface{})
-			if pbdRecord["SR"].(string) == string(srRefNew) && pbdRecord["currently_attached"].(bool) {
-				return true
-			}
-		}
-		return false
+	ctx, cancel := context.WithTimeout(context.Background(), SR_READY_TIMEOUT)
+	defer cancel()
+	IsSRCreated := func(event xsutil.Event[xenapi.PBDRecord]) bool {
+		return event.Record.SR == srRefNew && event.Record.CurrentlyAttached
 	}
-	return WaitUntil(session, []string{"PBD"}, IsSRCreated)
-}
-
-func WaitUntil(session *xenapi.Session, eventTypes []string, fn func(xenapi.EventRecord) bool) error {
-	token := ""
-	maxTries := 3
-	for i := 0; i < maxTries; i++ {
-		eventBatch, err := xenapi.Event.From(session, eventTypes, token, 10.0)
-		if err != nil {
-			return err
-		}
-		token = eventBatch.Token
-		for _, event := range eventBatch.Events {
-			if fn(event) {
-				return nil
-			}
-		}
-		time.Sleep(time.Duration(5) * time.Second)
+	err := xsutil.WaitFor(ctx, session, "pbd", IsSRCreated)
+	if errors.Is(err, context.DeadlineExceeded) {
+		return fmt.Errorf("Cannot find an expected event.")
 	}
-	return fmt.Errorf("Cannot find an expected event.")
+	return err
 }
@@ -1,15 +1,20 @@
 package testGoSDK
 
 import (
-	"strings"
 	"testing"
 
 	"xenapi"
+
+	"github.com/xenserver/xenserver-samples/go/provision"
 )
 
 var NEW_VM_NAME = "GoSDK-TestVM"
 
 func TestVMCreateAndDestory(t *testing.T) {
+	Connected(t)
+	Require(t, NeedVDICreateSR)
+	objects := TrackObjects(t)
+
 	// Find a template
 	templateRef, templateName, err := GetFirstTemplate("Windows")
 	if err != nil {
@@ -27,6 +32,7 @@ func TestVMCreateAndDestory(t *testing.T) {
 		t.Fail()
 		return
 	}
+	objects.VM(vmRef)
 	vmRecord, err := xenapi.VM.GetRecord(session, vmRef)
 	if err != nil {
 		t.Log(err)
@@ -73,23 +79,23 @@ func TestVMCreateAndDestory(t *testing.T) {
 	vifRecord.Device = "0"
 	vifRecord.MTU = 1500
 	vifRecord.LockingMode = xenapi.VifLockingModeNetworkDefault
-	_, err = xenapi.VIF.Create(session, vifRecord)
+	vifRef, err := xenapi.VIF.Create(session, vifRecord)
 	if err != nil {
 		t.Log(err)
 		t.Fail()
 		return
 	}
+	objects.VIF(vifRef)
 	t.Log("Vif created")
 
 	// Put the SR uuid into the provision XML
-	otherConifg, err := xenapi.VM.GetOtherConfig(session, vmRef)
+	disks, err := provision.GetDisks(session, vmRef)
 	if err != nil {
 		t.Log(err)
 		t.Fail()
 		return
 	}
-	disks, ok := otherConifg["disks"]
-	if !ok {
+	if len(disks.Disks) == 0 {
 		t.Log("No disks found.")
 		t.Fail()
 		return
@@ -100,9 +106,8 @@ func TestVMCreateAndDestory(t *testing.T) {
 		t.Fail()
 		return
 	}
-	disks = strings.Replace(disks, "sr=\"\"", "sr=\""+srUuid+"\"", -1)
-	otherConifg["disks"] = disks
-	err = xenapi.VM.SetOtherConfig(session, vmRef, otherConifg)
+	disks.SetSR(srUuid)
+	err = provision.SetDisks(session, vmRef, disks)
 	if err != nil {
 		t.Log(err)
 		t.Fail()
@@ -116,12 +121,13 @@ func TestVMCreateAndDestory(t *testing.T) {
 	vbdRecord.Mode = xenapi.VbdModeRO
 	vbdRecord.Type = xenapi.VbdTypeCD
 	vbdRecord.Empty = true
-	_, err = xenapi.VBD.Create(session, vbdRecord)
+	vbdRef, err := xenapi.VBD.Create(session, vbdRecord)
 	if err != nil {
 		t.Log(err)
 		t.Fail()
 		return
 	}
+	objects.VBD(vbdRef)
 	t.Log("VBD created")
 
 	// Now provision the disks
@@ -133,6 +139,12 @@ func TestVMCreateAndDestory(t *testing.T) {
 		return
 	}
 	t.Log("provisioned.")
+	err = objects.VMDisks(vmRef)
+	if err != nil {
+		t.Log(err)
+		t.Fail()
+		return
+	}
 
 	// Should have done the trick. Let's see if it starts.
 	err = xenapi.VM.Start(session, vmRef, false, false)
@@ -161,6 +173,10 @@ func TestVMCreateAndDestory(t *testing.T) {
 }
 
 func TestVMAsyncCreateAndDestory(t *testing.T) {
+	Connected(t)
+	Require(t, NeedVDICreateSR)
+	objects := TrackObjects(t)
+
 	// Find a template
 	templateRef, templateName, err := GetFirstTemplate("Windows")
 	if err != nil {
@@ -178,13 +194,19 @@ func TestVMAsyncCreateAndDestory(t *testing.T) {
 		t.Fail()
 		return
 	}
-	err = WaitForTask(taskRef, 1)
+	err = WaitForTask(taskRef)
 	if err != nil {
 		t.Log(err)
 		t.Fail()
 		return
 	}
 	vmRefs, err := xenapi.VM.GetByNameLabel(session, NEW_VM_NAME)
+	if err != nil || len(vmRefs) == 0 {
+		t.Log("Cannot find the new VM:", err)
+		t.Fail()
+		return
+	}
+	objects.VM(vmRefs[0])
 	vmRecord, err := xenapi.VM.GetRecord(session, vmRefs[0])
 	if err != nil {
 		t.Log(err)
@@ -237,7 +259,7 @@ func TestVMAsyncCreateAndDestory(t *testing.T) {
 		t.Fail()
 		return
 	}
-	err = WaitForTask(taskRef, 1)
+	err = WaitForTask(taskRef)
 	if err != nil {
 		t.Log(err)
 		t.Fail()
@@ -246,14 +268,13 @@ func TestVMAsyncCreateAndDestory(t *testing.T) {
 	t.Log("Vif created")
 
 	// Put the SR uuid into the provision XML
-	otherConifg, err := xenapi.VM.GetOtherConfig(session, vmRefs[0])
+	disks, err := provision.GetDisks(session, vmRefs[0])
 	if err != nil {
 		t.Log(err)
 		t.Fail()
 		return
 	}
-	disks, ok := otherConifg["disks"]
-	if !ok {
+	if len(disks.Disks) == 0 {
 		t.Log("No disks found.")
 		t.Fail()
 		return
@@ -264,9 +285,8 @@ func TestVMAsyncCreateAndDestory(t *testing.T) {
 		t.Fail()
 		return
 	}
-	disks = strings.Replace(disks, "sr=\"\"", "sr=\""+srUuid+"\"", -1)
-	otherConifg["disks"] = disks
-	err = xenapi.VM.SetOtherConfig(session, vmRefs[0], otherConifg)
+	disks.SetSR(srUuid)
+	err = provision.SetDisks(session, vmRefs[0], disks)
 	if err != nil {
 		t.Log(err)
 		t.Fail()
@@ -286,7 +306,7 @@ func TestVMAsyncCreateAndDestory(t *testing.T) {
 		t.Fail()
 		return
 	}
-	err = WaitForTask(taskRef, 1)
+	err = WaitForTask(taskRef)
 	if err != nil {
 		t.Log(err)
 		t.Fail()
@@ -302,13 +322,19 @@ func TestVMAsyncCreateAndDestory(t *testing.T) {
 		t.Fail()
 		return
 	}
-	err = WaitForTask(taskRef, 1)
+	err = WaitForTask(taskRef)
 	if err != nil {
 		t.Log(err)
 		t.Fail()
 		return
 	}
 	t.Log("provisioned.")
+	err = objects.VMDisks(vmRefs[0])
+	if err != nil {
+		t.Log(err)
+		t.Fail()
+		return
+	}
 
 	// Should have done the trick. Let's see if it starts.
 	taskRef, err = xenapi.VM.AsyncStart(session, vmRefs[0], false, false)
@@ -317,7 +343,7 @@ func TestVMAsyncCreateAndDestory(t *testing.T) {
 		t.Fail()
 		return
 	}
-	err = WaitForTask(taskRef, 1)
+	err = WaitForTask(taskRef)
 	if err != nil {
 		t.Log(err)
 		t.Fail()
@@ -331,7 +357,7 @@ func TestVMAsyncCreateAndDestory(t *testing.T) {
 		t.Fail()
 		return
 	}
-	err = WaitForTask(taskRef, 1)
+	err = WaitForTask(taskRef)
 	if err != nil {
 		t.Log(err)
 		t.Fail()
@@ -345,7 +371,7 @@ func TestVMAsyncCreateAndDestory(t *testing.T) {
 		t.Fail()
 		return
 	}
-	err = WaitForTask(taskRef, 1)
+	err = WaitForTask(taskRef)
 	if err != nil {
 		t.Log(err)
 		t.Fail()
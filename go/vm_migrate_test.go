@@ -0,0 +1,99 @@
+package testGoSDK
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"xenapi"
+
+	"github.com/xenserver/xenserver-samples/go/migrate"
+)
+
+func TestVMMigrateStorage(t *testing.T) {
+	Connected(t)
+	Require(t, NeedHaltedVM, NeedVDICreateSR, NeedSecondVDICreateSR)
+	objects := TrackObjects(t)
+	vmRefTest, err := FindHaltedLinuxVM()
+	if err != nil {
+		t.Log(err)
+		t.Fail()
+		return
+	}
+	srRef, err := GetStorage()
+	if err != nil {
+		t.Log(err)
+		t.Fail()
+		return
+	}
+	srRefOther, err := GetOtherStorage(srRef)
+	if err != nil {
+		t.Log(err)
+		t.Fail()
+		return
+	}
+
+	// to avoid playing with existing data, copy the VM onto the first SR and move the copy
+	vmRef, err := xenapi.VM.Copy(session, vmRefTest, "Migrated VM (copy)", srRef)
+	if err != nil {
+		t.Log(err)
+		t.Fail()
+		return
+	}
+	objects.VM(vmRef)
+	err = objects.VMDisks(vmRef)
+	if err != nil {
+		t.Log(err)
+		t.Fail()
+		return
+	}
+	err = xenapi.VM.Start(session, vmRef, false, false)
+	if err != nil {
+		t.Log(err)
+		t.Fail()
+		return
+	}
+	hostRef, err := xenapi.VM.GetResidentOn(session, vmRef)
+	if err != nil {
+		t.Log(err)
+		t.Fail()
+		return
+	}
+
+	// move the running VM's disks to the other SR, staying on the same host
+	t.Log("Migrating the VM's disks...")
+	report, err := migrate.Migrate(context.Background(), session, vmRef, migrate.Options{
+		Host:     hostRef,
+		SRs:      map[xenapi.SRRef]xenapi.SRRef{srRef: srRefOther},
+		Progress: func(progress float64) { t.Log(fmt.Sprintf("Progress: %.0f%%", progress*100)) },
+	})
+	if err != nil {
+		t.Log(err)
+		t.Fail()
+		return
+	}
+	// the copied disks replace the tracked ones
+	err = objects.VMDisks(report.VM)
+	if err != nil {
+		t.Log(err)
+		t.Fail()
+		return
+	}
+	for _, disk := range report.Disks {
+		t.Log(fmt.Sprintf("Disk %s is now on SR '%s'", disk.Device, disk.SRName))
+		if disk.SR != srRefOther {
+			t.Log("The disk was not moved")
+			t.Fail()
+		}
+	}
+	for _, nic := range report.NICs {
+		t.Log(fmt.Sprintf("NIC %s is on network '%s'", nic.Device, nic.NetworkName))
+	}
+
+	err = xenapi.VM.HardShutdown(session, report.VM)
+	if err != nil {
+		t.Log(err)
+		t.Fail()
+		return
+	}
+}
@@ -9,6 +9,9 @@ import (
 )
 
 func TestVMPowercycle(t *testing.T) {
+	Connected(t)
+	Require(t, NeedHaltedVMWithTools)
+	objects := TrackObjects(t)
 	vmRefTest, err := FindHaltedLinuxVM()
 	if err != nil {
 		t.Log(err)
@@ -30,6 +33,13 @@ func TestVMPowercycle(t *testing.T) {
 		t.Fail()
 		return
 	}
+	objects.VM(vmRef)
+	err = objects.VMDisks(vmRef)
+	if err != nil {
+		t.Log(err)
+		t.Fail()
+		return
+	}
 	t.Log("Cloned VM; new VM's ref is", vmRef)
 
 	err = xenapi.VM.SetNameDescription(session, vmRef, "Another cloned VM")
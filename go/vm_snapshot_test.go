@@ -4,9 +4,14 @@ import (
 	"testing"
 
 	"xenapi"
+
+	"github.com/xenserver/xenserver-samples/go/xsutil"
 )
 
 func TestVMSnapshot(t *testing.T) {
+	Connected(t)
+	Require(t, NeedHaltedVM)
+	objects := TrackObjects(t)
 	vmRefTest, err := FindHaltedLinuxVM()
 	if err != nil {
 		t.Log(err)
@@ -16,7 +21,7 @@ func TestVMSnapshot(t *testing.T) {
 
 	// Snapshot Type 1 Disk
 	var snapshotRef xenapi.VMRef
-	if session.APIVersion >= xenapi.APIVersion2_21 {
+	if xsutil.Supports(session, xsutil.FeatureSnapshotIgnoreVDIs) {
 		snapshotRef, err = xenapi.VM.Snapshot(session, vmRefTest, "Snapshot1", []xenapi.VDIRef{})
 		if err != nil {
 			t.Log(err)
@@ -30,7 +35,14 @@ func TestVMSnapshot(t *testing.T) {
 			t.Fail()
 			return
 		}
-	}	
+	}
+	objects.VM(snapshotRef)
+	err = objects.VMDisks(snapshotRef)
+	if err != nil {
+		t.Log(err)
+		t.Fail()
+		return
+	}
 	snapshotRecord, err := xenapi.VM.GetRecord(session, snapshotRef)
 	if err != nil {
 		t.Log(err)
@@ -68,6 +80,9 @@ func TestVMSnapshot(t *testing.T) {
 }
 
 func TestVMAsyncSnapshot(t *testing.T) {
+	Connected(t)
+	Require(t, NeedHaltedVM)
+	objects := TrackObjects(t)
 	vmRefTest, err := FindHaltedLinuxVM()
 	if err != nil {
 		t.Log(err)
@@ -90,7 +105,7 @@ func TestVMAsyncSnapshot(t *testing.T) {
 				t.Fail()
 				return
 			}
-			err = WaitForTask(taskRef, 1)
+			err = WaitForTask(taskRef)
 			if err != nil {
 				t.Log(err)
 				t.Fail()
@@ -103,7 +118,7 @@ func TestVMAsyncSnapshot(t *testing.T) {
 				t.Fail()
 				return
 			}
-			err = WaitForTask(taskRef, 1)
+			err = WaitForTask(taskRef)
 			if err != nil {
 				t.Log(err)
 				t.Fail()
@@ -115,7 +130,7 @@ func TestVMAsyncSnapshot(t *testing.T) {
 				t.Fail()
 				return
 			}
-			err = WaitForTask(taskRef, 1)
+			err = WaitForTask(taskRef)
 			if err != nil {
 				t.Log(err)
 				t.Fail()
@@ -130,7 +145,7 @@ func TestVMAsyncSnapshot(t *testing.T) {
 				t.Fail()
 				return
 			}
-			err = WaitForTask(taskRef, 1)
+			err = WaitForTask(taskRef)
 			if err != nil {
 				t.Log(err)
 				t.Fail()
@@ -143,7 +158,7 @@ func TestVMAsyncSnapshot(t *testing.T) {
 				t.Fail()
 				return
 			}
-			err = WaitForTask(taskRef, 1)
+			err = WaitForTask(taskRef)
 			if err != nil {
 				t.Log(err)
 				t.Fail()
@@ -155,7 +170,7 @@ func TestVMAsyncSnapshot(t *testing.T) {
 				t.Fail()
 				return
 			}
-			err = WaitForTask(taskRef, 1)
+			err = WaitForTask(taskRef)
 			if err != nil {
 				t.Log(err)
 				t.Fail()
@@ -169,7 +184,7 @@ func TestVMAsyncSnapshot(t *testing.T) {
 		t.Fail()
 		return
 	}
-	err = WaitForTask(taskRef, 1)
+	err = WaitForTask(taskRef)
 	if err != nil {
 		t.Log(err)
 		t.Fail()
@@ -181,6 +196,13 @@ func TestVMAsyncSnapshot(t *testing.T) {
 		t.Fail()
 		return
 	}
+	objects.VM(snapshotRefs[0])
+	err = objects.VMDisks(snapshotRefs[0])
+	if err != nil {
+		t.Log(err)
+		t.Fail()
+		return
+	}
 	snapshotName, err := xenapi.VM.GetNameLabel(session, snapshotRefs[0])
 	if err != nil {
 		t.Log(err)
@@ -198,7 +220,7 @@ func TestVMAsyncSnapshot(t *testing.T) {
 		t.Fail()
 		return
 	}
-	err = WaitForTask(taskRef, 1)
+	err = WaitForTask(taskRef)
 	if err != nil {
 		t.Log(err)
 		t.Fail()
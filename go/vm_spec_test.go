@@ -0,0 +1,116 @@
+package testGoSDK
+
+import (
+	"testing"
+
+	"xenapi"
+
+	"github.com/xenserver/xenserver-samples/go/provision"
+)
+
+var SPEC_VM_NAME = "GoSDK-SpecVM"
+
+func TestVMCreateFromSpec(t *testing.T) {
+	Connected(t)
+	Require(t, NeedVDICreateSR)
+	objects := TrackObjects(t)
+
+	// Describe the VM: a template, a disk on the chosen SR, a network and an empty CD drive
+	_, templateName, err := GetFirstTemplate("Windows")
+	if err != nil {
+		t.Log(err)
+		t.Fail()
+		return
+	}
+	srRef, err := GetStorage()
+	if err != nil {
+		t.Log(err)
+		t.Fail()
+		return
+	}
+	srUuid, err := xenapi.SR.GetUUID(session, srRef)
+	if err != nil {
+		t.Log(err)
+		t.Fail()
+		return
+	}
+	networkRef, err := GetFirstNetwork()
+	if err != nil {
+		t.Log(err)
+		t.Fail()
+		return
+	}
+	networkUuid, err := xenapi.Network.GetUUID(session, networkRef)
+	if err != nil {
+		t.Log(err)
+		t.Fail()
+		return
+	}
+	spec := &provision.Spec{
+		Name:       SPEC_VM_NAME,
+		Template:   templateName,
+		MemorySize: 2 << 30,
+		VCPUs:      2,
+		Disks:      []provision.Disk{{SR: srUuid, Size: 32 << 30, Bootable: true}},
+		Networks:   []provision.NIC{{Network: networkUuid}},
+		CD:         &provision.CD{},
+	}
+
+	// Create the VM
+	result, err := provision.Apply(session, spec)
+	if result != nil {
+		objects.VM(result.VM)
+	}
+	if err != nil {
+		t.Log(err)
+		t.Fail()
+		return
+	}
+	// Destroying the VM leaves its disks behind
+	err = objects.VMDisks(result.VM)
+	if err != nil {
+		t.Log(err)
+		t.Fail()
+		return
+	}
+	for _, change := range result.Changes {
+		t.Log(change)
+	}
+
+	// Applying the same spec again should change nothing
+	again, err := provision.Apply(session, spec)
+	if err != nil {
+		t.Log(err)
+		t.Fail()
+		return
+	}
+	if len(again.Changes) != 0 {
+		t.Log("Unexpected changes:", again.Changes)
+		t.Fail()
+		return
+	}
+
+	err = xenapi.VM.Start(session, result.VM, false, false)
+	if err != nil {
+		t.Log(err)
+		t.Fail()
+		return
+	}
+	t.Log("VM Started.")
+
+	err = xenapi.VM.HardShutdown(session, result.VM)
+	if err != nil {
+		t.Log(err)
+		t.Fail()
+		return
+	}
+	t.Log("VM Shut down.")
+
+	err = xenapi.VM.Destroy(session, result.VM)
+	if err != nil {
+		t.Log(err)
+		t.Fail()
+		return
+	}
+	t.Log("VM Destroyed.")
+}
@@ -0,0 +1,256 @@
+package xsutil
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"xenapi"
+)
+
+// cacheRetryDelay is how long the cache waits before polling again after
+// event.from fails.
+const cacheRetryDelay = time.Second
+
+// cacheClass knows how to bulk-load one class and what record type its
+// event snapshots decode into.
+type cacheClass struct {
+	recordType reflect.Type
+	getAll     func(session *xenapi.Session) (map[string]interface{}, error)
+}
+
+func newCacheClass[R ~string, T any](getAll func(session *xenapi.Session) (map[R]T, error)) cacheClass {
+	return cacheClass{
+		recordType: reflect.TypeOf((*T)(nil)).Elem(),
+		getAll: func(session *xenapi.Session) (map[string]interface{}, error) {
+			records, err := getAll(session)
+			if err != nil {
+				return nil, err
+			}
+			table := make(map[string]interface{}, len(records))
+			for ref, record := range records {
+				table[string(ref)] = record
+			}
+			return table, nil
+		},
+	}
+}
+
+// cacheClasses lists the classes a Cache can mirror, keyed by the
+// lower-case names event.from uses.
+var cacheClasses = map[string]cacheClass{
+	"pool":             newCacheClass(xenapi.Pool.GetAllRecords),
+	"host":             newCacheClass(xenapi.Host.GetAllRecords),
+	"host_metrics":     newCacheClass(xenapi.HostMetrics.GetAllRecords),
+	"sm":               newCacheClass(xenapi.SM.GetAllRecords),
+	"sr":               newCacheClass(xenapi.SR.GetAllRecords),
+	"pbd":              newCacheClass(xenapi.PBD.GetAllRecords),
+	"vdi":              newCacheClass(xenapi.VDI.GetAllRecords),
+	"vm":               newCacheClass(xenapi.VM.GetAllRecords),
+	"vm_metrics":       newCacheClass(xenapi.VMMetrics.GetAllRecords),
+	"vm_guest_metrics": newCacheClass(xenapi.VMGuestMetrics.GetAllRecords),
+	"vbd":              newCacheClass(xenapi.VBD.GetAllRecords),
+	"vif":              newCacheClass(xenapi.VIF.GetAllRecords),
+	"network":          newCacheClass(xenapi.Network.GetAllRecords),
+	"pif":              newCacheClass(xenapi.PIF.GetAllRecords),
+}
+
+// Cache is an in-memory mirror of some classes of pool state. It is
+// loaded with one get_all_records call per class and then kept up to date
+// from event.from in the background. Records handed out by the query
+// functions share slices and maps with the cache and must not be modified.
+type Cache struct {
+	session *xenapi.Session
+	classes []string
+	cancel  context.CancelFunc
+	done    chan struct{}
+
+	mu     sync.RWMutex
+	token  string
+	tables map[string]map[string]interface{}
+	err    error
+}
+
+// NewCache loads the given classes ("vm", "sr", ...) and starts following
+// their events. The cache stops when ctx ends or Close is called.
+func NewCache(ctx context.Context, session *xenapi.Session, classes ...string) (*Cache, error) {
+	c := &Cache{session: session, done: make(chan struct{})}
+	for _, class := range classes {
+		class = strings.ToLower(class)
+		if _, ok := cacheClasses[class]; !ok {
+			return nil, fmt.Errorf("cannot cache objects of class %q", class)
+		}
+		c.classes = append(c.classes, class)
+	}
+	if err := c.load(); err != nil {
+		return nil, err
+	}
+	ctx, c.cancel = context.WithCancel(ctx)
+	go c.follow(ctx)
+	return c, nil
+}
+
+// Close stops following events and waits for the background poll to end.
+func (c *Cache) Close() {
+	c.cancel()
+	<-c.done
+}
+
+// Err returns the last error met while following events, or nil if the
+// most recent poll succeeded.
+func (c *Cache) Err() error {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.err
+}
+
+// load replaces the contents of the cache with a fresh bulk load. The
+// token is taken first, so events that race with the load are replayed
+// afterwards rather than lost; replaying them is harmless because every
+// event carries a full snapshot of its object.
+func (c *Cache) load() error {
+	batch, err := xenapi.Event.From(c.session, []string{"pool"}, "", 0)
+	if err != nil {
+		return Decode(err)
+	}
+	tables := make(map[string]map[string]interface{}, len(c.classes))
+	for _, class := range c.classes {
+		table, err := cacheClasses[class].getAll(c.session)
+		if err != nil {
+			return Decode(err)
+		}
+		tables[class] = table
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.tables = tables
+	c.token = batch.Token
+	return nil
+}
+
+func (c *Cache) follow(ctx context.Context) {
+	defer close(c.done)
+	for {
+		_, err := c.poll(ctx, maxEventTimeout)
+		if ctx.Err() != nil {
+			return
+		}
+		c.mu.Lock()
+		c.err = err
+		c.mu.Unlock()
+		if err != nil {
+			select {
+			case <-time.After(cacheRetryDelay):
+			case <-ctx.Done():
+				return
+			}
+		}
+	}
+}
+
+// poll applies one batch of events, reloading if the token has expired.
+// It reports whether its batch was applied rather than dropped for having
+// been overtaken by another poll's.
+func (c *Cache) poll(ctx context.Context, timeout time.Duration) (bool, error) {
+	c.mu.RLock()
+	token := c.token
+	c.mu.RUnlock()
+	batch, err := eventFrom(ctx, c.session, c.classes, token, timeout)
+	if errors.Is(Decode(err), ErrEventsLost) {
+		return true, c.load()
+	}
+	if err != nil {
+		return false, Decode(err)
+	}
+	return c.apply(token, batch)
+}
+
+// apply updates the tables from a batch fetched with token. A batch that
+// another poll has already overtaken is dropped, so events are never
+// applied out of order, and apply reports false. An object whose snapshot
+// cannot be decoded is dropped from the cache rather than left stale, and
+// the rest of the batch is applied; the returned error names the objects
+// that were dropped.
+func (c *Cache) apply(token string, batch xenapi.EventBatch) (bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.token != token {
+		return false, nil
+	}
+	var errs []error
+	for _, event := range batch.Events {
+		table, ok := c.tables[event.Class]
+		if !ok {
+			continue
+		}
+		if event.Operation == xenapi.EventOperationDel {
+			delete(table, event.Ref)
+			continue
+		}
+		record := reflect.New(cacheClasses[event.Class].recordType)
+		if err := DecodeRecord(event.Snapshot, record.Interface()); err != nil {
+			delete(table, event.Ref)
+			errs = append(errs, fmt.Errorf("%s event for %s: %w", event.Class, event.Ref, err))
+			continue
+		}
+		table[event.Ref] = record.Elem().Interface()
+	}
+	c.token = batch.Token
+	return true, errors.Join(errs...)
+}
+
+// Sync brings the cache up to date with the server before returning, so
+// that a query made afterwards sees every change completed before Sync
+// was called.
+func (c *Cache) Sync(ctx context.Context) error {
+	for {
+		// A batch of the background poll that lands first overtakes this
+		// one, but it may have been taken before Sync was called, so poll
+		// again from where it left the cache.
+		applied, err := c.poll(ctx, 0)
+		if applied || err != nil {
+			return err
+		}
+	}
+}
+
+// Records returns every cached object of class, which must be one the
+// cache was created with, as a map from reference to record.
+func Records[R ~string, T any](c *Cache, class string) map[R]T {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	table := c.tables[strings.ToLower(class)]
+	records := make(map[R]T, len(table))
+	for ref, record := range table {
+		if r, ok := record.(T); ok {
+			records[R(ref)] = r
+		}
+	}
+	return records
+}
+
+// Record returns one cached object, or false if the cache does not hold it.
+func Record[R ~string, T any](c *Cache, class string, ref R) (T, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	record, ok := c.tables[strings.ToLower(class)][string(ref)].(T)
+	return record, ok
+}
+
+// Find returns the references of the cached objects of class for which
+// match returns true, in a stable order.
+func Find[R ~string, T any](c *Cache, class string, match func(ref R, record T) bool) []R {
+	var refs []R
+	for ref, record := range Records[R, T](c, class) {
+		if match(ref, record) {
+			refs = append(refs, ref)
+		}
+	}
+	sort.Slice(refs, func(i, j int) bool { return refs[i] < refs[j] })
+	return refs
+}
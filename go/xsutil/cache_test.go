@@ -0,0 +1,222 @@
+package xsutil
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"xenapi"
+
+	"github.com/xenserver/xenserver-samples/go/fakexapi"
+)
+
+func newTestCache(t *testing.T, session *xenapi.Session, classes ...string) *Cache {
+	cache, err := NewCache(context.Background(), session, classes...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(cache.Close)
+	return cache
+}
+
+func findCachedVM(cache *Cache, name string) []xenapi.VMRef {
+	return Find(cache, "vm", func(ref xenapi.VMRef, record xenapi.VMRecord) bool {
+		return record.NameLabel == name
+	})
+}
+
+func TestCacheLoad(t *testing.T) {
+	session := fakexapi.Start(t).Login(t)
+	cache := newTestCache(t, session, "vm", "SR")
+	vms, err := xenapi.VM.GetAll(session)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cached := Records[xenapi.VMRef, xenapi.VMRecord](cache, "vm"); len(cached) != len(vms) {
+		t.Log("Expected", len(vms), "cached VMs, got", len(cached))
+		t.Fail()
+	}
+	if len(Records[xenapi.SRRef, xenapi.SRRecord](cache, "sr")) == 0 {
+		t.Log("Expected the SRs to be cached")
+		t.Fail()
+	}
+	if len(Records[xenapi.HostRef, xenapi.HostRecord](cache, "host")) != 0 {
+		t.Log("Classes the cache was not asked for should be empty")
+		t.Fail()
+	}
+}
+
+func TestCacheFollowsEvents(t *testing.T) {
+	session := fakexapi.Start(t).Login(t)
+	cache := newTestCache(t, session, "vm")
+	template := findVM(t, session, fakexapi.LinuxTemplate)
+	clone, err := xenapi.VM.Clone(session, template, "cached clone")
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for len(findCachedVM(cache, "cached clone")) == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if refs := findCachedVM(cache, "cached clone"); len(refs) != 1 || refs[0] != clone {
+		t.Fatal("The background poll did not pick up the new VM")
+	}
+
+	if err := xenapi.VM.Destroy(session, clone); err != nil {
+		t.Fatal(err)
+	}
+	if err := cache.Sync(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := Record[xenapi.VMRef, xenapi.VMRecord](cache, "vm", clone); ok {
+		t.Log("The destroyed VM is still cached after Sync")
+		t.Fail()
+	}
+}
+
+func TestCacheReloadsAfterEventsLost(t *testing.T) {
+	server := fakexapi.Start(t)
+	session := server.Login(t)
+	cache := newTestCache(t, session, "vm")
+	cache.Close()
+
+	vm := findVM(t, session, fakexapi.LinuxVM)
+	server.Do(func(st *fakexapi.Store) {
+		st.SetEventLimit(1)
+		st.Update("VM", string(vm), fakexapi.Record{"name_description": "first"})
+		st.Update("VM", string(vm), fakexapi.Record{"name_description": "second"})
+	})
+	if err := cache.Sync(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	record, ok := Record[xenapi.VMRef, xenapi.VMRecord](cache, "vm", vm)
+	if !ok || record.NameDescription != "second" {
+		t.Log("Expected the cache to reload after EVENTS_LOST, got:", record.NameDescription)
+		t.Fail()
+	}
+}
+
+func TestCacheSyncOvertaken(t *testing.T) {
+	server := fakexapi.Start(t)
+	// The proxy holds back the reply to the first event.from that is let
+	// through after gate is set, until release is closed.
+	target, _ := url.Parse(server.URL())
+	forward := httputil.NewSingleHostReverseProxy(target)
+	gate := make(chan chan struct{}, 1)
+	arrived := make(chan struct{})
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		if strings.Contains(string(body), `"event.from"`) {
+			select {
+			case release := <-gate:
+				rec := httptest.NewRecorder()
+				forward.ServeHTTP(rec, r)
+				close(arrived)
+				<-release
+				for k, v := range rec.Header() {
+					w.Header()[k] = v
+				}
+				w.WriteHeader(rec.Code)
+				w.Write(rec.Body.Bytes())
+				return
+			default:
+			}
+		}
+		forward.ServeHTTP(w, r)
+	}))
+	t.Cleanup(proxy.Close)
+	session := xenapi.NewSession(&xenapi.ClientOpts{URL: proxy.URL})
+	if _, err := session.LoginWithPassword(server.Username, server.Password, "1.0", t.Name()); err != nil {
+		t.Fatal(err)
+	}
+	cache := newTestCache(t, session, "vm")
+	cache.Close()
+
+	// A background poll takes its batch, with an earlier change, before
+	// the change Sync must see is made ...
+	token := cache.token
+	if err := xenapi.VM.SetNameDescription(session, findVM(t, session, fakexapi.LinuxVM), "earlier"); err != nil {
+		t.Fatal(err)
+	}
+	stale, err := eventFrom(context.Background(), session, cache.classes, token, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clone, err := xenapi.VM.Clone(session, findVM(t, session, fakexapi.LinuxTemplate), "synced clone")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// ... and lands while Sync's batch, which has the change, is on its
+	// way.
+	release := make(chan struct{})
+	gate <- release
+	synced := make(chan error)
+	go func() { synced <- cache.Sync(context.Background()) }()
+	<-arrived
+	if applied, err := cache.apply(token, stale); !applied || err != nil {
+		t.Fatal("Expected the background batch to be applied:", applied, err)
+	}
+	close(release)
+	if err := <-synced; err != nil {
+		t.Fatal(err)
+	}
+	if refs := findCachedVM(cache, "synced clone"); len(refs) != 1 || refs[0] != clone {
+		t.Log("Expected Sync to see the change made before it was called")
+		t.Fail()
+	}
+}
+
+func TestCacheUnknownClass(t *testing.T) {
+	session := fakexapi.Start(t).Login(t)
+	if _, err := NewCache(context.Background(), session, "no_such_class"); err == nil {
+		t.Log("Expected an error for a class the cache does not support")
+		t.Fail()
+	}
+}
+
+func TestCacheSkipsUndecodableRecords(t *testing.T) {
+	server := fakexapi.Start(t)
+	session := server.Login(t)
+	cache := newTestCache(t, session, "vm")
+	cache.Close()
+
+	vm := findVM(t, session, fakexapi.LinuxVM)
+	clone, err := xenapi.VM.Clone(session, findVM(t, session, fakexapi.LinuxTemplate), "cached clone")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.Do(func(st *fakexapi.Store) {
+		st.Update("VM", string(vm), fakexapi.Record{"name_label": []string{"not", "a", "name"}})
+	})
+	if err := cache.Sync(context.Background()); err == nil {
+		t.Log("Expected the undecodable VM to be reported")
+		t.Fail()
+	}
+	if _, ok := Record[xenapi.VMRef, xenapi.VMRecord](cache, "vm", vm); ok {
+		t.Log("Expected the undecodable VM to be dropped")
+		t.Fail()
+	}
+	if refs := findCachedVM(cache, "cached clone"); len(refs) != 1 || refs[0] != clone {
+		t.Log("Expected the rest of the batch to be applied")
+		t.Fail()
+	}
+
+	server.Do(func(st *fakexapi.Store) {
+		st.Update("VM", string(vm), fakexapi.Record{"name_label": "fixed"})
+	})
+	if err := cache.Sync(context.Background()); err != nil {
+		t.Fatal("Expected the cache to carry on after the bad record:", err)
+	}
+	if refs := findCachedVM(cache, "fixed"); len(refs) != 1 || refs[0] != vm {
+		t.Log("Expected the VM to be cached again once it decodes")
+		t.Fail()
+	}
+}
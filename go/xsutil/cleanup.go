@@ -0,0 +1,283 @@
+package xsutil
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"xenapi"
+)
+
+// teardownOrder lists the classes a Tracker handles in the order they are
+// torn down: an object is always removed before the objects it depends on.
+var teardownOrder = []string{"VM", "VBD", "VIF", "VDI", "VLAN", "network", "PBD", "SR", "introduced SR"}
+
+// TrackedKey is the other_config key a marking Tracker sets on the VMs,
+// networks and SRs it tracks. Its value is the time they were tracked, so
+// that objects a run failed to clean up can be recognised later.
+const TrackedKey = "xsutil_tracked_since"
+
+type trackedObject struct {
+	class string
+	ref   string
+}
+
+// Tracker records objects created during a run so they can all be removed
+// at the end, even when the run stops part way through. Objects that have
+// already been destroyed are skipped, so code may tear down what it created
+// itself and still track it.
+type Tracker struct {
+	session *xenapi.Session
+
+	mark    bool
+	mu      sync.Mutex
+	objects []trackedObject
+	errs    []error
+}
+
+// NewTracker returns a Tracker that removes objects through session.
+func NewTracker(session *xenapi.Session) *Tracker {
+	return &Tracker{session: session}
+}
+
+// Mark makes the Tracker tag the VMs, networks and SRs tracked from now on
+// with TrackedKey. Failures to tag them are reported by Cleanup.
+func (t *Tracker) Mark() {
+	t.mark = true
+}
+
+func (t *Tracker) track(class, ref string) {
+	if ref == "" || ref == "OpaqueRef:NULL" {
+		return
+	}
+	var err error
+	if t.mark {
+		err = Decode(t.tag(class, ref))
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.objects = append(t.objects, trackedObject{class, ref})
+	if err != nil && !errors.Is(err, ErrHandleInvalid) {
+		t.errs = append(t.errs, fmt.Errorf("cannot mark %s %s: %w", class, ref, err))
+	}
+}
+
+// tag sets TrackedKey in the other_config of a VM, network or SR. A clone
+// inherits the tag of the VM it was cloned from, so an existing tag is
+// overwritten.
+func (t *Tracker) tag(class, ref string) error {
+	var get func() (map[string]string, error)
+	var set func(map[string]string) error
+	switch class {
+	case "VM":
+		vm := xenapi.VMRef(ref)
+		get = func() (map[string]string, error) {
+			return xenapi.VM.GetOtherConfig(t.session, vm)
+		}
+		set = func(otherConfig map[string]string) error {
+			return xenapi.VM.SetOtherConfig(t.session, vm, otherConfig)
+		}
+	case "network":
+		network := xenapi.NetworkRef(ref)
+		get = func() (map[string]string, error) {
+			return xenapi.Network.GetOtherConfig(t.session, network)
+		}
+		set = func(otherConfig map[string]string) error {
+			return xenapi.Network.SetOtherConfig(t.session, network, otherConfig)
+		}
+	case "SR", "introduced SR":
+		sr := xenapi.SRRef(ref)
+		get = func() (map[string]string, error) {
+			return xenapi.SR.GetOtherConfig(t.session, sr)
+		}
+		set = func(otherConfig map[string]string) error {
+			return xenapi.SR.SetOtherConfig(t.session, sr, otherConfig)
+		}
+	default:
+		return nil
+	}
+	otherConfig, err := get()
+	if err != nil {
+		return err
+	}
+	if otherConfig == nil {
+		otherConfig = make(map[string]string)
+	}
+	otherConfig[TrackedKey] = time.Now().UTC().Format(time.RFC3339)
+	return set(otherConfig)
+}
+
+// VM tracks a VM or snapshot. It is shut down if needed and destroyed
+// along with its VBDs and VIFs, but not its disks; track those with VDI.
+func (t *Tracker) VM(ref xenapi.VMRef) { t.track("VM", string(ref)) }
+
+func (t *Tracker) VBD(ref xenapi.VBDRef) { t.track("VBD", string(ref)) }
+
+func (t *Tracker) VIF(ref xenapi.VIFRef) { t.track("VIF", string(ref)) }
+
+func (t *Tracker) VDI(ref xenapi.VDIRef) { t.track("VDI", string(ref)) }
+
+func (t *Tracker) VLAN(ref xenapi.VLANRef) { t.track("VLAN", string(ref)) }
+
+// Network tracks a network. Any VLANs still carried on it are destroyed
+// first.
+func (t *Tracker) Network(ref xenapi.NetworkRef) { t.track("network", string(ref)) }
+
+func (t *Tracker) PBD(ref xenapi.PBDRef) { t.track("PBD", string(ref)) }
+
+// SR tracks an SR the run created. Its PBDs are unplugged and it is
+// destroyed, along with its disks.
+func (t *Tracker) SR(ref xenapi.SRRef) { t.track("SR", string(ref)) }
+
+// IntroducedSR tracks an SR the run introduced rather than created. Its
+// PBDs are unplugged and it is forgotten, leaving its storage as it was.
+func (t *Tracker) IntroducedSR(ref xenapi.SRRef) { t.track("introduced SR", string(ref)) }
+
+// VMDisks tracks the VDIs behind the disk VBDs of vm, such as those
+// VM.provision has just created.
+func (t *Tracker) VMDisks(vm xenapi.VMRef) error {
+	vbds, err := xenapi.VM.GetVBDs(t.session, vm)
+	if err != nil {
+		return err
+	}
+	for _, vbd := range vbds {
+		record, err := xenapi.VBD.GetRecord(t.session, vbd)
+		if err != nil {
+			return err
+		}
+		if record.Type == xenapi.VbdTypeDisk {
+			t.VDI(record.VDI)
+		}
+	}
+	return nil
+}
+
+// Cleanup tears down every tracked object, in dependency order and with
+// the most recently tracked first within each class, and forgets them. It
+// carries on past failures and returns them all.
+func (t *Tracker) Cleanup() error {
+	t.mu.Lock()
+	objects, errs := t.objects, t.errs
+	t.objects, t.errs = nil, nil
+	t.mu.Unlock()
+
+	for _, class := range teardownOrder {
+		for i := len(objects) - 1; i >= 0; i-- {
+			object := objects[i]
+			if object.class != class {
+				continue
+			}
+			err := Decode(t.teardown(object))
+			if err != nil && !errors.Is(err, ErrHandleInvalid) {
+				errs = append(errs, fmt.Errorf("cannot remove %s %s: %w", object.class, object.ref, err))
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (t *Tracker) teardown(object trackedObject) error {
+	session := t.session
+	switch object.class {
+	case "VM":
+		ref := xenapi.VMRef(object.ref)
+		state, err := xenapi.VM.GetPowerState(session, ref)
+		if err != nil {
+			return err
+		}
+		if state != xenapi.VMPowerStateHalted {
+			isSnapshot, err := xenapi.VM.GetIsASnapshot(session, ref)
+			if err != nil {
+				return err
+			}
+			if !isSnapshot {
+				if err := xenapi.VM.HardShutdown(session, ref); err != nil {
+					return err
+				}
+			}
+		}
+		return xenapi.VM.Destroy(session, ref)
+	case "VBD":
+		ref := xenapi.VBDRef(object.ref)
+		attached, err := xenapi.VBD.GetCurrentlyAttached(session, ref)
+		if err != nil {
+			return err
+		}
+		if attached {
+			if err := xenapi.VBD.UnplugForce(session, ref); err != nil {
+				return err
+			}
+		}
+		return xenapi.VBD.Destroy(session, ref)
+	case "VIF":
+		ref := xenapi.VIFRef(object.ref)
+		attached, err := xenapi.VIF.GetCurrentlyAttached(session, ref)
+		if err != nil {
+			return err
+		}
+		if attached {
+			if err := xenapi.VIF.UnplugForce(session, ref); err != nil {
+				return err
+			}
+		}
+		return xenapi.VIF.Destroy(session, ref)
+	case "VDI":
+		return xenapi.VDI.Destroy(session, xenapi.VDIRef(object.ref))
+	case "VLAN":
+		return xenapi.VLAN.Destroy(session, xenapi.VLANRef(object.ref))
+	case "network":
+		ref := xenapi.NetworkRef(object.ref)
+		pifs, err := xenapi.Network.GetPIFs(session, ref)
+		if err != nil {
+			return err
+		}
+		for _, pif := range pifs {
+			vlan, err := xenapi.PIF.GetVLANMasterOf(session, pif)
+			if err != nil {
+				return err
+			}
+			if vlan != "" && vlan != "OpaqueRef:NULL" {
+				if err := xenapi.VLAN.Destroy(session, vlan); err != nil {
+					return err
+				}
+			}
+		}
+		return xenapi.Network.Destroy(session, ref)
+	case "PBD":
+		ref := xenapi.PBDRef(object.ref)
+		if err := t.unplugPBD(ref); err != nil {
+			return err
+		}
+		return xenapi.PBD.Destroy(session, ref)
+	case "SR", "introduced SR":
+		ref := xenapi.SRRef(object.ref)
+		pbds, err := xenapi.SR.GetPBDs(session, ref)
+		if err != nil {
+			return err
+		}
+		for _, pbd := range pbds {
+			if err := t.unplugPBD(pbd); err != nil {
+				return err
+			}
+		}
+		if object.class == "introduced SR" {
+			return xenapi.SR.Forget(session, ref)
+		}
+		return xenapi.SR.Destroy(session, ref)
+	}
+	return fmt.Errorf("unknown class %q", object.class)
+}
+
+func (t *Tracker) unplugPBD(ref xenapi.PBDRef) error {
+	attached, err := xenapi.PBD.GetCurrentlyAttached(t.session, ref)
+	if err != nil {
+		return err
+	}
+	if attached {
+		if err := xenapi.PBD.Unplug(t.session, ref); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,197 @@
+package xsutil
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"xenapi"
+
+	"github.com/xenserver/xenserver-samples/go/fakexapi"
+)
+
+func TestTrackerCleanup(t *testing.T) {
+	session := fakexapi.Start(t).Login(t)
+	tracker := NewTracker(session)
+
+	// A running clone with a disk of its own and a VIF.
+	vm, err := xenapi.VM.Clone(session, findVM(t, session, fakexapi.LinuxVM), "tracked VM")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tracker.VM(vm)
+	srs, err := xenapi.SR.GetByNameLabel(session, "Local storage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	vdi, err := xenapi.VDI.Create(session, xenapi.VDIRecord{
+		NameLabel: "tracked disk", SR: srs[0], VirtualSize: 1 << 30, Type: xenapi.VdiTypeUser,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tracker.VDI(vdi)
+	vbd, err := xenapi.VBD.Create(session, xenapi.VBDRecord{
+		VM: vm, VDI: vdi, Userdevice: "1", Mode: xenapi.VbdModeRW, Type: xenapi.VbdTypeDisk,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tracker.VBD(vbd)
+	if err := xenapi.VM.Start(session, vm, false, false); err != nil {
+		t.Fatal(err)
+	}
+
+	// A network carrying a VLAN that was never tracked itself.
+	network, err := xenapi.Network.Create(session, xenapi.NetworkRecord{NameLabel: "tracked network"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tracker.Network(network)
+	pifs, err := xenapi.PIF.GetAllRecords(session)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for ref, pif := range pifs {
+		if pif.Physical {
+			if _, err := xenapi.Pool.CreateVLANFromPIF(session, ref, network, 42); err != nil {
+				t.Fatal(err)
+			}
+			break
+		}
+	}
+
+	// An SR with a plugged PBD, and another that is already gone.
+	hosts, err := xenapi.Host.GetAll(session)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sr, err := xenapi.SR.Create(session, hosts[0], map[string]string{}, 0, "tracked SR", "", "dummy", "", false, map[string]string{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tracker.SR(sr)
+	gone, err := xenapi.SR.Introduce(session, "5b1c7f0e-23d4-4e8a-9c6b-7f2e1d0a3b4c", "gone SR", "", "dummy", "", false, map[string]string{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tracker.IntroducedSR(gone)
+	if err := xenapi.SR.Forget(session, gone); err != nil {
+		t.Fatal(err)
+	}
+	introduced, err := xenapi.SR.Introduce(session, "0d9e4f6a-8b2c-4c1e-a7d3-5e6f7a8b9c0d", "introduced SR", "", "dummy", "", false, map[string]string{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tracker.IntroducedSR(introduced)
+
+	if err := tracker.Cleanup(); err != nil {
+		t.Fatal(err)
+	}
+	for _, check := range []struct {
+		class string
+		get   func() error
+	}{
+		{"VM", func() error { _, err := xenapi.VM.GetRecord(session, vm); return err }},
+		{"VDI", func() error { _, err := xenapi.VDI.GetRecord(session, vdi); return err }},
+		{"network", func() error { _, err := xenapi.Network.GetRecord(session, network); return err }},
+		{"SR", func() error { _, err := xenapi.SR.GetRecord(session, sr); return err }},
+		{"introduced SR", func() error { _, err := xenapi.SR.GetRecord(session, introduced); return err }},
+	} {
+		if err := Decode(check.get()); !errors.Is(err, ErrHandleInvalid) {
+			t.Log("Expected the", check.class, "to be destroyed, got:", err)
+			t.Fail()
+		}
+	}
+	vlans, err := xenapi.VLAN.GetAll(session)
+	if err != nil || len(vlans) != 0 {
+		t.Log("Expected no VLANs to remain:", vlans, err)
+		t.Fail()
+	}
+
+	// Everything was forgotten, so a second cleanup has nothing to do.
+	if err := tracker.Cleanup(); err != nil {
+		t.Log(err)
+		t.Fail()
+	}
+}
+
+func TestTrackerReportsFailures(t *testing.T) {
+	session := fakexapi.Start(t).Login(t)
+	tracker := NewTracker(session)
+	vms, err := xenapi.VM.GetAllRecords(session)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for ref, record := range vms {
+		if record.IsControlDomain {
+			tracker.VM(ref)
+		}
+	}
+	err = tracker.Cleanup()
+	if err == nil {
+		t.Fatal("Expected destroying the control domain to fail")
+	}
+	var failure *Failure
+	if !errors.As(err, &failure) || failure.Code != "OPERATION_NOT_ALLOWED" {
+		t.Log("Unexpected error:", err)
+		t.Fail()
+	}
+
+	// An introduced SR tracked as created is not quietly forgotten.
+	sr, err := xenapi.SR.Introduce(session, "3c4d5e6f-7a8b-4c9d-8e0f-1a2b3c4d5e6f", "introduced SR", "", "dummy", "", false, map[string]string{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tracker.SR(sr)
+	err = tracker.Cleanup()
+	if !errors.As(err, &failure) || failure.Code != "SR_HAS_NO_PBDS" {
+		t.Log("Expected destroying an SR without PBDs to fail, got:", err)
+		t.Fail()
+	}
+	if _, err := xenapi.SR.GetRecord(session, sr); err != nil {
+		t.Log("Expected the SR to be left alone:", err)
+		t.Fail()
+	}
+}
+
+func TestTrackerMark(t *testing.T) {
+	session := fakexapi.Start(t).Login(t)
+	tracker := NewTracker(session)
+	tracker.Mark()
+	vm, err := xenapi.VM.Clone(session, findVM(t, session, fakexapi.LinuxVM), "marked VM")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tracker.VM(vm)
+	// The clone of a marked VM already carries the tag.
+	clone, err := xenapi.VM.Clone(session, vm, "marked clone")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tracker.VM(clone)
+	network, err := xenapi.Network.Create(session, xenapi.NetworkRecord{NameLabel: "marked network", OtherConfig: map[string]string{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tracker.Network(network)
+
+	for _, get := range []func() (map[string]string, error){
+		func() (map[string]string, error) { return xenapi.VM.GetOtherConfig(session, vm) },
+		func() (map[string]string, error) { return xenapi.VM.GetOtherConfig(session, clone) },
+		func() (map[string]string, error) { return xenapi.Network.GetOtherConfig(session, network) },
+	} {
+		otherConfig, err := get()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := time.Parse(time.RFC3339, otherConfig[TrackedKey]); err != nil {
+			t.Log("Expected a tracking time, got:", otherConfig)
+			t.Fail()
+		}
+	}
+	if err := tracker.Cleanup(); err != nil {
+		t.Log(err)
+		t.Fail()
+	}
+}
@@ -0,0 +1,133 @@
+package xsutil
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"time"
+
+	"xenapi"
+)
+
+//go:generate go run ./internal/classgen -sdk ../goSDK -out classes_gen.go
+
+// Class is one of the xenapi package's classes, such as xenapi.VM.
+type Class struct {
+	// Name is the class as XAPI names it on the wire, e.g. "PIF_metrics".
+	Name  string
+	class interface{}
+}
+
+// classFeatures maps the classes that older servers lack to the feature
+// that gates them.
+var classFeatures = map[string]Feature{
+	"Observer":   FeatureObserver,
+	"Repository": FeatureRepository,
+	"VTPM":       FeatureVTPM,
+}
+
+// Classes lists every class the xenapi package can list records of, sorted
+// by name. The list is generated from the SDK; see classgen.
+func Classes() []Class {
+	return append([]Class(nil), classes...)
+}
+
+// Check returns nil if the server session is logged in to should have the
+// class, and an *UnsupportedFeatureError otherwise.
+func (c Class) Check(session *xenapi.Session) error {
+	if feature, ok := classFeatures[c.Name]; ok {
+		return CheckFeature(session, feature)
+	}
+	return nil
+}
+
+// GetAllRecords calls the class's GetAllRecords and returns the records in
+// wire format, as EncodeRecord makes them, keyed by reference.
+func (c Class) GetAllRecords(session *xenapi.Session) (map[string]interface{}, error) {
+	method := reflect.ValueOf(c.class).MethodByName("GetAllRecords")
+	if !method.IsValid() {
+		return nil, fmt.Errorf("%s has no GetAllRecords", c.Name)
+	}
+	results := method.Call([]reflect.Value{reflect.ValueOf(session)})
+	if err, _ := results[1].Interface().(error); err != nil {
+		return nil, Decode(err)
+	}
+	records := make(map[string]interface{}, results[0].Len())
+	iter := results[0].MapRange()
+	for iter.Next() {
+		records[iter.Key().String()] = EncodeRecord(iter.Value().Interface())
+	}
+	return records, nil
+}
+
+// redacted maps classes to the fields Dump blanks out because they hold
+// credentials, such as the passwords SRs keep in secrets.
+var redacted = map[string][]string{
+	"secret": {"value"},
+}
+
+// Redacted replaces the value of every field Dump leaves out of a
+// snapshot.
+const Redacted = "<redacted>"
+
+// Snapshot is every record of every class, as Dump takes it.
+type Snapshot struct {
+	APIVersion string    `json:"api_version"`
+	Taken      time.Time `json:"taken"`
+	// Records maps each class to its records, keyed by reference.
+	Records map[string]map[string]interface{} `json:"records"`
+	// Unsupported maps each class the server lacks to the reason why.
+	Unsupported map[string]string `json:"unsupported,omitempty"`
+}
+
+// Dump fetches the records of every class in Classes. Classes that are too
+// new for the server's API version are not asked for, and classes the
+// server answers with MESSAGE_METHOD_UNKNOWN are noted in Unsupported. Any
+// other failure is returned, joined with the rest, alongside the records
+// that could be read. The values of secrets are replaced with Redacted.
+func Dump(session *xenapi.Session) (*Snapshot, error) {
+	snapshot := &Snapshot{
+		APIVersion:  session.APIVersion.String(),
+		Taken:       time.Now().UTC(),
+		Records:     make(map[string]map[string]interface{}),
+		Unsupported: make(map[string]string),
+	}
+	var errs []error
+	for _, class := range classes {
+		if err := class.Check(session); err != nil {
+			snapshot.Unsupported[class.Name] = err.Error()
+			continue
+		}
+		records, err := class.GetAllRecords(session)
+		if errors.Is(err, ErrMessageMethodUnknown) {
+			snapshot.Unsupported[class.Name] = err.Error()
+			continue
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", class.Name, err))
+			continue
+		}
+		for _, record := range records {
+			fields, _ := record.(map[string]interface{})
+			for _, field := range redacted[class.Name] {
+				if _, ok := fields[field]; ok {
+					fields[field] = Redacted
+				}
+			}
+		}
+		snapshot.Records[class.Name] = records
+	}
+	return snapshot, errors.Join(errs...)
+}
+
+// WriteFile writes the snapshot to path as indented JSON, readable only by
+// its owner: even without secrets, a pool's records say a lot about it.
+func (s *Snapshot) WriteFile(path string) error {
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(data, '\n'), 0o600)
+}
@@ -0,0 +1,98 @@
+package xsutil
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"xenapi"
+
+	"github.com/xenserver/xenserver-samples/go/fakexapi"
+)
+
+func TestClasses(t *testing.T) {
+	seen := make(map[string]bool)
+	for _, class := range Classes() {
+		if seen[class.Name] {
+			t.Log("Class listed twice:", class.Name)
+			t.Fail()
+		}
+		seen[class.Name] = true
+	}
+	for _, name := range []string{"VM", "host", "PIF_metrics", "PVS_cache_storage", "Observer"} {
+		if !seen[name] {
+			t.Log("Class missing:", name)
+			t.Fail()
+		}
+	}
+}
+
+func TestDump(t *testing.T) {
+	server := fakexapi.Start(t)
+	session := server.Login(t)
+	server.Handle("blob.get_all_records", func(c *fakexapi.Call) (interface{}, error) {
+		return nil, fakexapi.Failure{"MESSAGE_METHOD_UNKNOWN", c.Method}
+	})
+	session.APIVersion = xenapi.APIVersion2_20
+	var secret string
+	server.Do(func(st *fakexapi.Store) {
+		secret = st.Create("secret", fakexapi.Record{"value": "hunter2", "other_config": map[string]string{}})
+	})
+
+	snapshot, err := Dump(session)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"blob", "Observer", "Repository", "VTPM"} {
+		if _, ok := snapshot.Unsupported[name]; !ok {
+			t.Log("Expected the class to be unsupported:", name)
+			t.Fail()
+		}
+		if _, ok := snapshot.Records[name]; ok {
+			t.Log("Unsupported class has records:", name)
+			t.Fail()
+		}
+	}
+	if len(snapshot.Records)+len(snapshot.Unsupported) != len(Classes()) {
+		t.Log("Not every class was walked:", len(snapshot.Records), len(snapshot.Unsupported))
+		t.Fail()
+	}
+
+	vm := findVM(t, session, fakexapi.LinuxVM)
+	record, ok := snapshot.Records["VM"][string(vm)].(map[string]interface{})
+	if !ok || record["name_label"] != fakexapi.LinuxVM {
+		t.Fatal("VM missing from the snapshot:", record)
+	}
+	metrics, _ := record["metrics"].(string)
+	if _, ok := snapshot.Records["VM_metrics"][metrics]; !ok {
+		t.Log("The VM's metrics reference does not resolve:", metrics)
+		t.Fail()
+	}
+
+	if record, _ := snapshot.Records["secret"][secret].(map[string]interface{}); record["value"] != Redacted {
+		t.Log("Expected the secret's value to be left out, got:", record)
+		t.Fail()
+	}
+
+	path := filepath.Join(t.TempDir(), "snapshot.json")
+	if err := snapshot.WriteFile(path); err != nil {
+		t.Fatal(err)
+	}
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0o600 {
+		t.Log("Expected the snapshot to be readable only by its owner:", info.Mode(), err)
+		t.Fail()
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var written Snapshot
+	if err := json.Unmarshal(data, &written); err != nil {
+		t.Fatal(err)
+	}
+	if len(written.Records["VM"]) != len(snapshot.Records["VM"]) || written.APIVersion != snapshot.APIVersion {
+		t.Log("The written snapshot differs:", written.APIVersion, len(written.Records["VM"]))
+		t.Fail()
+	}
+}
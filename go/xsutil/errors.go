@@ -0,0 +1,175 @@
+package xsutil
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"xenapi"
+)
+
+// Failure codes that have a typed representation or a sentinel below.
+const (
+	CodeBadPowerState               = "VM_BAD_POWER_STATE"
+	CodeHostIsSlave                 = "HOST_IS_SLAVE"
+	CodeHandleInvalid               = "HANDLE_INVALID"
+	CodeSessionAuthenticationFailed = "SESSION_AUTHENTICATION_FAILED"
+	CodeSessionInvalid              = "SESSION_INVALID"
+	CodeEventsLost                  = "EVENTS_LOST"
+	CodeUnknownDriver               = "SR_UNKNOWN_DRIVER"
+	CodeMessageMethodUnknown        = "MESSAGE_METHOD_UNKNOWN"
+	backendFailurePrefix            = "SR_BACKEND_FAILURE_"
+)
+
+// Sentinels for use with errors.Is. Any failure with the same code
+// matches, whatever its parameters.
+var (
+	ErrBadPowerState               = &Failure{Code: CodeBadPowerState}
+	ErrHostIsSlave                 = &Failure{Code: CodeHostIsSlave}
+	ErrHandleInvalid               = &Failure{Code: CodeHandleInvalid}
+	ErrSessionAuthenticationFailed = &Failure{Code: CodeSessionAuthenticationFailed}
+	ErrSessionInvalid              = &Failure{Code: CodeSessionInvalid}
+	ErrEventsLost                  = &Failure{Code: CodeEventsLost}
+	ErrUnknownDriver               = &Failure{Code: CodeUnknownDriver}
+	ErrMessageMethodUnknown        = &Failure{Code: CodeMessageMethodUnknown}
+)
+
+// Failure is an XAPI failure: a code such as VM_BAD_POWER_STATE followed
+// by the parameters the server sent with it.
+type Failure struct {
+	Code   string
+	Params []string
+	err    error
+}
+
+func (f *Failure) Error() string {
+	if len(f.Params) == 0 {
+		return f.Code
+	}
+	return fmt.Sprintf("%s: %s", f.Code, strings.Join(f.Params, ", "))
+}
+
+// Is matches another *Failure with the same code and no parameters, so
+// that the sentinels above can be used with errors.Is.
+func (f *Failure) Is(target error) bool {
+	t, ok := target.(*Failure)
+	return ok && t.Code == f.Code && len(t.Params) == 0
+}
+
+// Unwrap returns the *xenapi.Error the failure was decoded from, if any.
+func (f *Failure) Unwrap() error {
+	return f.err
+}
+
+func (f *Failure) param(i int) string {
+	if i < len(f.Params) {
+		return f.Params[i]
+	}
+	return ""
+}
+
+// BadPowerStateError is VM_BAD_POWER_STATE: the VM was not in a power
+// state that allows the operation.
+type BadPowerStateError struct {
+	*Failure
+	VM       xenapi.VMRef
+	Expected string
+	Actual   string
+}
+
+func (e *BadPowerStateError) Unwrap() error { return e.Failure }
+
+// HostIsSlaveError is HOST_IS_SLAVE: the host contacted is a pool member
+// and Master is the address of the pool coordinator.
+type HostIsSlaveError struct {
+	*Failure
+	Master string
+}
+
+func (e *HostIsSlaveError) Unwrap() error { return e.Failure }
+
+// HandleInvalidError is HANDLE_INVALID: Ref does not name a live object
+// of Class.
+type HandleInvalidError struct {
+	*Failure
+	Class string
+	Ref   string
+}
+
+func (e *HandleInvalidError) Unwrap() error { return e.Failure }
+
+// BackendFailureError is one of the SR_BACKEND_FAILURE_<n> failures raised
+// by a storage driver. Number is the driver's error number.
+type BackendFailureError struct {
+	*Failure
+	Number int
+	Status string
+	Stdout string
+	Stderr string
+}
+
+func (e *BackendFailureError) Unwrap() error { return e.Failure }
+
+// ParseFailure turns an XAPI failure array, as found in a task's
+// error_info, into a typed error. It returns nil for an empty array.
+func ParseFailure(info []string) error {
+	if len(info) == 0 {
+		return nil
+	}
+	return typed(&Failure{Code: info[0], Params: info[1:]})
+}
+
+// Decode converts an error returned by the SDK into a typed failure. The
+// result still unwraps to the original *xenapi.Error. Errors that are not
+// XAPI failures, and nil, are returned unchanged.
+func Decode(err error) error {
+	var apiErr *xenapi.Error
+	if !errors.As(err, &apiErr) {
+		return err
+	}
+	var decoded *Failure
+	if errors.As(err, &decoded) {
+		return err
+	}
+	failure := &Failure{Code: apiErr.Message(), err: err}
+	if data, ok := apiErr.Data().([]interface{}); ok {
+		for _, d := range data {
+			failure.Params = append(failure.Params, fmt.Sprint(d))
+		}
+	}
+	// Some servers repeat the code as the first element of data.
+	if len(failure.Params) > 0 && failure.Params[0] == failure.Code {
+		failure.Params = failure.Params[1:]
+	}
+	return typed(failure)
+}
+
+func typed(f *Failure) error {
+	switch {
+	case f.Code == CodeBadPowerState:
+		return &BadPowerStateError{
+			Failure:  f,
+			VM:       xenapi.VMRef(f.param(0)),
+			Expected: f.param(1),
+			Actual:   f.param(2),
+		}
+	case f.Code == CodeHostIsSlave:
+		return &HostIsSlaveError{Failure: f, Master: f.param(0)}
+	case f.Code == CodeHandleInvalid:
+		return &HandleInvalidError{Failure: f, Class: f.param(0), Ref: f.param(1)}
+	case strings.HasPrefix(f.Code, backendFailurePrefix):
+		number, err := strconv.Atoi(strings.TrimPrefix(f.Code, backendFailurePrefix))
+		if err != nil {
+			return f
+		}
+		return &BackendFailureError{
+			Failure: f,
+			Number:  number,
+			Status:  f.param(0),
+			Stdout:  f.param(1),
+			Stderr:  f.param(2),
+		}
+	}
+	return f
+}
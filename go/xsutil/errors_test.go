@@ -0,0 +1,92 @@
+package xsutil
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"xenapi"
+
+	"github.com/xenserver/xenserver-samples/go/fakexapi"
+)
+
+func TestDecodeBadPowerState(t *testing.T) {
+	session := fakexapi.Start(t).Login(t)
+	vm := findVM(t, session, fakexapi.LinuxVM)
+	err := Decode(xenapi.VM.Unpause(session, vm))
+	var powerErr *BadPowerStateError
+	if !errors.As(err, &powerErr) {
+		t.Fatal("Expected a BadPowerStateError, got:", err)
+	}
+	if powerErr.VM != vm || powerErr.Expected != "paused" || powerErr.Actual != "halted" {
+		t.Log("Unexpected parameters:", powerErr.Params)
+		t.Fail()
+	}
+	if !errors.Is(err, ErrBadPowerState) || errors.Is(err, ErrHostIsSlave) {
+		t.Log("errors.Is does not match on the failure code")
+		t.Fail()
+	}
+	var apiErr *xenapi.Error
+	if !errors.As(err, &apiErr) {
+		t.Log("The decoded error no longer unwraps to the SDK error")
+		t.Fail()
+	}
+}
+
+func TestDecodeHandleInvalid(t *testing.T) {
+	session := fakexapi.Start(t).Login(t)
+	_, err := xenapi.VM.GetRecord(session, "OpaqueRef:missing")
+	var handleErr *HandleInvalidError
+	if !errors.As(Decode(err), &handleErr) || handleErr.Ref != "OpaqueRef:missing" {
+		t.Log("Expected HANDLE_INVALID for the missing VM, got:", err)
+		t.Fail()
+	}
+}
+
+func TestDecodePassesThrough(t *testing.T) {
+	if Decode(nil) != nil {
+		t.Log("Decode(nil) should be nil")
+		t.Fail()
+	}
+	plain := errors.New("not a failure")
+	if Decode(plain) != plain {
+		t.Log("Decode should return non-XAPI errors unchanged")
+		t.Fail()
+	}
+}
+
+func TestParseFailure(t *testing.T) {
+	err := ParseFailure([]string{"SR_BACKEND_FAILURE_37", "", "The request is missing the server parameter", ""})
+	var backendErr *BackendFailureError
+	if !errors.As(err, &backendErr) {
+		t.Fatal("Expected a BackendFailureError, got:", err)
+	}
+	if backendErr.Number != 37 || backendErr.Stdout != "The request is missing the server parameter" {
+		t.Log("Unexpected backend failure:", backendErr)
+		t.Fail()
+	}
+	if ParseFailure(nil) != nil {
+		t.Log("An empty failure array should parse to nil")
+		t.Fail()
+	}
+	var hostErr *HostIsSlaveError
+	if !errors.As(ParseFailure([]string{"HOST_IS_SLAVE", "192.0.2.1"}), &hostErr) || hostErr.Master != "192.0.2.1" {
+		t.Log("Expected HOST_IS_SLAVE naming the master")
+		t.Fail()
+	}
+}
+
+func TestTaskErrorUnwrapsFailure(t *testing.T) {
+	session := fakexapi.Start(t).Login(t)
+	vm := findVM(t, session, fakexapi.LinuxVM)
+	taskRef, err := xenapi.VM.AsyncUnpause(session, vm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = WaitForTask(context.Background(), session, taskRef)
+	var powerErr *BadPowerStateError
+	if !errors.As(err, &powerErr) || powerErr.VM != vm {
+		t.Log("Expected the task error to unwrap to VM_BAD_POWER_STATE, got:", err)
+		t.Fail()
+	}
+}
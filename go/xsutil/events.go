@@ -0,0 +1,113 @@
+package xsutil
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"xenapi"
+)
+
+// EventOperationSync marks the start of a full listing of the subscribed
+// objects. It is sent when a subscription starts and again after the
+// server reports EVENTS_LOST; the "add" events that follow describe every
+// object that currently exists, so any state built from earlier events
+// should be discarded.
+const EventOperationSync xenapi.EventOperation = "sync"
+
+// Event is an event whose snapshot has been decoded into T, usually one of
+// the SDK's record types. For "del" events Record holds the last known
+// state of the object, if the server sent one.
+type Event[T any] struct {
+	Class     string
+	Operation xenapi.EventOperation
+	Ref       string
+	Record    T
+	// Err is set when the snapshot could not be decoded into T; Record
+	// then holds only the fields decoded before the failure.
+	Err error
+}
+
+// Subscription delivers the events of one class until its context is
+// cancelled or an error occurs, then closes Events.
+type Subscription[T any] struct {
+	Events <-chan Event[T]
+	err    error
+}
+
+// Err reports why the subscription ended. It must only be called after
+// Events has been closed, and is nil if the context was cancelled.
+func (s *Subscription[T]) Err() error {
+	return s.err
+}
+
+// Subscribe follows the objects of class ("vm", "pbd", ...) through
+// event.from, decoding each snapshot into T. The token is tracked
+// internally and EVENTS_LOST is recovered from by starting a new listing.
+// An event whose snapshot cannot be decoded is delivered with Err set, and
+// the subscription carries on.
+func Subscribe[T any](ctx context.Context, session *xenapi.Session, class string) *Subscription[T] {
+	events := make(chan Event[T])
+	sub := &Subscription[T]{Events: events}
+	go func() {
+		defer close(events)
+		sub.err = follow(ctx, session, class, events)
+		if ctx.Err() != nil {
+			sub.err = nil
+		}
+	}()
+	return sub
+}
+
+func follow[T any](ctx context.Context, session *xenapi.Session, class string, events chan<- Event[T]) error {
+	send := func(e Event[T]) bool {
+		select {
+		case events <- e:
+			return true
+		case <-ctx.Done():
+			return false
+		}
+	}
+	token := ""
+	for {
+		if token == "" && !send(Event[T]{Class: class, Operation: EventOperationSync}) {
+			return nil
+		}
+		batch, err := eventFrom(ctx, session, []string{class}, token, maxEventTimeout)
+		if err != nil {
+			if errors.Is(Decode(err), ErrEventsLost) {
+				token = ""
+				continue
+			}
+			return Decode(err)
+		}
+		token = batch.Token
+		for _, raw := range batch.Events {
+			event := Event[T]{Class: raw.Class, Operation: raw.Operation, Ref: raw.Ref}
+			if err := DecodeRecord(raw.Snapshot, &event.Record); err != nil {
+				event.Err = fmt.Errorf("%s event for %s: %w", raw.Class, raw.Ref, err)
+			}
+			if !send(event) {
+				return nil
+			}
+		}
+	}
+}
+
+// WaitFor subscribes to class and returns once done accepts an event, or
+// with an error if ctx ends first. Events that could not be decoded are
+// not offered to done.
+func WaitFor[T any](ctx context.Context, session *xenapi.Session, class string, done func(Event[T]) bool) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	sub := Subscribe[T](ctx, session, class)
+	for event := range sub.Events {
+		if event.Operation != EventOperationSync && event.Err == nil && done(event) {
+			return nil
+		}
+	}
+	if err := sub.Err(); err != nil {
+		return err
+	}
+	return ctx.Err()
+}
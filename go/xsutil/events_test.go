@@ -0,0 +1,131 @@
+package xsutil
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"xenapi"
+
+	"github.com/xenserver/xenserver-samples/go/fakexapi"
+)
+
+// next returns the next event, failing the test if none arrives in time.
+func next[T any](t *testing.T, sub *Subscription[T]) Event[T] {
+	t.Helper()
+	select {
+	case event, ok := <-sub.Events:
+		if !ok {
+			t.Fatal("Subscription ended early:", sub.Err())
+		}
+		return event
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for an event")
+	}
+	panic("unreachable")
+}
+
+// skipTo discards events up to the first one matching done and returns it.
+func skipTo[T any](t *testing.T, sub *Subscription[T], done func(Event[T]) bool) Event[T] {
+	t.Helper()
+	for {
+		if event := next(t, sub); done(event) {
+			return event
+		}
+	}
+}
+
+func TestSubscribeDecodesRecords(t *testing.T) {
+	session := fakexapi.Start(t).Login(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sub := Subscribe[xenapi.VMRecord](ctx, session, "vm")
+	if event := next(t, sub); event.Operation != EventOperationSync {
+		t.Fatal("Expected the subscription to start with a sync marker, got:", event.Operation)
+	}
+	event := skipTo(t, sub, func(e Event[xenapi.VMRecord]) bool { return e.Record.NameLabel == fakexapi.LinuxVM })
+	if event.Operation != xenapi.EventOperationAdd || event.Record.PowerState != xenapi.VMPowerStateHalted {
+		t.Log("Unexpected listing event:", event.Operation, event.Record.PowerState)
+		t.Fail()
+	}
+
+	if err := xenapi.VM.SetNameDescription(session, xenapi.VMRef(event.Ref), "changed"); err != nil {
+		t.Fatal(err)
+	}
+	event = skipTo(t, sub, func(e Event[xenapi.VMRecord]) bool { return e.Operation == xenapi.EventOperationMod })
+	if event.Record.NameDescription != "changed" {
+		t.Log("Unexpected modification:", event.Record.NameDescription)
+		t.Fail()
+	}
+
+	cancel()
+	for range sub.Events {
+	}
+	if sub.Err() != nil {
+		t.Log("A cancelled subscription should end without an error, got:", sub.Err())
+		t.Fail()
+	}
+}
+
+func TestSubscribeRecoversFromEventsLost(t *testing.T) {
+	server := fakexapi.Start(t)
+	session := server.Login(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sub := Subscribe[xenapi.VMRecord](ctx, session, "vm")
+	next(t, sub)
+	vm := skipTo(t, sub, func(e Event[xenapi.VMRecord]) bool { return e.Record.NameLabel == fakexapi.LinuxVM })
+
+	// Make more changes at once than the server retains, so that the
+	// subscription's token falls out of the event log.
+	server.Do(func(st *fakexapi.Store) {
+		st.SetEventLimit(1)
+		for _, description := range []string{"one", "two", "three"} {
+			st.Update("VM", vm.Ref, fakexapi.Record{"name_description": description})
+		}
+	})
+	skipTo(t, sub, func(e Event[xenapi.VMRecord]) bool { return e.Operation == EventOperationSync })
+	event := skipTo(t, sub, func(e Event[xenapi.VMRecord]) bool { return e.Ref == vm.Ref })
+	if event.Operation != xenapi.EventOperationAdd || event.Record.NameDescription != "three" {
+		t.Log("Expected a fresh listing with the latest state, got:", event.Operation, event.Record.NameDescription)
+		t.Fail()
+	}
+}
+
+func TestSubscribeReportsUndecodableEvents(t *testing.T) {
+	server := fakexapi.Start(t)
+	session := server.Login(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sub := Subscribe[xenapi.VMRecord](ctx, session, "vm")
+	next(t, sub)
+	vm := skipTo(t, sub, func(e Event[xenapi.VMRecord]) bool { return e.Record.NameLabel == fakexapi.LinuxVM })
+
+	server.Do(func(st *fakexapi.Store) {
+		st.Update("VM", vm.Ref, fakexapi.Record{"name_label": []string{"not", "a", "name"}})
+	})
+	event := skipTo(t, sub, func(e Event[xenapi.VMRecord]) bool { return e.Ref == vm.Ref })
+	if event.Err == nil {
+		t.Log("Expected the undecodable snapshot to be reported")
+		t.Fail()
+	}
+	if err := xenapi.VM.SetNameLabel(session, xenapi.VMRef(vm.Ref), "fixed"); err != nil {
+		t.Fatal(err)
+	}
+	event = skipTo(t, sub, func(e Event[xenapi.VMRecord]) bool { return e.Ref == vm.Ref })
+	if event.Err != nil || event.Record.NameLabel != "fixed" {
+		t.Log("Expected the subscription to carry on, got:", event.Record.NameLabel, event.Err)
+		t.Fail()
+	}
+}
+
+func TestWaitForTimesOut(t *testing.T) {
+	session := fakexapi.Start(t).Login(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	err := WaitFor(ctx, session, "vm", func(Event[xenapi.VMRecord]) bool { return false })
+	if err != context.DeadlineExceeded {
+		t.Log("Expected the deadline to be exceeded, got:", err)
+		t.Fail()
+	}
+}
@@ -0,0 +1,84 @@
+package xsutil
+
+import (
+	"fmt"
+	"sort"
+
+	"xenapi"
+)
+
+// Feature is a part of the API that older servers lack.
+type Feature string
+
+const (
+	// FeatureObserver is the Observer class, for tracing.
+	FeatureObserver Feature = "Observer"
+	// FeatureRepository is the Repository class, for update repositories.
+	FeatureRepository Feature = "Repository"
+	// FeatureVTPM is the VTPM class.
+	FeatureVTPM Feature = "VTPM"
+	// FeatureSnapshotIgnoreVDIs is VM.snapshot taking a list of VDIs to
+	// leave out; older servers only have the form VM.Snapshot3 calls.
+	FeatureSnapshotIgnoreVDIs Feature = "snapshot with ignore_vdis"
+	// FeatureCertificateVerification is a server certificate that can be
+	// verified against its CA, with the server's address among its SANs.
+	FeatureCertificateVerification Feature = "certificate verification"
+)
+
+// featureVersions maps each feature to the first API version that has it.
+var featureVersions = map[Feature]xenapi.APIVersion{
+	FeatureObserver:                xenapi.APIVersion2_21,
+	FeatureRepository:              xenapi.APIVersion2_21,
+	FeatureVTPM:                    xenapi.APIVersion2_21,
+	FeatureSnapshotIgnoreVDIs:      xenapi.APIVersion2_21,
+	FeatureCertificateVerification: xenapi.APIVersion2_21,
+}
+
+// Features lists the known features in a stable order.
+func Features() []Feature {
+	features := make([]Feature, 0, len(featureVersions))
+	for feature := range featureVersions {
+		features = append(features, feature)
+	}
+	sort.Slice(features, func(i, j int) bool { return features[i] < features[j] })
+	return features
+}
+
+// MinAPIVersion returns the first API version that has feature.
+func MinAPIVersion(feature Feature) (xenapi.APIVersion, error) {
+	version, ok := featureVersions[feature]
+	if !ok {
+		return 0, fmt.Errorf("unknown feature %q", feature)
+	}
+	return version, nil
+}
+
+// UnsupportedFeatureError reports that the server's API version is too old
+// for a feature.
+type UnsupportedFeatureError struct {
+	Feature  Feature
+	Required xenapi.APIVersion
+	Actual   xenapi.APIVersion
+}
+
+func (e *UnsupportedFeatureError) Error() string {
+	return fmt.Sprintf("%s needs API version %s or later, but the server speaks %s", e.Feature, e.Required, e.Actual)
+}
+
+// CheckFeature returns nil if the server session is logged in to has
+// feature, and an *UnsupportedFeatureError otherwise.
+func CheckFeature(session *xenapi.Session, feature Feature) error {
+	required, err := MinAPIVersion(feature)
+	if err != nil {
+		return err
+	}
+	if session.APIVersion < required {
+		return &UnsupportedFeatureError{Feature: feature, Required: required, Actual: session.APIVersion}
+	}
+	return nil
+}
+
+// Supports reports whether the server session is logged in to has feature.
+func Supports(session *xenapi.Session, feature Feature) bool {
+	return CheckFeature(session, feature) == nil
+}
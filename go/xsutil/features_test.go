@@ -0,0 +1,39 @@
+package xsutil
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"xenapi"
+)
+
+func TestCheckFeature(t *testing.T) {
+	session := xenapi.NewSession(&xenapi.ClientOpts{URL: "http://192.0.2.1"})
+	session.APIVersion = xenapi.APIVersion2_20
+	err := CheckFeature(session, FeatureVTPM)
+	var unsupported *UnsupportedFeatureError
+	if !errors.As(err, &unsupported) || unsupported.Required != xenapi.APIVersion2_21 || unsupported.Actual != xenapi.APIVersion2_20 {
+		t.Fatal("Expected VTPM to need a newer version, got:", err)
+	}
+	if !strings.Contains(err.Error(), "2.21") || !strings.Contains(err.Error(), "2.20") {
+		t.Log("The error does not name both versions:", err)
+		t.Fail()
+	}
+	if Supports(session, FeatureSnapshotIgnoreVDIs) {
+		t.Log("API 2.20 should not snapshot with ignore_vdis")
+		t.Fail()
+	}
+
+	session.APIVersion = xenapi.APIVersionLatest
+	for _, feature := range Features() {
+		if err := CheckFeature(session, feature); err != nil {
+			t.Log(err)
+			t.Fail()
+		}
+	}
+	if err := CheckFeature(session, "teleportation"); err == nil || errors.As(err, &unsupported) {
+		t.Log("Expected an unknown feature to be reported as such, got:", err)
+		t.Fail()
+	}
+}
@@ -0,0 +1,42 @@
+package xsutil
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"os"
+
+	"xenapi"
+)
+
+// HTTPClient returns a client for those HTTP handlers that checks the
+// server's certificate the way a session created with opts does: against
+// opts.SecureOpts.ServerCert if set, and not at all otherwise. The SDK
+// keeps its own client to itself.
+func HTTPClient(opts *xenapi.ClientOpts) (*http.Client, error) {
+	config := &tls.Config{InsecureSkipVerify: true}
+	if opts.SecureOpts != nil && opts.SecureOpts.ServerCert != "" {
+		pem, err := os.ReadFile(opts.SecureOpts.ServerCert)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", opts.SecureOpts.ServerCert)
+		}
+		config = &tls.Config{RootCAs: pool}
+	}
+	return &http.Client{Transport: &http.Transport{TLSClientConfig: config, Proxy: http.ProxyFromEnvironment}}, nil
+}
+
+// HostOpts returns a copy of opts pointing at a pool member's address, for
+// the HTTP handlers, such as /rrd_updates, that only serve the host they
+// run on. The scheme and, when address has none, the port are kept.
+func HostOpts(opts *xenapi.ClientOpts, address string) (*xenapi.ClientOpts, error) {
+	hostOpts, err := withHost(*opts, address)
+	if err != nil {
+		return nil, err
+	}
+	return &hostOpts, nil
+}
@@ -0,0 +1,215 @@
+package xsutil
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+)
+
+// NullRef is the reference XAPI uses for "no object".
+const NullRef = "OpaqueRef:NULL"
+
+// Kinds of integrity problem.
+const (
+	ProblemDangling     = "dangling reference"
+	ProblemOrphanedVDI  = "orphaned VDI"
+	ProblemUnpluggedPBD = "unplugged PBD"
+	ProblemMissingPBD   = "missing PBD"
+)
+
+// Problem is an inconsistency CheckIntegrity found in a snapshot.
+type Problem struct {
+	Kind   string `json:"kind"`
+	Class  string `json:"class"`
+	Ref    string `json:"ref"`
+	Name   string `json:"name"`
+	Detail string `json:"detail"`
+}
+
+func (p Problem) String() string {
+	return fmt.Sprintf("%s: %s %q (%s): %s", p.Kind, p.Class, p.Name, p.Ref, p.Detail)
+}
+
+// refField is a field of a record type that holds references, and the
+// class they refer to. For a map, key says whether the references are its
+// keys or its values.
+type refField struct {
+	name   string
+	target string
+	key    bool
+}
+
+// refFields maps each class to its reference fields, found by reflection
+// on the SDK's record types.
+func refFields() map[string][]refField {
+	refClasses := make(map[reflect.Type]string, len(classes))
+	recordTypes := make(map[string]reflect.Type, len(classes))
+	for _, class := range classes {
+		records := reflect.ValueOf(class.class).MethodByName("GetAllRecords").Type().Out(0)
+		refClasses[records.Key()] = class.Name
+		recordTypes[class.Name] = records.Elem()
+	}
+	fields := make(map[string][]refField)
+	for name, recordType := range recordTypes {
+		for i := 0; i < recordType.NumField(); i++ {
+			field := recordType.Field(i)
+			tag := field.Tag.Get("xapi")
+			if class, key := refTarget(refClasses, field.Type); tag != "" && class != "" {
+				fields[name] = append(fields[name], refField{name: tag, target: class, key: key})
+			}
+		}
+	}
+	return fields
+}
+
+// refTarget returns the class the references in a field of type t refer
+// to, "" if it holds none, and whether they are the keys of a map.
+func refTarget(refClasses map[reflect.Type]string, t reflect.Type) (string, bool) {
+	switch t.Kind() {
+	case reflect.Slice:
+		return refClasses[t.Elem()], false
+	case reflect.Map:
+		if name, ok := refClasses[t.Key()]; ok {
+			return name, true
+		}
+		return refClasses[t.Elem()], false
+	}
+	return refClasses[t], false
+}
+
+// refsIn returns the references in a field value in wire format: a
+// string, a list of them, or a map with them as its keys if keys is set
+// and as its values otherwise.
+func refsIn(value interface{}, keys bool) []string {
+	var refs []string
+	switch value := value.(type) {
+	case string:
+		refs = append(refs, value)
+	case []interface{}:
+		for _, item := range value {
+			if ref, ok := item.(string); ok {
+				refs = append(refs, ref)
+			}
+		}
+	case map[string]interface{}:
+		for key, item := range value {
+			if keys {
+				refs = append(refs, key)
+			} else if ref, ok := item.(string); ok {
+				refs = append(refs, ref)
+			}
+		}
+	}
+	return refs
+}
+
+// CheckIntegrity follows every reference in a snapshot, such as VBD.VDI or
+// VM.snapshot_of, and reports the ones whose object is missing. References
+// to classes the snapshot does not have are not checked. It also reports
+// user and system VDIs that no VBD uses, leaving out snapshots and ISOs,
+// and the PBDs of SRs in use that are unplugged or, for shared SRs,
+// missing on some host. An SR is in use when any of its PBDs is plugged.
+func CheckIntegrity(snapshot *Snapshot) []Problem {
+	var problems []Problem
+	add := func(kind, class, ref string, record interface{}, format string, args ...interface{}) {
+		problems = append(problems, Problem{
+			Kind: kind, Class: class, Ref: ref, Name: recordName(record), Detail: fmt.Sprintf(format, args...),
+		})
+	}
+
+	for class, fields := range refFields() {
+		for ref, record := range snapshot.Records[class] {
+			for _, field := range fields {
+				targets, ok := snapshot.Records[field.target]
+				if !ok {
+					continue
+				}
+				for _, target := range refsIn(fieldValue(record, field.name), field.key) {
+					if _, ok := targets[target]; !ok && target != NullRef && target != "" {
+						add(ProblemDangling, class, ref, record, "%s refers to %s %s, which does not exist", field.name, field.target, target)
+					}
+				}
+			}
+		}
+	}
+
+	used := make(map[string]bool)
+	for _, vbd := range snapshot.Records["VBD"] {
+		if vdi, ok := fieldValue(vbd, "VDI").(string); ok {
+			used[vdi] = true
+		}
+	}
+	for ref, vdi := range snapshot.Records["VDI"] {
+		vdiType, _ := fieldValue(vdi, "type").(string)
+		isSnapshot, _ := fieldValue(vdi, "is_a_snapshot").(bool)
+		sr, _ := fieldValue(vdi, "SR").(string)
+		contentType, _ := fieldValue(snapshot.Records["SR"][sr], "content_type").(string)
+		if used[ref] || isSnapshot || contentType == "iso" || (vdiType != "user" && vdiType != "system") {
+			continue
+		}
+		add(ProblemOrphanedVDI, "VDI", ref, vdi, "no VBD uses this %s disk", vdiType)
+	}
+
+	for srRef, sr := range snapshot.Records["SR"] {
+		pbdsOnHost := make(map[string]bool)
+		var inUse bool
+		for _, pbdRef := range refsIn(fieldValue(sr, "PBDs"), false) {
+			pbd := snapshot.Records["PBD"][pbdRef]
+			host, _ := fieldValue(pbd, "host").(string)
+			pbdsOnHost[host] = true
+			if attached, _ := fieldValue(pbd, "currently_attached").(bool); attached {
+				inUse = true
+			}
+		}
+		if !inUse {
+			continue
+		}
+		for _, pbdRef := range refsIn(fieldValue(sr, "PBDs"), false) {
+			pbd, ok := snapshot.Records["PBD"][pbdRef]
+			if attached, _ := fieldValue(pbd, "currently_attached").(bool); ok && !attached {
+				host, _ := fieldValue(pbd, "host").(string)
+				add(ProblemUnpluggedPBD, "SR", srRef, sr, "PBD %s on host %q is not plugged", pbdRef, recordName(snapshot.Records["host"][host]))
+			}
+		}
+		if shared, _ := fieldValue(sr, "shared").(bool); !shared {
+			continue
+		}
+		for hostRef, host := range snapshot.Records["host"] {
+			if !pbdsOnHost[hostRef] {
+				add(ProblemMissingPBD, "SR", srRef, sr, "host %q has no PBD for this shared SR", recordName(host))
+			}
+		}
+	}
+
+	sort.Slice(problems, func(i, j int) bool {
+		a, b := problems[i], problems[j]
+		if a.Kind != b.Kind {
+			return a.Kind < b.Kind
+		}
+		if a.Class != b.Class {
+			return a.Class < b.Class
+		}
+		if a.Name != b.Name {
+			return a.Name < b.Name
+		}
+		if a.Ref != b.Ref {
+			return a.Ref < b.Ref
+		}
+		return a.Detail < b.Detail
+	})
+	return problems
+}
+
+func fieldValue(record interface{}, field string) interface{} {
+	m, _ := record.(map[string]interface{})
+	return m[field]
+}
+
+// recordName names a record by its name label, else its UUID.
+func recordName(record interface{}) string {
+	if name, _ := fieldValue(record, "name_label").(string); name != "" {
+		return name
+	}
+	uuid, _ := fieldValue(record, "uuid").(string)
+	return uuid
+}
@@ -0,0 +1,124 @@
+package xsutil
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"testing"
+
+	"xenapi"
+
+	"github.com/xenserver/xenserver-samples/go/fakexapi"
+)
+
+func TestCheckIntegrity(t *testing.T) {
+	session := fakexapi.Start(t).Login(t)
+	srs, err := xenapi.SR.GetByNameLabel(session, "NFS virtual disk storage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	orphan, err := xenapi.VDI.Create(session, xenapi.VDIRecord{
+		NameLabel: "forgotten disk", SR: srs[0], VirtualSize: 1 << 30, Type: xenapi.VdiTypeUser,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	vm := findVM(t, session, fakexapi.LinuxVM)
+	vbds, err := xenapi.VM.GetVBDs(session, vm)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Check a saved snapshot, as an operator would.
+	dumped, err := Dump(session)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "snapshot.json")
+	if err := dumped.WriteFile(path); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var snapshot Snapshot
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		t.Fatal(err)
+	}
+
+	problems := CheckIntegrity(&snapshot)
+	if len(problems) != 1 || problems[0].Kind != ProblemOrphanedVDI || problems[0].Ref != string(orphan) {
+		t.Fatal("Expected only the orphaned VDI, got:", problems)
+	}
+
+	// Lose the VM's first disk, unplug the NFS SR on one host and add a
+	// host that has no PBD for it.
+	vdi := fieldValue(snapshot.Records["VBD"][string(vbds[0])], "VDI").(string)
+	delete(snapshot.Records["VDI"], vdi)
+	nfs := snapshot.Records["SR"][string(srs[0])].(map[string]interface{})
+	if shared, _ := nfs["shared"].(bool); !shared {
+		t.Fatal("Expected the NFS SR to be shared")
+	}
+	pbds := refsIn(nfs["PBDs"], false)
+	if len(pbds) == 0 {
+		t.Fatal("The NFS SR has no PBDs")
+	}
+	snapshot.Records["PBD"][pbds[0]].(map[string]interface{})["currently_attached"] = false
+	if len(pbds) == 1 {
+		// With one PBD the SR would no longer be in use; plug in another.
+		snapshot.Records["PBD"]["OpaqueRef:extra"] = map[string]interface{}{"host": "OpaqueRef:elsewhere", "SR": string(srs[0]), "currently_attached": true}
+		nfs["PBDs"] = append(nfs["PBDs"].([]interface{}), "OpaqueRef:extra")
+		snapshot.Records["host"]["OpaqueRef:elsewhere"] = map[string]interface{}{"name_label": "elsewhere"}
+	}
+	snapshot.Records["host"]["OpaqueRef:new"] = map[string]interface{}{"name_label": "new host"}
+
+	var dangling, unplugged, missing []Problem
+	for _, problem := range CheckIntegrity(&snapshot) {
+		switch {
+		case problem.Kind == ProblemDangling && problem.Ref == string(vbds[0]):
+			dangling = append(dangling, problem)
+		case problem.Kind == ProblemUnpluggedPBD && problem.Ref == string(srs[0]):
+			unplugged = append(unplugged, problem)
+		case problem.Kind == ProblemMissingPBD && problem.Ref == string(srs[0]):
+			missing = append(missing, problem)
+		}
+	}
+	if len(dangling) != 1 || dangling[0].Class != "VBD" {
+		t.Log("Expected the VBD's VDI to dangle, got:", dangling)
+		t.Fail()
+	}
+	if len(unplugged) != 1 {
+		t.Log("Expected one unplugged PBD, got:", unplugged)
+		t.Fail()
+	}
+	if len(missing) != 1 || missing[0].Detail != `host "new host" has no PBD for this shared SR` {
+		t.Log("Expected the new host to miss a PBD, got:", missing)
+		t.Fail()
+	}
+}
+
+func TestRefsInMaps(t *testing.T) {
+	refClasses := map[reflect.Type]string{reflect.TypeOf(xenapi.VDIRef("")): "VDI"}
+	value := map[string]interface{}{"data": "OpaqueRef:vdi"}
+	for _, test := range []struct {
+		fieldType reflect.Type
+		want      []string
+	}{
+		{reflect.TypeOf(map[string]xenapi.VDIRef{}), []string{"OpaqueRef:vdi"}},
+		{reflect.TypeOf(map[xenapi.VDIRef]string{}), []string{"data"}},
+		{reflect.TypeOf(map[string]string{}), nil},
+	} {
+		class, key := refTarget(refClasses, test.fieldType)
+		var got []string
+		if class != "" {
+			got = refsIn(value, key)
+		}
+		if !slices.Equal(got, test.want) {
+			t.Logf("Expected %v in a %v, got %v", test.want, test.fieldType, got)
+			t.Fail()
+		}
+	}
+}
@@ -0,0 +1,147 @@
+// Command classgen writes the list of classes that Dump walks. It reads
+// the xenapi package's source and keeps every package variable whose type
+// has a GetAllRecords method, naming it as the method names it on the
+// wire, e.g. "PIF_metrics" for xenapi.PIFMetrics.
+//
+// Run it through go generate in the xsutil directory after updating the
+// SDK.
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"go/ast"
+	"go/format"
+	"go/parser"
+	"go/token"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+type class struct {
+	wireName string
+	varName  string
+}
+
+func main() {
+	sdk := flag.String("sdk", "../goSDK", "directory of the xenapi package")
+	out := flag.String("out", "classes_gen.go", "file to write")
+	pkg := flag.String("package", "xsutil", "package of the file to write")
+	flag.Parse()
+
+	classes, err := findClasses(*sdk)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(classes) == 0 {
+		log.Fatalf("no classes with GetAllRecords found in %s", *sdk)
+	}
+	src, err := render(*pkg, classes)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := os.WriteFile(*out, src, 0o644); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// findClasses parses the Go files in dir and returns its classes sorted by
+// wire name.
+func findClasses(dir string) ([]class, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*.go"))
+	if err != nil {
+		return nil, err
+	}
+	fset := token.NewFileSet()
+	varsOfType := make(map[string][]string)
+	wireNames := make(map[string]string)
+	for _, file := range files {
+		if strings.HasSuffix(file, "_test.go") {
+			continue
+		}
+		f, err := parser.ParseFile(fset, file, nil, 0)
+		if err != nil {
+			return nil, err
+		}
+		for _, decl := range f.Decls {
+			switch decl := decl.(type) {
+			case *ast.GenDecl:
+				if decl.Tok != token.VAR {
+					continue
+				}
+				for _, spec := range decl.Specs {
+					value := spec.(*ast.ValueSpec)
+					ident, ok := value.Type.(*ast.Ident)
+					if !ok {
+						continue
+					}
+					for _, name := range value.Names {
+						if name.IsExported() {
+							varsOfType[ident.Name] = append(varsOfType[ident.Name], name.Name)
+						}
+					}
+				}
+			case *ast.FuncDecl:
+				if decl.Name.Name != "GetAllRecords" || decl.Recv == nil || decl.Body == nil {
+					continue
+				}
+				receiver, ok := decl.Recv.List[0].Type.(*ast.Ident)
+				if !ok {
+					continue
+				}
+				if wireName := calledClass(decl.Body); wireName != "" {
+					wireNames[receiver.Name] = wireName
+				}
+			}
+		}
+	}
+
+	var classes []class
+	for typeName, wireName := range wireNames {
+		for _, varName := range varsOfType[typeName] {
+			classes = append(classes, class{wireName: wireName, varName: varName})
+		}
+	}
+	sort.Slice(classes, func(i, j int) bool { return classes[i].wireName < classes[j].wireName })
+	return classes, nil
+}
+
+// calledClass returns the class of the first "<class>.get_all_records"
+// string in body.
+func calledClass(body *ast.BlockStmt) string {
+	var wireName string
+	ast.Inspect(body, func(n ast.Node) bool {
+		lit, ok := n.(*ast.BasicLit)
+		if !ok || lit.Kind != token.STRING || wireName != "" {
+			return wireName == ""
+		}
+		s, err := strconv.Unquote(lit.Value)
+		if err == nil && strings.HasSuffix(s, ".get_all_records") {
+			wireName = strings.TrimSuffix(s, ".get_all_records")
+		}
+		return false
+	})
+	return wireName
+}
+
+func render(pkg string, classes []class) ([]byte, error) {
+	var buf bytes.Buffer
+	fmt.Fprintln(&buf, "// Code generated by classgen from the xenapi package; DO NOT EDIT.")
+	fmt.Fprintln(&buf)
+	fmt.Fprintf(&buf, "package %s\n\n", pkg)
+	fmt.Fprintln(&buf, `import "xenapi"`)
+	fmt.Fprintln(&buf)
+	fmt.Fprintln(&buf, "// classes lists every class the xenapi package can list records of,")
+	fmt.Fprintln(&buf, "// sorted by wire name.")
+	fmt.Fprintln(&buf, "var classes = []Class{")
+	for _, c := range classes {
+		fmt.Fprintf(&buf, "\t{Name: %q, class: xenapi.%s},\n", c.wireName, c.varName)
+	}
+	fmt.Fprintln(&buf, "}")
+	return format.Source(buf.Bytes())
+}
@@ -0,0 +1,434 @@
+package xsutil
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"xenapi"
+)
+
+// DefaultJoinTimeout is how long JoinPool waits for the joining host to be
+// enabled in the pool unless told otherwise.
+const DefaultJoinTimeout = 10 * time.Minute
+
+// The checks CheckJoin runs.
+const (
+	JoinCheckPool    = "pool"
+	JoinCheckVersion = "version"
+	JoinCheckCPU     = "cpu"
+	JoinCheckLicence = "licence"
+	JoinCheckNetwork = "network"
+	JoinCheckStorage = "storage"
+	JoinCheckVMs     = "vms"
+)
+
+// JoinProblem is something that stops a host from joining a pool, or, as
+// a warning, something the join will change.
+type JoinProblem struct {
+	Check  string
+	Detail string
+}
+
+func (p JoinProblem) String() string {
+	return p.Check + ": " + p.Detail
+}
+
+// SharedSR is a shared SR of the joining host, which has to be forgotten
+// before the host can join.
+type SharedSR struct {
+	Ref  xenapi.SRRef
+	UUID string
+	Name string
+	Type string
+	// InPool is whether the pool has the same SR, which the host will then
+	// reach through the pool's PBD for it.
+	InPool bool
+}
+
+func (s SharedSR) String() string {
+	if s.InPool {
+		return fmt.Sprintf("forget SR %q (%s); the pool already has it, so the host gets it back once joined", s.Name, s.Type)
+	}
+	return fmt.Sprintf("forget SR %q (%s); its disks are unreachable from the host until the SR is introduced to the pool", s.Name, s.Type)
+}
+
+// JoinReport is what CheckJoin found.
+type JoinReport struct {
+	// Host is the name of the joining host.
+	Host string
+	// Problems stop the join; Warnings do not.
+	Problems []JoinProblem
+	Warnings []JoinProblem
+	// SharedSRs must be detached from the host for the join to go ahead.
+	SharedSRs []SharedSR
+}
+
+// OK reports whether nothing but shared SRs stands in the way of the join.
+func (r *JoinReport) OK() bool {
+	return len(r.Problems) == 0
+}
+
+// JoinError is returned by JoinPool when the checks fail. Nothing has been
+// changed on either side.
+type JoinError struct {
+	Host     string
+	Problems []JoinProblem
+}
+
+func (e *JoinError) Error() string {
+	details := make([]string, len(e.Problems))
+	for i, p := range e.Problems {
+		details[i] = p.String()
+	}
+	return fmt.Sprintf("host %q cannot join the pool: %s", e.Host, strings.Join(details, "; "))
+}
+
+// joinSide is what the checks read from each side of a join.
+type joinSide struct {
+	host     xenapi.HostRecord
+	hostRef  xenapi.HostRef
+	hosts    map[xenapi.HostRef]xenapi.HostRecord
+	pool     xenapi.PoolRecord
+	srs      map[xenapi.SRRef]xenapi.SRRecord
+	pifs     map[xenapi.PIFRef]xenapi.PIFRecord
+	bonds    int
+	guestVMs []string
+}
+
+// readJoinSide reads a pool from its coordinator's point of view.
+func readJoinSide(session *xenapi.Session) (*joinSide, error) {
+	s := &joinSide{}
+	pools, err := xenapi.Pool.GetAllRecords(session)
+	if err != nil {
+		return nil, err
+	}
+	for _, pool := range pools {
+		s.pool = pool
+	}
+	if s.hosts, err = xenapi.Host.GetAllRecords(session); err != nil {
+		return nil, err
+	}
+	s.hostRef = s.pool.Master
+	s.host = s.hosts[s.hostRef]
+	if s.srs, err = xenapi.SR.GetAllRecords(session); err != nil {
+		return nil, err
+	}
+	if s.pifs, err = xenapi.PIF.GetAllRecords(session); err != nil {
+		return nil, err
+	}
+	bonds, err := xenapi.Bond.GetAllRecords(session)
+	if err != nil {
+		return nil, err
+	}
+	s.bonds = len(bonds)
+	vms, err := xenapi.VM.GetAllRecords(session)
+	if err != nil {
+		return nil, err
+	}
+	for _, vm := range vms {
+		if !vm.IsControlDomain && vm.PowerState != xenapi.VMPowerStateHalted {
+			s.guestVMs = append(s.guestVMs, vm.NameLabel)
+		}
+	}
+	sort.Strings(s.guestVMs)
+	return s, nil
+}
+
+// CheckJoin checks whether the host joiner is logged in to can join the
+// pool coordinator is logged in to, looking for what XAPI would refuse
+// the join for, and lists the shared SRs that must be detached first.
+func CheckJoin(joiner, coordinator *xenapi.Session) (*JoinReport, error) {
+	j, err := readJoinSide(joiner)
+	if err != nil {
+		return nil, err
+	}
+	p, err := readJoinSide(coordinator)
+	if err != nil {
+		return nil, err
+	}
+	return checkJoin(j, p), nil
+}
+
+func checkJoin(j, p *joinSide) *JoinReport {
+	r := &JoinReport{Host: j.host.NameLabel}
+	problem := func(check, format string, args ...interface{}) {
+		r.Problems = append(r.Problems, JoinProblem{Check: check, Detail: fmt.Sprintf(format, args...)})
+	}
+	warning := func(check, format string, args ...interface{}) {
+		r.Warnings = append(r.Warnings, JoinProblem{Check: check, Detail: fmt.Sprintf(format, args...)})
+	}
+
+	if len(j.hosts) > 1 {
+		problem(JoinCheckPool, "the host is the coordinator of a pool of %d hosts; only a standalone host can join", len(j.hosts))
+	}
+	for _, host := range p.hosts {
+		if host.UUID == j.host.UUID {
+			problem(JoinCheckPool, "the host is already a member of the pool")
+		}
+	}
+	if p.pool.HaEnabled {
+		problem(JoinCheckPool, "HA is enabled on the pool; disable it for the join")
+	}
+
+	if j.host.APIVersionMajor != p.host.APIVersionMajor || j.host.APIVersionMinor != p.host.APIVersionMinor {
+		problem(JoinCheckVersion, "the host speaks API %d.%d, the pool %d.%d",
+			j.host.APIVersionMajor, j.host.APIVersionMinor, p.host.APIVersionMajor, p.host.APIVersionMinor)
+	}
+	for _, key := range []string{"product_version", "platform_version", "xapi_build"} {
+		if have, want := j.host.SoftwareVersion[key], p.host.SoftwareVersion[key]; have != want {
+			problem(JoinCheckVersion, "the host has %s %q, the pool %q; update the host first", key, have, want)
+		}
+	}
+
+	if have, want := j.host.CPUInfo["vendor"], p.host.CPUInfo["vendor"]; have != want {
+		problem(JoinCheckCPU, "the host has %s CPUs, the pool %s", have, want)
+	} else if missing := missingFeatures(j.host.CPUInfo["features"], p.host.CPUInfo["features"]); missing != "" {
+		warning(JoinCheckCPU, "the host lacks CPU features the pool has (%s); the pool's features will be levelled down, which running VMs only see once restarted", missing)
+	}
+
+	if j.host.Edition != p.host.Edition {
+		problem(JoinCheckLicence, "the host is licensed as %q, the pool as %q; apply the pool's licence to the host", j.host.Edition, p.host.Edition)
+	}
+
+	if j.bonds > 0 {
+		problem(JoinCheckNetwork, "the host has %d bonds; remove them, the pool's are created on the host when it joins", j.bonds)
+	}
+	for _, pif := range sortedPIFs(j.pifs) {
+		switch {
+		case pif.Management && !pif.Physical:
+			problem(JoinCheckNetwork, "the host's management interface %s is not a physical NIC", pif.Device)
+		case pif.VLAN >= 0 && !pif.Management:
+			problem(JoinCheckNetwork, "the host has VLAN %d on %s; remove it, the pool's VLANs are created on the host when it joins", pif.VLAN, pif.Device)
+		}
+	}
+
+	if len(j.guestVMs) > 0 {
+		problem(JoinCheckVMs, "the host is running VMs: %s; shut them down or move them away", strings.Join(j.guestVMs, ", "))
+	}
+
+	for ref, sr := range j.srs {
+		if !sr.Shared || len(sr.PBDs) == 0 {
+			continue
+		}
+		_, inPool := findSRByUUID(p.srs, sr.UUID)
+		r.SharedSRs = append(r.SharedSRs, SharedSR{Ref: ref, UUID: sr.UUID, Name: sr.NameLabel, Type: sr.Type, InPool: inPool})
+	}
+	sort.Slice(r.SharedSRs, func(a, b int) bool { return r.SharedSRs[a].Name < r.SharedSRs[b].Name })
+	return r
+}
+
+// missingFeatures returns the CPU feature words, such as "word 2:
+// 00000010", that pool has and host lacks, or "" if it lacks none. The
+// features are hex words separated by dashes, as in host.cpu_info.
+func missingFeatures(host, pool string) string {
+	hostWords, poolWords := strings.Split(host, "-"), strings.Split(pool, "-")
+	var missing []string
+	for i, word := range poolWords {
+		want, err := strconv.ParseUint(word, 16, 32)
+		if err != nil {
+			continue
+		}
+		var have uint64
+		if i < len(hostWords) {
+			have, _ = strconv.ParseUint(hostWords[i], 16, 32)
+		}
+		if lacking := want &^ have; lacking != 0 {
+			missing = append(missing, fmt.Sprintf("word %d: %08x", i, lacking))
+		}
+	}
+	return strings.Join(missing, ", ")
+}
+
+func sortedPIFs(pifs map[xenapi.PIFRef]xenapi.PIFRecord) []xenapi.PIFRecord {
+	sorted := make([]xenapi.PIFRecord, 0, len(pifs))
+	for _, pif := range pifs {
+		sorted = append(sorted, pif)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].Device != sorted[j].Device {
+			return sorted[i].Device < sorted[j].Device
+		}
+		return sorted[i].VLAN < sorted[j].VLAN
+	})
+	return sorted
+}
+
+func findSRByUUID(srs map[xenapi.SRRef]xenapi.SRRecord, uuid string) (xenapi.SRRef, bool) {
+	for ref, sr := range srs {
+		if sr.UUID == uuid {
+			return ref, true
+		}
+	}
+	return "", false
+}
+
+// JoinOptions adjust JoinPool.
+type JoinOptions struct {
+	// Address is how the joining host reaches the coordinator; it defaults
+	// to the coordinator's address as the pool records it.
+	Address string
+	// Username and Password are the pool's credentials.
+	Username string
+	Password string
+	// DetachSharedSRs lets JoinPool forget the joining host's shared SRs.
+	// Without it, a host that has any is refused with a JoinError saying
+	// what to detach.
+	DetachSharedSRs bool
+	// Timeout bounds the wait for the host to be enabled in the pool; it
+	// is DefaultJoinTimeout if 0.
+	Timeout time.Duration
+}
+
+// detachedSR is what it takes to put back a shared SR JoinPool forgot.
+type detachedSR struct {
+	record        xenapi.SRRecord
+	deviceConfigs []map[string]string
+}
+
+// JoinPool makes the host joiner is logged in to a member of the pool
+// coordinator is logged in to, and returns the host's reference in the
+// pool. It runs CheckJoin first and refuses with a *JoinError if anything
+// stands in the way, detaches the host's shared SRs if allowed to, then
+// waits for the join task and for the host to be enabled in the pool,
+// following events rather than sleeping.
+//
+// If the join fails, the shared SRs are introduced and plugged on the
+// host again. A host that joined but is not enabled before the timeout is
+// left in the pool: ejecting it would wipe its local storage, so that is
+// left to the caller.
+func JoinPool(ctx context.Context, joiner, coordinator *xenapi.Session, opts JoinOptions) (xenapi.HostRef, error) {
+	j, err := readJoinSide(joiner)
+	if err != nil {
+		return "", err
+	}
+	p, err := readJoinSide(coordinator)
+	if err != nil {
+		return "", err
+	}
+	report := checkJoin(j, p)
+	problems := report.Problems
+	if !opts.DetachSharedSRs {
+		for _, sr := range report.SharedSRs {
+			problems = append(problems, JoinProblem{Check: JoinCheckStorage, Detail: sr.String()})
+		}
+	}
+	if len(problems) > 0 {
+		return "", &JoinError{Host: report.Host, Problems: problems}
+	}
+	address := opts.Address
+	if address == "" {
+		address = p.host.Address
+	}
+	timeout := opts.Timeout
+	if timeout == 0 {
+		timeout = DefaultJoinTimeout
+	}
+
+	detached, err := detachSRs(joiner, j, report.SharedSRs)
+	if err != nil {
+		return "", errors.Join(fmt.Errorf("detaching the host's shared SRs: %w", err), reattachSRs(joiner, j.hostRef, detached))
+	}
+	task, err := xenapi.Pool.AsyncJoin(joiner, address, opts.Username, opts.Password)
+	if err != nil {
+		return "", errors.Join(Decode(err), reattachSRs(joiner, j.hostRef, detached))
+	}
+	_, err = WaitForTask(ctx, joiner, task)
+	// Once joined, the host restarts as a supporter and forgets the session
+	// it was told to join with, so losing the session or the connection
+	// while waiting is no sign of failure; the pool has the final word.
+	var netErr net.Error
+	if err != nil && !errors.Is(err, ErrSessionInvalid) && !errors.As(err, &netErr) {
+		xenapi.Task.Destroy(joiner, task)
+		return "", errors.Join(fmt.Errorf("joining the pool: %w", err), reattachSRs(joiner, j.hostRef, detached))
+	}
+	if err == nil {
+		xenapi.Task.Destroy(joiner, task)
+	}
+
+	wait, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	var ref xenapi.HostRef
+	err = WaitFor(wait, coordinator, "host", func(e Event[xenapi.HostRecord]) bool {
+		if e.Record.UUID == j.host.UUID && e.Record.Enabled {
+			ref = xenapi.HostRef(e.Ref)
+			return true
+		}
+		return false
+	})
+	if err != nil {
+		return "", fmt.Errorf("waiting for host %q to be enabled in the pool: %w", report.Host, err)
+	}
+	return ref, nil
+}
+
+// detachSRs unplugs and forgets srs, returning what it takes to put back
+// those it managed to.
+func detachSRs(session *xenapi.Session, j *joinSide, srs []SharedSR) ([]detachedSR, error) {
+	var detached []detachedSR
+	for _, shared := range srs {
+		record := j.srs[shared.Ref]
+		d := detachedSR{record: record}
+		for _, pbd := range record.PBDs {
+			deviceConfig, err := xenapi.PBD.GetDeviceConfig(session, pbd)
+			if err != nil {
+				return detached, err
+			}
+			d.deviceConfigs = append(d.deviceConfigs, deviceConfig)
+		}
+		for _, pbd := range record.PBDs {
+			if err := xenapi.PBD.Unplug(session, pbd); err != nil {
+				// Plug back what was unplugged; the SR was not forgotten.
+				for _, unplugged := range record.PBDs {
+					xenapi.PBD.Plug(session, unplugged)
+				}
+				return detached, fmt.Errorf("SR %q: %w", record.NameLabel, Decode(err))
+			}
+		}
+		if err := xenapi.SR.Forget(session, shared.Ref); err != nil {
+			return append(detached, d), fmt.Errorf("SR %q: %w", record.NameLabel, Decode(err))
+		}
+		detached = append(detached, d)
+	}
+	return detached, nil
+}
+
+// reattachSRs introduces and plugs again the SRs detachSRs forgot. An SR
+// whose forgetting failed is still there, and only has its PBDs plugged.
+func reattachSRs(session *xenapi.Session, host xenapi.HostRef, detached []detachedSR) error {
+	var errs []error
+	for _, d := range detached {
+		sr := d.record
+		ref, err := xenapi.SR.GetByUUID(session, sr.UUID)
+		if err == nil {
+			for _, pbd := range sr.PBDs {
+				if err := xenapi.PBD.Plug(session, pbd); err != nil {
+					errs = append(errs, fmt.Errorf("plugging SR %q again: %w", sr.NameLabel, Decode(err)))
+				}
+			}
+			continue
+		}
+		ref, err = xenapi.SR.Introduce(session, sr.UUID, sr.NameLabel, sr.NameDescription, sr.Type, sr.ContentType, sr.Shared, sr.SmConfig)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("introducing SR %q again: %w", sr.NameLabel, Decode(err)))
+			continue
+		}
+		for _, deviceConfig := range d.deviceConfigs {
+			pbd, err := xenapi.PBD.Create(session, xenapi.PBDRecord{Host: host, SR: ref, DeviceConfig: deviceConfig})
+			if err == nil {
+				err = xenapi.PBD.Plug(session, pbd)
+			}
+			if err != nil {
+				errs = append(errs, fmt.Errorf("plugging SR %q again: %w", sr.NameLabel, Decode(err)))
+			}
+		}
+		// The VDIs' names and descriptions come back with a scan.
+		xenapi.SR.Scan(session, ref)
+	}
+	return errors.Join(errs...)
+}
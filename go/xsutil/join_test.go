@@ -0,0 +1,136 @@
+package xsutil
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"xenapi"
+
+	"github.com/xenserver/xenserver-samples/go/fakexapi"
+)
+
+func TestJoinPool(t *testing.T) {
+	master := fakexapi.Start(t)
+	coordinator := master.Login(t)
+	member := fakexapi.Start(t)
+	joiner := member.Login(t)
+
+	report, err := CheckJoin(joiner, coordinator)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.OK() || len(report.SharedSRs) != 2 {
+		t.Fatal("Expected only the NFS and tools SRs in the way:", report.Problems, report.SharedSRs)
+	}
+
+	// The shared SRs stop the join unless JoinPool may detach them.
+	opts := JoinOptions{Username: master.Username, Password: master.Password, Timeout: 10 * time.Second}
+	_, err = JoinPool(context.Background(), joiner, coordinator, opts)
+	var joinErr *JoinError
+	if !errors.As(err, &joinErr) || len(joinErr.Problems) != 2 || joinErr.Problems[0].Check != JoinCheckStorage {
+		t.Fatal("Expected a JoinError listing the shared SRs, got:", err)
+	}
+
+	opts.DetachSharedSRs = true
+	host, err := JoinPool(context.Background(), joiner, coordinator, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(host) != member.Host() {
+		t.Log("Expected the member's host, got:", host)
+		t.Fail()
+	}
+	hosts, err := xenapi.Host.GetAll(coordinator)
+	if err != nil || len(hosts) != 2 {
+		t.Log("Expected a two-host pool:", hosts, err)
+		t.Fail()
+	}
+}
+
+func TestJoinPoolRollsBack(t *testing.T) {
+	master := fakexapi.Start(t)
+	coordinator := master.Login(t)
+	member := fakexapi.Start(t)
+	joiner := member.Login(t)
+	member.Handle("pool.join", func(c *fakexapi.Call) (interface{}, error) {
+		return nil, fakexapi.Failure{"POOL_JOINING_HOST_CONNECTION_FAILED"}
+	})
+
+	opts := JoinOptions{Username: master.Username, Password: master.Password, DetachSharedSRs: true, Timeout: 10 * time.Second}
+	if _, err := JoinPool(context.Background(), joiner, coordinator, opts); err == nil {
+		t.Fatal("Expected the join to fail")
+	}
+	srs, err := xenapi.SR.GetAllRecords(joiner)
+	if err != nil {
+		t.Fatal(err)
+	}
+	shared := 0
+	for _, sr := range srs {
+		if !sr.Shared {
+			continue
+		}
+		shared++
+		if len(sr.PBDs) != 1 {
+			t.Fatal("Expected one PBD for SR", sr.NameLabel, "got", sr.PBDs)
+		}
+		attached, err := xenapi.PBD.GetCurrentlyAttached(joiner, sr.PBDs[0])
+		if err != nil || !attached {
+			t.Log("Expected SR", sr.NameLabel, "to be plugged again:", err)
+			t.Fail()
+		}
+	}
+	if shared != 2 {
+		t.Log("Expected both shared SRs back, got", shared)
+		t.Fail()
+	}
+}
+
+func TestCheckJoinProblems(t *testing.T) {
+	coordinator := fakexapi.Start(t).Login(t)
+	member := fakexapi.Start(t)
+	joiner := member.Login(t)
+	member.Do(func(st *fakexapi.Store) {
+		host, _ := st.Get("host", member.Host())
+		cpu := host.Map("cpu_info")
+		cpu["features"] = "1fcbfbff-f7fa3223-2d93fbff-00000003"
+		versions := host.Map("software_version")
+		versions["product_version"] = "8.2.1"
+		st.Update("host", member.Host(), fakexapi.Record{"edition": "free", "cpu_info": cpu, "software_version": versions})
+	})
+	vm := findVM(t, joiner, fakexapi.LinuxVM)
+	if err := xenapi.VM.Start(joiner, vm, false, false); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := CheckJoin(joiner, coordinator)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checks := map[string]int{}
+	for _, p := range report.Problems {
+		checks[p.Check]++
+	}
+	if checks[JoinCheckVersion] != 1 || checks[JoinCheckLicence] != 1 || checks[JoinCheckVMs] != 1 || len(report.Problems) != 3 {
+		t.Log("Expected version, licence and VM problems, got:", report.Problems)
+		t.Fail()
+	}
+	if len(report.Warnings) != 1 || report.Warnings[0].Check != JoinCheckCPU {
+		t.Log("Expected a CPU levelling warning, got:", report.Warnings)
+		t.Fail()
+	}
+}
+
+func TestMissingFeatures(t *testing.T) {
+	for _, c := range []struct{ host, pool, want string }{
+		{"0000000f-000000ff", "0000000f-000000ff", ""},
+		{"0000000f-000000ff", "0000000f", ""},
+		{"0000000f-000000f0", "0000001f-000000ff", "word 0: 00000010, word 1: 0000000f"},
+		{"0000000f", "0000000f-00000001", "word 1: 00000001"},
+	} {
+		if got := missingFeatures(c.host, c.pool); got != c.want {
+			t.Errorf("missingFeatures(%q, %q) = %q, want %q", c.host, c.pool, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,252 @@
+package xsutil
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// timeLayouts are the date formats XAPI uses on the wire.
+var timeLayouts = []string{
+	"20060102T15:04:05Z",
+	"20060102T15:04:05",
+	time.RFC3339,
+	"2006-01-02T15:04:05",
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// DecodeRecord fills out, which must be a pointer, from an object in wire
+// format such as the snapshot of an event. Struct fields are matched by
+// their xapi tag, so any of the SDK's record types can be used; fields
+// missing from in are left at their zero value.
+func DecodeRecord(in interface{}, out interface{}) error {
+	v := reflect.ValueOf(out)
+	if v.Kind() != reflect.Pointer || v.IsNil() {
+		return fmt.Errorf("DecodeRecord needs a non-nil pointer, got %T", out)
+	}
+	return decodeValue(in, v.Elem(), "")
+}
+
+func decodeValue(in interface{}, out reflect.Value, path string) error {
+	if in == nil {
+		return nil
+	}
+	mismatch := func() error {
+		return fmt.Errorf("%s: cannot decode %T into %s", pathName(path), in, out.Type())
+	}
+	if out.Type() == timeType {
+		s, ok := in.(string)
+		if !ok {
+			return mismatch()
+		}
+		t, err := parseTime(s)
+		if err != nil {
+			return fmt.Errorf("%s: %w", pathName(path), err)
+		}
+		out.Set(reflect.ValueOf(t))
+		return nil
+	}
+	switch out.Kind() {
+	case reflect.Interface:
+		if !reflect.TypeOf(in).AssignableTo(out.Type()) {
+			return mismatch()
+		}
+		out.Set(reflect.ValueOf(in))
+	case reflect.Pointer:
+		if out.IsNil() {
+			out.Set(reflect.New(out.Type().Elem()))
+		}
+		return decodeValue(in, out.Elem(), path)
+	case reflect.String:
+		s, ok := in.(string)
+		if !ok {
+			return mismatch()
+		}
+		out.SetString(s)
+	case reflect.Bool:
+		switch b := in.(type) {
+		case bool:
+			out.SetBool(b)
+		case string:
+			parsed, err := strconv.ParseBool(b)
+			if err != nil {
+				return mismatch()
+			}
+			out.SetBool(parsed)
+		default:
+			return mismatch()
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		switch n := in.(type) {
+		case float64:
+			out.SetInt(int64(n))
+		case int64:
+			out.SetInt(n)
+		case string:
+			parsed, err := strconv.ParseInt(n, 10, 64)
+			if err != nil {
+				return mismatch()
+			}
+			out.SetInt(parsed)
+		default:
+			return mismatch()
+		}
+	case reflect.Float32, reflect.Float64:
+		switch n := in.(type) {
+		case float64:
+			out.SetFloat(n)
+		case int64:
+			out.SetFloat(float64(n))
+		case string:
+			parsed, err := strconv.ParseFloat(n, 64)
+			if err != nil {
+				return mismatch()
+			}
+			out.SetFloat(parsed)
+		default:
+			return mismatch()
+		}
+	case reflect.Slice:
+		list, ok := in.([]interface{})
+		if !ok {
+			return mismatch()
+		}
+		slice := reflect.MakeSlice(out.Type(), len(list), len(list))
+		for i, item := range list {
+			if err := decodeValue(item, slice.Index(i), fmt.Sprintf("%s[%d]", path, i)); err != nil {
+				return err
+			}
+		}
+		out.Set(slice)
+	case reflect.Map:
+		m, ok := in.(map[string]interface{})
+		if !ok {
+			return mismatch()
+		}
+		result := reflect.MakeMapWithSize(out.Type(), len(m))
+		for k, item := range m {
+			key := reflect.New(out.Type().Key()).Elem()
+			if err := decodeValue(mapKey(k, key.Kind()), key, path); err != nil {
+				return err
+			}
+			value := reflect.New(out.Type().Elem()).Elem()
+			if err := decodeValue(item, value, path+"."+k); err != nil {
+				return err
+			}
+			result.SetMapIndex(key, value)
+		}
+		out.Set(result)
+	case reflect.Struct:
+		m, ok := in.(map[string]interface{})
+		if !ok {
+			return mismatch()
+		}
+		for i := 0; i < out.NumField(); i++ {
+			field := out.Type().Field(i)
+			name := field.Tag.Get("xapi")
+			if name == "" || !field.IsExported() {
+				continue
+			}
+			if err := decodeValue(m[name], out.Field(i), path+"."+name); err != nil {
+				return err
+			}
+		}
+	default:
+		return mismatch()
+	}
+	return nil
+}
+
+// EncodeRecord is the reverse of DecodeRecord: it turns one of the SDK's
+// values into wire format, with struct fields named by their xapi tag.
+// References stay the strings the server sent, and times use XAPI's own
+// format, so DecodeRecord gives back the value it was passed.
+func EncodeRecord(in interface{}) interface{} {
+	return encodeValue(reflect.ValueOf(in))
+}
+
+func encodeValue(v reflect.Value) interface{} {
+	if !v.IsValid() {
+		return nil
+	}
+	if v.Type() == timeType {
+		return v.Interface().(time.Time).UTC().Format(timeLayouts[0])
+	}
+	switch v.Kind() {
+	case reflect.Interface, reflect.Pointer:
+		if v.IsNil() {
+			return nil
+		}
+		return encodeValue(v.Elem())
+	case reflect.String:
+		return v.String()
+	case reflect.Bool:
+		return v.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int()
+	case reflect.Float32, reflect.Float64:
+		f := v.Float()
+		if math.IsNaN(f) || math.IsInf(f, 0) {
+			// JSON has no such numbers; decodeValue parses the string.
+			return strconv.FormatFloat(f, 'g', -1, 64)
+		}
+		return f
+	case reflect.Slice, reflect.Array:
+		list := make([]interface{}, v.Len())
+		for i := range list {
+			list[i] = encodeValue(v.Index(i))
+		}
+		return list
+	case reflect.Map:
+		m := make(map[string]interface{}, v.Len())
+		iter := v.MapRange()
+		for iter.Next() {
+			m[fmt.Sprint(encodeValue(iter.Key()))] = encodeValue(iter.Value())
+		}
+		return m
+	case reflect.Struct:
+		m := make(map[string]interface{}, v.NumField())
+		for i := 0; i < v.NumField(); i++ {
+			field := v.Type().Field(i)
+			name := field.Tag.Get("xapi")
+			if name == "" || !field.IsExported() {
+				continue
+			}
+			m[name] = encodeValue(v.Field(i))
+		}
+		return m
+	}
+	return v.Interface()
+}
+
+// mapKey lets numeric map keys, which JSON always sends as strings, go
+// through the numeric cases of decodeValue.
+func mapKey(k string, kind reflect.Kind) interface{} {
+	switch kind {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64, reflect.Float32, reflect.Float64:
+		if n, err := strconv.ParseFloat(k, 64); err == nil {
+			return n
+		}
+	}
+	return k
+}
+
+func parseTime(s string) (time.Time, error) {
+	for _, layout := range timeLayouts {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("cannot parse %q as a time", s)
+}
+
+func pathName(path string) string {
+	if path == "" {
+		return "record"
+	}
+	return strings.TrimPrefix(path, ".")
+}
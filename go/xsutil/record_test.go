@@ -0,0 +1,98 @@
+package xsutil
+
+import (
+	"testing"
+	"time"
+
+	"xenapi"
+)
+
+func TestDecodeRecord(t *testing.T) {
+	snapshot := map[string]interface{}{
+		"name_label":        "vm",
+		"power_state":       "Running",
+		"VCPUs_max":         float64(4),
+		"memory_static_max": "4294967296",
+		"is_a_template":     false,
+		"VBDs":              []interface{}{"OpaqueRef:a", "OpaqueRef:b"},
+		"other_config":      map[string]interface{}{"key": "value"},
+		"snapshot_time":     "20240102T03:04:05Z",
+		"not_in_the_sdk":    true,
+	}
+	var record xenapi.VMRecord
+	if err := DecodeRecord(snapshot, &record); err != nil {
+		t.Fatal(err)
+	}
+	if record.NameLabel != "vm" || record.PowerState != xenapi.VMPowerStateRunning || record.VCPUsMax != 4 ||
+		record.MemoryStaticMax != 4<<30 || len(record.VBDs) != 2 || record.VBDs[1] != "OpaqueRef:b" ||
+		record.OtherConfig["key"] != "value" {
+		t.Log("Unexpected record:", record)
+		t.Fail()
+	}
+	if !record.SnapshotTime.Equal(time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)) {
+		t.Log("Unexpected snapshot time:", record.SnapshotTime)
+		t.Fail()
+	}
+}
+
+func TestDecodeRecordNumericKeys(t *testing.T) {
+	var record xenapi.VMMetricsRecord
+	err := DecodeRecord(map[string]interface{}{"VCPUs_utilisation": map[string]interface{}{"0": 0.5}}, &record)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if record.VCPUsUtilisation[0] != 0.5 {
+		t.Log("Unexpected utilisation:", record.VCPUsUtilisation)
+		t.Fail()
+	}
+}
+
+func TestDecodeRecordMismatch(t *testing.T) {
+	var record xenapi.VMRecord
+	err := DecodeRecord(map[string]interface{}{"VBDs": "not a list"}, &record)
+	if err == nil {
+		t.Log("Expected an error for a field of the wrong shape")
+		t.Fail()
+	}
+	if err := DecodeRecord("not a record", &record); err == nil {
+		t.Log("Expected an error for a snapshot that is not an object")
+		t.Fail()
+	}
+	if err := DecodeRecord(map[string]interface{}{}, record); err == nil {
+		t.Log("Expected an error for a non-pointer destination")
+		t.Fail()
+	}
+}
+
+func TestEncodeRecord(t *testing.T) {
+	record := xenapi.VMRecord{
+		NameLabel:    "vm",
+		PowerState:   xenapi.VMPowerStateHalted,
+		VCPUsMax:     2,
+		VBDs:         []xenapi.VBDRef{"OpaqueRef:a"},
+		OtherConfig:  map[string]string{"key": "value"},
+		SnapshotTime: time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC),
+	}
+	encoded, ok := EncodeRecord(record).(map[string]interface{})
+	if !ok {
+		t.Fatalf("Expected an object, got %T", EncodeRecord(record))
+	}
+	if encoded["name_label"] != "vm" || encoded["power_state"] != "Halted" || encoded["snapshot_time"] != "20240102T03:04:05Z" {
+		t.Log("Unexpected encoding:", encoded)
+		t.Fail()
+	}
+	if vbds, _ := encoded["VBDs"].([]interface{}); len(vbds) != 1 || vbds[0] != "OpaqueRef:a" {
+		t.Log("The VBD references were not kept:", encoded["VBDs"])
+		t.Fail()
+	}
+
+	var decoded xenapi.VMRecord
+	if err := DecodeRecord(encoded, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if decoded.NameLabel != record.NameLabel || decoded.VCPUsMax != record.VCPUsMax || decoded.VBDs[0] != record.VBDs[0] ||
+		decoded.OtherConfig["key"] != "value" || !decoded.SnapshotTime.Equal(record.SnapshotTime) {
+		t.Log("The record did not survive a round trip:", decoded)
+		t.Fail()
+	}
+}
@@ -0,0 +1,197 @@
+package xsutil
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"sync"
+
+	"xenapi"
+)
+
+// maxRedirects bounds how many HOST_IS_SLAVE answers a login follows.
+const maxRedirects = 3
+
+// Credentials are what a login needs besides the server address.
+type Credentials struct {
+	Username   string
+	Password   string
+	Version    string
+	Originator string
+}
+
+func (c Credentials) login(session *xenapi.Session) (xenapi.SessionRef, error) {
+	version := c.Version
+	if version == "" {
+		version = "1.0"
+	}
+	return session.LoginWithPassword(c.Username, c.Password, version, c.Originator)
+}
+
+// withHost returns a copy of opts pointing at address, keeping the scheme
+// and, when address has none, the port of the original URL.
+func withHost(opts xenapi.ClientOpts, address string) (xenapi.ClientOpts, error) {
+	u, err := url.Parse(opts.URL)
+	if err != nil {
+		return opts, err
+	}
+	if _, _, err := net.SplitHostPort(address); err != nil && u.Port() != "" {
+		address = net.JoinHostPort(address, u.Port())
+	}
+	u.Host = address
+	opts.URL = u.String()
+	return opts, nil
+}
+
+// Login logs in to the server named by opts. If that server is a pool
+// member, the HOST_IS_SLAVE failure is followed to the pool coordinator.
+func Login(opts *xenapi.ClientOpts, creds Credentials) (*xenapi.Session, error) {
+	session, _, _, err := login(*opts, creds)
+	return session, err
+}
+
+// login is Login that also returns the session's reference and the
+// options of the server it ended up logged in to.
+func login(opts xenapi.ClientOpts, creds Credentials) (*xenapi.Session, xenapi.SessionRef, xenapi.ClientOpts, error) {
+	for i := 0; ; i++ {
+		session := xenapi.NewSession(&opts)
+		ref, err := creds.login(session)
+		err = Decode(err)
+		var slaveErr *HostIsSlaveError
+		if !errors.As(err, &slaveErr) || i == maxRedirects {
+			if err != nil {
+				return nil, "", opts, err
+			}
+			return session, ref, opts, nil
+		}
+		opts, err = withHost(opts, slaveErr.Master)
+		if err != nil {
+			return nil, "", opts, err
+		}
+	}
+}
+
+// PoolSession is a session to a pool coordinator that survives the
+// coordinator moving. Calls made through Do that fail because the
+// coordinator moved or cannot be reached are retried once on a new
+// session, logged in to the current coordinator, which then replaces the
+// session Session returns. Calls made on a *xenapi.Session obtained
+// earlier do not fail over: that session stays as it was, and XAPI will
+// have invalidated it. A PoolSession may be used from several goroutines.
+type PoolSession struct {
+	opts  xenapi.ClientOpts
+	creds Credentials
+
+	mu      sync.Mutex
+	master  xenapi.ClientOpts
+	members []string
+	session *xenapi.Session
+	ref     xenapi.SessionRef
+}
+
+// Connect logs in to the pool that the server named by opts belongs to.
+func Connect(opts *xenapi.ClientOpts, creds Credentials) (*PoolSession, error) {
+	session, ref, master, err := login(*opts, creds)
+	if err != nil {
+		return nil, err
+	}
+	p := &PoolSession{opts: *opts, master: master, creds: creds, session: session, ref: ref}
+	p.members = members(session)
+	return p, nil
+}
+
+// Session returns the current session, which a reconnect replaces.
+func (p *PoolSession) Session() *xenapi.Session {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.session
+}
+
+// Current returns the current session and the reference it is logged in
+// with, which the HTTP handlers XAPI serves next to its API, such as
+// /export or /rrd_updates, take as session_id.
+func (p *PoolSession) Current() (*xenapi.Session, xenapi.SessionRef) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.session, p.ref
+}
+
+// members returns the address of every host in the pool, for use as
+// fallbacks when the coordinator can no longer be reached.
+func members(session *xenapi.Session) []string {
+	hosts, err := xenapi.Host.GetAllRecords(session)
+	if err != nil {
+		return nil
+	}
+	var addresses []string
+	for _, host := range hosts {
+		if host.Address != "" {
+			addresses = append(addresses, host.Address)
+		}
+	}
+	return addresses
+}
+
+// Reconnect re-resolves the pool coordinator and logs in to it, replacing
+// the current session.
+func (p *PoolSession) Reconnect() error {
+	return p.reconnect(nil)
+}
+
+// reconnect is Reconnect that does nothing if the current session is no
+// longer stale, because another goroutine has already replaced it.
+func (p *PoolSession) reconnect(stale *xenapi.Session) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if stale != nil && p.session != stale {
+		return nil
+	}
+	candidates := []xenapi.ClientOpts{p.master, p.opts}
+	for _, member := range p.members {
+		opts, err := withHost(p.opts, member)
+		if err == nil {
+			candidates = append(candidates, opts)
+		}
+	}
+	var lastErr error
+	for _, opts := range candidates {
+		session, ref, master, err := login(opts, p.creds)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		p.session, p.ref, p.master = session, ref, master
+		if addresses := members(session); addresses != nil {
+			p.members = addresses
+		}
+		return nil
+	}
+	return fmt.Errorf("cannot reach the pool coordinator: %w", lastErr)
+}
+
+// Do calls fn with the current session. If fn fails because the
+// coordinator has moved, the session has been invalidated or the server
+// is unreachable, Do reconnects and calls fn once more with the new
+// session.
+func (p *PoolSession) Do(fn func(session *xenapi.Session) error) error {
+	session := p.Session()
+	err := Decode(fn(session))
+	if !needsReconnect(err) {
+		return err
+	}
+	if err := p.reconnect(session); err != nil {
+		return err
+	}
+	return Decode(fn(p.Session()))
+}
+
+// Logout ends the current session.
+func (p *PoolSession) Logout() error {
+	return p.Session().Logout()
+}
+
+func needsReconnect(err error) bool {
+	var netErr net.Error
+	return errors.Is(err, ErrHostIsSlave) || errors.Is(err, ErrSessionInvalid) || errors.As(err, &netErr)
+}
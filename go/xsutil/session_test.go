@@ -0,0 +1,97 @@
+package xsutil
+
+import (
+	"errors"
+	"testing"
+
+	"xenapi"
+
+	"github.com/xenserver/xenserver-samples/go/fakexapi"
+)
+
+var testCreds = Credentials{Username: "root", Password: "xenroot", Originator: "xsutil test"}
+
+func TestLoginFollowsHostIsSlave(t *testing.T) {
+	_, member := fakexapi.NewPool(t)
+
+	session, err := Login(&xenapi.ClientOpts{URL: member.URL()}, testCreds)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hosts, err := xenapi.Host.GetAll(session)
+	if err != nil || len(hosts) != 2 {
+		t.Log("Expected to reach the coordinator of a two-host pool:", hosts, err)
+		t.Fail()
+	}
+}
+
+func TestPoolSessionFollowsNewCoordinator(t *testing.T) {
+	first, second := fakexapi.Start(t), fakexapi.Start(t)
+
+	pool, err := Connect(&xenapi.ClientOpts{URL: first.URL()}, testCreds)
+	if err != nil {
+		t.Fatal(err)
+	}
+	session := pool.Session()
+	first.Join(t, second)
+
+	var hosts []xenapi.HostRef
+	err = pool.Do(func(session *xenapi.Session) (err error) {
+		hosts, err = xenapi.Host.GetAll(session)
+		return
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hosts) != 2 {
+		t.Log("Expected the session to follow the host into its new pool, got hosts:", hosts)
+		t.Fail()
+	}
+	if pool.Session() == session {
+		t.Log("Expected reconnecting to replace the session")
+		t.Fail()
+	}
+	if _, err := xenapi.Pool.GetAll(session); !errors.Is(Decode(err), ErrSessionInvalid) {
+		t.Log("Expected the old session to be left as it was, invalid, got:", err)
+		t.Fail()
+	}
+}
+
+func TestPoolSessionUnreachable(t *testing.T) {
+	server := fakexapi.NewServer()
+	pool, err := Connect(&xenapi.ClientOpts{URL: server.URL()}, testCreds)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.Close()
+	err = pool.Do(func(session *xenapi.Session) error {
+		_, err := xenapi.Pool.GetAll(session)
+		return err
+	})
+	if err == nil {
+		t.Log("Expected an error once the only host is gone")
+		t.Fail()
+	}
+}
+
+func TestPoolSessionCurrent(t *testing.T) {
+	server := fakexapi.NewServer()
+	defer server.Close()
+	pool, err := Connect(&xenapi.ClientOpts{URL: server.URL()}, testCreds)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Logout()
+	session, ref := pool.Current()
+	if session != pool.Session() || !server.ValidSession(string(ref)) {
+		t.Log(ref, "is not the session's reference")
+		t.Fail()
+	}
+	if err := pool.Reconnect(); err != nil {
+		t.Fatal(err)
+	}
+	if _, newRef := pool.Current(); newRef == ref || !server.ValidSession(string(newRef)) {
+		t.Log("Expected a reconnect to replace the reference, got:", newRef)
+		t.Fail()
+	}
+}
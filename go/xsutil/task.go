@@ -0,0 +1,136 @@
+// Package xsutil collects helpers shared by the Go samples and tools that
+// are not part of the generated SDK: task waiting, typed failures and
+// other plumbing around xenapi.Session.
+package xsutil
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"xenapi"
+)
+
+// maxEventTimeout bounds a single event.from call so that a long wait is
+// split into several requests rather than one very long HTTP call.
+const maxEventTimeout = 30 * time.Second
+
+// ErrTaskCancelled is matched by the TaskError of a cancelled task.
+var ErrTaskCancelled = errors.New("task was cancelled")
+
+// TaskError reports a task that finished without succeeding.
+type TaskError struct {
+	Task      xenapi.TaskRef
+	Status    xenapi.TaskStatusType
+	ErrorInfo []string
+	Result    string
+}
+
+func (e *TaskError) Error() string {
+	if e.Status == xenapi.TaskStatusTypeCancelled {
+		return fmt.Sprintf("task %s was cancelled", e.Task)
+	}
+	return fmt.Sprintf("task %s failed: %s", e.Task, strings.Join(e.ErrorInfo, " "))
+}
+
+// Unwrap returns the typed failure decoded from ErrorInfo.
+func (e *TaskError) Unwrap() error {
+	return ParseFailure(e.ErrorInfo)
+}
+
+func (e *TaskError) Is(target error) bool {
+	return target == ErrTaskCancelled && e.Status == xenapi.TaskStatusTypeCancelled
+}
+
+// WaitForTask blocks until the task leaves the pending state and returns
+// its result. Instead of polling, it follows the task through event.from.
+// A task that fails or is cancelled yields a *TaskError; if ctx ends first
+// its error is returned and the task is left running.
+func WaitForTask(ctx context.Context, session *xenapi.Session, taskRef xenapi.TaskRef) (string, error) {
+	return FollowTask(ctx, session, taskRef, nil)
+}
+
+// FollowTask is WaitForTask that also calls progress, if not nil, with the
+// task's progress from 0 to 1 each time the server reports a change.
+func FollowTask(ctx context.Context, session *xenapi.Session, taskRef xenapi.TaskRef, progress func(float64)) (string, error) {
+	token := ""
+	last := -1.0
+	for {
+		batch, err := eventFrom(ctx, session, []string{"task"}, token, maxEventTimeout)
+		if err != nil {
+			if errors.Is(Decode(err), ErrEventsLost) {
+				token = ""
+				continue
+			}
+			return "", Decode(err)
+		}
+		token = batch.Token
+		for _, event := range batch.Events {
+			if event.Ref != string(taskRef) {
+				continue
+			}
+			if event.Operation == xenapi.EventOperationDel {
+				return "", fmt.Errorf("task %s was destroyed before it completed", taskRef)
+			}
+			snapshot, _ := event.Snapshot.(map[string]interface{})
+			if done, ok := snapshot["progress"].(float64); ok && progress != nil && done != last {
+				last = done
+				progress(done)
+			}
+			if result, err, done := taskOutcome(taskRef, snapshot); done {
+				return result, err
+			}
+		}
+	}
+}
+
+func taskOutcome(taskRef xenapi.TaskRef, snapshot map[string]interface{}) (string, error, bool) {
+	status, _ := snapshot["status"].(string)
+	result, _ := snapshot["result"].(string)
+	switch xenapi.TaskStatusType(status) {
+	case xenapi.TaskStatusTypeSuccess:
+		return result, nil, true
+	case xenapi.TaskStatusTypeFailure, xenapi.TaskStatusTypeCancelled:
+		var errorInfo []string
+		list, _ := snapshot["error_info"].([]interface{})
+		for _, item := range list {
+			errorInfo = append(errorInfo, fmt.Sprint(item))
+		}
+		return "", &TaskError{
+			Task:      taskRef,
+			Status:    xenapi.TaskStatusType(status),
+			ErrorInfo: errorInfo,
+			Result:    result,
+		}, true
+	}
+	return "", nil, false
+}
+
+// eventFrom runs one event.from call, returning early if ctx ends. The
+// server-side timeout never exceeds the context deadline.
+func eventFrom(ctx context.Context, session *xenapi.Session, classes []string, token string, timeout time.Duration) (xenapi.EventBatch, error) {
+	if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < timeout {
+		timeout = time.Until(deadline)
+	}
+	if err := ctx.Err(); err != nil {
+		return xenapi.EventBatch{}, err
+	}
+
+	type reply struct {
+		batch xenapi.EventBatch
+		err   error
+	}
+	done := make(chan reply, 1)
+	go func() {
+		batch, err := xenapi.Event.From(session, classes, token, timeout.Seconds())
+		done <- reply{batch, err}
+	}()
+	select {
+	case r := <-done:
+		return r.batch, r.err
+	case <-ctx.Done():
+		return xenapi.EventBatch{}, ctx.Err()
+	}
+}
@@ -0,0 +1,120 @@
+package xsutil
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"xenapi"
+
+	"github.com/xenserver/xenserver-samples/go/fakexapi"
+)
+
+func findVM(t *testing.T, session *xenapi.Session, name string) xenapi.VMRef {
+	vms, err := xenapi.VM.GetByNameLabel(session, name)
+	if err != nil || len(vms) == 0 {
+		t.Fatal("VM not found:", name, err)
+	}
+	return vms[0]
+}
+
+func TestWaitForTaskSuccess(t *testing.T) {
+	session := fakexapi.Start(t).Login(t)
+	template := findVM(t, session, fakexapi.LinuxTemplate)
+	taskRef, err := xenapi.VM.AsyncClone(session, template, "xsutil clone")
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := WaitForTask(context.Background(), session, taskRef)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result == "" {
+		t.Log("Expected the task result to carry the new VM reference")
+		t.Fail()
+	}
+}
+
+func TestFollowTaskProgress(t *testing.T) {
+	server := fakexapi.Start(t)
+	session := server.Login(t)
+	server.TaskDelay = 200 * time.Millisecond
+	template := findVM(t, session, fakexapi.LinuxTemplate)
+	taskRef, err := xenapi.VM.AsyncClone(session, template, "xsutil clone")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.Do(func(st *fakexapi.Store) {
+		st.Update("task", string(taskRef), fakexapi.Record{"progress": 0.5})
+	})
+	var seen []float64
+	if _, err := FollowTask(context.Background(), session, taskRef, func(p float64) { seen = append(seen, p) }); err != nil {
+		t.Fatal(err)
+	}
+	if len(seen) < 2 || seen[len(seen)-2] != 0.5 || seen[len(seen)-1] != 1 {
+		t.Log("Expected progress to go through 0.5 to 1, got:", seen)
+		t.Fail()
+	}
+}
+
+func TestWaitForTaskFailure(t *testing.T) {
+	session := fakexapi.Start(t).Login(t)
+	vm := findVM(t, session, fakexapi.LinuxVM)
+	taskRef, err := xenapi.VM.AsyncUnpause(session, vm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = WaitForTask(context.Background(), session, taskRef)
+	var taskErr *TaskError
+	if !errors.As(err, &taskErr) {
+		t.Fatal("Expected a TaskError, got:", err)
+	}
+	if taskErr.Task != taskRef || len(taskErr.ErrorInfo) == 0 || taskErr.ErrorInfo[0] != "VM_BAD_POWER_STATE" {
+		t.Log("Unexpected task error:", taskErr)
+		t.Fail()
+	}
+	if errors.Is(err, ErrTaskCancelled) {
+		t.Log("A failed task should not match ErrTaskCancelled")
+		t.Fail()
+	}
+}
+
+func TestWaitForTaskCancelled(t *testing.T) {
+	server := fakexapi.Start(t)
+	session := server.Login(t)
+	server.TaskDelay = time.Second
+	template := findVM(t, session, fakexapi.LinuxTemplate)
+	taskRef, err := xenapi.VM.AsyncClone(session, template, "xsutil clone")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := xenapi.Task.Cancel(session, taskRef); err != nil {
+		t.Fatal(err)
+	}
+	_, err = WaitForTask(context.Background(), session, taskRef)
+	if !errors.Is(err, ErrTaskCancelled) {
+		t.Log("Expected ErrTaskCancelled, got:", err)
+		t.Fail()
+	}
+}
+
+func TestWaitForTaskContext(t *testing.T) {
+	session := fakexapi.Start(t).Login(t)
+	taskRef, err := xenapi.Task.Create(session, "xsutil", "never completes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err = WaitForTask(ctx, session, taskRef)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Log("Expected the deadline to be exceeded, got:", err)
+		t.Fail()
+	}
+	if time.Since(start) > 5*time.Second {
+		t.Log("WaitForTask did not return promptly after the deadline")
+		t.Fail()
+	}
+}